@@ -0,0 +1,165 @@
+// Package auth authenticates callers of the TradeService.
+//
+// Every strategy process gets a token from the scheduler that names the
+// strategy it may trade for. Tokens are HMAC-SHA256 signed with
+// TRADE_TOKEN_SECRET, which the scheduler and backend share:
+//
+//	<strategy_name>.<issued unix seconds>.<hex signature>
+//
+// Tokens expire TRADE_TOKEN_MAX_AGE (a duration, 168h by default) after they
+// were issued; the scheduler renews them by restarting setups before then.
+// Rotating the secret revokes every token. TLS is enabled when
+// GRPC_TLS_CERT and GRPC_TLS_KEY point to a certificate and key.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pytrader/logging"
+	pb "pytrader/tradepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var logger = logging.For("auth")
+
+const (
+	// DefaultMaxTokenAge is how long a token is accepted when
+	// TRADE_TOKEN_MAX_AGE is not set
+	DefaultMaxTokenAge = 7 * 24 * time.Hour
+	// maxClockSkew allows for the scheduler's clock running ahead
+	maxClockSkew = time.Minute
+)
+
+type strategyKey struct{}
+
+// Secret returns TRADE_TOKEN_SECRET, which must be set
+func Secret() ([]byte, error) {
+	secret := os.Getenv("TRADE_TOKEN_SECRET")
+	if len(secret) < 32 {
+		return nil, errors.New("TRADE_TOKEN_SECRET must be set to at least 32 characters")
+	}
+	return []byte(secret), nil
+}
+
+// MaxTokenAge returns TRADE_TOKEN_MAX_AGE, or DefaultMaxTokenAge when unset
+func MaxTokenAge() (time.Duration, error) {
+	value := os.Getenv("TRADE_TOKEN_MAX_AGE")
+	if value == "" {
+		return DefaultMaxTokenAge, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge <= 0 {
+		return 0, fmt.Errorf("invalid TRADE_TOKEN_MAX_AGE %q, expected a positive duration like 72h", value)
+	}
+	return maxAge, nil
+}
+
+// VerifyToken checks a token's signature and age and returns the strategy
+// it was issued for
+func VerifyToken(secret []byte, token string, maxAge time.Duration) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", errors.New("malformed token")
+	}
+	issuedUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid token signature")
+	}
+	issued := time.Unix(issuedUnix, 0)
+	if time.Since(issued) > maxAge {
+		return "", errors.New("token expired")
+	}
+	if time.Until(issued) > maxClockSkew {
+		return "", errors.New("token issued in the future")
+	}
+	return parts[0], nil
+}
+
+// StrategyFromContext returns the authenticated strategy of a request
+func StrategyFromContext(ctx context.Context) string {
+	strategy, _ := ctx.Value(strategyKey{}).(string)
+	return strategy
+}
+
+// UnaryInterceptor rejects requests without a valid bearer token in the
+// "authorization" metadata, and trades whose strategy_name differs from the
+// strategy the token was issued for.
+func UnaryInterceptor(secret []byte, maxAge time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get("authorization")
+		if len(values) == 0 || !strings.HasPrefix(values[0], "Bearer ") {
+			return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+		}
+		strategy, err := VerifyToken(secret, strings.TrimPrefix(values[0], "Bearer "), maxAge)
+		if err != nil {
+			logger.Warn("Rejected call", "method", info.FullMethod, logging.Key, correlationID(md), "error", err)
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		if trade, ok := req.(*pb.Trade); ok && trade.StrategyName != strategy {
+			logger.Warn("Rejected trade sent with another strategy's token", logging.Key, correlationID(md),
+				"strategy", trade.StrategyName, "token_strategy", strategy)
+			return nil, status.Error(codes.PermissionDenied,
+				fmt.Sprintf("token is not valid for strategy %q", trade.StrategyName))
+		}
+		return handler(context.WithValue(ctx, strategyKey{}, strategy), req)
+	}
+}
+
+// correlationID returns the correlation ID a caller sent, if any
+func correlationID(md metadata.MD) string {
+	if values := md.Get(logging.MetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ServerOptions returns the TLS credentials and auth interceptor for the
+// gRPC server
+func ServerOptions() ([]grpc.ServerOption, error) {
+	secret, err := Secret()
+	if err != nil {
+		return nil, err
+	}
+	maxAge, err := MaxTokenAge()
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(UnaryInterceptor(secret, maxAge))}
+
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	if certFile == "" || keyFile == "" {
+		logger.Warn("GRPC_TLS_CERT/GRPC_TLS_KEY not set, TradeService is not using TLS")
+		return opts, nil
+	}
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	logger.Info("TradeService using TLS certificate", "cert", certFile)
+	return append(opts, grpc.Creds(creds)), nil
+}
@@ -0,0 +1,204 @@
+// Package brokerapi calls broker_api over HTTP.
+//
+// Every call has a timeout, which also covers reading the response body.
+// Reads are idempotent and retried a few times with jittered backoff;
+// orders are sent once, as a retry after a timeout could place them twice.
+// Calls count against the read or order circuit breaker of their broker, see
+// circuit.go.
+// A call made for a trade instruction sends its correlation ID in the
+// X-Correlation-ID header, so broker_api logs it with the request.
+package brokerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"pytrader/logging"
+)
+
+const (
+	// ReadTimeout is the timeout of a call when none is given
+	ReadTimeout = 10 * time.Second
+	// OrderTimeout leaves IB time to qualify the contract of an order
+	OrderTimeout = 30 * time.Second
+
+	readAttempts = 3
+)
+
+// retryBaseDelay is a variable so tests can shorten it
+var retryBaseDelay = 250 * time.Millisecond
+
+var (
+	client = &http.Client{}
+	logger = logging.For("broker")
+)
+
+// BaseURL returns broker_api's URL: BROKER_API_URL when set, otherwise the
+// one for the environment
+func BaseURL() string {
+	if url := os.Getenv("BROKER_API_URL"); url != "" {
+		return url
+	}
+	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
+		return "http://broker_api:8000"
+	}
+	return "http://127.0.0.1:8000"
+}
+
+// Call is one request to broker_api
+type Call struct {
+	Broker     string // the circuit the call counts against
+	Method     string
+	Path       string // below BaseURL, with the query
+	Body       []byte
+	Header     http.Header
+	Timeout    time.Duration // ReadTimeout when zero
+	Idempotent bool          // retried when set
+	// CorrelationID ties the call to a trade instruction, if not empty
+	CorrelationID string
+}
+
+// StatusError is returned for a response other than 200 OK
+type StatusError struct {
+	Path       string
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %s", e.Path, e.Status)
+}
+
+// Do sends a call and returns the response of its last attempt. Responses
+// with a 5xx status count as failures but are returned like any other; the
+// caller must close the body.
+func Do(call Call) (*http.Response, error) {
+	attempts, kind := 1, KindOrder
+	if call.Idempotent {
+		attempts, kind = readAttempts, KindRead
+	}
+	log := logger.With("broker", call.Broker, "method", call.Method, "path", call.Path)
+	if call.CorrelationID != "" {
+		log = log.With(logging.Key, call.CorrelationID)
+	}
+	breaker := circuitFor(call.Broker, kind)
+	for attempt := 1; ; attempt++ {
+		if err := breaker.allow(); err != nil {
+			log.Warn("Call not sent", "error", err)
+			return nil, err
+		}
+		started := time.Now()
+		resp, err := send(call)
+		elapsed := time.Since(started)
+		requestDuration.WithLabelValues(call.Broker, endpoint(call.Path)).Observe(elapsed.Seconds())
+		switch {
+		case err != nil:
+			requestErrors.WithLabelValues(call.Broker, endpoint(call.Path)).Inc()
+			breaker.record(err.Error())
+			log.Warn("Call failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "error", err)
+		case resp.StatusCode >= 500:
+			requestErrors.WithLabelValues(call.Broker, endpoint(call.Path)).Inc()
+			breaker.record(fmt.Sprintf("%s returned %s", call.Path, resp.Status))
+			log.Warn("Call failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "status", resp.StatusCode)
+		default:
+			breaker.record("")
+			log.Debug("Call done", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "status", resp.StatusCode)
+			return resp, nil
+		}
+		if attempt == attempts {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// Full jitter keeps retries of concurrent callers apart
+		time.Sleep(time.Duration(rand.Int63n(int64(retryBaseDelay) << attempt)))
+	}
+}
+
+// Get reads a broker_api resource into out. correlationID ties the call to
+// a trade instruction and may be empty.
+func Get(broker, path, correlationID string, out interface{}) error {
+	return doJSON(Call{Broker: broker, Method: http.MethodGet, Path: path, Idempotent: true,
+		CorrelationID: correlationID}, out)
+}
+
+// Query posts a request that reads from the broker, retried like Get
+func Query(broker, path, correlationID string, body, out interface{}) error {
+	return postJSON(Call{Broker: broker, Path: path, Idempotent: true, CorrelationID: correlationID}, body, out)
+}
+
+// Post sends a request that changes state at the broker, exactly once
+func Post(broker, path, correlationID string, timeout time.Duration, body, out interface{}) error {
+	return postJSON(Call{Broker: broker, Path: path, Timeout: timeout, CorrelationID: correlationID}, body, out)
+}
+
+func postJSON(call Call, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	call.Method = http.MethodPost
+	call.Body = data
+	call.Header = http.Header{"Content-Type": {"application/json"}}
+	return doJSON(call, out)
+}
+
+func doJSON(call Call, out interface{}) error {
+	resp, err := Do(call)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Path: call.Path, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes one attempt of a call
+func send(call Call) (*http.Response, error) {
+	timeout := call.Timeout
+	if timeout == 0 {
+		timeout = ReadTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, call.Method, BaseURL()+call.Path, bytes.NewReader(call.Body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range call.Header {
+		req.Header[name] = values
+	}
+	if call.CorrelationID != "" {
+		req.Header.Set(logging.Header, call.CorrelationID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the timeout of a call once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
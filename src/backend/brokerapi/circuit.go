@@ -0,0 +1,146 @@
+package brokerapi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each broker has two circuit breakers, one for reads and one for orders, so
+// failing quote or position reads cannot hold back the orders closing a
+// position. After failureThreshold calls in a row fail, with an error or a
+// 5xx response, the circuit opens and calls fail fast with ErrCircuitOpen for
+// openDuration. The circuit is then half open: one trial call goes through,
+// closing the circuit when it succeeds and opening it again when it fails.
+// The scheduler's client in handlers/brokerapi.go works the same way.
+
+const failureThreshold = 5
+
+// openDuration is a variable so tests can shorten it
+var openDuration = 30 * time.Second
+
+// Kinds of calls, each with its own circuit
+const (
+	KindRead  = "read"  // idempotent calls
+	KindOrder = "order" // calls that change state at the broker
+)
+
+// Circuit states
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned for calls to a broker whose circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitState is a snapshot of the circuit breaker of one kind of call to
+// a broker
+type CircuitState struct {
+	Broker              string     `json:"broker"`
+	Kind                string     `json:"kind"` // read or order
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type circuit struct {
+	mu        sync.Mutex
+	broker    string
+	kind      string
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half open circuit let its trial call through
+	lastError string
+}
+
+var (
+	circuitsMu sync.Mutex
+	circuits   = make(map[string]*circuit) // by broker and kind
+)
+
+func circuitFor(broker, kind string) *circuit {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	key := broker + "|" + kind
+	c, ok := circuits[key]
+	if !ok {
+		c = &circuit{broker: broker, kind: kind, state: StateClosed}
+		circuits[key] = c
+	}
+	return c
+}
+
+// allow reports whether a call may go out
+func (c *circuit) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == StateOpen && time.Since(c.openedAt) >= openDuration {
+		c.state, c.trial = StateHalfOpen, false
+	}
+	switch {
+	case c.state == StateOpen, c.state == StateHalfOpen && c.trial:
+		return fmt.Errorf("broker_api %s %ss: %w", c.broker, c.kind, ErrCircuitOpen)
+	case c.state == StateHalfOpen:
+		c.trial = true
+	}
+	return nil
+}
+
+// record counts the outcome of a call, failed when failure is not empty
+func (c *circuit) record(failure string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if failure == "" {
+		if c.state != StateClosed {
+			logger.Info("Circuit closed", "broker", c.broker, "kind", c.kind)
+		}
+		c.state, c.failures, c.trial = StateClosed, 0, false
+		return
+	}
+	c.failures++
+	c.lastError = failure
+	if c.state == StateHalfOpen || c.failures >= failureThreshold {
+		if c.state != StateOpen {
+			logger.Warn("Circuit opened", "broker", c.broker, "kind", c.kind, "failures", c.failures, "error", failure)
+		}
+		c.state, c.openedAt, c.trial = StateOpen, time.Now(), false
+	}
+}
+
+func (c *circuit) snapshot() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CircuitState{Broker: c.broker, Kind: c.kind, State: c.state, ConsecutiveFailures: c.failures, LastError: c.lastError}
+	if c.state == StateOpen && time.Since(c.openedAt) >= openDuration {
+		s.State = StateHalfOpen
+	}
+	if s.State != StateClosed {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// Circuits returns the circuit breakers of the brokers and kinds of calls
+// made so far
+func Circuits() []CircuitState {
+	circuitsMu.Lock()
+	states := make([]CircuitState, 0, len(circuits))
+	for _, c := range circuits {
+		states = append(states, c.snapshot())
+	}
+	circuitsMu.Unlock()
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Broker != states[j].Broker {
+			return states[i].Broker < states[j].Broker
+		}
+		return states[i].Kind < states[j].Kind
+	})
+	return states
+}
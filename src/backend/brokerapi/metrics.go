@@ -0,0 +1,35 @@
+package brokerapi
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Every attempt of a call is timed, retries included. Errors are attempts
+// that failed or got a 5xx response, the same failures the circuit counts.
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "backend",
+		Name:      "broker_api_request_duration_seconds",
+		Help:      "Duration of broker_api requests by broker and endpoint.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"broker", "endpoint"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "backend",
+		Name:      "broker_api_errors_total",
+		Help:      "broker_api requests that failed or returned a 5xx status.",
+	}, []string{"broker", "endpoint"})
+)
+
+// endpoint names a call by the resource after /api/{broker}/, leaving out
+// the contract and order IDs in the rest of the path
+func endpoint(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) >= 3 && parts[0] == "api" {
+		return parts[2]
+	}
+	return path
+}
@@ -0,0 +1,296 @@
+// Package calendar knows when exchanges trade.
+//
+// Each calendar has a daily session and a set of holidays. A session that
+// opens later in the day than it closes runs overnight and belongs to the
+// trading date it closes on: CME Globex opens at 17:00 CT for the next
+// day's trading date, so Sunday evening trades on Monday's date. Holidays
+// either close the exchange all day or close it early, see holidays.go.
+//
+// A time outside every session belongs to the trading date of the next
+// session, which is also when an order queued at that time is sent.
+package calendar
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// The runtime image has no zoneinfo
+	_ "time/tzdata"
+)
+
+// clock is a time of day in the calendar's time zone
+type clock struct {
+	hour, minute int
+}
+
+func (c clock) on(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), c.hour, c.minute, 0, 0, date.Location())
+}
+
+func (c clock) before(other clock) bool {
+	return c.hour < other.hour || (c.hour == other.hour && c.minute < other.minute)
+}
+
+func parseClock(value string) (clock, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return clock{}, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock{t.Hour(), t.Minute()}, nil
+}
+
+// Holiday is a trading date the exchange is closed, or closes early
+type Holiday struct {
+	Date string // YYYY-MM-DD
+	Name string
+	// Early closes keep the session open until this time
+	EarlyClose *clock
+}
+
+// Calendar is the trading schedule of an exchange
+type Calendar struct {
+	Name     string
+	Location *time.Location
+	Open     clock
+	Close    clock
+	rules    func(year int) []Holiday
+
+	mu        sync.Mutex
+	years     map[int]bool
+	holidays  map[string]Holiday
+	overrides map[string]*Holiday // nil removes a holiday
+}
+
+// Session is one trading date's session
+type Session struct {
+	TradingDate string
+	Opens       time.Time
+	Closes      time.Time
+	// Holiday name of an early close, empty otherwise
+	Note string
+}
+
+// overnight reports a session that opens the evening before its trading date
+func (c *Calendar) overnight() bool {
+	return c.Close.before(c.Open)
+}
+
+// holiday returns the holiday on a date, if any
+func (c *Calendar) holiday(date string) (Holiday, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.overrides[date]; ok {
+		if h == nil {
+			return Holiday{}, false
+		}
+		return *h, true
+	}
+	year, _ := time.Parse("2006-01-02", date)
+	if !c.years[year.Year()] {
+		for _, h := range c.rules(year.Year()) {
+			c.holidays[h.Date] = h
+		}
+		c.years[year.Year()] = true
+	}
+	h, ok := c.holidays[date]
+	return h, ok
+}
+
+// SessionOn returns the session of a trading date, ok is false when the
+// exchange is closed all day
+func (c *Calendar) SessionOn(date time.Time) (Session, bool) {
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, c.Location)
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return Session{}, false
+	}
+	s := Session{TradingDate: date.Format("2006-01-02")}
+	h, isHoliday := c.holiday(s.TradingDate)
+	if isHoliday && h.EarlyClose == nil {
+		return Session{}, false
+	}
+
+	s.Opens = c.Open.on(date)
+	if c.overnight() {
+		s.Opens = c.Open.on(date.AddDate(0, 0, -1))
+	}
+	s.Closes = c.Close.on(date)
+	if isHoliday {
+		s.Closes = h.EarlyClose.on(date)
+		s.Note = h.Name
+	}
+	return s, true
+}
+
+// Holiday returns the name of the holiday closing the exchange all day on a
+// date, ok is false for weekends and trading days
+func (c *Calendar) Holiday(date time.Time) (string, bool) {
+	h, ok := c.holiday(date.Format("2006-01-02"))
+	if !ok || h.EarlyClose != nil {
+		return "", false
+	}
+	return h.Name, true
+}
+
+// NextSession returns the session open at t, or the next one to open
+func (c *Calendar) NextSession(t time.Time) Session {
+	date := t.In(c.Location).AddDate(0, 0, -1)
+	for {
+		if s, ok := c.SessionOn(date); ok && s.Closes.After(t) {
+			return s
+		}
+		date = date.AddDate(0, 0, 1)
+	}
+}
+
+// IsOpen reports whether the exchange trades at t
+func (c *Calendar) IsOpen(t time.Time) bool {
+	return !c.NextSession(t).Opens.After(t)
+}
+
+// TradingDate returns the trading date of t: that of the session open at t,
+// or of the next one when the exchange is closed
+func (c *Calendar) TradingDate(t time.Time) string {
+	return c.NextSession(t).TradingDate
+}
+
+// -----------------------------------------------------------------
+// Exchanges
+// -----------------------------------------------------------------
+
+var (
+	chicago   = mustLoadLocation("America/Chicago")
+	newYork   = mustLoadLocation("America/New_York")
+	calendars = map[string]*Calendar{
+		"CME":  newCalendar("CME", chicago, clock{17, 0}, clock{16, 0}, cmeHolidays),
+		"NYSE": newCalendar("NYSE", newYork, clock{9, 30}, clock{16, 0}, nyseHolidays),
+	}
+	// exchanges maps the exchange of an order to its calendar
+	exchanges = map[string]string{
+		"CME":    "CME",
+		"CBOT":   "CME",
+		"NYMEX":  "CME",
+		"COMEX":  "CME",
+		"GLOBEX": "CME",
+		"NYSE":   "NYSE",
+		"NASDAQ": "NYSE",
+		"ARCA":   "NYSE",
+		"AMEX":   "NYSE",
+		"BATS":   "NYSE",
+		"ISLAND": "NYSE",
+		"SMART":  "NYSE",
+	}
+)
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+func newCalendar(name string, loc *time.Location, open, close clock, rules func(int) []Holiday) *Calendar {
+	return &Calendar{
+		Name:      name,
+		Location:  loc,
+		Open:      open,
+		Close:     close,
+		rules:     rules,
+		years:     make(map[int]bool),
+		holidays:  make(map[string]Holiday),
+		overrides: make(map[string]*Holiday),
+	}
+}
+
+// ForExchange returns the calendar of an exchange, ok is false for exchanges
+// without one
+func ForExchange(exchange string) (*Calendar, bool) {
+	name, ok := exchanges[strings.ToUpper(exchange)]
+	if !ok {
+		return nil, false
+	}
+	return calendars[name], true
+}
+
+// Exchanges lists the exchanges with a calendar
+func Exchanges() []string {
+	names := make([]string, 0, len(exchanges))
+	for exchange := range exchanges {
+		names = append(names, exchange)
+	}
+	return names
+}
+
+// overrideFile is the optional calendar file, keyed by calendar name:
+//
+//	{"CME": {"holidays": {"2027-01-09": "National Day of Mourning"},
+//	         "early_closes": {"2026-12-31": "12:15"},
+//	         "open": ["2026-04-03"]}}
+//
+// open lists dates whose built-in holiday does not apply.
+type overrideFile map[string]struct {
+	Holidays    map[string]string `json:"holidays"`
+	EarlyCloses map[string]string `json:"early_closes"`
+	Open        []string          `json:"open"`
+}
+
+// LoadOverrides adds the holidays and early closes in a calendar file to
+// the built-in ones. A missing file is not an error.
+func LoadOverrides(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file overrideFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid calendar file %s: %v", path, err)
+	}
+
+	for name, o := range file {
+		c, ok := calendars[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("calendar file %s: unknown calendar %q", path, name)
+		}
+		overrides := make(map[string]*Holiday)
+		for _, date := range o.Open {
+			if err := checkDate(date); err != nil {
+				return fmt.Errorf("calendar file %s: %s: %v", path, name, err)
+			}
+			overrides[date] = nil
+		}
+		for date, holiday := range o.Holidays {
+			if err := checkDate(date); err != nil {
+				return fmt.Errorf("calendar file %s: %s: %v", path, name, err)
+			}
+			overrides[date] = &Holiday{Date: date, Name: holiday}
+		}
+		for date, value := range o.EarlyCloses {
+			if err := checkDate(date); err != nil {
+				return fmt.Errorf("calendar file %s: %s: %v", path, name, err)
+			}
+			early, err := parseClock(value)
+			if err != nil {
+				return fmt.Errorf("calendar file %s: %s: %s: %v", path, name, date, err)
+			}
+			overrides[date] = &Holiday{Date: date, Name: "Early close", EarlyClose: &early}
+		}
+		c.mu.Lock()
+		c.overrides = overrides
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func checkDate(date string) error {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEaster(t *testing.T) {
+	tests := []struct {
+		year int
+		want string
+	}{
+		{2008, "2008-03-23"},
+		{2019, "2019-04-21"},
+		{2024, "2024-03-31"},
+		{2025, "2025-04-20"},
+		{2026, "2026-04-05"},
+		{2038, "2038-04-25"},
+		{2285, "2285-03-22"},
+	}
+	for _, tt := range tests {
+		if got := easter(tt.year).Format("2006-01-02"); got != tt.want {
+			t.Errorf("easter(%d) = %s, want %s", tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestHoliday(t *testing.T) {
+	tests := []struct {
+		exchange string
+		date     string
+		want     string // empty for a trading day
+	}{
+		{"NYSE", "2025-01-01", "New Year's Day"},
+		{"NYSE", "2025-01-20", "Martin Luther King Jr. Day"},
+		{"NYSE", "2025-02-17", "Presidents' Day"},
+		{"NYSE", "2025-04-18", "Good Friday"},
+		{"NYSE", "2026-04-03", "Good Friday"},
+		{"NYSE", "2025-05-26", "Memorial Day"},
+		{"NYSE", "2025-06-19", "Juneteenth"},
+		{"NYSE", "2025-09-01", "Labor Day"},
+		{"NYSE", "2025-11-27", "Thanksgiving Day"},
+		{"NYSE", "2025-12-25", "Christmas Day"},
+		// Saturday holidays move to Friday, Sunday ones to Monday
+		{"NYSE", "2026-07-03", "Independence Day"},
+		{"NYSE", "2027-06-18", "Juneteenth"},
+		{"NYSE", "2022-06-20", "Juneteenth"},
+		{"NYSE", "2022-12-26", "Christmas Day"},
+		// except New Year's Day on a Saturday
+		{"NYSE", "2021-12-31", ""},
+		{"NYSE", "2025-04-21", ""},
+		// Early closes are trading days
+		{"NYSE", "2025-11-28", ""},
+		{"CME", "2025-04-18", "Good Friday"},
+		{"CME", "2025-12-25", "Christmas Day"},
+		{"CME", "2025-01-20", ""},
+		{"CME", "2025-11-27", ""},
+	}
+	for _, tt := range tests {
+		cal, _ := ForExchange(tt.exchange)
+		got, _ := cal.Holiday(day(tt.date))
+		if got != tt.want {
+			t.Errorf("%s Holiday(%s) = %q, want %q", tt.exchange, tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestSessionOn(t *testing.T) {
+	tests := []struct {
+		exchange string
+		date     string
+		open     bool
+		opens    string // in the calendar's time zone
+		closes   string
+		note     string
+	}{
+		{"NYSE", "2025-03-10", true, "2025-03-10 09:30", "2025-03-10 16:00", ""},
+		{"NYSE", "2025-03-08", false, "", "", ""},
+		{"NYSE", "2025-04-18", false, "", "", ""},
+		{"NYSE", "2025-07-03", true, "2025-07-03 09:30", "2025-07-03 13:00", "Independence Day eve"},
+		{"NYSE", "2025-11-28", true, "2025-11-28 09:30", "2025-11-28 13:00", "Day after Thanksgiving"},
+		{"NYSE", "2025-12-24", true, "2025-12-24 09:30", "2025-12-24 13:00", "Christmas Eve"},
+		// No eve when the holiday itself is observed on the 3rd or the 26th
+		{"NYSE", "2026-07-02", true, "2026-07-02 09:30", "2026-07-02 16:00", ""},
+		{"NYSE", "2022-12-23", true, "2022-12-23 09:30", "2022-12-23 16:00", ""},
+		{"CME", "2025-03-10", true, "2025-03-09 17:00", "2025-03-10 16:00", ""},
+		{"CME", "2025-11-27", true, "2025-11-26 17:00", "2025-11-27 12:00", "Thanksgiving Day"},
+		{"CME", "2025-11-28", true, "2025-11-27 17:00", "2025-11-28 12:15", "Day after Thanksgiving"},
+		{"CME", "2025-12-24", true, "2025-12-23 17:00", "2025-12-24 12:15", "Christmas Eve"},
+		{"CME", "2025-12-25", false, "", "", ""},
+	}
+	for _, tt := range tests {
+		cal, _ := ForExchange(tt.exchange)
+		s, ok := cal.SessionOn(day(tt.date))
+		if ok != tt.open {
+			t.Errorf("%s SessionOn(%s) open = %v, want %v", tt.exchange, tt.date, ok, tt.open)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		const layout = "2006-01-02 15:04"
+		opens, closes := s.Opens.In(cal.Location).Format(layout), s.Closes.In(cal.Location).Format(layout)
+		if opens != tt.opens || closes != tt.closes || s.Note != tt.note || s.TradingDate != tt.date {
+			t.Errorf("%s SessionOn(%s) = %s %s-%s %q, want %s %s-%s %q", tt.exchange, tt.date,
+				s.TradingDate, opens, closes, s.Note, tt.date, tt.opens, tt.closes, tt.note)
+		}
+	}
+}
+
+// The CME session opens at 17:00 CT for the next trading date, which is
+// 23:00 UTC in winter and 22:00 UTC in summer
+func TestCMETradingDate(t *testing.T) {
+	tests := []struct {
+		name string
+		at   string // UTC
+		open bool
+		date string
+	}{
+		{"Friday before the close", "2025-03-07T21:59:00Z", true, "2025-03-07"},
+		{"Friday after the close", "2025-03-07T22:30:00Z", false, "2025-03-10"},
+		{"Sunday before the open, CDT", "2025-03-09T21:59:00Z", false, "2025-03-10"},
+		{"Sunday open, CDT", "2025-03-09T22:00:00Z", true, "2025-03-10"},
+		{"Sunday an hour early, CST", "2025-03-02T22:00:00Z", false, "2025-03-03"},
+		{"Sunday open, CST", "2025-03-02T23:00:00Z", true, "2025-03-03"},
+		{"daily close", "2025-03-10T21:00:00Z", false, "2025-03-11"},
+		{"daily reopen rolls the date", "2025-03-10T22:00:00Z", true, "2025-03-11"},
+		{"maintenance break, CDT", "2025-10-27T21:30:00Z", false, "2025-10-28"},
+		{"reopen, CDT", "2025-10-27T22:00:00Z", true, "2025-10-28"},
+		{"Sunday after fall back, still closed", "2025-11-02T22:30:00Z", false, "2025-11-03"},
+		{"Sunday open after fall back, CST", "2025-11-02T23:00:00Z", true, "2025-11-03"},
+		{"before the close, CST", "2025-11-03T21:59:00Z", true, "2025-11-03"},
+		{"maintenance break, CST", "2025-11-03T22:30:00Z", false, "2025-11-04"},
+		{"reopen, CST", "2025-11-03T23:00:00Z", true, "2025-11-04"},
+		{"evening before Good Friday", "2025-04-17T22:00:00Z", false, "2025-04-21"},
+		{"after the Thanksgiving early halt", "2025-11-27T19:00:00Z", false, "2025-11-28"},
+		{"reopen after Thanksgiving", "2025-11-27T23:00:00Z", true, "2025-11-28"},
+	}
+	cal, _ := ForExchange("GLOBEX")
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cal.IsOpen(at); got != tt.open {
+			t.Errorf("%s: IsOpen(%s) = %v, want %v", tt.name, tt.at, got, tt.open)
+		}
+		if got := cal.TradingDate(at); got != tt.date {
+			t.Errorf("%s: TradingDate(%s) = %s, want %s", tt.name, tt.at, got, tt.date)
+		}
+	}
+}
+
+func TestForExchange(t *testing.T) {
+	for exchange, want := range map[string]string{"cbot": "CME", "SMART": "NYSE", "nasdaq": "NYSE"} {
+		if cal, ok := ForExchange(exchange); !ok || cal.Name != want {
+			t.Errorf("ForExchange(%s) = %v, want the %s calendar", exchange, cal, want)
+		}
+	}
+	if _, ok := ForExchange("EUREX"); ok {
+		t.Error("ForExchange(EUREX) found a calendar")
+	}
+}
+
+func day(value string) time.Time {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,153 @@
+package calendar
+
+import "time"
+
+// US exchange holidays, worked out from the rules each exchange publishes.
+// Holidays falling on a Saturday are observed the Friday before and those on
+// a Sunday the Monday after, except New Year's Day on a Saturday, which is
+// not observed.
+
+// cmeHolidays follows the CME Globex equity and interest rate schedule:
+// closed on New Year's Day, Good Friday and Christmas, an early halt at
+// 12:00 CT on the other federal holidays and at 12:15 CT on the day after
+// Thanksgiving and Christmas Eve
+func cmeHolidays(year int) []Holiday {
+	noon, quarterPast := &clock{12, 0}, &clock{12, 15}
+	days := usHolidays(year)
+	holidays := []Holiday{
+		{Date: days.newYear, Name: "New Year's Day"},
+		{Date: days.goodFriday, Name: "Good Friday"},
+		{Date: days.christmas, Name: "Christmas Day"},
+		{Date: days.mlk, Name: "Martin Luther King Jr. Day", EarlyClose: noon},
+		{Date: days.presidents, Name: "Presidents' Day", EarlyClose: noon},
+		{Date: days.memorial, Name: "Memorial Day", EarlyClose: noon},
+		{Date: days.juneteenth, Name: "Juneteenth", EarlyClose: noon},
+		{Date: days.independence, Name: "Independence Day", EarlyClose: noon},
+		{Date: days.labor, Name: "Labor Day", EarlyClose: noon},
+		{Date: days.thanksgiving, Name: "Thanksgiving Day", EarlyClose: noon},
+		{Date: days.blackFriday, Name: "Day after Thanksgiving", EarlyClose: quarterPast},
+	}
+	if days.christmasEve != "" {
+		holidays = append(holidays, Holiday{Date: days.christmasEve, Name: "Christmas Eve", EarlyClose: quarterPast})
+	}
+	return dropEmpty(holidays)
+}
+
+// nyseHolidays follows the NYSE schedule: closed on every holiday and an
+// early close at 13:00 ET on the day before Independence Day, the day after
+// Thanksgiving and Christmas Eve
+func nyseHolidays(year int) []Holiday {
+	one := &clock{13, 0}
+	days := usHolidays(year)
+	holidays := []Holiday{
+		{Date: days.newYear, Name: "New Year's Day"},
+		{Date: days.mlk, Name: "Martin Luther King Jr. Day"},
+		{Date: days.presidents, Name: "Presidents' Day"},
+		{Date: days.goodFriday, Name: "Good Friday"},
+		{Date: days.memorial, Name: "Memorial Day"},
+		{Date: days.juneteenth, Name: "Juneteenth"},
+		{Date: days.independence, Name: "Independence Day"},
+		{Date: days.labor, Name: "Labor Day"},
+		{Date: days.thanksgiving, Name: "Thanksgiving Day"},
+		{Date: days.christmas, Name: "Christmas Day"},
+		{Date: days.blackFriday, Name: "Day after Thanksgiving", EarlyClose: one},
+	}
+	if days.independenceEve != "" {
+		holidays = append(holidays, Holiday{Date: days.independenceEve, Name: "Independence Day eve", EarlyClose: one})
+	}
+	if days.christmasEve != "" {
+		holidays = append(holidays, Holiday{Date: days.christmasEve, Name: "Christmas Eve", EarlyClose: one})
+	}
+	return dropEmpty(holidays)
+}
+
+// usDays are the dates of the US market holidays in a year, empty when a
+// holiday is not observed that year
+type usDays struct {
+	newYear, mlk, presidents, goodFriday, memorial, juneteenth      string
+	independence, independenceEve, labor, thanksgiving, blackFriday string
+	christmasEve, christmas                                         string
+}
+
+func usHolidays(year int) usDays {
+	format := func(t time.Time) string { return t.Format("2006-01-02") }
+	var days usDays
+
+	if newYear := date(year, time.January, 1); newYear.Weekday() != time.Saturday {
+		days.newYear = format(observed(newYear))
+	}
+	days.mlk = format(nthWeekday(year, time.January, time.Monday, 3))
+	days.presidents = format(nthWeekday(year, time.February, time.Monday, 3))
+	days.goodFriday = format(easter(year).AddDate(0, 0, -2))
+	days.memorial = format(nthWeekday(year, time.June, time.Monday, 1).AddDate(0, 0, -7))
+	days.juneteenth = format(observed(date(year, time.June, 19)))
+
+	independence := observed(date(year, time.July, 4))
+	days.independence = format(independence)
+	if eve := date(year, time.July, 3); independence.Day() == 4 && isWeekday(eve) {
+		days.independenceEve = format(eve)
+	}
+	days.labor = format(nthWeekday(year, time.September, time.Monday, 1))
+	thanksgiving := nthWeekday(year, time.November, time.Thursday, 4)
+	days.thanksgiving = format(thanksgiving)
+	days.blackFriday = format(thanksgiving.AddDate(0, 0, 1))
+
+	christmas := observed(date(year, time.December, 25))
+	days.christmas = format(christmas)
+	if eve := date(year, time.December, 24); christmas.Day() == 25 && isWeekday(eve) {
+		days.christmasEve = format(eve)
+	}
+	return days
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func isWeekday(t time.Time) bool {
+	return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+}
+
+// observed moves a Saturday holiday to Friday and a Sunday one to Monday
+func observed(t time.Time) time.Time {
+	switch t.Weekday() {
+	case time.Saturday:
+		return t.AddDate(0, 0, -1)
+	case time.Sunday:
+		return t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// nthWeekday returns the nth given weekday of a month
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	first := date(year, month, 1)
+	offset := (int(weekday) - int(first.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, offset+7*(n-1))
+}
+
+// easter returns Easter Sunday (anonymous Gregorian algorithm)
+func easter(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return date(year, time.Month(month), day)
+}
+
+func dropEmpty(holidays []Holiday) []Holiday {
+	kept := holidays[:0]
+	for _, h := range holidays {
+		if h.Date != "" {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"pytrader/brokerapi"
+	"pytrader/database"
+	"pytrader/logging"
+)
+
+// The scheduler shows the circuit breakers of the backend's broker_api
+// client on the dashboard, so their states are published every
+// circuitPublishInterval.
+const circuitPublishInterval = 10 * time.Second
+
+func publishCircuits(done chan struct{}) {
+	ticker := time.NewTicker(circuitPublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var circuits []database.BrokerCircuit
+		for _, c := range brokerapi.Circuits() {
+			circuits = append(circuits, database.BrokerCircuit{
+				Broker:              c.Broker,
+				Kind:                c.Kind,
+				State:               c.State,
+				ConsecutiveFailures: c.ConsecutiveFailures,
+				OpenedAt:            c.OpenedAt,
+				LastError:           c.LastError,
+			})
+		}
+		if err := database.SaveBrokerCircuits("backend", circuits); err != nil {
+			logging.For("broker").Error("Failed to publish broker circuits", "error", err)
+		}
+	}
+}
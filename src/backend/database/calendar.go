@@ -0,0 +1,43 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// CalendarDay is one exchange's session on a trading date. Opens and Closes
+// are nil on days the exchange is closed, and Note names the holiday.
+type CalendarDay struct {
+	Exchange    string
+	TradingDate string
+	Opens       *time.Time
+	Closes      *time.Time
+	Note        string
+}
+
+// SaveTradingCalendar replaces the stored sessions of each day given
+func SaveTradingCalendar(days []CalendarDay) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to save trading calendar: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO trading_calendar (exchange, trading_date, opens_at, closes_at, note)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (exchange, trading_date) DO UPDATE
+	SET opens_at = EXCLUDED.opens_at, closes_at = EXCLUDED.closes_at, note = EXCLUDED.note
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to save trading calendar: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, day := range days {
+		if _, err := stmt.Exec(day.Exchange, day.TradingDate, day.Opens, day.Closes, day.Note); err != nil {
+			return fmt.Errorf("failed to save trading calendar: %v", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// BrokerCircuit is the circuit breaker state of a service's reads from or
+// orders to one broker
+type BrokerCircuit struct {
+	Broker              string
+	Kind                string // read or order
+	State               string
+	ConsecutiveFailures int
+	OpenedAt            *time.Time
+	LastError           string
+}
+
+// SaveBrokerCircuits stores the circuit breaker states of a service
+func SaveBrokerCircuits(service string, circuits []BrokerCircuit) error {
+	for _, c := range circuits {
+		_, err := db.Exec(`
+		INSERT INTO broker_circuits (service, broker, kind, state, consecutive_failures, opened_at, last_error, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (service, broker, kind) DO UPDATE
+		SET state = EXCLUDED.state, consecutive_failures = EXCLUDED.consecutive_failures,
+			opened_at = EXCLUDED.opened_at, last_error = EXCLUDED.last_error, updated_at = EXCLUDED.updated_at
+		`, service, c.Broker, c.Kind, c.State, c.ConsecutiveFailures, c.OpenedAt, c.LastError)
+		if err != nil {
+			return fmt.Errorf("failed to save broker circuits: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// The contracts table is the contract master kept by the scheduler
+
+// ContractTickSize returns the tick size of a contract by conId. ok is false
+// when the contract, or its tick size, is not known yet.
+func ContractTickSize(contractID int32) (tick float64, ok bool, err error) {
+	err = db.QueryRow(`SELECT tick_size FROM contracts WHERE con_id = $1`, contractID).Scan(&tick)
+	var pqErr *pq.Error
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &pqErr) && pqErr.Code == "42P01") {
+		// No such contract, or the scheduler has not created the table yet
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return tick, tick > 0, nil
+}
+
+// ContractFees returns the commission and exchange fees charged per contract
+// and side, from the contract's row or, failing that, another expiry of the
+// same symbol. ok is false when no fees are set.
+func ContractFees(contractID int32, symbol string) (perContract float64, ok bool, err error) {
+	err = db.QueryRow(`
+	SELECT commission + exchange_fee FROM contracts
+	WHERE con_id = $1 OR (symbol = $2 AND commission + exchange_fee > 0)
+	ORDER BY COALESCE(con_id = $1, false) DESC
+	LIMIT 1
+	`, contractID, symbol).Scan(&perContract)
+	var pqErr *pq.Error
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &pqErr) && (pqErr.Code == "42P01" || pqErr.Code == "42703")) {
+		// No such contract, or the scheduler has not created the columns yet
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return perContract, perContract > 0, nil
+}
@@ -3,14 +3,18 @@ package database
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"pytrader/logging"
+
 	_ "github.com/lib/pq"
 )
 
-var db *sql.DB
+var (
+	db     *sql.DB
+	logger = logging.For("db")
+)
 
 // Initialize sets up the database connection
 func Initialize() error {
@@ -33,7 +37,7 @@ func Initialize() error {
 				break
 			}
 		}
-		log.Printf("Failed to connect to DB, retrying in 3 seconds... (attempt %d/10)", i+1)
+		logger.Warn("Failed to connect to DB, retrying in 3 seconds", "attempt", i+1, "attempts", 10, "error", err)
 		time.Sleep(3 * time.Second)
 	}
 
@@ -51,7 +55,7 @@ func Initialize() error {
 		return fmt.Errorf("failed to create tables: %v", err)
 	}
 
-	log.Println("Database connection established successfully")
+	logger.Info("Database connection established")
 	return nil
 }
 
@@ -77,6 +81,11 @@ func createTables() error {
 		last_updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 	);
 
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS script_version VARCHAR(80) NOT NULL DEFAULT '';
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS setup_name VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS commission FLOAT NOT NULL DEFAULT 0;
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS commission_source VARCHAR(10) NOT NULL DEFAULT '';
+
 	CREATE UNIQUE INDEX IF NOT EXISTS trades_broker_order_id_trading_date_idx
 	ON trades (broker_order_id, trading_date)
 	WHERE broker_order_id > 0;
@@ -85,12 +94,101 @@ func createTables() error {
 		return err
 	}
 
+	// Every insert/update gets the next change_seq and notifies listeners on
+	// trades_changed, so the scheduler can stream changes instead of re-reading
+	// recent trades and resume a client from the last change it saw.
+	_, err = db.Exec(`
+	CREATE SEQUENCE IF NOT EXISTS trades_change_seq;
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS change_seq BIGINT;
+	ALTER TABLE trades ADD COLUMN IF NOT EXISTS last_change VARCHAR(6) NOT NULL DEFAULT 'insert';
+
+	CREATE OR REPLACE FUNCTION trades_track_change() RETURNS trigger AS $$
+	BEGIN
+		NEW.change_seq := nextval('trades_change_seq');
+		NEW.last_change := lower(TG_OP);
+		PERFORM pg_notify('trades_changed', NEW.change_seq::text);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS trades_track_change ON trades;
+	CREATE TRIGGER trades_track_change
+		BEFORE INSERT OR UPDATE ON trades
+		FOR EACH ROW EXECUTE PROCEDURE trades_track_change();
+
+	-- The trigger numbers rows written before it existed
+	UPDATE trades SET change_seq = NULL WHERE change_seq IS NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_trades_change_seq ON trades(change_seq);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Sessions of the exchanges the backend knows, published for the
+	// scheduler. Days the exchange is closed have no open and close times.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS trading_calendar (
+		exchange VARCHAR(50) NOT NULL,
+		trading_date DATE NOT NULL,
+		opens_at TIMESTAMPTZ,
+		closes_at TIMESTAMPTZ,
+		note VARCHAR(100) NOT NULL DEFAULT '',
+		PRIMARY KEY (exchange, trading_date)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Transaction cost inputs of each trade: the quote mid when the
+	// instruction came in and when the order went out, the spread then, and
+	// the fill. Prices are 0 until known.
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS trade_costs (
+		trade_id INTEGER PRIMARY KEY REFERENCES trades (id) ON DELETE CASCADE,
+		decision_price FLOAT NOT NULL DEFAULT 0,
+		decided_at TIMESTAMPTZ,
+		arrival_price FLOAT NOT NULL DEFAULT 0,
+		spread FLOAT NOT NULL DEFAULT 0,
+		submitted_at TIMESTAMPTZ,
+		fill_price FLOAT NOT NULL DEFAULT 0,
+		filled_at TIMESTAMPTZ
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Circuit breaker state of each service's broker_api client, published
+	// for the scheduler's dashboard
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS broker_circuits (
+		service VARCHAR(20) NOT NULL,
+		broker VARCHAR(20) NOT NULL,
+		kind VARCHAR(10) NOT NULL DEFAULT 'read',
+		state VARCHAR(10) NOT NULL,
+		consecutive_failures INTEGER NOT NULL DEFAULT 0,
+		opened_at TIMESTAMPTZ,
+		last_error TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	-- Reads and orders have a circuit each since the kind column was added
+	ALTER TABLE broker_circuits ADD COLUMN IF NOT EXISTS kind VARCHAR(10) NOT NULL DEFAULT 'read';
+	ALTER TABLE broker_circuits DROP CONSTRAINT IF EXISTS broker_circuits_pkey;
+	CREATE UNIQUE INDEX IF NOT EXISTS broker_circuits_key ON broker_circuits (service, broker, kind);
+	`)
+	if err != nil {
+		return err
+	}
+
 	// Create indexes for better query performance
 	_, err = db.Exec(`
 	CREATE INDEX IF NOT EXISTS idx_trades_status ON trades(status);
 	CREATE INDEX IF NOT EXISTS idx_trades_symbol ON trades(symbol);
 	CREATE INDEX IF NOT EXISTS idx_trades_strategy ON trades(strategy_name);
 	CREATE INDEX IF NOT EXISTS idx_trades_created ON trades(created_at);
+	CREATE INDEX IF NOT EXISTS idx_trades_setup ON trades(setup_name);
+	CREATE INDEX IF NOT EXISTS idx_trades_trading_date ON trades(trading_date);
 	`)
 
 	return err
@@ -21,4 +21,6 @@ type Trade struct {
 	Status        string    `db:"status"`          // pending, submitted, filled, cancelled, rejected
 	CreatedAt     time.Time `db:"created_at"`
 	LastUpdatedAt time.Time `db:"last_updated_at"`
+	ScriptVersion string    `db:"script_version"` // e.g. v3:1a2b3c4d5e6f, empty for unversioned scripts
+	SetupName     string    `db:"setup_name"`     // empty for trades sent before setups were recorded
 }
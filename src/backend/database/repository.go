@@ -2,18 +2,18 @@ package database
 
 import (
 	"fmt"
-	"log"
 	"time"
 )
 
 // SaveTradeInstruction stores a new trade instruction in the database
-func SaveTradeInstruction(strategyName string, contractID int32, exchange, symbol, side, orderType, broker string, quantity float64, price float64) (int64, error) {
+// along with the setup and version of the strategy script that sent it
+func SaveTradeInstruction(strategyName string, contractID int32, exchange, symbol, side, orderType, broker string, quantity float64, price float64, scriptVersion, setupName, tradingDate string) (int64, error) {
 	query := `
 	INSERT INTO trades (
 		strategy_name, contract_id, exchange, symbol, side, quantity, order_type, broker,
-		trading_date, status, created_at, last_updated_at, price
+		trading_date, status, created_at, last_updated_at, price, script_version, setup_name
 	)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	RETURNING id
 	`
 
@@ -28,11 +28,13 @@ func SaveTradeInstruction(strategyName string, contractID int32, exchange, symbo
 		quantity,
 		orderType,
 		broker,
-		time.Now().Format("2006-01-02"), // current trading date
+		tradingDate,
 		"Pending",
 		time.Now(),
 		time.Now(),
 		price,
+		scriptVersion,
+		setupName,
 	).Scan(&id)
 
 	if err != nil {
@@ -55,11 +57,39 @@ func UpdateTradeToSubmitted(id int64, brokerOrderID int, price float64) error {
 	return nil
 }
 
-// UpdateTradeStatus updates the status of a trade
-func UpdateTradeStatus(brokerOrderID int, status string, filledPrice float64) error {
-	// Get current date in YYYY-MM-DD format for the trading day reference
-	tradingDate := time.Now().Format("2006-01-02")
+// UpdateTradeToRejected marks a trade that was never sent to the broker
+func UpdateTradeToRejected(id int64, price float64) error {
+	query := `
+	UPDATE trades
+	SET status = 'Rejected', price = $1, last_updated_at = $2
+	WHERE id = $3
+	`
+	_, err := db.Exec(query, price, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update trade to rejected: %v", err)
+	}
+	return nil
+}
+
+// RejectUnsentTrades marks the trades still Pending without a broker order
+// as Rejected and returns how many there were. Called at startup, before
+// the backend sends any order.
+func RejectUnsentTrades() (int64, error) {
+	query := `
+	UPDATE trades
+	SET status = 'Rejected', last_updated_at = $1
+	WHERE status = 'Pending' AND broker_order_id = 0
+	`
+	result, err := db.Exec(query, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to reject unsent trades: %v", err)
+	}
+	return result.RowsAffected()
+}
 
+// UpdateTradeStatus updates the status of the trade a broker order was sent
+// for on a trading date
+func UpdateTradeStatus(brokerOrderID int, tradingDate string, status string, filledPrice float64) error {
 	query := `
 	UPDATE trades
 	SET status = $1, last_updated_at = $2, price = CASE WHEN $6 = 'Filled' THEN $3 ELSE price END
@@ -68,7 +98,6 @@ func UpdateTradeStatus(brokerOrderID int, status string, filledPrice float64) er
 
 	result, err := db.Exec(query, status, time.Now(), filledPrice, brokerOrderID, tradingDate, status)
 	if err != nil {
-		fmt.Println("Error:", status, filledPrice, brokerOrderID, tradingDate)
 		return fmt.Errorf("failed to update trade status: %v", err)
 	}
 
@@ -78,17 +107,33 @@ func UpdateTradeStatus(brokerOrderID int, status string, filledPrice float64) er
 	}
 
 	if rows == 0 {
-		log.Printf("Warning: No trade found with broker ID %d for date %s", brokerOrderID, tradingDate)
+		logger.Warn("No trade found for broker order", "order_id", brokerOrderID, "trading_date", tradingDate)
 	}
 
 	return nil
 }
 
+// UpdateTradeCommission stores the commission and fees paid for the trade a
+// broker order was sent for on a trading date, and where they came from:
+// "broker" or "schedule"
+func UpdateTradeCommission(brokerOrderID int, tradingDate string, commission float64, source string) error {
+	query := `
+	UPDATE trades
+	SET commission = $1, commission_source = $2
+	WHERE broker_order_id = $3 AND trading_date = $4
+	`
+	_, err := db.Exec(query, commission, source, brokerOrderID, tradingDate)
+	if err != nil {
+		return fmt.Errorf("failed to update trade commission: %v", err)
+	}
+	return nil
+}
+
 // GetPendingTrades retrieves all pending trades
 func GetPendingTrades() ([]Trade, error) {
 	query := `
 	SELECT id, strategy_name, contract_id, exchange, symbol, side, quantity,
-	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at
+	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at, script_version, setup_name
 	FROM trades
 	WHERE status IN ('Pending', 'Submitted')
 	ORDER BY created_at DESC
@@ -108,7 +153,7 @@ func GetPendingTrades() ([]Trade, error) {
 			&trade.ID, &trade.StrategyName, &trade.ContractID,
 			&trade.Exchange, &trade.Symbol, &trade.Side, &trade.Quantity,
 			&trade.OrderType, &trade.Broker, &trade.Price, &trade.BrokerOrderID, &trade.TradingDate,
-			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt,
+			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt, &trade.ScriptVersion, &trade.SetupName,
 		)
 
 		if err != nil {
@@ -129,7 +174,7 @@ func GetPendingTrades() ([]Trade, error) {
 func GetRecentTradesBySymbol(symbol string, limit int) ([]Trade, error) {
 	query := `
 	SELECT id, strategy_name, contract_id, exchange, symbol, side, quantity,
-	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at
+	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at, script_version, setup_name
 	FROM trades
 	WHERE symbol = $1
 	ORDER BY created_at DESC
@@ -150,7 +195,7 @@ func GetRecentTradesBySymbol(symbol string, limit int) ([]Trade, error) {
 			&trade.ID, &trade.StrategyName, &trade.ContractID,
 			&trade.Exchange, &trade.Symbol, &trade.Side, &trade.Quantity,
 			&trade.OrderType, &trade.Broker, &trade.Price, &trade.BrokerOrderID, &trade.TradingDate,
-			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt,
+			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt, &trade.ScriptVersion, &trade.SetupName,
 		)
 
 		if err != nil {
@@ -171,7 +216,7 @@ func GetRecentTradesBySymbol(symbol string, limit int) ([]Trade, error) {
 func GetTradesByStrategyAndDate(strategy string, startDate, endDate string) ([]Trade, error) {
 	query := `
 	SELECT id, strategy_name, contract_id, exchange, symbol, side, quantity,
-	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at
+	       order_type, broker, price, broker_order_id, trading_date, status, created_at, last_updated_at, script_version, setup_name
 	FROM trades
 	WHERE strategy_name = $1 AND trading_date BETWEEN $2 AND $3
 	ORDER BY created_at DESC
@@ -191,7 +236,7 @@ func GetTradesByStrategyAndDate(strategy string, startDate, endDate string) ([]T
 			&trade.ID, &trade.StrategyName, &trade.ContractID,
 			&trade.Exchange, &trade.Symbol, &trade.Side, &trade.Quantity,
 			&trade.OrderType, &trade.Broker, &trade.Price, &trade.BrokerOrderID, &trade.TradingDate,
-			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt,
+			&trade.Status, &trade.CreatedAt, &trade.LastUpdatedAt, &trade.ScriptVersion, &trade.SetupName,
 		)
 
 		if err != nil {
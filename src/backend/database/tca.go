@@ -0,0 +1,52 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecordDecisionPrice stores the quote mid when a trade instruction was
+// received
+func RecordDecisionPrice(tradeID int64, price float64, decidedAt time.Time) error {
+	_, err := db.Exec(`
+	INSERT INTO trade_costs (trade_id, decision_price, decided_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (trade_id) DO UPDATE
+	SET decision_price = EXCLUDED.decision_price, decided_at = EXCLUDED.decided_at
+	`, tradeID, price, decidedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record decision price: %v", err)
+	}
+	return nil
+}
+
+// RecordArrivalPrice stores the quote mid and spread when a trade's order
+// was sent to the broker
+func RecordArrivalPrice(tradeID int64, price, spread float64, submittedAt time.Time) error {
+	_, err := db.Exec(`
+	INSERT INTO trade_costs (trade_id, arrival_price, spread, submitted_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (trade_id) DO UPDATE
+	SET arrival_price = EXCLUDED.arrival_price, spread = EXCLUDED.spread, submitted_at = EXCLUDED.submitted_at
+	`, tradeID, price, spread, submittedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record arrival price: %v", err)
+	}
+	return nil
+}
+
+// RecordFillPrice stores the fill of the trade a broker order was sent for
+// on a trading date
+func RecordFillPrice(brokerOrderID int, tradingDate string, price float64, filledAt time.Time) error {
+	_, err := db.Exec(`
+	INSERT INTO trade_costs (trade_id, fill_price, filled_at)
+	SELECT id, $3, $4 FROM trades
+	WHERE broker_order_id = $1 AND trading_date = $2
+	ON CONFLICT (trade_id) DO UPDATE
+	SET fill_price = EXCLUDED.fill_price, filled_at = EXCLUDED.filled_at
+	`, brokerOrderID, tradingDate, price, filledAt)
+	if err != nil {
+		return fmt.Errorf("failed to record fill price: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"pytrader/brokerapi"
+	"pytrader/database"
+	"pytrader/logging"
+)
+
+// -----------------------------------------------------------------
+// Commissions & Fees
+// -----------------------------------------------------------------
+
+// The commission of a filled order is the sum the broker reports on each of
+// its executions. IB sends the commission report shortly after the
+// execution, so it is polled for a while; brokers that never report one are
+// charged the per-contract fees of the contract master instead.
+
+const (
+	commissionAttempts = 6
+	commissionInterval = 5 * time.Second
+)
+
+// Fill is an execution as broker_api reports it
+type Fill struct {
+	OrderId    int      `json:"order_id"`
+	Quantity   float64  `json:"quantity"`
+	Price      float64  `json:"price"`
+	Commission *float64 `json:"commission"` // nil until reported
+}
+
+// recordCommission stores the commission paid for a filled order
+func recordCommission(orderResp OrderResponse, quantity float64) {
+	trade := orderResp.Order.TradeInstruction
+	log := fillsLog.With(logging.Key, orderResp.Order.CorrelationID, "order_id", orderResp.OrderId)
+	for attempt := 1; attempt <= commissionAttempts; attempt++ {
+		commission, ok, err := fetchCommission(trade.Broker, orderResp.OrderId, orderResp.Order.CorrelationID)
+		if err != nil {
+			log.Warn("Failed to fetch commission", "attempt", attempt, "error", err)
+		} else if ok {
+			saveCommission(orderResp, commission, "broker")
+			return
+		}
+		if attempt < commissionAttempts {
+			time.Sleep(commissionInterval)
+		}
+	}
+
+	perContract, ok, err := database.ContractFees(int32(trade.ContractId), trade.Symbol)
+	if err != nil {
+		log.Error("Failed to look up contract fees", "contract_id", trade.ContractId, "error", err)
+		return
+	}
+	if !ok {
+		log.Warn("No commission reported and no fees set for contract", "contract_id", trade.ContractId)
+		return
+	}
+	saveCommission(orderResp, perContract*math.Abs(quantity), "schedule")
+}
+
+func saveCommission(orderResp OrderResponse, commission float64, source string) {
+	log := fillsLog.With(logging.Key, orderResp.Order.CorrelationID, "order_id", orderResp.OrderId)
+	err := database.UpdateTradeCommission(orderResp.OrderId, orderResp.TradingDate, commission, source)
+	if err != nil {
+		log.Error("Failed to record commission", "error", err)
+		return
+	}
+	log.Info("Recorded commission", "commission", commission, "source", source)
+}
+
+// fetchCommission sums the commissions of an order's executions. ok is false
+// while any execution has not reported one.
+func fetchCommission(broker string, orderID int, correlationID string) (commission float64, ok bool, err error) {
+	if broker == "" {
+		broker = "IB"
+	}
+	var fills []Fill
+	if err := brokerapi.Get(broker, fmt.Sprintf("/api/%s/fills?order_id=%d", broker, orderID), correlationID, &fills); err != nil {
+		return 0, false, err
+	}
+	if len(fills) == 0 {
+		return 0, false, nil
+	}
+	for _, fill := range fills {
+		if fill.Commission == nil {
+			return 0, false, nil
+		}
+		commission += *fill.Commission
+	}
+	return commission, true, nil
+}
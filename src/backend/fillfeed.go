@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pytrader/brokerapi"
+)
+
+// broker_api pushes order updates as server-sent events, one "trade" event
+// in the shape of /trades per status change. streamFills keeps a connection
+// open and reconnects with backoff when it drops; monitorFills keeps polling
+// as a reconciliation fallback for the updates sent while it was down.
+
+const fillStreamBroker = "IB"
+
+// Variables so tests can shorten them
+var (
+	// broker_api sends a keepalive every 15 seconds, a stream quiet for
+	// longer than this is taken as dead
+	fillStreamIdleTimeout = 45 * time.Second
+	fillStreamMinBackoff  = time.Second
+	fillStreamMaxBackoff  = 30 * time.Second
+	// How often monitorFills checks for outstanding orders
+	fillPollInterval = 5 * time.Second
+	// How often monitorFills polls while the stream is up
+	fillReconcileInterval = 30 * time.Second
+	// How long a streamed update waits for its order to be queued
+	streamedTradeTTL = 5 * time.Minute
+)
+
+// settleTrades settles the orders of broker updates, tests replace it to
+// keep the database out
+var settleTrades = reconcileTrades
+
+// fillStreamUp is set while the stream is connected
+var fillStreamUp atomic.Bool
+
+// Market orders can fill before transmitOrder returns, so the update comes
+// in before the order is queued. Such updates are kept by order ID until
+// sendOrdersToFillMonitor queues the order.
+var streamedTrades sync.Map // map[int]streamedTrade
+
+type streamedTrade struct {
+	Trade      Trade
+	ReceivedAt time.Time
+}
+
+// streamFills follows broker_api's trade stream until done is closed
+func streamFills(done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	backoff := fillStreamMinBackoff
+	for {
+		connected, err := readFillStream(ctx)
+		fillStreamUp.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = fillStreamMinBackoff
+		}
+		fillsLog.Warn("Fill stream disconnected", "reconnect_in", backoff.String(), "error", err)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, fillStreamMaxBackoff)
+	}
+}
+
+// readFillStream reads one connection to the stream. connected tells
+// whether broker_api accepted it.
+func readFillStream(ctx context.Context) (connected bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The stream stays open, so it has no timeout of its own; the idle
+	// timer also covers a broker_api that never answers
+	idle := time.AfterFunc(fillStreamIdleTimeout, cancel)
+	defer idle.Stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/api/%s/trades/stream", brokerapi.BaseURL(), fillStreamBroker), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("broker_api returned %s", resp.Status)
+	}
+	fillsLog.Info("Fill stream connected")
+	fillStreamUp.Store(true)
+	// Catch up on the updates sent while disconnected
+	if hasOutstandingOrders() {
+		settleTrades(queryTradesAtBroker())
+	}
+
+	var event string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(fillStreamIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "trade" && len(data) > 0 {
+				handleStreamedTrade(strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// keepalive comment
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	// Cancelling the request also fails the read, so check the idle timer
+	// before the read error
+	if ctx.Err() != nil {
+		return true, fmt.Errorf("no data for %v", fillStreamIdleTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, fmt.Errorf("stream closed by broker_api")
+}
+
+// handleStreamedTrade settles the order of a filled or cancelled update, or
+// keeps the update until the order is queued
+func handleStreamedTrade(data string) {
+	var trade Trade
+	if err := json.Unmarshal([]byte(data), &trade); err != nil {
+		fillsLog.Error("Unable to decode streamed trade", "error", err)
+		return
+	}
+	fillsLog.Debug("Streamed trade", "order_id", trade.Id, "status", trade.Status)
+	if trade.Status != "Filled" && trade.Status != "Cancelled" {
+		return
+	}
+
+	now := time.Now()
+	streamedTrades.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(streamedTrade).ReceivedAt) > streamedTradeTTL {
+			streamedTrades.Delete(key)
+		}
+		return true
+	})
+	streamedTrades.Store(trade.Id, streamedTrade{Trade: trade, ReceivedAt: now})
+	settleStreamedTrade(trade.Id)
+}
+
+// settleStreamedTrade reconciles the streamed update of an order, once the
+// order is queued
+func settleStreamedTrade(orderID int) {
+	value, ok := streamedTrades.Load(orderID)
+	if !ok {
+		return
+	}
+	queued := false
+	orderResponseQueue.Range(func(key, v interface{}) bool {
+		if orderResponse, ok := v.(*OrderResponse); ok && orderResponse.OrderId == orderID {
+			queued = true
+			return false
+		}
+		return true
+	})
+	if queued {
+		streamedTrades.Delete(orderID)
+		settleTrades([]Trade{value.(streamedTrade).Trade})
+	}
+}
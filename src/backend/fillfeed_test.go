@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// settled records the trades handed to settleTrades in place of the database
+type settled struct {
+	mu     sync.Mutex
+	trades []Trade
+}
+
+func (s *settled) ids() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, len(s.trades))
+	for i, trade := range s.trades {
+		ids[i] = trade.Id
+	}
+	return ids
+}
+
+// fakeBrokerAPI serves handler as broker_api and resets the fill feed state
+// when the test ends
+func fakeBrokerAPI(t *testing.T, handler http.HandlerFunc) *settled {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Setenv("BROKER_API_URL", server.URL)
+
+	s := &settled{}
+	settleTrades = func(trades []Trade) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, trade := range findOrderInTrades(trades, &orderResponseQueue) {
+			s.trades = append(s.trades, trade.Trade)
+		}
+	}
+	idle, minBackoff, maxBackoff := fillStreamIdleTimeout, fillStreamMinBackoff, fillStreamMaxBackoff
+	poll, reconcile := fillPollInterval, fillReconcileInterval
+	t.Cleanup(func() {
+		server.Close()
+		settleTrades = reconcileTrades
+		fillStreamIdleTimeout, fillStreamMinBackoff, fillStreamMaxBackoff = idle, minBackoff, maxBackoff
+		fillPollInterval, fillReconcileInterval = poll, reconcile
+		fillStreamUp.Store(false)
+		streamedTrades.Clear()
+		orderResponseQueue.Clear()
+	})
+	return s
+}
+
+func queueOrder(orderID int) {
+	orderResponseQueue.Store(fmt.Sprintf("test-%d", orderID), &OrderResponse{OrderId: orderID})
+}
+
+func buffered(orderID int) bool {
+	_, ok := streamedTrades.Load(orderID)
+	return ok
+}
+
+func TestReadFillStreamParsesEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": keepalive",
+		"",
+		"event: order",
+		`data: {"order_id": 1, "order_status": "Filled"}`,
+		"",
+		"event: trade",
+		`data: {"order_id": 2, "order_status": "Submitted"}`,
+		"",
+		"event: trade",
+		`data: {"order_id": 3,`,
+		`data: "order_status": "Filled", "price": 101.25}`,
+		"",
+		"event: trade",
+		"data: not json",
+		"",
+		"event: trade",
+		`data:{"order_id": 4, "order_status": "Cancelled"}`,
+		"",
+		"event: trade",
+		`data: {"order_id": 5, "order_status": "Filled"}`,
+		// no blank line, the event is never complete
+	}, "\n")
+	caughtUp := false
+	s := fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/IB/trades":
+			// With an order outstanding the stream first catches up
+			caughtUp = true
+			fmt.Fprint(w, `[]`)
+		case r.URL.Path != "/api/IB/trades/stream" || r.Header.Get("Accept") != "text/event-stream":
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Accept"))
+		default:
+			fmt.Fprint(w, stream)
+		}
+	})
+	queueOrder(3)
+
+	connected, err := readFillStream(context.Background())
+	if !connected || err == nil || !strings.Contains(err.Error(), "closed by broker_api") {
+		t.Fatalf("readFillStream = %v, %v, want connected and closed by broker_api", connected, err)
+	}
+	if !fillStreamUp.Load() {
+		t.Error("fill stream not marked up")
+	}
+	if !caughtUp {
+		t.Error("connected without catching up on the outstanding order")
+	}
+	if got := s.ids(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("settled orders %v, want [3]", got)
+	}
+	for orderID, want := range map[int]bool{1: false, 2: false, 3: false, 4: true, 5: false} {
+		if buffered(orderID) != want {
+			t.Errorf("order %d buffered = %v, want %v", orderID, !want, want)
+		}
+	}
+}
+
+func TestReadFillStreamRejectedConnection(t *testing.T) {
+	fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not connected to IB", http.StatusServiceUnavailable)
+	})
+	connected, err := readFillStream(context.Background())
+	if connected || err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("readFillStream = %v, %v, want not connected with the status", connected, err)
+	}
+	if fillStreamUp.Load() {
+		t.Error("fill stream marked up")
+	}
+}
+
+func TestReadFillStreamIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepalive bool
+		want      string
+	}{
+		{"silent stream is dropped", false, "no data for"},
+		{"keepalives hold the stream open", true, "closed by broker_api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				end := time.After(300 * time.Millisecond)
+				for {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-end:
+						return
+					case <-time.After(20 * time.Millisecond):
+						if tt.keepalive {
+							fmt.Fprint(w, ": keepalive\n\n")
+							w.(http.Flusher).Flush()
+						}
+					}
+				}
+			})
+			fillStreamIdleTimeout = 100 * time.Millisecond
+
+			started := time.Now()
+			connected, err := readFillStream(context.Background())
+			if !connected || err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("readFillStream = %v, %v, want connected and %q", connected, err, tt.want)
+			}
+			if !tt.keepalive && time.Since(started) >= 300*time.Millisecond {
+				t.Errorf("idle stream dropped after %v, want about %v", time.Since(started), fillStreamIdleTimeout)
+			}
+		})
+	}
+}
+
+func TestStreamFillsReconnectsWithBackoff(t *testing.T) {
+	// Three refused connections, one accepted and closed, then refused again
+	var mu sync.Mutex
+	var attempts []time.Time
+	fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts = append(attempts, time.Now())
+		n := len(attempts)
+		mu.Unlock()
+		if n == 4 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	fillStreamMinBackoff, fillStreamMaxBackoff = 20*time.Millisecond, 60*time.Millisecond
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		streamFills(done)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(attempts)
+		mu.Unlock()
+		if n >= 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d connection attempts", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("streamFills did not stop when done was closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Doubling from the minimum up to the maximum, back to the minimum after
+	// a connection was accepted
+	wantAtLeast := []time.Duration{20, 40, 60, 20, 40}
+	for i, want := range wantAtLeast {
+		gap := attempts[i+1].Sub(attempts[i])
+		if gap < want*time.Millisecond {
+			t.Errorf("attempt %d came %v after the one before, want at least %v", i+2, gap, want*time.Millisecond)
+		}
+	}
+	if gap := attempts[4].Sub(attempts[3]); gap >= 60*time.Millisecond {
+		t.Errorf("backoff not reset after a connection: %v", gap)
+	}
+}
+
+func TestStreamedTradeWaitsForItsOrder(t *testing.T) {
+	s := fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	// A market order fills before transmitOrder returns
+	handleStreamedTrade(`{"order_id": 7, "order_status": "Filled", "price": 99.5}`)
+	if got := s.ids(); len(got) != 0 {
+		t.Fatalf("settled %v before the order was queued", got)
+	}
+	if !buffered(7) {
+		t.Fatal("update of an order not yet queued was dropped")
+	}
+
+	// What sendOrdersToFillMonitor does once the order is queued
+	queueOrder(7)
+	settleStreamedTrade(7)
+	if got := s.ids(); len(got) != 1 || got[0] != 7 {
+		t.Errorf("settled %v, want [7]", got)
+	}
+	if buffered(7) {
+		t.Error("settled update still buffered")
+	}
+
+	// Updates whose order never shows up expire
+	streamedTrades.Store(8, streamedTrade{Trade: Trade{Id: 8, Status: "Filled"}, ReceivedAt: time.Now().Add(-streamedTradeTTL - time.Second)})
+	handleStreamedTrade(`{"order_id": 9, "order_status": "Cancelled"}`)
+	if buffered(8) {
+		t.Error("expired update still buffered")
+	}
+	if !buffered(9) {
+		t.Error("new update not buffered")
+	}
+}
+
+func TestMonitorFillsPolling(t *testing.T) {
+	tests := []struct {
+		name     string
+		streamUp bool
+		want     int // polls in the first 200ms
+	}{
+		{"polls every tick while the stream is down", false, 3},
+		{"reconciles once while the stream is up", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			s := fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/IB/trades" {
+					t.Errorf("unexpected request %s", r.URL.Path)
+				}
+				mu.Lock()
+				polls++
+				mu.Unlock()
+				fmt.Fprint(w, `[{"order_id": 11, "order_status": "Submitted"}, {"order_id": 12, "order_status": "Filled"}]`)
+			})
+			fillPollInterval, fillReconcileInterval = 20*time.Millisecond, time.Hour
+			fillStreamUp.Store(tt.streamUp)
+			queueOrder(11)
+			queueOrder(12)
+
+			runMonitorFills(200 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.streamUp && polls != tt.want {
+				t.Errorf("polled %d times, want %d", polls, tt.want)
+			}
+			if !tt.streamUp && polls < tt.want {
+				t.Errorf("polled %d times, want at least %d", polls, tt.want)
+			}
+			if got := s.ids(); len(got) == 0 || got[0] != 12 {
+				t.Errorf("settled %v, want order 12", got)
+			}
+		})
+	}
+}
+
+func TestMonitorFillsIdleWithoutOrders(t *testing.T) {
+	fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("polled %s with no order outstanding", r.URL.Path)
+	})
+	fillPollInterval = 10 * time.Millisecond
+
+	runMonitorFills(50 * time.Millisecond)
+}
+
+// runMonitorFills runs monitorFills for a while and waits for it to stop
+func runMonitorFills(d time.Duration) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		monitorFills(done)
+		close(stopped)
+	}()
+	time.Sleep(d)
+	close(done)
+	<-stopped
+}
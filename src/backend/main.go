@@ -1,21 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
 	"math/rand"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"pytrader/auth"
+	"pytrader/brokerapi"
+	"pytrader/calendar"
 	"pytrader/database"
 	"pytrader/definitions"
+	"pytrader/logging"
 	"syscall"
 
 	pb "pytrader/tradepb"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // server is used to implement TradeService
@@ -32,8 +34,9 @@ type server struct {
 }
 
 type OrderResponse struct {
-	Order   Order
-	OrderId int
+	Order       Order
+	OrderId     int
+	TradingDate string
 }
 
 type TradeInstruction struct {
@@ -52,6 +55,7 @@ type Order struct {
 	TradeInstruction TradeInstruction `json:"trade"`
 	PriceQuote       float64          `json:"price"`
 	Timestamp        time.Time        `json:"timestamp"`
+	CorrelationID    string           `json:"-"` // of the trade instruction
 }
 
 type Trade struct {
@@ -79,18 +83,54 @@ func (m *MyError) Error() string {
 
 // Add a struct to carry the trade along with its database ID
 type TradeWithID struct {
-	Trade   *pb.Trade
-	TradeID int64
+	Trade    *pb.Trade
+	TradeID  int64
+	Quantity float64 // parsed from Trade.Quantity
+	Price    float64 // parsed from Trade.Price, 0 when not provided
+	// Trading date of the exchange session the trade was received for
+	TradingDate string
+	// Follows the trade through the logs, see package logging
+	CorrelationID string
+}
+
+// Component loggers, see package logging
+var (
+	mainLog      = logging.For("main")
+	grpcLog      = logging.For("grpc")
+	ordersLog    = logging.For("orders")
+	fillsLog     = logging.For("fills")
+	positionsLog = logging.For("positions")
+	sessionsLog  = logging.For("sessions")
+	tcaLog       = logging.For("tca")
+)
+
+// correlationID returns the correlation ID the caller sent as gRPC metadata,
+// or a new one when it sent none
+func correlationID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(logging.MetadataKey); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return logging.NewCorrelationID()
 }
 
 // SendTrade implements the SendTrade RPC
 func (s *server) SendTrade(ctx context.Context, trade *pb.Trade) (*pb.TradeResponse, error) {
-	log.Printf("Received trade: %+v", trade)
+	// The caller gets the correlation ID back in the response header
+	correlation := correlationID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(logging.MetadataKey, correlation))
+	log := grpcLog.With(logging.Key, correlation)
+	log.Info("Received trade", "strategy", trade.StrategyName, "symbol", trade.Symbol,
+		"contract_id", trade.ContractId, "exchange", trade.Exchange, "side", trade.Side,
+		"quantity", trade.Quantity, "order_type", trade.OrderType, "price", trade.Price, "broker", trade.Broker)
+	tradesReceived.Inc()
 
 	// Convert quantity string to float64
 	quantity, err := strconv.ParseFloat(trade.Quantity, 64)
 	if err != nil {
-		log.Printf("Failed to convert quantity '%s' to float64: %v", trade.Quantity, err)
+		log.Error("Invalid quantity", "quantity", trade.Quantity, "error", err)
+		tradesRejected.WithLabelValues(rejectInvalid).Inc()
 		return &pb.TradeResponse{Status: "Error: Invalid quantity"}, err
 	}
 
@@ -99,12 +139,24 @@ func (s *server) SendTrade(ctx context.Context, trade *pb.Trade) (*pb.TradeRespo
 	if trade.Price != "" {
 		price, err = strconv.ParseFloat(trade.Price, 64)
 		if err != nil {
-			log.Printf("Warning: Failed to convert price '%s' to float64: %v", trade.Price, err)
+			log.Warn("Invalid price, sending without one", "price", trade.Price, "error", err)
 			// Continue with price = 0.0
 		}
 	}
 
+	// Strategy processes report the setup and script version they run as gRPC metadata
+	scriptVersion, setupName := "", ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("script-version"); len(values) > 0 {
+			scriptVersion = values[0]
+		}
+		if values := md.Get("setup-name"); len(values) > 0 {
+			setupName = values[0]
+		}
+	}
+
 	// Save trade instruction to database
+	date := tradingDate(trade.Exchange, time.Now())
 	tradeID, err := database.SaveTradeInstruction(
 		trade.StrategyName,
 		trade.ContractId,
@@ -115,58 +167,61 @@ func (s *server) SendTrade(ctx context.Context, trade *pb.Trade) (*pb.TradeRespo
 		trade.Broker,
 		quantity,
 		price,
+		scriptVersion,
+		setupName,
+		date,
 	)
 
 	if err != nil {
-		log.Printf("Error saving trade instruction: %v", err)
+		log.Error("Failed to save trade instruction", "error", err)
 		// Continue processing anyway - we don't want to block the trade
+	} else {
+		log.Debug("Saved trade instruction", "trade_id", tradeID)
+		go recordDecision(tradeID, trade, correlation, time.Now())
 	}
 
 	// Store the trade ID for later use in the channel
 	tradeWithID := &TradeWithID{
-		Trade:   trade,
-		TradeID: tradeID,
+		Trade:    trade,
+		TradeID:  tradeID,
+		Quantity: quantity,
+		Price:    price,
+
+		TradingDate:   date,
+		CorrelationID: correlation,
 	}
 
 	// Send trade to the processing channel
-	tradeChannel <- tradeWithID
+	if !queueTrade(tradeWithID) {
+		log.Warn("Backend stopping, trade rejected")
+		if tradeID > 0 {
+			if err := database.UpdateTradeToRejected(tradeID, price); err != nil {
+				log.Error("Failed to update trade status to Rejected in database", "error", err)
+			}
+		}
+		return &pb.TradeResponse{Status: "Error: Backend is shutting down"}, nil
+	}
 
 	return &pb.TradeResponse{Status: "Trade received and processing"}, nil
 }
 
 // Function to send a GET request to retrieve the last price
-func fetchPriceQuote(contractID int32, exchange string, broker string) (Quote, error) {
+func fetchPriceQuote(contractID int32, exchange string, broker string, correlationID string) (Quote, error) {
 	// Default to IB if broker is not specified
 	if broker == "" {
 		broker = "IB"
 	}
 
-	// Determine the URL based on environment
-	var baseURL string
-	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
-		baseURL = "http://broker_api:8000"
-	} else {
-		baseURL = "http://127.0.0.1:8000"
-	}
-
-	url := fmt.Sprintf("%s/api/%s/quote/%s/%d", baseURL, broker, exchange, contractID)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println("Error sending GET request:", err)
-		return Quote{}, err // Empty quote if there is an error
-	}
-	defer resp.Body.Close()
-
 	// Parse the response body to extract the price
 	var response Quote
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err := brokerapi.Get(broker, fmt.Sprintf("/api/%s/quote/%s/%d", broker, exchange, contractID), correlationID, &response)
+	log := ordersLog.With(logging.Key, correlationID, "contract_id", contractID)
 	if err != nil {
-		fmt.Println("Error decoding quote:", err)
+		log.Warn("Failed to get quote", "error", err)
 		return Quote{}, err // Empty quote if there is an error
 	}
 
-	fmt.Printf("Bid: %f\tAsk: %f\tLast:%f\n", response.Bid, response.Ask, response.Last)
+	log.Debug("Quote", "bid", response.Bid, "ask", response.Ask, "last", response.Last)
 	if response.Last == 0.0 {
 		return Quote{}, &MyError{}
 	}
@@ -175,8 +230,9 @@ func fetchPriceQuote(contractID int32, exchange string, broker string) (Quote, e
 
 // Send order to BrokerAPI
 func transmitOrder(order Order, testTrade bool) (int, error) {
+	log := ordersLog.With(logging.Key, order.CorrelationID)
 	if testTrade {
-		fmt.Println("Test Trade --> ")
+		log.Info("Test trade, order not sent")
 		return rand.Intn(1000), nil
 	}
 
@@ -186,59 +242,19 @@ func transmitOrder(order Order, testTrade bool) (int, error) {
 		broker = "IB"
 	}
 
-	// Determine the URL based on environment
-	var baseURL string
-	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
-		baseURL = "http://broker_api:8000"
-	} else {
-		baseURL = "http://127.0.0.1:8000"
-	}
-
-	url := fmt.Sprintf("%s/api/%s/order", baseURL, broker)
-	orderJSON, err := json.Marshal(order)
-	if err != nil {
-		fmt.Println("Error marshaling order to JSON:", err)
-		return 0, err
-	}
-	fmt.Println("Order Spec: ", string(orderJSON))
-
-	// req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(string(orderJSON)))
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(orderJSON))
-	if err != nil {
-		fmt.Println("Error creating POST request:", err)
-		return 0, err
-	}
-
-	// Set headers for the POST request
-	req.Header.Add("Content-Type", "application/json")
-	fmt.Println("Transmitting Order...")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending POST request:", err)
-		return 0, err
-	}
-	defer resp.Body.Close()
-
-	fmt.Printf("POST request to %s completed with status: %s\n", url, resp.Status)
-	// read response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err)
-		return 0, err
-
-	}
-
+	// Orders are never retried, a retry after a timeout could place the
+	// order twice
+	log.Info("Transmitting order", "order", order)
 	var orderIDStr string
-	if err := json.Unmarshal(body, &orderIDStr); err != nil {
-		return 0, fmt.Errorf("error unmarshaling response: %v", err)
+	if err := brokerapi.Post(broker, fmt.Sprintf("/api/%s/order", broker), order.CorrelationID, brokerapi.OrderTimeout, order, &orderIDStr); err != nil {
+		return 0, err
 	}
 
 	orderID, err := strconv.Atoi(orderIDStr)
 	if err != nil {
 		return 0, fmt.Errorf("error converting to int: %v", err)
 	}
-	fmt.Println("Order Sent\t-->\tID: ", orderID)
+	log.Info("Order sent", "order_id", orderID)
 
 	return orderID, nil
 }
@@ -248,6 +264,8 @@ func processNewTrades() {
 	for tradeWithID := range tradeChannel {
 		trade := tradeWithID.Trade
 		tradeID := tradeWithID.TradeID
+		quantity := tradeWithID.Quantity
+		log := ordersLog.With(logging.Key, tradeWithID.CorrelationID, "strategy", trade.StrategyName, "symbol", trade.Symbol)
 
 		// Create key for Order
 		positionId := fmt.Sprintf("%s-%s", trade.StrategyName, trade.Symbol)
@@ -259,15 +277,37 @@ func processNewTrades() {
 			//load position to struct
 			current_pos, ok1 := i.(definitions.Position)
 			if !ok1 {
-				fmt.Printf("Issue reading position: i: %s \n cp: %t\n", i, ok1)
+				log.Error("Unable to read position", "position", i)
 				continue
 			}
 
 			if current_pos.Status == "Pending" {
-				fmt.Printf("Pending order exists, trade skipped: %s - %s - %t \n", trade, i, ok)
+				log.Warn("Pending order exists, trade skipped", "position", current_pos)
+				tradesRejected.WithLabelValues(rejectPending).Inc()
+				if tradeID > 0 {
+					if err := database.UpdateTradeToRejected(tradeID, tradeWithID.Price); err != nil {
+						log.Error("Failed to update trade status to Rejected in database", "error", err)
+					}
+				}
 				continue
 			}
 		}
+		// Orders only go out while the exchange is in session
+		inSession, err := checkSession(tradeWithID)
+		if err != nil {
+			log.Warn("Rejected order", "order_type", trade.OrderType, "error", err)
+			tradesRejected.WithLabelValues(rejectSession).Inc()
+			if tradeID > 0 {
+				if err := database.UpdateTradeToRejected(tradeID, tradeWithID.Price); err != nil {
+					log.Error("Failed to update trade status to Rejected in database", "error", err)
+				}
+			}
+			continue
+		}
+		if !inSession {
+			continue
+		}
+
 		var lmtPrice float64 = 0.0 // Limit price for limit orders
 
 		// // Check if price is provided in the trade instruction
@@ -291,21 +331,25 @@ func processNewTrades() {
 		// } else if lmtPrice != 0.0 {
 		// 	log.Printf("Using provided price: %f\n", lmtPrice)
 		// } else {
-		if trade.OrderType == "LMT" && trade.Price == 0.0{ 
-			// Fetch price quote
-			quote, err := fetchPriceQuote(trade.ContractId, trade.Exchange, trade.Broker)
+		// The arrival quote, taken before the order goes out so a fill does
+		// not move it, and the market limit and stop prices are checked against
+		quote, quoteErr := fetchPriceQuote(trade.ContractId, trade.Exchange, trade.Broker, tradeWithID.CorrelationID)
+		quotedAt := time.Now()
+
+		// Limit and stop prices go out on the tick grid and near the market
+		if trade.OrderType != "MKT" {
+			price, err := orderPrice(trade, tradeWithID.Price, quote, quoteErr, tradeWithID.CorrelationID)
 			if err != nil {
-				log.Printf("Failed to fetch price for symbol %s: %v", trade.Symbol, err)
+				log.Warn("Rejected order", "order_type", trade.OrderType, "error", err)
+				tradesRejected.WithLabelValues(rejectPrice).Inc()
+				if tradeID > 0 {
+					if err := database.UpdateTradeToRejected(tradeID, tradeWithID.Price); err != nil {
+						log.Error("Failed to update trade status to Rejected in database", "error", err)
+					}
+				}
 				continue
 			}
-			lmtPrice = quote.Bid
-			if trade.Side == "SELL" {
-				lmtPrice = quote.Ask
-			}
-		}
-		
-		if trade.OrderType == "LMT" && trade.Price != 0.0{ 
-			lmtPrice=trade.Price
+			lmtPrice = price
 		}
 
 		// price and quantity are being parsed on receipt of trade.
@@ -328,35 +372,43 @@ func processNewTrades() {
 				Broker:       trade.Broker,
 				Price:        lmtPrice, // Include the price in the trade instruction
 			},
-			PriceQuote: lmtPrice,
-			Timestamp:  time.Now(),
+			PriceQuote:    lmtPrice,
+			Timestamp:     time.Now(),
+			CorrelationID: tradeWithID.CorrelationID,
 		}
 
 		// Send order
 		orderId, err := transmitOrder(order, false)
 		if err != nil {
-			log.Printf("Failed to submit order for strategy-symbol %s-%s: %v", trade.StrategyName, trade.Symbol, err)
+			log.Error("Failed to submit order", "error", err)
+			tradesRejected.WithLabelValues(rejectTransmit).Inc()
+			if tradeID > 0 {
+				if err := database.UpdateTradeToRejected(tradeID, lmtPrice); err != nil {
+					log.Error("Failed to update trade status to Rejected in database", "error", err)
+				}
+			}
 			continue
 		}
+		tradesTransmitted.Inc()
 
 		// Update the trade record with the broker order ID
 		if tradeID > 0 {
 			err = database.UpdateTradeToSubmitted(tradeID, orderId, lmtPrice)
 			if err != nil {
-				log.Printf("Warning: Failed to update trade status to Submitted in database: %v", err)
+				log.Error("Failed to update trade status to Submitted in database", "error", err)
 			}
+			go recordArrival(tradeID, quote, quoteErr, tradeWithID.CorrelationID, quotedAt)
 		}
 
 		// Save Order Id received from API call to broker
 		orderResponse := OrderResponse{
-			Order:   order,
-			OrderId: orderId,
+			Order:       order,
+			OrderId:     orderId,
+			TradingDate: tradeWithID.TradingDate,
 		}
 		updatePositionsToPending(orderResponse)
-		log.Println("Sending order response to channel")
+		log.Debug("Sending order to the fill monitor", "order_id", orderId)
 		orderResponseChannel <- &orderResponse
-
-		// go monitorFill(orderResponse)
 	}
 }
 
@@ -365,81 +417,21 @@ func startWorkerPool(numWorkers int, f poolFunction) {
 		go f(i)
 	}
 }
-func monitorFill(orderResp OrderResponse) {
-	fmt.Println("Monitoring fill")
-	isFilled := false
-	for !isFilled {
-		url := "http://broker_api:8000/api/IB/trades"
-		resp, err := http.Get(url)
-		if err != nil {
-			fmt.Println("Error sending GET request:", err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		// Parse the response body
-		var response []Trade
-		err = json.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			fmt.Println("Error decoding fills:", err)
-		}
-
-		for _, trade := range response {
-			fmt.Printf("Order %s: %d\n", trade.Status, orderResp.OrderId)
-
-			if trade.Id != orderResp.OrderId {
-				continue
-			}
-			if trade.Status != "Filled" && trade.Status != "Cancelled" {
-				continue
-			}
-
-			direction := 1.0
-			if orderResp.Order.TradeInstruction.Side == "SELL" {
-				direction = -1.0
-			}
-
-			// Update trade status in database
-			err := database.UpdateTradeStatus(
-				orderResp.OrderId,
-				trade.Status,
-				trade.Price,
-			)
-			if err != nil {
-				log.Printf("Warning: Failed to update trade status to Filled/Cancelled in database: %v\n", err)
-			}
-
-			updatePositionsFromResponse(orderResp, trade.Status, trade.Price,
-				int(direction*math.Abs(float64(trade.Quantity))))
-			fmt.Printf("Order %s: %d -- %f\n", trade.Status, orderResp.OrderId, trade.Price)
-			isFilled = true
-		}
-		time.Sleep(time.Second*2)
-	}
-}
 
 func sendOrdersToFillMonitor() {
 	for orderResponse := range orderResponseChannel {
-		log.Println("Transfering order response to check for Fills")
+		fillsLog.Debug("Waiting for fill", logging.Key, orderResponse.Order.CorrelationID, "order_id", orderResponse.OrderId)
 		key := fmt.Sprintf("%v-%d", orderResponse.Order.Timestamp, orderResponse.OrderId)
 		orderResponseQueue.Store(key, orderResponse)
+		settleStreamedTrade(orderResponse.OrderId)
 	}
 }
 
 func queryTradesAtBroker() []Trade {
-	url := "http://broker_api:8000/api/IB/trades"
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println("Error sending GET request:", err)
-		return nil
-	}
-	defer resp.Body.Close()
-
-	// Parse the response body
 	var response []Trade
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err := brokerapi.Get(fillStreamBroker, fmt.Sprintf("/api/%s/trades", fillStreamBroker), "", &response)
 	if err != nil {
-		fmt.Println("Error decoding fills:", err)
+		fillsLog.Warn("Failed to get trades", "error", err)
 		return nil
 	}
 	return response
@@ -457,16 +449,12 @@ func findOrderInTrades(tradeList []Trade, orderResponseMap *sync.Map) []MatchedT
 
 		orderResponse, ok := value.(*OrderResponse) // Type assertion for the value from sync.Map
 		if !ok {
-			log.Printf("Unable to assert Order Response: %v (type: %T)\n", value, value)
+			fillsLog.Error("Unable to read queued order", "key", key, "type", fmt.Sprintf("%T", value))
 			return true
 		}
 
 		for _, trade := range tradeList {
-			log.Printf("Matching Trade -> OrderID %d, Trade ID: %d,  Trade Status: %s", orderResponse.OrderId, trade.Id, trade.Status)
-
-			if trade.Id == orderResponse.OrderId && trade.Status == "Filled" {
-				log.Println("Trade Trades")
-
+			if trade.Id == orderResponse.OrderId && (trade.Status == "Filled" || trade.Status == "Cancelled") {
 				intersection = append(intersection, MatchedTrades{OrderResponse: *orderResponse, Trade: trade})
 				break // Avoid duplicates from orderResponseMap
 			}
@@ -477,74 +465,121 @@ func findOrderInTrades(tradeList []Trade, orderResponseMap *sync.Map) []MatchedT
 	return intersection
 }
 
+// monitorFills polls broker_api for the trades of the session. Fills are
+// pushed by streamFills, so while the stream is up polling only reconciles
+// the updates it missed.
 func monitorFills(done chan struct{}) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(fillPollInterval)
 	defer ticker.Stop()
 
+	var lastPoll time.Time
 	for {
 		select {
 		case <-done:
 			return
 		case <-ticker.C:
-			//if order resposne queue is not empty
-			// if len(orderResponseQueue) != 0 {
-			var trades []Trade
-			// orderResponseQueue.Range(func(key, value any) {
-
+			if !hasOutstandingOrders() {
+				continue
+			}
+			if fillStreamUp.Load() && time.Since(lastPoll) < fillReconcileInterval {
+				continue
+			}
+			lastPoll = time.Now()
 			// query borker api for list of trades
-			trades = queryTradesAtBroker()
-			// check for orderIds in Trades
-			ordersFoundInTrades := findOrderInTrades(trades, &orderResponseQueue)
-			// for each order filled, Update system state
-			for _, order := range ordersFoundInTrades {
-				log.Println("Reconciling Trades")
-
-				fmt.Printf("Order Filled: %d\n", order.OrderResponse.OrderId)
-				// check for orderrespos.id
-				direction := 1.0
-				if order.OrderResponse.Order.TradeInstruction.Side == "SELL" {
-					direction = -1.0
-				}
+			settleTrades(queryTradesAtBroker())
+		}
+	}
+}
 
-				// Update trade status in database
-				err := database.UpdateTradeStatus(
-					order.OrderResponse.OrderId,
-					order.Trade.Status,
-					order.Trade.Price,
-				)
-				if err != nil {
-					log.Printf("Warning: Failed to update trade status to Filled/Cancelled in database: %v\n", err)
-				}
-				// update positions json
-				updatePositionsFromResponse(order.OrderResponse,
-					order.Trade.Status,
-					order.Trade.Price,
-					int(direction*math.Abs(float64(order.Trade.Quantity)))
-				)
-				
-				fmt.Printf("Order %s: %d -- %f\n", order.Trade.Status,
-												order.OrderResponse.OrderId,
-												order.Trade.Price)
-
-				// remove from orderResponse queue
-				orq_key := fmt.Sprintf("%v-%d", order.OrderResponse.Order.Timestamp, order.OrderResponse.OrderId)
-				orderResponseQueue.Delete(orq_key) // change this to map[int]OrderResponse
+// hasOutstandingOrders reports whether any order waits for its fill
+func hasOutstandingOrders() bool {
+	outstanding := false
+	orderResponseQueue.Range(func(key, value interface{}) bool {
+		outstanding = true
+		return false
+	})
+	return outstanding
+}
 
+// reconcileMu keeps the fill stream and the poller from settling the same
+// order twice
+var reconcileMu sync.Mutex
+
+// reconcileTrades settles the outstanding orders the broker reports as
+// filled or cancelled
+func reconcileTrades(trades []Trade) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	// check for orderIds in Trades
+	ordersFoundInTrades := findOrderInTrades(trades, &orderResponseQueue)
+	// for each order filled, Update system state
+	for _, order := range ordersFoundInTrades {
+		log := fillsLog.With(logging.Key, order.OrderResponse.Order.CorrelationID, "order_id", order.OrderResponse.OrderId)
+
+		// Cancelled orders leave the position as it was
+		if order.Trade.Status == "Cancelled" {
+			err := database.UpdateTradeStatus(order.OrderResponse.OrderId, order.OrderResponse.TradingDate, "Cancelled", 0)
+			if err != nil {
+				log.Error("Failed to update trade status to Cancelled in database", "error", err)
 			}
+			updatePositionsToCancelled(order.OrderResponse)
+			log.Info("Order cancelled")
+			orderResponseQueue.Delete(fmt.Sprintf("%v-%d", order.OrderResponse.Order.Timestamp, order.OrderResponse.OrderId))
+			continue
 		}
+
+		// check for orderrespos.id
+		direction := 1.0
+		if order.OrderResponse.Order.TradeInstruction.Side == "SELL" {
+			direction = -1.0
+		}
+
+		// Update trade status in database
+		err := database.UpdateTradeStatus(
+			order.OrderResponse.OrderId,
+			order.OrderResponse.TradingDate,
+			order.Trade.Status,
+			order.Trade.Price,
+		)
+		if err != nil {
+			log.Error("Failed to update trade status to Filled in database", "error", err)
+		}
+		filledAt := order.Trade.Time
+		if filledAt.IsZero() {
+			filledAt = time.Now()
+		}
+		orderFillLatency.Observe(filledAt.Sub(order.OrderResponse.Order.Timestamp).Seconds())
+		if err := database.RecordFillPrice(order.OrderResponse.OrderId, order.OrderResponse.TradingDate, order.Trade.Price, filledAt); err != nil {
+			log.Error("Failed to record fill price", "error", err)
+		}
+		go recordCommission(order.OrderResponse, order.Trade.Quantity)
+		// update positions json
+		updatePositionsFromResponse(order.OrderResponse,
+			order.Trade.Status,
+			order.Trade.Price,
+			int(direction*math.Abs(float64(order.Trade.Quantity))),
+		)
+		log.Info("Order filled", "price", order.Trade.Price, "quantity", order.Trade.Quantity)
+
+		// remove from orderResponse queue
+		orq_key := fmt.Sprintf("%v-%d", order.OrderResponse.Order.Timestamp, order.OrderResponse.OrderId)
+		orderResponseQueue.Delete(orq_key) // change this to map[int]OrderResponse
+
 	}
 }
 
 func updatePositionsFromResponse(orderResp OrderResponse, status string, costBasis float64, quantity int) {
-	fmt.Printf("Updating Positions for %s Order\n", status)
 	positionId := fmt.Sprintf("%s-%s",
 		orderResp.Order.TradeInstruction.StrategyName,
 		orderResp.Order.TradeInstruction.Symbol)
+	log := positionsLog.With(logging.Key, orderResp.Order.CorrelationID, "position", positionId)
+	log.Debug("Updating position", "status", status)
 	positionMap, ok := positions.Load(positionId)
 	if ok {
 		pos, ok := positionMap.(definitions.Position)
 		if ok {
-			fmt.Print("Position Map:", pos)
+			log.Debug("Previous position", "quantity", pos.Quantity, "cost_basis", pos.CostBasis)
 			quantity += pos.Quantity
 		}
 
@@ -565,20 +600,21 @@ func updatePositionsFromResponse(orderResp OrderResponse, status string, costBas
 	shared_positions := GetSharedFilePath("positions.json")
 	// Marshal to JSON file
 	if err := SyncMapToJSONFile(&positions, shared_positions); err != nil {
-		fmt.Println("Error marshalling sync.Map to JSON:", err)
+		log.Error("Failed to write positions file", "error", err)
 		return
 	}
 
 }
 func updatePositionsToPending(orderResp OrderResponse) {
-	fmt.Println("Updating Positions for Pending Order")
 	positionId := fmt.Sprintf("%s-%s",
 		orderResp.Order.TradeInstruction.StrategyName,
 		orderResp.Order.TradeInstruction.Symbol)
+	log := positionsLog.With(logging.Key, orderResp.Order.CorrelationID, "position", positionId)
+	log.Debug("Updating position", "status", "Pending")
 
 	p, ok := positions.Load(positionId)
 	if !ok {
-		fmt.Println("Positon does not exist")
+		log.Debug("Opening new position")
 
 		positions.Store(positionId, definitions.Position{
 			Symbol:     orderResp.Order.TradeInstruction.Symbol,
@@ -592,7 +628,7 @@ func updatePositionsToPending(orderResp OrderResponse) {
 	} else {
 		p, _ := p.(definitions.Position)
 		if !ok {
-			fmt.Println("Could not assert Position type on p:", p)
+			log.Error("Unable to read position", "position", p)
 		}
 		p.Status = "Pending"
 		positions.Store(positionId, p)
@@ -600,12 +636,39 @@ func updatePositionsToPending(orderResp OrderResponse) {
 	shared_positions := GetSharedFilePath("positions.json")
 	// Marshal to JSON file
 	if err := SyncMapToJSONFile(&positions, shared_positions); err != nil {
-		fmt.Println("Error marshalling sync.Map to JSON:", err)
+		log.Error("Failed to write positions file", "error", err)
 		return
 	}
 
 }
 
+// updatePositionsToCancelled clears the pending status a cancelled order set,
+// keeping the quantity and cost basis of the position
+func updatePositionsToCancelled(orderResp OrderResponse) {
+	positionId := fmt.Sprintf("%s-%s",
+		orderResp.Order.TradeInstruction.StrategyName,
+		orderResp.Order.TradeInstruction.Symbol)
+
+	p, ok := positions.Load(positionId)
+	if !ok {
+		return
+	}
+	log := positionsLog.With(logging.Key, orderResp.Order.CorrelationID, "position", positionId)
+	pos, ok := p.(definitions.Position)
+	if !ok {
+		log.Error("Unable to read position", "position", p)
+		return
+	}
+	pos.Status = "Filled"
+	if pos.Quantity == 0 {
+		pos.Status = "Closed"
+	}
+	positions.Store(positionId, pos)
+	if err := SyncMapToJSONFile(&positions, GetSharedFilePath("positions.json")); err != nil {
+		log.Error("Failed to write positions file", "error", err)
+	}
+}
+
 // GetSharedFilePath returns the appropriate path based on environment
 func GetSharedFilePath(filename string) string {
 	// Check if running in container by looking for /.dockerenv
@@ -638,7 +701,7 @@ func SyncMapFromJSONFile(m *sync.Map, filename string) error {
 		var pos definitions.Position
 		err := json.Unmarshal(v, &pos)
 		if err != nil {
-			fmt.Printf("Error unmarshaling position for key %s: %v\n", k, err)
+			positionsLog.Error("Unable to read position", "position", k, "error", err)
 			continue
 		}
 		m.Store(k, pos)
@@ -682,11 +745,13 @@ func shutdown() {
 
 	// Save positions to file
 	if err := SyncMapToJSONFile(&positions, GetSharedFilePath("positions.json")); err != nil {
-		log.Printf("Error saving positions: %v", err)
+		positionsLog.Error("Failed to save positions", "error", err)
 	}
 
 	// Close channels
+	tradeChannelMu.Lock()
 	close(tradeChannel)
+	tradeChannelMu.Unlock()
 	close(orderResponseChannel)
 
 	// Give goroutines time to finish
@@ -696,28 +761,57 @@ func shutdown() {
 }
 
 var tradeChannel = make(chan *TradeWithID, 100)           // Buffered channel for trades
+var tradeChannelMu sync.RWMutex                           // held to send on tradeChannel, and to close it
 var orderResponseChannel = make(chan *OrderResponse, 100) // Channel for order response pointers
 var orderResponseQueue sync.Map                           // map[int]OrderResponse
 type poolFunction func(int)
 
 var done = make(chan struct{})
 
+// queueTrade hands a trade to processNewTrades. It returns false once the
+// backend is stopping, when tradeChannel is or is about to be closed.
+func queueTrade(tradeWithID *TradeWithID) bool {
+	tradeChannelMu.RLock()
+	defer tradeChannelMu.RUnlock()
+	// shutdown closes done before it closes tradeChannel
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	select {
+	case <-done:
+		return false
+	case tradeChannel <- tradeWithID:
+		return true
+	}
+}
+
 var positions sync.Map // hols positions
 
 func main() {
+	// LOG_LEVEL and LOG_LEVELS set the verbosity of each component
+	logging.Setup()
 
 	// Initialize database connection
 	err := database.Initialize()
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("Failed to initialize database", err)
 	}
 	defer database.Close()
+
+	// Exchange sessions, with holidays added or removed by the calendar file
+	if err := calendar.LoadOverrides(GetSharedFilePath("exchange-calendar.json")); err != nil {
+		fatal("Failed to load exchange calendar", err)
+	}
+	go publishCalendar()
+	rejectUnsentTrades()
 	// Clear the original map to demonstrate loading from file
 	shared_positions := GetSharedFilePath("positions.json")
 
 	// Unmarshal from JSON file
 	if err := SyncMapFromJSONFile(&positions, shared_positions); err != nil {
-		fmt.Println("Error unmarshalling JSON to sync.Map:", err)
+		positionsLog.Error("Failed to load positions", "error", err)
 		return
 	}
 
@@ -725,26 +819,40 @@ func main() {
 	go processNewTrades()
 	go sendOrdersToFillMonitor()
 	go monitorFills(done)
+	go streamFills(done)
+	go publishCircuits(done)
+	go serveMetrics()
 	// Start the gRPC server
 	listener, err := net.Listen("tcp", ":50051")
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		fatal("Failed to listen", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	// Callers must present a strategy token, see package auth
+	serverOpts, err := auth.ServerOptions()
+	if err != nil {
+		fatal("Failed to configure TradeService auth", err)
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
 	pb.RegisterTradeServiceServer(grpcServer, &server{})
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	// Start a goroutine to handle shutdown
 	go func() {
 		<-sigChan
-		log.Println("Shutting down...")
+		mainLog.Info("Shutting down")
 		shutdown()
 		grpcServer.GracefulStop()
 		os.Exit(0)
 	}()
-	log.Println("Server is running on port 50051")
+	mainLog.Info("Server is running", "port", 50051)
 	if err := grpcServer.Serve(listener); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		fatal("Failed to serve", err)
 	}
 }
+
+// fatal logs an error that stops the backend and exits
+func fatal(msg string, err error) {
+	mainLog.Error(msg, "error", err)
+	os.Exit(1)
+}
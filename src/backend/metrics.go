@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -----------------------------------------------------------------
+// Metrics
+// -----------------------------------------------------------------
+
+// Prometheus metrics are served on their own port, METRICS_ADDR (:2112 by
+// default), as the backend otherwise only speaks gRPC. broker_api call
+// latency and errors are recorded by package brokerapi.
+
+var (
+	tradesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "backend",
+		Name:      "trades_received_total",
+		Help:      "Trade instructions received over SendTrade.",
+	})
+	tradesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "backend",
+		Name:      "trades_rejected_total",
+		Help:      "Trade instructions that did not become an order, by reason.",
+	}, []string{"reason"})
+	tradesTransmitted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "backend",
+		Name:      "trades_transmitted_total",
+		Help:      "Orders broker_api accepted.",
+	})
+	orderFillLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "backend",
+		Name:      "order_fill_latency_seconds",
+		Help:      "Time from sending an order to its fill at the broker.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	})
+)
+
+// Reasons a trade instruction is rejected
+const (
+	rejectInvalid  = "invalid"       // quantity could not be parsed
+	rejectPending  = "pending_order" // the position has an order working
+	rejectSession  = "session"       // no session to send the order in
+	rejectPrice    = "price"         // no valid limit or stop price
+	rejectTransmit = "transmit"      // broker_api did not take the order
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "backend",
+		Name:      "trade_channel_depth",
+		Help:      "Trade instructions waiting in the trade channel.",
+	}, func() float64 { return float64(len(tradeChannel)) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "backend",
+		Name:      "outstanding_orders",
+		Help:      "Orders sent to the broker and waiting for their fill.",
+	}, func() float64 {
+		count := 0
+		orderResponseQueue.Range(func(key, value interface{}) bool {
+			count++
+			return true
+		})
+		return float64(count)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "backend",
+		Name:      "fill_stream_connected",
+		Help:      "1 while the broker_api fill stream is connected.",
+	}, func() float64 {
+		if fillStreamUp.Load() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// serveMetrics serves /metrics until the process exits
+func serveMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":2112"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mainLog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		mainLog.Error("Metrics server stopped", "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"pytrader/database"
+	"pytrader/logging"
+	pb "pytrader/tradepb"
+)
+
+// -----------------------------------------------------------------
+// Order Price Checks
+// -----------------------------------------------------------------
+
+// priceBandPct is how far, in percent of the last price, a limit or stop
+// price may be from the market. PRICE_BAND_PCT=0 turns the check off.
+var priceBandPct = loadPriceBand()
+
+func loadPriceBand() float64 {
+	value := os.Getenv("PRICE_BAND_PCT")
+	if value == "" {
+		return 2
+	}
+	band, err := strconv.ParseFloat(value, 64)
+	if err != nil || band < 0 {
+		log.Fatalf("Invalid PRICE_BAND_PCT %q, expected a non-negative number", value)
+	}
+	return band
+}
+
+// orderPrice returns the price to send for a non-market order: the requested
+// price, or the bid (BUY) or ask (SELL) of quote when none was given, rounded
+// to the contract's tick and checked against the quote's last price.
+// quoteErr is why there is no quote.
+func orderPrice(trade *pb.Trade, requested float64, quote Quote, quoteErr error, correlationID string) (float64, error) {
+	price := requested
+	if price == 0 {
+		if quoteErr != nil {
+			return 0, fmt.Errorf("no price given and no quote available: %v", quoteErr)
+		}
+		price = quote.Bid
+		if trade.Side == "SELL" {
+			price = quote.Ask
+		}
+		if price <= 0 {
+			return 0, fmt.Errorf("no price given and the quote has no %s side", strings.ToLower(trade.Side))
+		}
+	}
+
+	log := ordersLog.With(logging.Key, correlationID, "contract_id", trade.ContractId)
+	tick, ok, err := database.ContractTickSize(trade.ContractId)
+	if err != nil {
+		log.Error("Failed to look up tick size", "error", err)
+	} else if !ok {
+		log.Warn("Tick size unknown, sending price unrounded", "price", price)
+	} else {
+		rounded := roundToTick(price, tick, trade.Side, trade.OrderType)
+		if rounded != price {
+			log.Info("Rounded price to tick", "side", trade.Side, "order_type", trade.OrderType,
+				"price", price, "rounded", rounded, "tick", tick)
+		}
+		price = rounded
+	}
+
+	if priceBandPct > 0 {
+		if quoteErr != nil {
+			return 0, fmt.Errorf("cannot check price %f against the market: %v", price, quoteErr)
+		}
+		if err := checkPriceBand(price, quote.Last, priceBandPct); err != nil {
+			return 0, err
+		}
+	}
+	return price, nil
+}
+
+// checkPriceBand rejects a price more than bandPct percent from the last
+// price
+func checkPriceBand(price, last, bandPct float64) error {
+	if last <= 0 {
+		return fmt.Errorf("cannot check price %f against the market: no last price", price)
+	}
+	if away := math.Abs(price-last) / last * 100; away > bandPct {
+		return fmt.Errorf("price %f is %.2f%% from last %f, outside the %g%% band", price, away, last, bandPct)
+	}
+	return nil
+}
+
+// roundToTick rounds a price onto the tick grid so it never crosses further
+// into the market than asked: a buy limit rounds down and a sell limit up,
+// while a buy stop rounds up and a sell stop down
+func roundToTick(price, tick float64, side, orderType string) float64 {
+	if tick <= 0 {
+		return price
+	}
+	up := side == "SELL"
+	if strings.HasPrefix(orderType, "STP") {
+		up = !up
+	}
+	// Prices already on the grid stay put despite float error
+	ticks := price / tick
+	if nearest := math.Round(ticks); math.Abs(ticks-nearest) < 1e-9 {
+		ticks = nearest
+	} else if up {
+		ticks = math.Ceil(ticks)
+	} else {
+		ticks = math.Floor(ticks)
+	}
+	// Drop the float noise of ticks*tick, e.g. 0.1*3
+	decimals := 0
+	for t := tick; t != math.Trunc(t) && decimals < 10; t *= 10 {
+		decimals++
+	}
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(ticks*tick*scale) / scale
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestRoundToTick(t *testing.T) {
+	tests := []struct {
+		name      string
+		price     float64
+		tick      float64
+		side      string
+		orderType string
+		want      float64
+	}{
+		{"buy limit rounds down", 100.13, 0.25, "BUY", "LMT", 100},
+		{"sell limit rounds up", 100.13, 0.25, "SELL", "LMT", 100.25},
+		{"buy stop rounds up", 100.13, 0.25, "BUY", "STP", 100.25},
+		{"sell stop rounds down", 100.13, 0.25, "SELL", "STP", 100},
+		{"buy stop limit rounds up", 100.13, 0.25, "BUY", "STP LMT", 100.25},
+		{"sell stop limit rounds down", 100.13, 0.25, "SELL", "STP LMT", 100},
+		{"price on the grid stays put", 5012.75, 0.25, "BUY", "LMT", 5012.75},
+		{"float error on a 0.01 grid", 0.29, 0.01, "SELL", "LMT", 0.29},
+		{"float error on a 0.1 grid", 0.3, 0.1, "BUY", "LMT", 0.3},
+		{"no float noise in the result", 1.23456, 0.1, "SELL", "LMT", 1.3},
+		{"0.01 grid buy", 12.345, 0.01, "BUY", "LMT", 12.34},
+		{"0.01 grid sell", 12.345, 0.01, "SELL", "LMT", 12.35},
+		{"fractional tick", 110.02, 1.0 / 64, "BUY", "LMT", 110.015625},
+		{"whole tick", 4321.5, 1, "SELL", "LMT", 4322},
+		{"no tick leaves the price", 100.13, 0, "BUY", "LMT", 100.13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundToTick(tt.price, tt.tick, tt.side, tt.orderType); got != tt.want {
+				t.Errorf("roundToTick(%v, %v, %s, %s) = %v, want %v", tt.price, tt.tick, tt.side, tt.orderType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPriceBand(t *testing.T) {
+	tests := []struct {
+		name    string
+		price   float64
+		last    float64
+		bandPct float64
+		wantErr bool
+	}{
+		{"at the last price", 100, 100, 2, false},
+		{"inside the band", 101.5, 100, 2, false},
+		{"on the upper edge", 102, 100, 2, false},
+		{"on the lower edge", 98, 100, 2, false},
+		{"above the band", 102.5, 100, 2, true},
+		{"below the band", 97, 100, 2, true},
+		{"narrow band", 100.2, 100, 0.1, true},
+		{"no last price", 100, 0, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPriceBand(tt.price, tt.last, tt.bandPct)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkPriceBand(%v, %v, %v) = %v, want error %v", tt.price, tt.last, tt.bandPct, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPriceBand(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", 2},
+		{"0", 0},
+		{"0.5", 0.5},
+		{"10", 10},
+	}
+	for _, tt := range tests {
+		t.Setenv("PRICE_BAND_PCT", tt.value)
+		if got := loadPriceBand(); got != tt.want {
+			t.Errorf("PRICE_BAND_PCT=%q gives %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"pytrader/calendar"
+	"pytrader/database"
+	"pytrader/logging"
+)
+
+// -----------------------------------------------------------------
+// Trading Sessions
+// -----------------------------------------------------------------
+
+// outOfSessionOrders is what happens to an order received while its exchange
+// is closed: "reject" (default) or "queue", which holds it until the next
+// session opens. Queued orders are only held in memory, so they are rejected
+// when the backend stops and any left Pending by a crash are rejected when it
+// starts again.
+var outOfSessionOrders = loadOutOfSessionPolicy()
+
+func loadOutOfSessionPolicy() string {
+	policy := os.Getenv("OUT_OF_SESSION_ORDERS")
+	switch policy {
+	case "":
+		return "reject"
+	case "reject", "queue":
+		return policy
+	}
+	log.Fatalf("Invalid OUT_OF_SESSION_ORDERS %q, expected reject or queue", policy)
+	return ""
+}
+
+// tradingDate returns the trading date of an order sent to an exchange at t.
+// Exchanges without a calendar use the local date.
+func tradingDate(exchange string, t time.Time) string {
+	if cal, ok := calendar.ForExchange(exchange); ok {
+		return cal.TradingDate(t)
+	}
+	return t.Format("2006-01-02")
+}
+
+// checkSession reports whether an order can go to its exchange now. When
+// it cannot, the order is queued for the next session or rejected with the
+// returned error.
+func checkSession(tradeWithID *TradeWithID) (bool, error) {
+	trade := tradeWithID.Trade
+	cal, ok := calendar.ForExchange(trade.Exchange)
+	if !ok {
+		sessionsLog.Warn("No trading calendar for exchange, sending order without a session check",
+			logging.Key, tradeWithID.CorrelationID, "exchange", trade.Exchange)
+		return true, nil
+	}
+	now := time.Now()
+	if cal.IsOpen(now) {
+		return true, nil
+	}
+
+	next := cal.NextSession(now)
+	if outOfSessionOrders != "queue" {
+		return false, fmt.Errorf("%s is closed, next session opens %s", trade.Exchange, next.Opens.Format(time.RFC3339))
+	}
+	sessionsLog.Info("Exchange closed, queued order until the next session",
+		logging.Key, tradeWithID.CorrelationID, "exchange", trade.Exchange, "strategy", trade.StrategyName,
+		"symbol", trade.Symbol, "side", trade.Side, "order_type", trade.OrderType, "opens", next.Opens)
+	go func() {
+		timer := time.NewTimer(time.Until(next.Opens))
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			if queueTrade(tradeWithID) {
+				return
+			}
+		}
+		rejectQueuedTrade(tradeWithID)
+	}()
+	return false, nil
+}
+
+// rejectQueuedTrade marks a queued order that will not be sent because the
+// backend is stopping
+func rejectQueuedTrade(tradeWithID *TradeWithID) {
+	sessionsLog.Warn("Backend stopping, rejected queued order", logging.Key, tradeWithID.CorrelationID,
+		"strategy", tradeWithID.Trade.StrategyName, "symbol", tradeWithID.Trade.Symbol)
+	tradesRejected.WithLabelValues(rejectSession).Inc()
+	if tradeWithID.TradeID > 0 {
+		if err := database.UpdateTradeToRejected(tradeWithID.TradeID, tradeWithID.Price); err != nil {
+			sessionsLog.Error("Failed to update trade status to Rejected in database", logging.Key, tradeWithID.CorrelationID, "error", err)
+		}
+	}
+}
+
+// rejectUnsentTrades rejects the orders a previous run saved but never sent,
+// such as orders queued for a session when it stopped
+func rejectUnsentTrades() {
+	rejected, err := database.RejectUnsentTrades()
+	if err != nil {
+		sessionsLog.Error("Failed to reject unsent trades", "error", err)
+		return
+	}
+	if rejected > 0 {
+		sessionsLog.Warn("Rejected trades left unsent by the last run", "trades", rejected)
+	}
+}
+
+// publishCalendar stores the sessions from a week back to 90 days ahead for
+// every exchange with a calendar, so the scheduler can skip runs on
+// holidays, then refreshes them daily
+func publishCalendar() {
+	for {
+		if err := saveCalendar(time.Now()); err != nil {
+			sessionsLog.Error("Failed to publish trading calendar", "error", err)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+func saveCalendar(now time.Time) error {
+	var days []database.CalendarDay
+	for _, exchange := range calendar.Exchanges() {
+		cal, _ := calendar.ForExchange(exchange)
+		today := now.In(cal.Location)
+		for date := today.AddDate(0, 0, -7); date.Before(today.AddDate(0, 0, 90)); date = date.AddDate(0, 0, 1) {
+			if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+				continue
+			}
+			day := database.CalendarDay{Exchange: exchange, TradingDate: date.Format("2006-01-02")}
+			if session, ok := cal.SessionOn(date); ok {
+				day.Opens, day.Closes, day.Note = &session.Opens, &session.Closes, session.Note
+			} else {
+				day.Note, _ = cal.Holiday(date)
+			}
+			days = append(days, day)
+		}
+	}
+	return database.SaveTradingCalendar(days)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"pytrader/database"
+	"pytrader/logging"
+	pb "pytrader/tradepb"
+)
+
+// -----------------------------------------------------------------
+// Transaction Cost Capture
+// -----------------------------------------------------------------
+
+// Every order's costs are measured against two benchmarks: the decision
+// price, the quote mid when the backend received the trade instruction, and
+// the arrival price, the quote mid just before the order went to the broker.
+// The decision quote is fetched off the order path. The arrival quote is the
+// one the order is priced with, taken before transmitting so an order that
+// fills at once is not measured against the market it moved.
+// The scheduler turns these into slippage reports.
+
+// recordDecision stores the decision price of a trade instruction
+func recordDecision(tradeID int64, trade *pb.Trade, correlationID string, receivedAt time.Time) {
+	log := tcaLog.With(logging.Key, correlationID, "trade_id", tradeID)
+	quote, err := fetchPriceQuote(trade.ContractId, trade.Exchange, trade.Broker, correlationID)
+	if err != nil {
+		log.Warn("No decision price", "error", err)
+		return
+	}
+	mid, _ := quoteMid(quote)
+	if err := database.RecordDecisionPrice(tradeID, mid, receivedAt); err != nil {
+		log.Error("Failed to record decision price", "error", err)
+	}
+}
+
+// recordArrival stores the arrival price and spread of an order sent to
+// the broker from the quote taken at quotedAt, before it was transmitted.
+// quoteErr is why there is no quote.
+func recordArrival(tradeID int64, quote Quote, quoteErr error, correlationID string, quotedAt time.Time) {
+	log := tcaLog.With(logging.Key, correlationID, "trade_id", tradeID)
+	if quoteErr != nil {
+		log.Warn("No arrival price", "error", quoteErr)
+		return
+	}
+	mid, spread := quoteMid(quote)
+	if err := database.RecordArrivalPrice(tradeID, mid, spread, quotedAt); err != nil {
+		log.Error("Failed to record arrival price", "error", err)
+	}
+}
+
+// quoteMid returns the mid and spread of a quote, or the last price and no
+// spread when one side is missing
+func quoteMid(quote Quote) (mid, spread float64) {
+	if quote.Bid <= 0 || quote.Ask <= 0 || quote.Ask < quote.Bid {
+		return quote.Last, 0
+	}
+	return (quote.Bid + quote.Ask) / 2, quote.Ask - quote.Bid
+}
@@ -1,12 +1,21 @@
-from fastapi import FastAPI, HTTPException
+from fastapi import FastAPI, HTTPException, Request
 from broker_interface import BrokerFactory
-from models import Contract, Order
+from models import CancelRequest, Contract, Order
 from datetime import datetime
 from typing import Optional
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.responses import StreamingResponse
+import json_logging
+import time
+
+json_logging.setup()
+request_log = json_logging.get_logger("requests")
 
 app = FastAPI(title="Multi-Broker Trading API")
 
+# Seconds between keepalive comments on an idle trade stream
+STREAM_KEEPALIVE = 15
+
 app.add_middleware(
     CORSMiddleware,
     allow_origins=["http://localhost:8080"],
@@ -15,6 +24,31 @@ app.add_middleware(
     allow_headers=["Content-Type"],
 )
 
+@app.middleware("http")
+async def log_requests(request: Request, call_next):
+    # Lines logged while serving the request carry the trade's correlation ID
+    token = json_logging.correlation_id.set(request.headers.get(json_logging.HEADER, ""))
+    started = time.monotonic()
+    fields = {"method": request.method, "path": request.url.path}
+    try:
+        response = await call_next(request)
+    except Exception:
+        fields["duration_ms"] = round((time.monotonic() - started) * 1000)
+        request_log.exception("Request failed", extra={"fields": fields})
+        raise
+    else:
+        fields.update(status=response.status_code, duration_ms=round((time.monotonic() - started) * 1000))
+        # Reads are polled all day, so only changes and failures log at info
+        if response.status_code >= 500:
+            request_log.error("Request failed", extra={"fields": fields})
+        elif request.method == "GET":
+            request_log.debug("Request served", extra={"fields": fields})
+        else:
+            request_log.info("Request served", extra={"fields": fields})
+        return response
+    finally:
+        json_logging.correlation_id.reset(token)
+
 @app.get("/")
 async def get_index() -> str:
     return "Multi-Broker Trading API"
@@ -30,15 +64,20 @@ async def get_quote_by_contract_id(broker: str, exchange:str, contract_id:int):
     return await broker_instance.get_quote_by_contract_id(exchange, contract_id)
 
 @app.get("/api/{broker}/fills")
-async def get_fills(broker: str):
+async def get_fills(broker: str, order_id: Optional[int] = None):
     broker_instance = BrokerFactory.get_broker(broker)
-    return await broker_instance.get_fills()
+    return await broker_instance.get_fills(order_id)
 
 @app.post("/api/{broker}/order")
 async def place_order(broker: str, order: Order):
     broker_instance = BrokerFactory.get_broker(broker)
     return await broker_instance.place_order(order)
 
+@app.post("/api/{broker}/cancel-orders")
+async def cancel_orders(broker: str, request: CancelRequest):
+    broker_instance = BrokerFactory.get_broker(broker)
+    return await broker_instance.cancel_orders(request)
+
 @app.post("/api/{broker}/historicalData")
 async def get_historical_data(
     broker: str,
@@ -61,6 +100,11 @@ async def get_contract_id(broker: str, contract: Contract):
     broker_instance = BrokerFactory.get_broker(broker)
     return await broker_instance.get_contract_id(contract)
 
+@app.post("/api/{broker}/contract-details")
+async def get_contract_details(broker: str, contract: Contract):
+    broker_instance = BrokerFactory.get_broker(broker)
+    return await broker_instance.get_contract_details(contract)
+
 @app.post("/api/{broker}/currentMinuteBarOpen/{exchange}/{contract_id}")
 async def get_current_minute_bar_open(broker: str, exchange:str, contract_id:int):
     broker_instance = BrokerFactory.get_broker(broker)
@@ -81,6 +125,22 @@ async def get_trades(broker: str):
     broker_instance = BrokerFactory.get_broker(broker)
     return await broker_instance.get_trades()
 
+@app.get("/api/{broker}/trades/stream")
+async def stream_trades(broker: str):
+    # Server-sent events, one per order update in the shape of /trades
+    broker_instance = BrokerFactory.get_broker(broker)
+    await broker_instance.connect()
+
+    async def events():
+        async for trade in broker_instance.stream_trades(STREAM_KEEPALIVE):
+            if trade is None:
+                yield ": keepalive\n\n"
+            else:
+                yield f"event: trade\ndata: {trade.model_dump_json()}\n\n"
+
+    return StreamingResponse(events(), media_type="text/event-stream",
+                             headers={"Cache-Control": "no-cache"})
+
 @app.get("/api/{broker}/accountSummary")
 async def get_account_summary(broker: str):
     broker_instance = BrokerFactory.get_broker(broker)
@@ -18,7 +18,11 @@ from schwab.auth import easy_client
 from schwab.orders.equities import equity_buy_market, equity_sell_market, equity_buy_limit, equity_sell_limit
 from schwab_orders_futures import future_buy_market, future_sell_market, future_buy_limit, future_sell_limit
 import json
+import asyncio
 from pathlib import Path
+from json_logging import get_logger
+
+ib_log = get_logger("ib")
 nest_asyncio.apply()
 
 # # Load environment variables
@@ -42,13 +46,17 @@ class BrokerInterface(ABC):
         pass
 
     @abstractmethod
-    async def get_fills(self, order_id: Optional[str] = None) -> List[Fill]:
+    async def get_fills(self, order_id: Optional[int] = None) -> List[Fill]:
         pass
 
     @abstractmethod
     async def place_order(self, order_request: Order) -> str:
         pass
 
+    @abstractmethod
+    async def cancel_orders(self, request: CancelRequest) -> List[CancelResult]:
+        pass
+
     @abstractmethod
     async def get_historical_data(
         self,
@@ -68,6 +76,28 @@ class BrokerInterface(ABC):
     async def get_account_summary(self) -> Dict[str, float]:
         pass
 
+    def _trade_subscribers(self) -> set:
+        # Brokers don't call the base __init__, so the set is created on first use
+        return self.__dict__.setdefault("_subscribers", set())
+
+    def _publish_trade(self, trade: Trade):
+        # Push an order update to every open trade stream
+        for queue in self._trade_subscribers():
+            queue.put_nowait(trade)
+
+    async def stream_trades(self, keepalive: float):
+        # Yields order updates as they happen, None after keepalive seconds without one
+        queue = asyncio.Queue()
+        self._trade_subscribers().add(queue)
+        try:
+            while True:
+                try:
+                    yield await asyncio.wait_for(queue.get(), timeout=keepalive)
+                except asyncio.TimeoutError:
+                    yield None
+        finally:
+            self._trade_subscribers().discard(queue)
+
 # Interactive Brokers Implementation
 class IBKRBroker(BrokerInterface):
     def __init__(self):
@@ -77,6 +107,10 @@ class IBKRBroker(BrokerInterface):
         self.ib = ib_async.IB()
         self._connected = False
         self.pending_trades = {}  # Initialize the pending trades dictionary
+        self.ib.orderStatusEvent += self._on_order_status
+
+    def _on_order_status(self, trade: ib_async.Trade):
+        self._publish_trade(self._to_trade(trade))
 
     async def connect(self) -> bool:
         # if not self._connected:
@@ -95,9 +129,13 @@ class IBKRBroker(BrokerInterface):
         return True
 
     def _convert_contract(self, contract: Optional[Contract]=None, contract_id:Optional[int]=None, exchange:Optional[str]=None) -> ib_async.Contract:
-        if contract is None or contract.contract_type=="":
+        if contract is not None and not contract.contract_type:
+            # Contract given by ID only, e.g. from /validate-contract
+            contract_id, exchange = contract.contract_id, contract.exchange
+            contract = None
+        if contract is None:
             try:
-                return ib_async.Contract(conId=contract_id, exchange=exchange)
+                return ib_async.Contract(conId=contract_id, exchange=exchange or "")
             except Exception:
                 raise ValueError(f"You did not pass the correct parameters: \n\t{contract}\n\t{contract_id}\n\t{exchange}")
 
@@ -148,23 +186,25 @@ class IBKRBroker(BrokerInterface):
         except Exception as e:
             raise HTTPException(status_code=500, detail=f"Failed to get quote: {str(e)}")
 
-    async def get_fills(self) -> List[Fill]:
+    async def get_fills(self, order_id: Optional[int] = None) -> List[Fill]:
         await self.connect()
         fills = []
         try:
-            for trade_id, trade in self.pending_trades.items():  # Iterate through the pending trades dictionary
-                if trade.orderStatus.status == 'Filled':  # Check if the trade is filled
-                    print("Fills:", trade.fills[0])  # Print the fill details
-                    fill = trade.fills[0]  # Get the fill details
-                    fills.append(Fill(
-                        order_id = fill.execution.orderId, # trade_id
-                        contract_id=fill.contract.conId,
-                        quantity = fill.execution.cumQty,
-                        price = fill.execution.avgPrice,
-                        time = fill.time,
-                        side="BUY" if fill.execution.side=="BOT" else "SELL"
-                    ))  # Append the fill details to the fills list
-                    self.pending_trades.pop(trade_id)  # Remove the trade from the pending trades dictionary
+            # One fill per execution of the session, with its commission once
+            # IB has sent the commission report
+            for fill in self.ib.fills():
+                if order_id is not None and fill.execution.orderId != order_id:
+                    continue
+                report = fill.commissionReport
+                fills.append(Fill(
+                    order_id = fill.execution.orderId,
+                    contract_id=fill.contract.conId,
+                    quantity = fill.execution.shares,
+                    price = fill.execution.price,
+                    time = fill.time,
+                    side="BUY" if fill.execution.side=="BOT" else "SELL",
+                    commission=report.commission if report and report.execId else None
+                ))
             return fills
         except Exception as e:
             raise HTTPException(status_code=500, detail=f"Failed to get fills: {str(e)}")
@@ -175,26 +215,31 @@ class IBKRBroker(BrokerInterface):
         try:
             ib_trades = self.ib.trades()
             for trade in ib_trades:
-                quantity=0
-                price=0.
-                if trade.orderStatus.status == "Filled":
-                    quantity=trade.fills[0].execution.shares
-                    price=trade.fills[0].execution.price
-                    order_id = trade.fills[0].execution.orderId
-
-                t = Trade(
-                    order_id=order_id,
-                    contract_id=trade.contract.conId,
-                    time=datetime.now().strftime("%Y-%m-%dT%H:%M:%SZ"),
-                    quantity=quantity,
-                    price=price,
-                    side=OrderSide.BUY if trade.order.action == "BUY" else OrderSide.SELL,
-                    order_status=trade.orderStatus.status)
-                trades.append(t)
+                trades.append(self._to_trade(trade))
             return trades
         except Exception as e:
             raise HTTPException(status_code=500, detail=f"Failed to get : {str(e)}")
 
+    def _to_trade(self, trade: ib_async.Trade) -> Trade:
+        quantity=0
+        price=0.
+        time = datetime.now().strftime("%Y-%m-%dT%H:%M:%SZ")
+        if trade.orderStatus.status == "Filled":
+            # Average over every partial fill, timed at the last one
+            quantity=int(trade.orderStatus.filled)
+            price=trade.orderStatus.avgFillPrice
+            if trade.fills:
+                time = trade.fills[-1].execution.time
+
+        return Trade(
+            order_id=trade.order.orderId,
+            contract_id=trade.contract.conId,
+            time=time,
+            quantity=quantity,
+            price=price,
+            side=OrderSide.BUY if trade.order.action == "BUY" else OrderSide.SELL,
+            order_status=self._order_status(trade.orderStatus.status))
+
     async def place_order(self, order: Order) -> str:
         ib_contract = self._convert_contract(contract_id=order.trade.contract_id,
                                              exchange=order.trade.exchange)
@@ -220,11 +265,60 @@ class IBKRBroker(BrokerInterface):
             trade = self.ib.placeOrder(ib_contract, ib_order)
             trade_id = str(trade.order.orderId)
             self.pending_trades[trade_id] = trade  # Add the trade to the pending trade dictionary
+            ib_log.info("Placed order", extra={"fields": {
+                "order_id": trade.order.orderId, "contract_id": order.trade.contract_id,
+                "side": ib_order.action, "quantity": order.trade.quantity, "order_type": order_type}})
             return trade_id  # Return the trade ID to the caller
 
         except Exception as e:
+            ib_log.error("Failed to place order", extra={"fields": {
+                "contract_id": order.trade.contract_id, "error": str(e)}})
             raise HTTPException(status_code=500, detail=f"Failed to place order: {str(e)}")
 
+    async def cancel_orders(self, request: CancelRequest) -> List[CancelResult]:
+        await self.connect()
+        if request.all:
+            return await self._cancel_all_orders(request.order_ids)
+        working = {t.order.orderId: t for t in self.ib.openTrades()}
+        results = []
+        order_ids = request.order_ids
+        for order_id in order_ids:
+            trade = working.get(order_id)
+            if trade is None:
+                results.append(CancelResult(order_id=order_id, status="NotFound"))
+                continue
+            try:
+                self.ib.cancelOrder(trade.order)
+                results.append(CancelResult(order_id=order_id, status="Cancelled"))
+            except Exception as e:
+                results.append(CancelResult(order_id=order_id, status="Failed", error=str(e)))
+        return results
+
+    async def _cancel_all_orders(self, order_ids: List[int]) -> List[CancelResult]:
+        # openTrades only holds this client's orders, so the account's open
+        # orders are listed from every client and cancelled with a global cancel
+        try:
+            trades = await self.ib.reqAllOpenOrdersAsync()
+            self.ib.reqGlobalCancel()
+        except Exception as e:
+            return [CancelResult(order_id=order_id, status="Failed", error=str(e)) for order_id in order_ids]
+        # Orders placed in TWS by hand have no API order id, report their permId
+        working = {t.order.orderId or t.order.permId for t in trades}
+        results = [CancelResult(order_id=order_id, status="Cancelled") for order_id in sorted(working)]
+        results += [CancelResult(order_id=order_id, status="NotFound") for order_id in order_ids if order_id not in working]
+        return results
+
+    @staticmethod
+    def _order_status(status: str) -> OrderStatus:
+        # IB reports more states than the API models
+        if status in ("Cancelled", "ApiCancelled", "Inactive"):
+            return OrderStatus.Cancelled
+        if status == "Filled":
+            return OrderStatus.Filled
+        if status == "Submitted":
+            return OrderStatus.Submitted
+        return OrderStatus.Pending
+
     async def get_historical_data(self, contract: Contract, start_time: datetime, end_time: datetime, bar_size: str, rth:bool=True) -> List[Dict[str, Any]]:
         await self.connect()
         if contract.contract_type is None:
@@ -295,6 +389,31 @@ class IBKRBroker(BrokerInterface):
         except Exception as e:
             raise HTTPException(status_code=500, detail=f"There was an error retrieving the contract ID: {str(e)}")
 
+    async def get_contract_details(self, contract: Contract) -> List[ContractDetails]:
+        ib_contract = self._convert_contract(contract)
+        await self.connect()
+        try:
+            details = await self.ib.reqContractDetailsAsync(ib_contract)
+        except Exception as e:
+            raise HTTPException(status_code=500, detail=f"There was an error retrieving the contract details: {str(e)}")
+        return [
+            ContractDetails(
+                contract_id=d.contract.conId,
+                symbol=d.contract.symbol,
+                contract_type=d.contract.secType,
+                exchange=d.contract.exchange,
+                currency=d.contract.currency,
+                expiry=d.contract.lastTradeDateOrContractMonth,
+                multiplier=float(d.contract.multiplier or 1),
+                tick_size=d.minTick,
+                trading_hours=d.tradingHours,
+                liquid_hours=d.liquidHours,
+                time_zone=d.timeZoneId,
+                description=d.longName,
+            )
+            for d in details
+        ]
+
     def _calculate_duration(self, start_time: datetime, end_time: datetime) -> str:
         # Calculate the duration string based on the time difference
         diff = end_time - start_time
@@ -937,6 +1056,7 @@ class TestBroker(BrokerInterface):
         self._positions = {}  # Store positions by symbol
         self._prices = {}  # Store simulated prices by symbol
         self.pending_trades = {}  # Initialize the pending trades dictionary similar to IBKRBroker
+        self._cancelled = set()  # order_ids of cancelled orders
 
     async def connect(self) -> bool:
         if not self._connected:
@@ -998,20 +1118,17 @@ class TestBroker(BrokerInterface):
             timestamp=datetime.now()
         )
 
-    async def get_fills(self) -> List[Fill]:
+    async def get_fills(self, order_id: Optional[int] = None) -> List[Fill]:
         await self.connect()
         if not self._connected:
             raise HTTPException(status_code=500, detail="Not connected")
 
         fills = []
         try:
-            for trade_id, trade in self.pending_trades.items():
-                if trade["orderStatus"]["status"] == 'Filled':
-                    # Get the fill from the _fills dictionary
-                    if trade_id in self._fills:
-                        fills.append(self._fills[trade_id])
-                        # Remove the trade from pending_trades after retrieving the fill
-                        self.pending_trades.pop(trade_id)
+            # Simulated fills carry no commission, like a broker that does not report it
+            for fill in self._fills.values():
+                if order_id is None or fill.order_id == order_id:
+                    fills.append(fill)
             return fills
         except Exception as e:
             raise HTTPException(status_code=500, detail=f"Failed to get fills: {str(e)}")
@@ -1093,8 +1210,29 @@ class TestBroker(BrokerInterface):
                 # Update the trade status to Filled
                 self.pending_trades[order_id]["orderStatus"]["status"] = "Filled"
 
+        self._publish_trade(self._to_trade(order_id))
         return order_id
 
+    async def cancel_orders(self, request: CancelRequest) -> List[CancelResult]:
+        await self.connect()
+        if not self._connected:
+            raise HTTPException(status_code=500, detail="Not connected")
+
+        # Orders are reported by the numeric part of their id, see get_trades
+        working = {int(order_id.split('_')[1]): order_id for order_id in self._orders
+                   if order_id not in self._fills and order_id not in self._cancelled}
+        order_ids = list(working) if request.all else request.order_ids
+        results = []
+        for order_id in order_ids:
+            if order_id not in working:
+                results.append(CancelResult(order_id=order_id, status="NotFound"))
+                continue
+            self._cancelled.add(working[order_id])
+            self.pending_trades[working[order_id]]["orderStatus"]["status"] = "Cancelled"
+            self._publish_trade(self._to_trade(working[order_id]))
+            results.append(CancelResult(order_id=order_id, status="Cancelled"))
+        return results
+
     async def get_historical_data(self, contract: Contract, start_time: datetime, end_time: datetime, bar_size: str) -> List[Dict[str, Any]]:
         await self.connect()
         if not self._connected:
@@ -1163,6 +1301,26 @@ class TestBroker(BrokerInterface):
         output = int("".join([str(alphabet.index(c)) for c in full_string.lower()]))
         return output
 
+    async def get_contract_details(self, contract: Contract) -> List[ContractDetails]:
+        await self.connect()
+        if not self._connected:
+            raise HTTPException(status_code=500, detail="Not connected")
+        contract_id = contract.contract_id or await self.get_contract_id(contract)
+        return [ContractDetails(
+            contract_id=contract_id,
+            symbol=contract.symbol or f"SYM_{contract_id}",
+            contract_type=contract.contract_type or ContractType.FUTURE,
+            exchange=contract.exchange or "CME",
+            currency=contract.currency,
+            expiry=contract.expiry or "",
+            multiplier=5.0,
+            tick_size=0.25,
+            trading_hours="",
+            liquid_hours="",
+            time_zone="US/Central",
+            description=f"Test contract {contract_id}",
+        )]
+
     async def get_quote_by_contract_id(self, exchange:str, contract_id:int) -> Quote:
         await self.connect()
         if not self._connected:
@@ -1276,34 +1434,38 @@ class TestBroker(BrokerInterface):
         trades = []
 
         # Convert orders and fills to Trade objects
-        for order_id, order in self._orders.items():
-            # Check if this order has a fill
-            fill = self._fills.get(order_id)
-
-            # Determine quantity and price based on fill status
-            quantity = 0
-            price = 0.0
-            status = OrderStatus.Submitted
-
-            if fill:
-                quantity = fill.quantity
-                price = fill.price
-                status = OrderStatus.Filled
-
-            trade = Trade(
-                order_id=int(order_id.split('_')[1]),  # Extract numeric part of order_id
-                contract_id=order.trade.contract_id,
-                time=datetime.now(),
-                quantity=quantity,
-                price=price,
-                side=order.trade.side,
-                order_status=status
-            )
-
-            trades.append(trade)
+        for order_id in self._orders:
+            trades.append(self._to_trade(order_id))
 
         return trades
 
+    def _to_trade(self, order_id: str) -> Trade:
+        order = self._orders[order_id]
+        # Check if this order has a fill
+        fill = self._fills.get(order_id)
+
+        # Determine quantity and price based on fill status
+        quantity = 0
+        price = 0.0
+        status = OrderStatus.Submitted
+
+        if fill:
+            quantity = fill.quantity
+            price = fill.price
+            status = OrderStatus.Filled
+        elif order_id in self._cancelled:
+            status = OrderStatus.Cancelled
+
+        return Trade(
+            order_id=int(order_id.split('_')[1]),  # Extract numeric part of order_id
+            contract_id=order.trade.contract_id,
+            time=datetime.now(),
+            quantity=quantity,
+            price=price,
+            side=order.trade.side,
+            order_status=status
+        )
+
 # class TestIBKR(IBKRBroker):
 #     def __init__(self):
 #         super().__init__()
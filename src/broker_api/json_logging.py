@@ -0,0 +1,74 @@
+"""JSON log lines for broker_api, in the format the backend and scheduler write.
+
+LOG_LEVEL sets the level of every component, info by default, and LOG_LEVELS
+overrides it for some, e.g. "requests=debug,ib=warn". Requests the backend
+sends for a trade instruction carry its correlation ID in the X-Correlation-ID
+header, which is added to every line logged while serving them.
+"""
+import contextvars
+import json
+import logging
+import os
+import sys
+from datetime import datetime, timezone
+
+HEADER = "X-Correlation-ID"
+
+# Correlation ID of the request being served
+correlation_id = contextvars.ContextVar("correlation_id", default="")
+
+_ROOT = "broker_api"
+
+
+class JSONFormatter(logging.Formatter):
+    def format(self, record: logging.LogRecord) -> str:
+        line = {
+            "time": datetime.fromtimestamp(record.created, timezone.utc).isoformat(),
+            "level": "WARN" if record.levelname == "WARNING" else record.levelname,
+            "msg": record.getMessage(),
+            "component": record.name.removeprefix(_ROOT + "."),
+        }
+        if correlation_id.get():
+            line["correlation_id"] = correlation_id.get()
+        line.update(getattr(record, "fields", {}))
+        if record.exc_info:
+            line["error"] = self.formatException(record.exc_info)
+        return json.dumps(line, default=str)
+
+
+def get_logger(component: str) -> logging.Logger:
+    return logging.getLogger(f"{_ROOT}.{component}")
+
+
+def _level(value: str) -> int:
+    level = logging.getLevelName(value.strip().upper())
+    if not isinstance(level, int):
+        raise ValueError(f"unknown level {value!r}")
+    return level
+
+
+def setup() -> None:
+    handler = logging.StreamHandler(sys.stdout)
+    handler.setFormatter(JSONFormatter())
+    root = logging.getLogger(_ROOT)
+    root.handlers = [handler]
+    root.propagate = False
+
+    problems = []
+    try:
+        root.setLevel(_level(os.getenv("LOG_LEVEL") or "info"))
+    except ValueError as e:
+        root.setLevel(logging.INFO)
+        problems.append(f"LOG_LEVEL: {e}")
+    for entry in os.getenv("LOG_LEVELS", "").split(","):
+        name, sep, value = entry.strip().partition("=")
+        if not sep:
+            if entry.strip():
+                problems.append(f"LOG_LEVELS: {entry!r} is not component=level")
+            continue
+        try:
+            get_logger(name).setLevel(_level(value))
+        except ValueError as e:
+            problems.append(f"LOG_LEVELS: {name}: {e}")
+    for problem in problems:
+        get_logger("main").warning("Invalid log level", extra={"fields": {"error": problem}})
@@ -1,6 +1,6 @@
 from enum import Enum
 from pydantic import BaseModel
-from typing import Optional, Union
+from typing import List, Optional, Union
 from datetime import datetime
 
 # Data Models
@@ -33,6 +33,20 @@ class Contract(BaseModel):
     currency: str = "USD"
     expiry: Optional[str] = None
 
+class ContractDetails(BaseModel):
+    contract_id: int
+    symbol: str
+    contract_type: str
+    exchange: str
+    currency: str
+    expiry: str = ""
+    multiplier: float = 1.0
+    tick_size: float = 0.0
+    trading_hours: str = ""  # e.g. 20250101:1700-20250102:1600;20250104:CLOSED
+    liquid_hours: str = ""
+    time_zone: str = ""
+    description: str = ""
+
 class TradeInstruction(BaseModel):
     strategy_name: str
     contract_id: int
@@ -54,6 +68,15 @@ class Order(BaseModel):
     # quantity: float
     # limit_price: Optional[float] = None
 
+class CancelRequest(BaseModel):
+    order_ids: List[int] = []
+    all: bool = False  # cancel every working order of the account
+
+class CancelResult(BaseModel):
+    order_id: int
+    status: str  # Cancelled, NotFound or Failed
+    error: str = ""
+
 class Fill(BaseModel):
     order_id: int
     contract_id: int
@@ -61,6 +84,7 @@ class Fill(BaseModel):
     quantity: int
     price: float
     side: OrderSide
+    commission: Optional[float] = None  # commission and fees, None until the broker reports them
 
 class Quote(BaseModel):
     symbol: str
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Performance Analytics
+// -----------------------------------------------------------------
+
+// apiAnalytics handles GET /api/v1/analytics. Returns the performance of each
+// strategy and its setups over from..to (inclusive trading dates, the last 30
+// days by default). strategy and setup narrow it down.
+func apiAnalytics(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	today := time.Now().Format("2006-01-02")
+	query := handlers.AnalyticsQuery{
+		StrategyName: q.Get("strategy"),
+		SetupName:    q.Get("setup"),
+		From:         q.Get("from"),
+		To:           q.Get("to"),
+	}
+	if query.To == "" {
+		query.To = today
+	}
+
+	var errs ValidationErrors
+	if _, err := time.Parse("2006-01-02", query.To); err != nil {
+		errs.add("to", "must be a date like 2006-01-02, got %q", query.To)
+	} else if query.From == "" {
+		to, _ := time.Parse("2006-01-02", query.To)
+		query.From = to.AddDate(0, 0, -30).Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", query.From); query.From != "" && err != nil {
+		errs.add("from", "must be a date like 2006-01-02, got %q", query.From)
+	} else if query.From > query.To {
+		errs.add("to", "must not be before from")
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	results, err := handlers.ComputeAnalytics(query)
+	if err != nil {
+		log.Println("[ERROR] Failed to compute analytics:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute analytics", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":       query.From,
+		"to":         query.To,
+		"strategies": results,
+	})
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// -----------------------------------------------------------------
+// REST API v1
+// -----------------------------------------------------------------
+
+// The /api/v1 surface exposes strategies and setups as resources with JSON
+// request and response bodies. Every error, including unknown routes and
+// methods, is returned as an ErrorResponse. The OpenAPI document describing
+// it is served at /api/v1/openapi.json.
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const apiV1Prefix = "/api/v1"
+
+type apiRoute struct {
+	method  string
+	path    string
+	role    string // minimum role, "" for public routes
+	handler http.HandlerFunc
+}
+
+var apiV1Routes = []apiRoute{
+	{"GET", "/openapi.json", "", serveOpenAPISpec},
+	{"POST", "/auth/login", "", apiLogin},
+	{"POST", "/auth/logout", "", apiLogout},
+	{"GET", "/auth/me", roleViewer, apiMe},
+	{"GET", "/users", roleAdmin, apiListUsers},
+	{"POST", "/users", roleAdmin, apiSaveUser},
+	{"DELETE", "/users/{username}", roleAdmin, apiDeleteUser},
+	{"POST", "/tokens", roleAdmin, apiCreateToken},
+	{"DELETE", "/tokens/{name}", roleAdmin, apiDeleteToken},
+	{"GET", "/audit-events", roleAdmin, apiListAuditEvents},
+	{"GET", "/trades", roleViewer, apiListTrades},
+	{"GET", "/equity", roleViewer, apiEquityCurve},
+	{"GET", "/pnl", roleViewer, apiPnL},
+	{"GET", "/analytics", roleViewer, apiAnalytics},
+	{"GET", "/tca", roleViewer, apiTCA},
+	{"GET", "/broker-circuits", roleViewer, apiBrokerCircuits},
+	{"GET", "/contracts", roleViewer, apiListContracts},
+	{"POST", "/contracts", roleAdmin, apiCreateContract},
+	{"POST", "/contract-sync", roleAdmin, apiSyncContracts},
+	{"GET", "/contracts/{id}", roleViewer, apiGetContract},
+	{"PUT", "/contracts/{id}", roleAdmin, apiUpdateContract},
+	{"DELETE", "/contracts/{id}", roleAdmin, apiDeleteContract},
+	{"POST", "/account/flatten", roleAdmin, apiFlatten("account")},
+	{"POST", "/strategy-groups/{group}/flatten", roleTrader, apiFlatten("group")},
+
+	{"GET", "/strategies", roleViewer, apiListStrategies},
+	{"POST", "/strategies", roleAdmin, apiCreateStrategy},
+	{"GET", "/strategies/{strategy}", roleViewer, apiGetStrategy},
+	{"PATCH", "/strategies/{strategy}", roleAdmin, apiUpdateStrategy},
+	{"DELETE", "/strategies/{strategy}", roleAdmin, apiDeleteStrategy},
+	{"POST", "/strategies/{strategy}/archive", roleAdmin, apiArchiveStrategy(true)},
+	{"POST", "/strategies/{strategy}/unarchive", roleAdmin, apiArchiveStrategy(false)},
+	{"GET", "/strategies/{strategy}/versions", roleViewer, apiListVersions},
+	{"POST", "/strategies/{strategy}/versions", roleAdmin, apiUploadVersion},
+	{"POST", "/strategies/{strategy}/rollback", roleAdmin, apiRollback},
+	{"POST", "/strategies/{strategy}/flatten", roleTrader, apiFlatten("strategy")},
+
+	{"GET", "/strategies/{strategy}/setups", roleViewer, apiListSetups},
+	{"POST", "/strategies/{strategy}/setups", roleTrader, apiCreateSetup},
+	{"GET", "/strategies/{strategy}/setups/{setup}", roleViewer, apiGetSetup},
+	{"PATCH", "/strategies/{strategy}/setups/{setup}", roleTrader, apiUpdateSetup},
+	{"DELETE", "/strategies/{strategy}/setups/{setup}", roleTrader, apiDeleteSetup},
+	{"POST", "/strategies/{strategy}/setups/{setup}/start", roleTrader, apiSetEnabled(true)},
+	{"POST", "/strategies/{strategy}/setups/{setup}/stop", roleTrader, apiSetEnabled(false)},
+	{"POST", "/strategies/{strategy}/setups/{setup}/close-position", roleTrader, apiClosePosition},
+	{"POST", "/strategies/{strategy}/setups/{setup}/archive", roleTrader, apiArchiveSetup(true)},
+	{"POST", "/strategies/{strategy}/setups/{setup}/unarchive", roleTrader, apiArchiveSetup(false)},
+}
+
+// newAPIv1Handler routes /api/v1 requests, answering unknown paths and
+// methods with JSON errors instead of the mux's plain-text ones.
+func newAPIv1Handler() http.Handler {
+	mux := http.NewServeMux()
+	allowed := make(map[string][]string)
+	for _, route := range apiV1Routes {
+		path := apiV1Prefix + route.path
+		handler := route.handler
+		if route.role != "" {
+			handler = requireRole(route.role, handler)
+		}
+		mux.HandleFunc(route.method+" "+path, handler)
+		allowed[path] = append(allowed[path], route.method)
+	}
+	for path, methods := range allowed {
+		allow := strings.Join(methods, ", ")
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		})
+	}
+	mux.HandleFunc(apiV1Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "Not found", nil)
+	})
+	return mux
+}
+
+func serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// -----------------------------------------------------------------
+// Request & Response Bodies
+// -----------------------------------------------------------------
+
+type strategyResource struct {
+	Name string `json:"name"`
+	Strategy
+}
+
+type setupResource struct {
+	Name     string `json:"name"`
+	Strategy string `json:"strategy"`
+	Running  bool   `json:"running"`
+	Setup
+}
+
+// scriptRequest carries a strategy script as text
+type scriptRequest struct {
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+type setupRequest struct {
+	Name          string                 `json:"name"`
+	Market        string                 `json:"market"`
+	ContractId    int                    `json:"contract_id"`
+	Timeframe     string                 `json:"timeframe"`
+	Schedule      string                 `json:"schedule"`
+	MarketData    []string               `json:"market_data"`
+	Params        map[string]interface{} `json:"params"`
+	ScriptVersion int                    `json:"script_version"`
+
+	FlattenAt          string `json:"flatten_at"`
+	FlattenBeforeClose int    `json:"flatten_before_close"`
+}
+
+type createStrategyRequest struct {
+	Name         string                  `json:"name"`
+	StrategyType string                  `json:"strategy_type"`
+	Group        string                  `json:"group"`
+	ParamSchema  []ParamSpec             `json:"param_schema"`
+	Script       *scriptRequest          `json:"script"`
+	Setups       map[string]setupRequest `json:"setups"`
+}
+
+// setupPatch lists the setup fields a PATCH may change; omitted fields keep
+// their current value and params are merged into the stored ones
+type setupPatch struct {
+	Market        *string                `json:"market"`
+	ContractId    *int                   `json:"contract_id"`
+	Timeframe     *string                `json:"timeframe"`
+	Schedule      *string                `json:"schedule"`
+	MarketData    *[]string              `json:"market_data"`
+	Params        map[string]interface{} `json:"params"`
+	ScriptVersion *int                   `json:"script_version"`
+
+	FlattenAt          *string `json:"flatten_at"`
+	FlattenBeforeClose *int    `json:"flatten_before_close"`
+}
+
+// strategyPatch lists the strategy fields a PATCH may change
+type strategyPatch struct {
+	Group *string `json:"group"`
+}
+
+type rollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// toSetup builds a stopped Setup from a request, resolving params against
+// the strategy's schema
+func (req setupRequest) toSetup(paramSchema []ParamSpec) (Setup, ValidationErrors) {
+	setup := Setup{
+		Market:        strings.TrimSpace(req.Market),
+		ContractId:    req.ContractId,
+		Timeframe:     req.Timeframe,
+		Schedule:      strings.TrimSpace(req.Schedule),
+		MarketData:    req.MarketData,
+		ScriptVersion: req.ScriptVersion,
+
+		FlattenAt:          strings.TrimSpace(req.FlattenAt),
+		FlattenBeforeClose: req.FlattenBeforeClose,
+	}
+	if setup.MarketData == nil {
+		setup.MarketData = []string{}
+	}
+	params, errs := mergeJSONParams(paramSchema, nil, req.Params)
+	setup.Params = params
+	return setup, errs
+}
+
+// checkScriptRequest reports a missing or misnamed script
+func checkScriptRequest(script *scriptRequest, errs *ValidationErrors) {
+	switch {
+	case script == nil || script.Content == "":
+		errs.add("script.content", "is required")
+	case filepath.Ext(script.Filename) != ".py":
+		errs.add("script.filename", "must be a .py script")
+	}
+}
+
+func (script *scriptRequest) upload(r *http.Request) *scriptUpload {
+	return &scriptUpload{
+		Filename:   script.Filename,
+		Src:        strings.NewReader(script.Content),
+		UploadedBy: uploadedBy(r),
+	}
+}
+
+// lookupStrategy returns a copy of a strategy, safe to read without the
+// lock, or a 404 apiError
+func lookupStrategy(strategyName string) (Strategy, error) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strat, ok := strategies[strategyName]
+	if !ok {
+		return strat, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	setups := make(map[string]Setup, len(strat.Setups))
+	for setupName, setup := range strat.Setups {
+		setups[setupName] = setup
+	}
+	strat.Setups = setups
+	return strat, nil
+}
+
+func newSetupResource(strategyName, setupName string, setup Setup) setupResource {
+	return setupResource{
+		Name:     setupName,
+		Strategy: strategyName,
+		Running:  isRunning(strategyName, setupName),
+		Setup:    setup,
+	}
+}
+
+// -----------------------------------------------------------------
+// Strategy Handlers
+// -----------------------------------------------------------------
+
+func apiListStrategies(w http.ResponseWriter, r *http.Request) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	config := strategies
+	if r.URL.Query().Get("include_archived") != "true" {
+		config = activeStrategies()
+	}
+	list := make([]strategyResource, 0, len(config))
+	for strategyName, strat := range config {
+		list = append(list, strategyResource{Name: strategyName, Strategy: strat})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiCreateStrategy(w http.ResponseWriter, r *http.Request) {
+	var req createStrategyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var errs ValidationErrors
+	checkScriptRequest(req.Script, &errs)
+	strat := Strategy{
+		StrategyType: req.StrategyType,
+		Group:        strings.TrimSpace(req.Group),
+		ParamSchema:  req.ParamSchema,
+		Setups:       make(map[string]Setup, len(req.Setups)),
+	}
+	for setupName, setupReq := range req.Setups {
+		setup, setupErrs := setupReq.toSetup(req.ParamSchema)
+		for _, fe := range setupErrs {
+			errs.add("setups."+setupName+"."+fe.Field, "%s", fe.Message)
+		}
+		strat.Setups[setupName] = setup
+	}
+
+	var script *scriptUpload
+	if req.Script != nil && req.Script.Content != "" {
+		script = req.Script.upload(r)
+	}
+	strat, err := createStrategy(callerIdentity(r), req.Name, strat, script, errs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, strategyResource{Name: req.Name, Strategy: strat})
+}
+
+func apiGetStrategy(w http.ResponseWriter, r *http.Request) {
+	strategyName := r.PathValue("strategy")
+	strat, err := lookupStrategy(strategyName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, strategyResource{Name: strategyName, Strategy: strat})
+}
+
+func apiUpdateStrategy(w http.ResponseWriter, r *http.Request) {
+	var patch strategyPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	strategyName := r.PathValue("strategy")
+	strat, err := updateStrategy(callerIdentity(r), strategyName, func(strat *Strategy) {
+		if patch.Group != nil {
+			strat.Group = strings.TrimSpace(*patch.Group)
+		}
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, strategyResource{Name: strategyName, Strategy: strat})
+}
+
+func apiDeleteStrategy(w http.ResponseWriter, r *http.Request) {
+	if _, err := deleteSetups(callerIdentity(r), r.PathValue("strategy"), "", r.URL.Query().Get("force") == "true"); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiArchiveStrategy(archive bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		strategyName := r.PathValue("strategy")
+		if _, err := archiveSetups(callerIdentity(r), strategyName, "", archive, r.URL.Query().Get("force") == "true"); err != nil {
+			writeError(w, err)
+			return
+		}
+		apiGetStrategy(w, r)
+	}
+}
+
+func apiListVersions(w http.ResponseWriter, r *http.Request) {
+	strat, err := lookupStrategy(r.PathValue("strategy"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	versions := strat.Versions
+	if versions == nil {
+		versions = []ScriptVersion{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"current_version": strat.CurrentVersion,
+		"versions":        versions,
+	})
+}
+
+func apiUploadVersion(w http.ResponseWriter, r *http.Request) {
+	var req scriptRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs ValidationErrors
+	checkScriptRequest(&req, &errs)
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	version, created, restarted, err := uploadScriptVersion(callerIdentity(r), r.PathValue("strategy"), *req.upload(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"version":   version,
+		"created":   created,
+		"restarted": restarted,
+	})
+}
+
+func apiRollback(w http.ResponseWriter, r *http.Request) {
+	var req rollbackRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	version, restarted, err := rollbackToVersion(callerIdentity(r), r.PathValue("strategy"), req.Version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":   version,
+		"restarted": restarted,
+	})
+}
+
+// -----------------------------------------------------------------
+// Setup Handlers
+// -----------------------------------------------------------------
+
+func apiListSetups(w http.ResponseWriter, r *http.Request) {
+	strategyName := r.PathValue("strategy")
+	strat, err := lookupStrategy(strategyName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	includeArchived := r.URL.Query().Get("include_archived") == "true"
+	list := make([]setupResource, 0, len(strat.Setups))
+	for setupName, setup := range strat.Setups {
+		if setup.Archived && !includeArchived {
+			continue
+		}
+		list = append(list, newSetupResource(strategyName, setupName, setup))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func apiCreateSetup(w http.ResponseWriter, r *http.Request) {
+	var req setupRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	strategyName := r.PathValue("strategy")
+	if _, err := lookupStrategy(strategyName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	setup, errs := req.toSetup(strategyParamSchema(strategyName))
+	setup, err := addSetup(callerIdentity(r), strategyName, req.Name, setup, errs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newSetupResource(strategyName, req.Name, setup))
+}
+
+func apiGetSetup(w http.ResponseWriter, r *http.Request) {
+	strategyName, setupName := r.PathValue("strategy"), r.PathValue("setup")
+	strat, err := lookupStrategy(strategyName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setup, ok := strat.Setups[setupName]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Setup not found", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSetupResource(strategyName, setupName, setup))
+}
+
+func apiUpdateSetup(w http.ResponseWriter, r *http.Request) {
+	var patch setupPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	strategyName, setupName := r.PathValue("strategy"), r.PathValue("setup")
+
+	setup, err := updateSetupConfig(callerIdentity(r), strategyName, setupName, func(setup *Setup, paramSchema []ParamSpec) ValidationErrors {
+		if patch.Market != nil {
+			setup.Market = strings.TrimSpace(*patch.Market)
+		}
+		if patch.ContractId != nil {
+			setup.ContractId = *patch.ContractId
+		}
+		if patch.Timeframe != nil {
+			setup.Timeframe = *patch.Timeframe
+		}
+		if patch.Schedule != nil {
+			setup.Schedule = strings.TrimSpace(*patch.Schedule)
+		}
+		if patch.MarketData != nil {
+			setup.MarketData = *patch.MarketData
+		}
+		if patch.ScriptVersion != nil {
+			setup.ScriptVersion = *patch.ScriptVersion
+		}
+		if patch.FlattenAt != nil {
+			setup.FlattenAt = strings.TrimSpace(*patch.FlattenAt)
+		}
+		if patch.FlattenBeforeClose != nil {
+			setup.FlattenBeforeClose = *patch.FlattenBeforeClose
+		}
+		params, errs := mergeJSONParams(paramSchema, setup.Params, patch.Params)
+		setup.Params = params
+		return errs
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSetupResource(strategyName, setupName, setup))
+}
+
+func apiDeleteSetup(w http.ResponseWriter, r *http.Request) {
+	if _, err := deleteSetups(callerIdentity(r), r.PathValue("strategy"), r.PathValue("setup"), r.URL.Query().Get("force") == "true"); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiSetEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		strategyName, setupName := r.PathValue("strategy"), r.PathValue("setup")
+		setup, err := setSetupEnabled(callerIdentity(r), strategyName, setupName, enabled)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		notifyStrategyConfigChanged(strategyName + "|" + setupName)
+		writeJSON(w, http.StatusOK, newSetupResource(strategyName, setupName, setup))
+	}
+}
+
+func apiClosePosition(w http.ResponseWriter, r *http.Request) {
+	strategyName, setupName := r.PathValue("strategy"), r.PathValue("setup")
+	if _, err := lookupStrategy(strategyName); err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := closeSetupPosition(callerIdentity(r), strategyName, setupName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// apiFlatten closes every open position of a strategy, a strategy group or
+// the account. The scope names the path parameter holding the target.
+func apiFlatten(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := flattenPositions(callerIdentity(r), scope, r.PathValue(scope))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func apiArchiveSetup(archive bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := archiveSetups(callerIdentity(r), r.PathValue("strategy"), r.PathValue("setup"), archive, r.URL.Query().Get("force") == "true"); err != nil {
+			writeError(w, err)
+			return
+		}
+		apiGetSetup(w, r)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// -----------------------------------------------------------------
+// Archive & Delete
+// -----------------------------------------------------------------
+
+// Archived strategies and setups stay in the config so their names keep
+// pointing at their trade history, but they are hidden from the active list
+// and cannot be started. Deleted ones are removed from the config.
+
+// setupTarget is one setup affected by an archive or delete request
+type setupTarget struct {
+	StrategyName string
+	SetupName    string
+}
+
+func (t setupTarget) key() string {
+	return t.StrategyName + "|" + t.SetupName
+}
+
+// isRunning reports whether the scheduler has a live process for the setup
+func isRunning(strategyName, setupName string) bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	_, ok := runningProcs[strategyName+"|"+setupName]
+	return ok
+}
+
+// readPositions reads positions.json without touching the shared positions
+// map used by the position stream, which is only refreshed while a client
+// is connected.
+func readPositions() (map[string]Position, error) {
+	data, err := os.ReadFile(GetSharedFilePath("positions.json"))
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]Position)
+	if err := json.Unmarshal(data, &current); err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// readPositionQuantities returns the position quantity of each setup
+func readPositionQuantities() (map[string]int, error) {
+	current, err := readPositions()
+	if err != nil {
+		return nil, err
+	}
+	quantities := make(map[string]int, len(current))
+	for setupName, position := range current {
+		quantities[setupName] = position.Quantity
+	}
+	return quantities, nil
+}
+
+// checkRemovable lists the reasons the targets may not be archived or deleted:
+// a setup that is running or still holds a position.
+func checkRemovable(targets []setupTarget) ValidationErrors {
+	var errs ValidationErrors
+	quantities, err := readPositionQuantities()
+	if errors.Is(err, fs.ErrNotExist) {
+		// The backend has not written positions yet, so nothing is held
+		err = nil
+	}
+	if err != nil {
+		errs.add("position", "unable to check positions: %v", err)
+	}
+
+	strategiesMu.Lock()
+	enabled := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		enabled[t.key()] = strategies[t.StrategyName].Setups[t.SetupName].Enabled
+	}
+	strategiesMu.Unlock()
+
+	for _, t := range targets {
+		if enabled[t.key()] || isRunning(t.StrategyName, t.SetupName) {
+			errs.add(t.SetupName, "is running")
+		}
+		if qty := quantities[t.SetupName]; qty != 0 {
+			errs.add(t.SetupName, "holds a position of %d", qty)
+		}
+	}
+	return errs
+}
+
+// lookupTargets returns the setups a request applies to: one setup, or every
+// setup of the strategy when setupName is empty.
+func lookupTargets(strategyName, setupName string) ([]setupTarget, int, string) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	strat, ok := strategies[strategyName]
+	if !ok {
+		return nil, http.StatusNotFound, "Strategy not found"
+	}
+	if setupName != "" {
+		if _, ok := strat.Setups[setupName]; !ok {
+			return nil, http.StatusNotFound, "Setup not found"
+		}
+		return []setupTarget{{strategyName, setupName}}, 0, ""
+	}
+
+	targets := make([]setupTarget, 0, len(strat.Setups))
+	for name := range strat.Setups {
+		targets = append(targets, setupTarget{strategyName, name})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].SetupName < targets[j].SetupName })
+	return targets, 0, ""
+}
+
+// guardRemoval refuses while any target is running or holds a position,
+// unless forced, in which case running setups are stopped first.
+func guardRemoval(targets []setupTarget, force bool) error {
+	errs := checkRemovable(targets)
+	if len(errs) == 0 {
+		return nil
+	}
+	if !force {
+		return newAPIError(http.StatusConflict, "Stop the setup and close its position first, or retry with force=true", errs)
+	}
+	log.Printf("[WARN] Forcing removal despite: %v", errs)
+	for _, t := range targets {
+		stopScript(t.StrategyName, t.SetupName)
+	}
+	return nil
+}
+
+// archiveSetups archives or unarchives one setup, or a whole strategy when
+// setupName is empty, and returns the setups it applied to
+func archiveSetups(actor identity, strategyName, setupName string, archive, force bool) (_ []string, err error) {
+	defer auditChange(actor, archiveAction(setupName, archive), strategyName, setupName)(&err)
+	targets, status, msg := lookupTargets(strategyName, setupName)
+	if status != 0 {
+		return nil, newAPIError(status, msg, nil)
+	}
+	if archive {
+		if err := guardRemoval(targets, force); err != nil {
+			return nil, err
+		}
+	}
+
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	if !ok {
+		strategiesMu.Unlock()
+		return nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	var archivedAt *time.Time
+	if archive {
+		now := time.Now()
+		archivedAt = &now
+	}
+	for _, t := range targets {
+		setup := strat.Setups[t.SetupName]
+		// Unarchiving a strategy leaves setups that were archived on their own
+		if setupName == "" && !archive && setup.Archived && !setupArchivedWithStrategy(setup, strat) {
+			continue
+		}
+		// Archiving a strategy leaves setups that are already archived as they are
+		if setupName == "" && archive && setup.Archived {
+			continue
+		}
+		if archive {
+			setup.Enabled = false
+		}
+		setup.Archived = archive
+		setup.ArchivedAt = archivedAt
+		strat.Setups[t.SetupName] = setup
+	}
+	if setupName == "" {
+		strat.Archived = archive
+		strat.ArchivedAt = archivedAt
+	}
+	strategies[strategyName] = strat
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	strategiesMu.Unlock()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+
+	for _, t := range targets {
+		notifyStrategyConfigChanged(t.key())
+	}
+	log.Printf("[INFO] archive=%t %s %s", archive, strategyName, setupName)
+	return setupNames(targets), nil
+}
+
+// setupArchivedWithStrategy reports whether a setup was archived by archiving
+// its strategy rather than on its own.
+func setupArchivedWithStrategy(setup Setup, strat Strategy) bool {
+	return strat.ArchivedAt != nil && setup.ArchivedAt != nil && setup.ArchivedAt.Equal(*strat.ArchivedAt)
+}
+
+// deleteSetups removes one setup, or a whole strategy when setupName is empty,
+// from the config. Trades already recorded keep their strategy name but are
+// no longer linked to a config entry; archive instead to keep that link.
+func deleteSetups(actor identity, strategyName, setupName string, force bool) (_ []string, err error) {
+	action := "setup.delete"
+	if setupName == "" {
+		action = "strategy.delete"
+	}
+	defer auditChange(actor, action, strategyName, setupName)(&err)
+	targets, status, msg := lookupTargets(strategyName, setupName)
+	if status != 0 {
+		return nil, newAPIError(status, msg, nil)
+	}
+	if err := guardRemoval(targets, force); err != nil {
+		return nil, err
+	}
+
+	strategiesMu.Lock()
+	previous, ok := strategies[strategyName]
+	if !ok {
+		strategiesMu.Unlock()
+		return nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	if setupName == "" {
+		delete(strategies, strategyName)
+	} else {
+		strat := previous
+		setups := make(map[string]Setup, len(strat.Setups))
+		for name, setup := range strat.Setups {
+			if name != setupName {
+				setups[name] = setup
+			}
+		}
+		strat.Setups = setups
+		strategies[strategyName] = strat
+	}
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	if err != nil {
+		strategies[strategyName] = previous
+	}
+	strategiesMu.Unlock()
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+
+	for _, t := range targets {
+		notifyStrategyConfigChanged(t.key())
+	}
+	log.Printf("[INFO] Deleted %s %s", strategyName, setupName)
+	return setupNames(targets), nil
+}
+
+// archiveHandler handles
+// POST /strategies/{strategyName}/archive
+// POST /strategies/{strategyName}/{setupName}/archive
+// and the matching /unarchive actions
+func archiveHandler(strategyName, setupName string, archive bool, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+	names, err := archiveSetups(callerIdentity(r), strategyName, setupName, archive, r.URL.Query().Get("force") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	action := "unarchived"
+	if archive {
+		action = "archived"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": action, "setups": names})
+}
+
+// deleteHandler handles
+// DELETE /strategies/{strategyName}
+// DELETE /strategies/{strategyName}/{setupName}
+func deleteHandler(strategyName, setupName string, w http.ResponseWriter, r *http.Request) {
+	names, err := deleteSetups(callerIdentity(r), strategyName, setupName, r.URL.Query().Get("force") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "setups": names})
+}
+
+// archiveAction names an archive operation in the audit log
+func archiveAction(setupName string, archive bool) string {
+	action := "archive"
+	if !archive {
+		action = "unarchive"
+	}
+	if setupName == "" {
+		return "strategy." + action
+	}
+	return "setup." + action
+}
+
+// activeStrategies returns the config without archived strategies and setups.
+// Callers must hold strategiesMu.
+func activeStrategies() map[string]Strategy {
+	active := make(map[string]Strategy, len(strategies))
+	for strategyName, strat := range strategies {
+		if strat.Archived {
+			continue
+		}
+		setups := make(map[string]Setup, len(strat.Setups))
+		for setupName, setup := range strat.Setups {
+			if !setup.Archived {
+				setups[setupName] = setup
+			}
+		}
+		strat.Setups = setups
+		active[strategyName] = strat
+	}
+	return active
+}
+
+// archivedError rejects starting a setup that has been archived
+func archivedError(strategyName, setupName string) error {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strat := strategies[strategyName]
+	if strat.Archived || strat.Setups[setupName].Archived {
+		return fmt.Errorf("%s is archived, unarchive it before starting", setupName)
+	}
+	return nil
+}
+
+func setupNames(targets []setupTarget) []string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.SetupName)
+	}
+	return names
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Audit Log
+// -----------------------------------------------------------------
+
+// Every mutating operation records who did what to which strategy/setup, the
+// config fields it changed and whether it succeeded in audit_events.
+
+// recordAudit appends an event to the audit log. A failed write is logged but
+// does not undo the action, which has already happened.
+func recordAudit(actor identity, action, strategyName, setupName string, changes map[string]handlers.AuditChange, err error) {
+	event := handlers.AuditEvent{
+		OccurredAt:   time.Now(),
+		Actor:        actor.Name,
+		ActorKind:    actor.Kind,
+		Action:       action,
+		StrategyName: strategyName,
+		SetupName:    setupName,
+		Changes:      changes,
+		Result:       "success",
+	}
+	if event.Actor == "" {
+		event.Actor = "anonymous"
+	}
+	if err != nil {
+		event.Result = "failure"
+		event.Error = err.Error()
+	}
+	log.Printf("[AUDIT] %s %s %s/%s %s changed=[%s] %s", event.Actor, action, strategyName, setupName, event.Result, auditFields(changes), event.Error)
+	if err := handlers.RecordAuditEvent(event); err != nil {
+		log.Printf("[ERROR] Failed to write audit event %s by %s: %v", action, event.Actor, err)
+	}
+}
+
+// auditChange snapshots the target's config and returns a function that
+// records the event with the fields that changed. Register it first so it
+// runs after every other deferred call, with a named error result:
+//
+//	defer auditChange(actor, "setup.start", strategyName, setupName)(&err)
+func auditChange(actor identity, action, strategyName, setupName string) func(*error) {
+	before := configSnapshot(strategyName, setupName)
+	return func(errp *error) {
+		after := configSnapshot(strategyName, setupName)
+		recordAudit(actor, action, strategyName, setupName, diffConfig(before, after), *errp)
+	}
+}
+
+// configSnapshot returns the JSON form of a setup, or of the whole strategy
+// when setupName is empty. Script versions are left out, the new current
+// version is enough to find them. Returns nil when the target does not exist.
+func configSnapshot(strategyName, setupName string) map[string]interface{} {
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	var target interface{} = strat
+	if setupName != "" {
+		target, ok = strat.Setups[setupName]
+	}
+	data, err := json.Marshal(target)
+	strategiesMu.Unlock()
+	if !ok || err != nil {
+		return nil
+	}
+
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil
+	}
+	delete(snapshot, "versions")
+	return snapshot
+}
+
+// diffConfig lists the fields that differ between two snapshots, with nested
+// objects flattened to dotted paths such as setups.A-ZF.enabled
+func diffConfig(before, after map[string]interface{}) map[string]handlers.AuditChange {
+	changes := map[string]handlers.AuditChange{}
+	var walk func(prefix string, before, after map[string]interface{})
+	walk = func(prefix string, before, after map[string]interface{}) {
+		keys := map[string]bool{}
+		for k := range before {
+			keys[k] = true
+		}
+		for k := range after {
+			keys[k] = true
+		}
+		for k := range keys {
+			b, a := before[k], after[k]
+			if reflect.DeepEqual(b, a) {
+				continue
+			}
+			bm, bIsMap := b.(map[string]interface{})
+			am, aIsMap := a.(map[string]interface{})
+			if bIsMap && aIsMap {
+				walk(prefix+k+".", bm, am)
+				continue
+			}
+			changes[prefix+k] = handlers.AuditChange{Before: b, After: a}
+		}
+	}
+	walk("", before, after)
+	return changes
+}
+
+// apiListAuditEvents handles GET /api/v1/audit-events
+func apiListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := handlers.AuditFilter{
+		Actor:        q.Get("actor"),
+		Action:       q.Get("action"),
+		StrategyName: q.Get("strategy"),
+		SetupName:    q.Get("setup"),
+		Result:       q.Get("result"),
+		Limit:        100,
+	}
+
+	var errs ValidationErrors
+	if filter.Result != "" && filter.Result != "success" && filter.Result != "failure" {
+		errs.add("result", "must be success or failure")
+	}
+	for _, field := range []string{"from", "to"} {
+		value := q.Get(field)
+		if value == "" {
+			continue
+		}
+		t, err := parseAuditTime(value)
+		if err != nil {
+			errs.add(field, "must be RFC 3339 or YYYY-MM-DD, got %q", value)
+			continue
+		}
+		if field == "from" {
+			filter.From = t
+		} else if len(value) == len("2006-01-02") {
+			filter.To = t.AddDate(0, 0, 1) // include the whole day
+		} else {
+			filter.To = t
+		}
+	}
+	if value := q.Get("before_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id <= 0 {
+			errs.add("before_id", "must be a positive integer")
+		}
+		filter.BeforeID = id
+	}
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			errs.add("limit", "must be between 1 and 1000")
+		}
+		filter.Limit = limit
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	events, err := handlers.QueryAuditEvents(filter)
+	if err != nil {
+		log.Println("[ERROR] Failed to query audit events:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to query audit events", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// parseAuditTime accepts a timestamp or a date, the latter in the
+// scheduler's local time zone
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", strings.TrimSpace(value), time.Local)
+}
+
+// auditFields lists changed field names, for log lines
+func auditFields(changes map[string]handlers.AuditChange) string {
+	fields := make([]string, 0, len(changes))
+	for field := range changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Authentication & Roles
+// -----------------------------------------------------------------
+
+// Users log in with a bcrypt-hashed password and get a session cookie.
+// Scripts use API tokens sent as "Authorization: Bearer <token>"; only the
+// sha256 of a token is stored. Both live in users.json on the shared volume.
+
+const (
+	roleViewer = "viewer" // read-only dashboard
+	roleTrader = "trader" // start/stop setups, edit setups, close positions
+	roleAdmin  = "admin"  // upload code, delete, manage users
+)
+
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleTrader: 2,
+	roleAdmin:  3,
+}
+
+const sessionCookieName = "pyquant_session"
+
+// User is a local dashboard login
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+}
+
+// APIToken grants a role to scripts and other non-interactive clients
+type APIToken struct {
+	Name      string    `json:"name"`
+	TokenHash string    `json:"token_hash"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type authStore struct {
+	Users  []User     `json:"users"`
+	Tokens []APIToken `json:"tokens"`
+}
+
+// identity is the authenticated caller of a request
+type identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Kind string `json:"kind"` // session, token or system
+}
+
+type session struct {
+	identity
+	Expires time.Time
+}
+
+type identityKey struct{}
+
+var (
+	auth     authStore
+	authMu   sync.Mutex
+	sessions = make(map[string]session)
+	// Sessions are kept in memory, so a restart logs everyone out
+	sessionsMu sync.Mutex
+	sessionTTL = 12 * time.Hour
+	// Compared against for unknown usernames
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-password"), bcrypt.DefaultCost)
+)
+
+// loadAuthStore reads users.json. When it does not exist yet an admin is
+// created from SCHEDULER_ADMIN_USER / SCHEDULER_ADMIN_PASSWORD.
+func loadAuthStore(filePath string) error {
+	if ttl, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && ttl > 0 {
+		sessionTTL = ttl
+	}
+
+	authMu.Lock()
+	defer authMu.Unlock()
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		username, password := os.Getenv("SCHEDULER_ADMIN_USER"), os.Getenv("SCHEDULER_ADMIN_PASSWORD")
+		if username == "" || password == "" {
+			log.Printf("[WARN] %s not found and SCHEDULER_ADMIN_USER/SCHEDULER_ADMIN_PASSWORD not set, nobody can log in", filePath)
+			return nil
+		}
+		user, err := newUser(username, password, roleAdmin)
+		if err != nil {
+			return err
+		}
+		auth = authStore{Users: []User{user}}
+		log.Printf("[INFO] Created admin user %s in %s", username, filePath)
+		return saveAuthStore(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	var store authStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return fmt.Errorf("invalid JSON in %s: %v", filePath, err)
+	}
+	auth = store
+	return nil
+}
+
+// saveAuthStore writes users.json. Callers must hold authMu.
+func saveAuthStore(filePath string) error {
+	data, err := json.MarshalIndent(auth, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0600)
+}
+
+func newUser(username, password, role string) (User, error) {
+	var errs ValidationErrors
+	if !paramNamePattern.MatchString(username) {
+		errs.add("username", "may only contain letters, digits and '_'")
+	}
+	if len(password) < 8 {
+		errs.add("password", "must be at least 8 characters")
+	}
+	if roleRank[role] == 0 {
+		errs.add("role", "must be one of viewer, trader, admin")
+	}
+	if len(errs) > 0 {
+		return User{}, validationFailed(errs)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Username: username, PasswordHash: string(hash), Role: role}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword returns the user's identity when the credentials match
+func checkPassword(username, password string) (identity, bool) {
+	authMu.Lock()
+	var user *User
+	for i := range auth.Users {
+		if auth.Users[i].Username == username {
+			u := auth.Users[i]
+			user = &u
+			break
+		}
+	}
+	authMu.Unlock()
+	if user == nil {
+		// Spend the same time as a real check so usernames can't be probed
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return identity{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return identity{}, false
+	}
+	return identity{Name: user.Username, Role: user.Role, Kind: "session"}, true
+}
+
+// lookupAPIToken returns the identity an API token grants
+func lookupAPIToken(token string) (identity, bool) {
+	hash := hashToken(token)
+	authMu.Lock()
+	defer authMu.Unlock()
+	for _, t := range auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.TokenHash), []byte(hash)) == 1 {
+			return identity{Name: t.Name, Role: t.Role, Kind: "token"}, true
+		}
+	}
+	return identity{}, false
+}
+
+func lookupSession(id string) (identity, bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[id]
+	if !ok {
+		return identity{}, false
+	}
+	if time.Now().After(s.Expires) {
+		delete(sessions, id)
+		return identity{}, false
+	}
+	return s.identity, true
+}
+
+// authenticate identifies the caller from a bearer API token or session cookie
+func authenticate(r *http.Request) (identity, bool) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return lookupAPIToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return lookupSession(cookie.Value)
+	}
+	return identity{}, false
+}
+
+// authorize checks the caller holds at least the given role, answering the
+// request with 401/403 when it does not. On success the identity is attached
+// to the request context.
+func authorize(w http.ResponseWriter, r *http.Request, role string) (*http.Request, bool) {
+	id, ok := authenticate(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Authentication required", nil)
+		return r, false
+	}
+	if roleRank[id.Role] < roleRank[role] {
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Requires the %s role", role), nil)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), true
+}
+
+// requireRole wraps a handler so only callers with at least role reach it
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authorize(w, r, role)
+		if !ok {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// callerIdentity returns the identity attached by authorize
+func callerIdentity(r *http.Request) identity {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id
+}
+
+// strategyActionRole is the role needed for a /strategies/... request
+// routed by handleStrategyActions
+func strategyActionRole(method string, parts []string) string {
+	if method == http.MethodGet {
+		return roleViewer
+	}
+	if method == http.MethodDelete {
+		// As on /api/v1: deleting a strategy is an admin action, a setup a
+		// trader one
+		if len(parts) == 3 {
+			return roleTrader
+		}
+		return roleAdmin
+	}
+	switch parts[len(parts)-1] {
+	case "versions", "rollback":
+		return roleAdmin
+	case "archive", "unarchive":
+		// Archiving a whole strategy is an admin action, a setup a trader one
+		if len(parts) == 3 {
+			return roleAdmin
+		}
+	}
+	return roleTrader
+}
+
+// -----------------------------------------------------------------
+// Login & User Management Handlers
+// -----------------------------------------------------------------
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Failed logins are counted per client address and per username. Once
+// either reaches maxLoginFailures within loginFailureWindow, logins from it
+// are refused until the window has passed. Failures only go to the log:
+// the audit log is permanent and its actor must be a real user.
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+type loginFailures struct {
+	count int
+	since time.Time
+}
+
+var (
+	failedLogins   = make(map[string]*loginFailures) // "addr:" or "user:" key
+	failedLoginsMu sync.Mutex
+)
+
+// loginKeys returns the keys a login attempt is counted under
+func loginKeys(r *http.Request, username string) []string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	return []string{"addr:" + addr, "user:" + logName(username)}
+}
+
+// loginBlocked reports how long logins under any of the keys are refused
+func loginBlocked(keys []string, now time.Time) time.Duration {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		f, ok := failedLogins[key]
+		if !ok || f.count < maxLoginFailures {
+			continue
+		}
+		if left := f.since.Add(loginFailureWindow).Sub(now); left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed login under each key, dropping counts
+// whose window has passed
+func recordLoginFailure(keys []string, now time.Time) {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	for key, f := range failedLogins {
+		if now.Sub(f.since) >= loginFailureWindow {
+			delete(failedLogins, key)
+		}
+	}
+	for _, key := range keys {
+		if f, ok := failedLogins[key]; ok {
+			f.count++
+		} else {
+			failedLogins[key] = &loginFailures{count: 1, since: now}
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures of a user who logged in
+func clearLoginFailures(keys []string) {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	for _, key := range keys {
+		delete(failedLogins, key)
+	}
+}
+
+// logName shortens a client-supplied username for the log
+func logName(username string) string {
+	const maxLen = 64
+	if len(username) > maxLen {
+		return username[:maxLen] + "..."
+	}
+	return username
+}
+
+// apiLogin handles POST /api/v1/auth/login and sets the session cookie
+func apiLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	keys := loginKeys(r, req.Username)
+	if wait := loginBlocked(keys, time.Now()); wait > 0 {
+		log.Printf("[WARN] Refused login for %q from %s: too many failures", logName(req.Username), r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeJSONError(w, http.StatusTooManyRequests, "Too many failed logins, try again later", nil)
+		return
+	}
+	id, ok := checkPassword(req.Username, req.Password)
+	if !ok {
+		recordLoginFailure(keys, time.Now())
+		log.Printf("[WARN] Failed login for %q from %s", logName(req.Username), r.RemoteAddr)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid username or password", nil)
+		return
+	}
+	clearLoginFailures(keys)
+
+	sessionID, err := randomToken()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	expires := time.Now().Add(sessionTTL)
+	sessionsMu.Lock()
+	sessions[sessionID] = session{identity: id, Expires: expires}
+	sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("[INFO] %s logged in", id.Name)
+	recordAudit(id, "auth.login", "", "", nil, nil)
+	writeJSON(w, http.StatusOK, id)
+}
+
+// apiLogout handles POST /api/v1/auth/logout
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		sessionsMu.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiMe handles GET /api/v1/auth/me
+func apiMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, callerIdentity(r))
+}
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type tokenRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	authMu.Lock()
+	users := make([]map[string]string, 0, len(auth.Users))
+	for _, u := range auth.Users {
+		users = append(users, map[string]string{"username": u.Username, "role": u.Role})
+	}
+	tokens := make([]map[string]interface{}, 0, len(auth.Tokens))
+	for _, t := range auth.Tokens {
+		tokens = append(tokens, map[string]interface{}{"name": t.Name, "role": t.Role, "created_at": t.CreatedAt})
+	}
+	authMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users, "tokens": tokens})
+}
+
+// apiSaveUser handles POST /api/v1/users, creating a user or replacing the
+// password and role of an existing one
+func apiSaveUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user, err := newUser(req.Username, req.Password, req.Role)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	authMu.Lock()
+	replaced := false
+	var previousRole interface{}
+	for i := range auth.Users {
+		if auth.Users[i].Username == user.Username {
+			previousRole = auth.Users[i].Role
+			auth.Users[i] = user
+			replaced = true
+		}
+	}
+	if !replaced {
+		auth.Users = append(auth.Users, user)
+	}
+	err = saveAuthStore(GetSharedFilePath("users.json"))
+	authMu.Unlock()
+	changes := map[string]handlers.AuditChange{"users." + user.Username + ".role": {Before: previousRole, After: user.Role}}
+	if replaced {
+		// Never log the hashes themselves
+		changes["users."+user.Username+".password"] = handlers.AuditChange{Before: "[redacted]", After: "[redacted]"}
+	}
+	recordAudit(callerIdentity(r), "user.save", "", "", changes, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if replaced {
+		endSessions(user.Username)
+	}
+	log.Printf("[INFO] %s saved user %s (%s)", callerIdentity(r).Name, user.Username, user.Role)
+	writeJSON(w, http.StatusOK, map[string]string{"username": user.Username, "role": user.Role})
+}
+
+func apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if username == callerIdentity(r).Name {
+		writeJSONError(w, http.StatusConflict, "You cannot delete your own user", nil)
+		return
+	}
+	authMu.Lock()
+	kept := auth.Users[:0:0]
+	var removedRole interface{}
+	for _, u := range auth.Users {
+		if u.Username != username {
+			kept = append(kept, u)
+		} else {
+			removedRole = u.Role
+		}
+	}
+	found := len(kept) != len(auth.Users)
+	auth.Users = kept
+	var err error
+	if found {
+		err = saveAuthStore(GetSharedFilePath("users.json"))
+	}
+	authMu.Unlock()
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	recordAudit(callerIdentity(r), "user.delete", "", "", map[string]handlers.AuditChange{
+		"users." + username + ".role": {Before: removedRole, After: nil},
+	}, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	endSessions(username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiCreateToken handles POST /api/v1/tokens. The token is only ever shown
+// in this response.
+func apiCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var errs ValidationErrors
+	if !setupNamePattern.MatchString(req.Name) {
+		errs.add("name", "may only contain letters, digits, '_' and '-'")
+	}
+	if roleRank[req.Role] == 0 {
+		errs.add("role", "must be one of viewer, trader, admin")
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	token, err := randomToken()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	authMu.Lock()
+	for _, t := range auth.Tokens {
+		if t.Name == req.Name {
+			authMu.Unlock()
+			writeJSONError(w, http.StatusConflict, "Token name already exists", nil)
+			return
+		}
+	}
+	auth.Tokens = append(auth.Tokens, APIToken{Name: req.Name, TokenHash: hashToken(token), Role: req.Role, CreatedAt: time.Now()})
+	err = saveAuthStore(GetSharedFilePath("users.json"))
+	authMu.Unlock()
+	recordAudit(callerIdentity(r), "token.create", "", "", map[string]handlers.AuditChange{
+		"tokens." + req.Name + ".role": {Before: nil, After: req.Role},
+	}, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("[INFO] %s created API token %s (%s)", callerIdentity(r).Name, req.Name, req.Role)
+	writeJSON(w, http.StatusCreated, map[string]string{"name": req.Name, "role": req.Role, "token": token})
+}
+
+func apiDeleteToken(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	authMu.Lock()
+	kept := auth.Tokens[:0:0]
+	var removedRole interface{}
+	for _, t := range auth.Tokens {
+		if t.Name != name {
+			kept = append(kept, t)
+		} else {
+			removedRole = t.Role
+		}
+	}
+	found := len(kept) != len(auth.Tokens)
+	auth.Tokens = kept
+	var err error
+	if found {
+		err = saveAuthStore(GetSharedFilePath("users.json"))
+	}
+	authMu.Unlock()
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Token not found", nil)
+		return
+	}
+	recordAudit(callerIdentity(r), "token.delete", "", "", map[string]handlers.AuditChange{
+		"tokens." + name + ".role": {Before: removedRole, After: nil},
+	}, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endSessions logs a user out everywhere, e.g. after a role change
+func endSessions(username string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for id, s := range sessions {
+		if s.Name == username {
+			delete(sessions, id)
+		}
+	}
+}
+
+// -----------------------------------------------------------------
+// CORS
+// -----------------------------------------------------------------
+
+// corsHandler applies one CORS policy to every route. Allowed origins come
+// from CORS_ALLOWED_ORIGINS (comma separated) and default to the React dev
+// server. Credentials are allowed so the session cookie reaches the API.
+func corsHandler(next http.Handler) http.Handler {
+	origins := map[string]bool{}
+	allowed := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if allowed == "" {
+		allowed = "http://localhost:3000"
+	}
+	for _, origin := range strings.Split(allowed, ",") {
+		origins[strings.TrimSpace(origin)] = true
+	}
+	list := make([]string, 0, len(origins))
+	for origin := range origins {
+		list = append(list, origin)
+	}
+	sort.Strings(list)
+	log.Printf("[INFO] CORS allowed origins: %s", strings.Join(list, ", "))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
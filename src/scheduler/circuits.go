@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// broker_api Circuit Breakers
+// -----------------------------------------------------------------
+
+// apiBrokerCircuits handles GET /api/v1/broker-circuits. Returns the circuit
+// breaker of each broker the scheduler and the backend have called.
+func apiBrokerCircuits(w http.ResponseWriter, r *http.Request) {
+	circuits, err := handlers.BrokerCircuits()
+	if err != nil {
+		log.Println("[ERROR] Failed to read broker circuits:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read broker circuits", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, circuits)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// -----------------------------------------------------------------
+// Strategy Config Hot Reload
+// -----------------------------------------------------------------
+
+// lastConfigHash is the sha256 of the strategy config as last read or written
+// by the scheduler. It lets the watcher tell operator edits apart from our own
+// saves. Guarded by strategiesMu.
+var lastConfigHash string
+
+// setupChange describes what has to happen to one setup after a reload.
+type setupChange struct {
+	StrategyName string
+	SetupName    string
+	Action       string // start, stop, restart, or "" when only the config changed
+}
+
+func (c setupChange) key() string {
+	return c.StrategyName + "|" + c.SetupName
+}
+
+func configHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// watchStrategyConfig polls the strategy config file and merges changes made
+// on disk (e.g. by an operator editing the shared volume) into memory.
+func watchStrategyConfig(filePath string, checkInterval time.Duration) {
+	go func() {
+		var lastMod time.Time
+		if info, err := os.Stat(filePath); err == nil {
+			lastMod = info.ModTime()
+		}
+
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			info, err := os.Stat(filePath)
+			if err != nil {
+				log.Printf("[WARN] Unable to stat strategy config: %v", err)
+				continue
+			}
+			if info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+
+			if err := reloadStrategyConfig(filePath); err != nil {
+				log.Printf("[WARN] Ignoring strategy config change: %v", err)
+			}
+		}
+	}()
+}
+
+// reloadStrategyConfig reads the config file, validates it and swaps it in
+// for the in-memory store, then starts/stops/restarts the affected setups.
+func reloadStrategyConfig(filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	sum := configHash(data)
+
+	strategiesMu.Lock()
+	if sum == lastConfigHash {
+		// Our own save, nothing to merge
+		strategiesMu.Unlock()
+		return nil
+	}
+	incoming, err := parseStrategyConfig(data)
+	if err != nil {
+		strategiesMu.Unlock()
+		return fmt.Errorf("invalid JSON in %s: %v", filePath, err)
+	}
+	if err := validateStrategyConfig(incoming); err != nil {
+		strategiesMu.Unlock()
+		return err
+	}
+	changes := diffStrategyConfig(strategies, incoming)
+	strategies = incoming
+	lastConfigHash = sum
+	strategiesMu.Unlock()
+
+	log.Printf("[INFO] Reloaded strategy config from %s (%d setups changed)", filePath, len(changes))
+	applySetupChanges(changes)
+	return nil
+}
+
+// validateStrategyConfig rejects configs that do not match the schema.
+func validateStrategyConfig(config map[string]Strategy) error {
+	var errs ValidationErrors
+	for strategyName, strat := range config {
+		for _, fe := range validateStrategy(strategyName, strat) {
+			errs.add(strategyName+"."+fe.Field, "%s", fe.Message)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// diffStrategyConfig compares the current and incoming configs and returns
+// every setup whose state or parameters changed. A change to a strategy's
+// parameter schema changes the params of all its setups, through defaults
+// and validation, so they restart with it.
+func diffStrategyConfig(current, incoming map[string]Strategy) []setupChange {
+	var changes []setupChange
+
+	for strategyName, strat := range current {
+		for setupName, setup := range strat.Setups {
+			newStrat, ok := incoming[strategyName]
+			newSetup, found := newStrat.Setups[setupName]
+			change := setupChange{StrategyName: strategyName, SetupName: setupName}
+
+			switch {
+			case !ok || !found:
+				if setup.Enabled {
+					change.Action = "stop"
+				}
+				changes = append(changes, change)
+			case setup.Enabled && !newSetup.Enabled:
+				change.Action = "stop"
+				changes = append(changes, change)
+			case !setup.Enabled && newSetup.Enabled:
+				change.Action = "start"
+				changes = append(changes, change)
+			case scriptChanged(strat, setup, newStrat, newSetup) || !reflect.DeepEqual(setup, newSetup) ||
+				!reflect.DeepEqual(strat.ParamSchema, newStrat.ParamSchema):
+				if newSetup.Enabled {
+					change.Action = "restart"
+				}
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	// Setups that only exist in the incoming config
+	for strategyName, strat := range incoming {
+		for setupName, setup := range strat.Setups {
+			if _, ok := current[strategyName].Setups[setupName]; ok {
+				continue
+			}
+			change := setupChange{StrategyName: strategyName, SetupName: setupName}
+			if setup.Enabled {
+				change.Action = "start"
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].key() < changes[j].key() })
+	return changes
+}
+
+// scriptChanged reports whether a setup would run a different script
+func scriptChanged(strat Strategy, setup Setup, newStrat Strategy, newSetup Setup) bool {
+	oldPath, _, _ := resolveScript(strat, setup)
+	newPath, _, _ := resolveScript(newStrat, newSetup)
+	return oldPath != newPath
+}
+
+// applySetupChanges brings running processes in line with a reloaded config
+// and tells the frontend to refresh.
+func applySetupChanges(changes []setupChange) {
+	for _, change := range changes {
+		switch change.Action {
+		case "stop":
+			stopScript(change.StrategyName, change.SetupName)
+		case "restart":
+			if err := restartScript(change.StrategyName, change.SetupName); err != nil {
+				log.Printf("[ERROR] Unable to start %s after reload: %v", change.key(), err)
+				disableSetup(change.StrategyName, change.SetupName)
+			}
+		case "start":
+			if err := startScript(change.StrategyName, change.SetupName); err != nil {
+				log.Printf("[ERROR] Unable to start %s after reload: %v", change.key(), err)
+				disableSetup(change.StrategyName, change.SetupName)
+			}
+		}
+		log.Printf("[INFO] Config change applied: %s %s", change.key(), change.Action)
+		notifyStrategyConfigChanged(change.key())
+	}
+}
+
+// disableSetup marks a setup as not running and persists the config.
+func disableSetup(strategyName, setupName string) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	strat, ok := strategies[strategyName]
+	if !ok {
+		return
+	}
+	setup, ok := strat.Setups[setupName]
+	if !ok {
+		return
+	}
+	setup.Enabled = false
+	strat.Setups[setupName] = setup
+	strategies[strategyName] = strat
+
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	if err := saveStrategies(shared_strategy_config); err != nil {
+		log.Println("Failed to save config: ", err.Error())
+	}
+}
+
+// notifyStrategyConfigChanged tells the frontend to refetch strategies without
+// blocking when no client is listening.
+func notifyStrategyConfigChanged(key string) {
+	select {
+	case refreshStrategyConfigChan <- key:
+	default:
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Contract Master
+// -----------------------------------------------------------------
+
+var expiryPattern = regexp.MustCompile(`^[0-9]{6}([0-9]{2})?$`)
+
+// contractRequest is the body of POST and PUT /api/v1/contracts
+type contractRequest struct {
+	ConID        int     `json:"con_id"`
+	Symbol       string  `json:"symbol"`
+	ContractType string  `json:"contract_type"`
+	Exchange     string  `json:"exchange"`
+	Currency     string  `json:"currency"`
+	Expiry       string  `json:"expiry"`
+	Multiplier   float64 `json:"multiplier"`
+	TickSize     float64 `json:"tick_size"`
+	TradingHours string  `json:"trading_hours"`
+	LiquidHours  string  `json:"liquid_hours"`
+	TimeZone     string  `json:"time_zone"`
+	Description  string  `json:"description"`
+	Commission   float64 `json:"commission"`
+	ExchangeFee  float64 `json:"exchange_fee"`
+}
+
+// toContract validates the request and fills in the defaults: a future in
+// USD. A multiplier of 0 is stored as unknown, so lookups fall back to the
+// other expiries of the symbol and the defaults rather than to 1.
+func (req contractRequest) toContract() (handlers.Contract, ValidationErrors) {
+	c := handlers.Contract{
+		ConID:        req.ConID,
+		Symbol:       strings.ToUpper(strings.TrimSpace(req.Symbol)),
+		ContractType: strings.ToUpper(strings.TrimSpace(req.ContractType)),
+		Exchange:     strings.ToUpper(strings.TrimSpace(req.Exchange)),
+		Currency:     strings.ToUpper(strings.TrimSpace(req.Currency)),
+		Expiry:       strings.TrimSpace(req.Expiry),
+		Multiplier:   req.Multiplier,
+		TickSize:     req.TickSize,
+		TradingHours: req.TradingHours,
+		LiquidHours:  req.LiquidHours,
+		TimeZone:     strings.TrimSpace(req.TimeZone),
+		Description:  strings.TrimSpace(req.Description),
+		Commission:   req.Commission,
+		ExchangeFee:  req.ExchangeFee,
+	}
+	if c.ContractType == "" {
+		c.ContractType = "FUT"
+	}
+	if c.Currency == "" {
+		c.Currency = "USD"
+	}
+
+	var errs ValidationErrors
+	if c.Symbol == "" {
+		errs.add("symbol", "is required")
+	}
+	if c.ContractType != "FUT" && c.ContractType != "STK" && c.ContractType != "ETF" {
+		errs.add("contract_type", "must be FUT, STK or ETF")
+	}
+	if c.ConID < 0 {
+		errs.add("con_id", "must not be negative")
+	}
+	if c.Expiry != "" && !expiryPattern.MatchString(c.Expiry) {
+		errs.add("expiry", "must be YYYYMM or YYYYMMDD, got %q", c.Expiry)
+	}
+	if c.Multiplier < 0 {
+		errs.add("multiplier", "must not be negative")
+	}
+	if c.TickSize < 0 {
+		errs.add("tick_size", "must not be negative")
+	}
+	if c.Commission < 0 {
+		errs.add("commission", "must not be negative")
+	}
+	if c.ExchangeFee < 0 {
+		errs.add("exchange_fee", "must not be negative")
+	}
+	return c, errs
+}
+
+// apiListContracts handles GET /api/v1/contracts. q searches the symbol and
+// description, or the conId when it is a number; symbol, type and exchange
+// filter exactly.
+func apiListContracts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := handlers.ContractQuery{
+		Search:       strings.TrimSpace(q.Get("q")),
+		Symbol:       strings.ToUpper(q.Get("symbol")),
+		ContractType: strings.ToUpper(q.Get("type")),
+		Exchange:     strings.ToUpper(q.Get("exchange")),
+	}
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			writeValidationError(w, ValidationErrors{{Field: "limit", Message: "must be between 1 and 1000"}})
+			return
+		}
+		query.Limit = limit
+	}
+	contracts, err := handlers.ListContracts(query)
+	if err != nil {
+		log.Println("[ERROR] Failed to list contracts:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list contracts", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, contracts)
+}
+
+func apiGetContract(w http.ResponseWriter, r *http.Request) {
+	c, err := lookupContract(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func apiCreateContract(w http.ResponseWriter, r *http.Request) {
+	var req contractRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	c, errs := req.toContract()
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	stored, err := handlers.CreateContract(c)
+	recordAudit(callerIdentity(r), "contract.create", "", "", diffConfig(nil, contractSnapshot(&stored)), err)
+	if err != nil {
+		writeContractError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+func apiUpdateContract(w http.ResponseWriter, r *http.Request) {
+	var req contractRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	before, err := lookupContract(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	c, errs := req.toContract()
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	c.ID = before.ID
+	stored, ok, err := handlers.UpdateContract(c)
+	if err == nil && !ok {
+		err = newAPIError(http.StatusNotFound, "Contract not found", nil)
+	}
+	recordAudit(callerIdentity(r), "contract.update", "", "", diffConfig(contractSnapshot(&before), contractSnapshot(&stored)), err)
+	if err != nil {
+		writeContractError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stored)
+}
+
+func apiDeleteContract(w http.ResponseWriter, r *http.Request) {
+	before, err := lookupContract(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ok, err := handlers.DeleteContract(before.ID)
+	if err == nil && !ok {
+		err = newAPIError(http.StatusNotFound, "Contract not found", nil)
+	}
+	recordAudit(callerIdentity(r), "contract.delete", "", "", diffConfig(contractSnapshot(&before), nil), err)
+	if err != nil {
+		writeContractError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSyncContracts handles POST /api/v1/contract-sync, running the sync job
+// now instead of waiting for its next run
+func apiSyncContracts(w http.ResponseWriter, r *http.Request) {
+	synced, err := handlers.SyncContracts(setupContractIDs())
+	recordAudit(callerIdentity(r), "contract.sync", "", "", nil, err)
+	if err != nil {
+		log.Println("[ERROR] Contract sync failed:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Contract sync failed", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"synced": synced})
+}
+
+func lookupContract(idValue string) (handlers.Contract, error) {
+	id, err := strconv.ParseInt(idValue, 10, 64)
+	if err != nil || id <= 0 {
+		return handlers.Contract{}, newAPIError(http.StatusNotFound, "Contract not found", nil)
+	}
+	c, ok, err := handlers.GetContract(id)
+	if err != nil {
+		return c, err
+	}
+	if !ok {
+		return c, newAPIError(http.StatusNotFound, "Contract not found", nil)
+	}
+	return c, nil
+}
+
+func writeContractError(w http.ResponseWriter, err error) {
+	if errors.Is(err, handlers.ErrDuplicateContract) {
+		writeJSONError(w, http.StatusConflict, "A contract with this conId, or symbol, type, exchange and expiry, already exists", nil)
+		return
+	}
+	var ae *apiError
+	if !errors.As(err, &ae) {
+		log.Println("[ERROR] Contract change failed:", err)
+	}
+	writeError(w, err)
+}
+
+// contractSnapshot returns the editable fields of a contract for the audit
+// log, nil for none
+func contractSnapshot(c *handlers.Contract) map[string]interface{} {
+	if c == nil || c.ID == 0 {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil
+	}
+	delete(snapshot, "synced_at")
+	delete(snapshot, "updated_at")
+	return snapshot
+}
+
+// setupContractIDs lists the conIds the setups trade, so the sync job adds
+// them to the contract master
+func setupContractIDs() []int {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	var conIDs []int
+	for _, strat := range strategies {
+		for _, setup := range strat.Setups {
+			if setup.ContractId > 0 {
+				conIDs = append(conIDs, setup.ContractId)
+			}
+		}
+	}
+	return conIDs
+}
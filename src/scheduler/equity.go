@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Equity Curve
+// -----------------------------------------------------------------
+
+// apiEquityCurve handles GET /api/v1/equity. resolution=intraday (default)
+// returns every account snapshot from the from date (today) to the to date,
+// resolution=daily the last snapshot of each day over the last 90 days unless
+// from/to are given. Dates are inclusive and in the scheduler's time zone.
+// previous_close is the last snapshot before from, null if there is none.
+func apiEquityCurve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	resolution := q.Get("resolution")
+	if resolution == "" {
+		resolution = "intraday"
+	}
+
+	var errs ValidationErrors
+	if resolution != "intraday" && resolution != "daily" {
+		errs.add("resolution", "must be intraday or daily")
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	from, to := today, today
+	if resolution == "daily" {
+		from = today.AddDate(0, 0, -90)
+	}
+	for _, date := range []struct {
+		field string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := q.Get(date.field)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			errs.add(date.field, "must be a date like 2006-01-02, got %q", value)
+			continue
+		}
+		*date.value = parsed
+	}
+	if to.Before(from) {
+		errs.add("to", "must not be before from")
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	tz := os.Getenv("TZ")
+	if tz == "" {
+		tz = "UTC"
+	}
+	points, err := handlers.EquityCurve(from, to.AddDate(0, 0, 1), resolution == "daily", tz)
+	if err != nil {
+		log.Println("[ERROR] Failed to query equity curve:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to query equity curve", nil)
+		return
+	}
+	var previousClose *handlers.AccountSnapshot
+	snapshot, ok, err := handlers.PreviousClose(from)
+	if err != nil {
+		log.Println("[ERROR] Failed to query previous close:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to query equity curve", nil)
+		return
+	}
+	if ok {
+		previousClose = &snapshot
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"resolution":     resolution,
+		"from":           from.Format("2006-01-02"),
+		"to":             to.Format("2006-01-02"),
+		"previous_close": previousClose,
+		"points":         points,
+	})
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// End-of-Day Flatten
+// -----------------------------------------------------------------
+
+// Setups with a flatten time are disabled and each position the trades
+// ledger holds for them closed with a market order through the backend each
+// trading day. The process is stopped
+// before the closing order goes out so the strategy cannot trade against it,
+// and the setup stays disabled until someone enables it again.
+// Every flatten is recorded in the audit log as setup.flatten with the
+// position in each symbol before and after, failing when a position is still
+// open flattenTimeout after the orders were sent.
+
+// schedulerIdentity is the actor of the changes the scheduler makes by itself
+var schedulerIdentity = identity{Name: "scheduler", Role: roleAdmin, Kind: "system"}
+
+// flattenTimeout is how long a closing order has to fill
+const flattenTimeout = 2 * time.Minute
+
+// scheduledRun is a setup whose flatten time is due
+type scheduledRun struct {
+	setupTarget
+	Exchange string
+}
+
+// runFlattens flattens setups at their flatten time
+func runFlattens() {
+	go func() {
+		for {
+			next := time.Now().Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(time.Until(next))
+			for _, run := range dueFlattens(next) {
+				go flattenSetup(run)
+			}
+		}
+	}()
+}
+
+// dueFlattens lists the setups to flatten at a minute
+func dueFlattens(at time.Time) []scheduledRun {
+	type candidate struct {
+		scheduledRun
+		flattenAt   string
+		beforeClose int
+	}
+	var candidates []candidate
+	strategiesMu.Lock()
+	for strategyName, strat := range strategies {
+		if strat.Archived {
+			continue
+		}
+		for setupName, setup := range strat.Setups {
+			if setup.Archived || (setup.FlattenAt == "" && setup.FlattenBeforeClose == 0) {
+				continue
+			}
+			exchange, _, _ := strings.Cut(setup.Market, ":")
+			candidates = append(candidates, candidate{
+				scheduledRun{setupTarget{strategyName, setupName}, exchange},
+				setup.FlattenAt, setup.FlattenBeforeClose,
+			})
+		}
+	}
+	strategiesMu.Unlock()
+
+	var due []scheduledRun
+	for _, c := range candidates {
+		var isDue bool
+		var err error
+		if c.flattenAt != "" {
+			isDue, err = flattenAtDue(c.Exchange, c.flattenAt, at)
+		} else {
+			isDue, err = flattenBeforeCloseDue(c.Exchange, c.beforeClose, at)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to check the flatten time of %s %s: %v", c.StrategyName, c.SetupName, err)
+			continue
+		}
+		if isDue {
+			due = append(due, c.scheduledRun)
+		}
+	}
+	return due
+}
+
+// flattenAtDue reports whether a flatten time falls on a minute of a day the
+// exchange trades
+func flattenAtDue(exchange, flattenAt string, at time.Time) (bool, error) {
+	if at.Format("15:04") != flattenAt || at.Weekday() == time.Saturday || at.Weekday() == time.Sunday {
+		return false, nil
+	}
+	_, closed, err := handlers.ExchangeHoliday(exchange, at)
+	return !closed, err
+}
+
+// flattenBeforeCloseDue reports whether a minute is the given number of
+// minutes before the close of the exchange's current session
+func flattenBeforeCloseDue(exchange string, minutes int, at time.Time) (bool, error) {
+	closes, ok, err := handlers.NextSessionClose(exchange, at)
+	if err != nil || !ok {
+		return false, err
+	}
+	return closes.Add(-time.Duration(minutes) * time.Minute).Truncate(time.Minute).Equal(at), nil
+}
+
+// flattenSetup disables a setup, closes its position and records whether the
+// position was flat in the end
+func flattenSetup(run scheduledRun) {
+	log.Printf("[INFO] Flattening %s %s", run.StrategyName, run.SetupName)
+	// Disabled, not just stopped, so nothing starts it again before someone
+	// enables it
+	if _, err := setSetupEnabled(schedulerIdentity, run.StrategyName, run.SetupName, false); err != nil {
+		log.Printf("[ERROR] Failed to disable %s %s before flattening: %v", run.StrategyName, run.SetupName, err)
+	}
+	notifyStrategyConfigChanged(run.key())
+
+	// The ledger, not positions.json, which may be stale when the backend
+	// has not written it lately
+	before, brokers, err := setupPositions(run.StrategyName, run.SetupName)
+	after := before
+	if err == nil && len(before) > 0 {
+		if err = closePositions(run.StrategyName, run.SetupName, before, brokers); err == nil {
+			after, err = waitFlat(run.StrategyName, run.SetupName, flattenTimeout)
+		}
+	}
+	changes := make(map[string]handlers.AuditChange)
+	for symbol, quantity := range symbolQuantities(before) {
+		changes["position."+symbol] = handlers.AuditChange{Before: quantity, After: 0.0}
+	}
+	for symbol, quantity := range symbolQuantities(after) {
+		change := changes["position."+symbol]
+		change.After = quantity
+		changes["position."+symbol] = change
+	}
+	recordAudit(schedulerIdentity, "setup.flatten", run.StrategyName, run.SetupName, changes, err)
+	if err != nil {
+		log.Printf("[ERROR] Failed to flatten %s %s, positions %v: %v", run.StrategyName, run.SetupName, symbolQuantities(after), err)
+	}
+}
+
+// setupPositions returns the open positions of a setup in the trades ledger
+// and the broker each contract is traded through
+func setupPositions(strategyName, setupName string) ([]handlers.PositionPnL, map[int]string, error) {
+	positions, brokers, err := handlers.OpenPositions([]string{strategyName})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read positions: %v", err)
+	}
+	kept := positions[:0]
+	for _, position := range positions {
+		if position.SetupName == setupName {
+			kept = append(kept, position)
+		}
+	}
+	return kept, brokers, nil
+}
+
+// closePositions sends a closing order for each position, one symbol at a
+// time since the backend drops a second order pending in the same symbol
+func closePositions(strategyName, setupName string, positions []handlers.PositionPnL, brokers map[int]string) error {
+	sent := make(map[string]bool)
+	for _, position := range positions {
+		if sent[position.Symbol] {
+			if err := waitOrdersInFlight(strategyName, position.Symbol, flattenTimeout); err != nil {
+				return err
+			}
+		}
+		broker := brokers[position.ContractID]
+		if broker == "" {
+			broker = "IB"
+		}
+		sent[position.Symbol] = true
+		if _, err := sendClosingOrder(strategyName, setupName, broker, position.ContractID, position.Exchange, position.Symbol, position.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symbolQuantities sums positions by symbol
+func symbolQuantities(positions []handlers.PositionPnL) map[string]float64 {
+	quantities := make(map[string]float64)
+	for _, position := range positions {
+		quantities[position.Symbol] += position.Quantity
+	}
+	return quantities
+}
+
+// waitFlat polls the positions of a setup until none is open or the timeout
+// passes, returning those still open
+func waitFlat(strategyName, setupName string, timeout time.Duration) ([]handlers.PositionPnL, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		positions, _, err := setupPositions(strategyName, setupName)
+		if err == nil && len(positions) == 0 {
+			return nil, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return positions, err
+			}
+			return positions, fmt.Errorf("positions %v still open after %s", symbolQuantities(positions), timeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// -----------------------------------------------------------------
+// Bulk Flatten
+// -----------------------------------------------------------------
+
+// A strategy, every strategy of a group or the whole account is flattened
+// from the positions in the trades ledger, not the positions stream, so
+// nothing open is missed while the stream is down. The setups are disabled
+// and their working orders cancelled first; the closing orders only go out once
+// the backend has seen the cancellations, so they cannot race an order still
+// working at the broker. Positions whose orders did not cancel in time are
+// skipped and reported.
+//
+// The backend holds one order at a time per strategy and symbol and drops
+// any sent while one is pending, so when several setups of a strategy hold
+// the same symbol their closing orders go out one after the other, each once
+// the one before is done. A position whose turn does not come within
+// flattenTimeout is skipped.
+
+// cancelTimeout is how long cancelled orders have to leave the working state
+const cancelTimeout = 20 * time.Second
+
+// flattenReport is the outcome of a bulk flatten
+type flattenReport struct {
+	Scope           string                  `json:"scope"` // strategy, group or account
+	Name            string                  `json:"name,omitempty"`
+	CancelledOrders []handlers.CancelResult `json:"cancelled_orders"`
+	Positions       []flattenResult         `json:"positions"`
+}
+
+// flattenResult is the outcome of closing one position
+type flattenResult struct {
+	Strategy    string  `json:"strategy"`
+	Setup       string  `json:"setup"`
+	Symbol      string  `json:"symbol"`
+	Exchange    string  `json:"exchange"`
+	ContractID  int     `json:"contract_id"`
+	Quantity    float64 `json:"quantity"` // negative when short
+	Side        string  `json:"side"`     // of the closing order
+	Status      string  `json:"status"`   // sent, failed or skipped
+	OrderStatus string  `json:"order_status,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// flattenPositions disables the setups in scope, cancels their working orders
+// and sends a market order closing each of their open positions
+func flattenPositions(actor identity, scope, name string) (report flattenReport, err error) {
+	report = flattenReport{Scope: scope, Name: name, CancelledOrders: []handlers.CancelResult{}, Positions: []flattenResult{}}
+	strategyNames, setups, err := flattenTargets(scope, name)
+	if err != nil {
+		return report, err
+	}
+	defer func() { auditBulkFlatten(actor, report, err) }()
+
+	// 1) Disable the setups so they cannot trade against the exits, and
+	// nothing starts them again before someone enables them
+	for _, target := range setups {
+		strategiesMu.Lock()
+		enabled := strategies[target.StrategyName].Setups[target.SetupName].Enabled
+		strategiesMu.Unlock()
+		if !enabled && !isRunning(target.StrategyName, target.SetupName) {
+			continue
+		}
+		if _, err := setSetupEnabled(actor, target.StrategyName, target.SetupName, false); err != nil {
+			log.Printf("[ERROR] Failed to disable %s %s before flattening: %v", target.StrategyName, target.SetupName, err)
+		}
+		notifyStrategyConfigChanged(target.key())
+	}
+
+	// 2) Cancel the working orders and wait for the backend to see it
+	orders, err := handlers.WorkingOrders(strategyNames)
+	if err != nil {
+		return report, newAPIError(http.StatusInternalServerError, "Unable to read working orders: "+err.Error(), nil)
+	}
+	report.CancelledOrders = append(report.CancelledOrders, cancelWorkingOrders(orders, scope == "account")...)
+	working := waitOrdersDone(strategyNames, orders, cancelTimeout)
+
+	// 3) Close what is left open
+	positions, brokers, err := handlers.OpenPositions(strategyNames)
+	if err != nil {
+		return report, newAPIError(http.StatusInternalServerError, "Unable to read positions: "+err.Error(), nil)
+	}
+	sent := make(map[string]bool) // strategy|symbol
+	for _, position := range positions {
+		result := flattenResult{
+			Strategy:   position.StrategyName,
+			Setup:      position.SetupName,
+			Symbol:     position.Symbol,
+			Exchange:   position.Exchange,
+			ContractID: position.ContractID,
+			Quantity:   position.Quantity,
+			Side:       "SELL",
+			Status:     "sent",
+		}
+		if position.Quantity < 0 {
+			result.Side = "BUY"
+		}
+		if order, ok := working[position.StrategyName+"|"+position.SetupName]; ok {
+			result.Status = "skipped"
+			result.Error = fmt.Sprintf("order %d is still working", order.BrokerOrderID)
+			report.Positions = append(report.Positions, result)
+			continue
+		}
+		key := position.StrategyName + "|" + position.Symbol
+		if sent[key] {
+			if err := waitOrdersInFlight(position.StrategyName, position.Symbol, flattenTimeout); err != nil {
+				result.Status = "skipped"
+				result.Error = err.Error()
+				report.Positions = append(report.Positions, result)
+				continue
+			}
+		}
+		broker := brokers[position.ContractID]
+		if broker == "" {
+			broker = "IB"
+		}
+		sent[key] = true
+		result.OrderStatus, err = sendClosingOrder(position.StrategyName, position.SetupName, broker,
+			position.ContractID, position.Exchange, position.Symbol, position.Quantity)
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			err = nil
+		}
+		report.Positions = append(report.Positions, result)
+	}
+	return report, nil
+}
+
+// flattenTargets resolves a scope to the strategies whose positions it
+// covers, nil meaning every strategy, and the setups to disable
+func flattenTargets(scope, name string) ([]string, []setupTarget, error) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	var strategyNames []string
+	switch scope {
+	case "strategy":
+		if _, ok := strategies[name]; !ok {
+			return nil, nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+		}
+		strategyNames = []string{name}
+	case "group":
+		for strategyName, strat := range strategies {
+			if strat.Group == name {
+				strategyNames = append(strategyNames, strategyName)
+			}
+		}
+		if len(strategyNames) == 0 {
+			return nil, nil, newAPIError(http.StatusNotFound, "Strategy group not found", nil)
+		}
+		sort.Strings(strategyNames)
+	}
+
+	inScope := make(map[string]bool, len(strategyNames))
+	for _, strategyName := range strategyNames {
+		inScope[strategyName] = true
+	}
+	var setups []setupTarget
+	for strategyName, strat := range strategies {
+		if strategyNames != nil && !inScope[strategyName] {
+			continue
+		}
+		for setupName := range strat.Setups {
+			setups = append(setups, setupTarget{strategyName, setupName})
+		}
+	}
+	return strategyNames, setups, nil
+}
+
+// cancelWorkingOrders asks each broker to cancel the working orders sent
+// through it. For the whole account broker_api sends IB a global cancel, which
+// also cancels the orders placed outside the backend.
+func cancelWorkingOrders(orders []handlers.WorkingOrder, all bool) []handlers.CancelResult {
+	byBroker := make(map[string][]int)
+	if all {
+		byBroker["IB"] = nil
+	}
+	for _, order := range orders {
+		byBroker[order.Broker] = append(byBroker[order.Broker], order.BrokerOrderID)
+	}
+
+	var results []handlers.CancelResult
+	for broker, orderIDs := range byBroker {
+		cancelled, err := handlers.CancelOrders(broker, orderIDs, all)
+		if err != nil {
+			log.Printf("[ERROR] Failed to cancel orders at %s: %v", broker, err)
+			for _, orderID := range orderIDs {
+				results = append(results, handlers.CancelResult{OrderID: orderID, Status: "Failed", Error: err.Error()})
+			}
+			continue
+		}
+		results = append(results, cancelled...)
+	}
+	return results
+}
+
+// waitOrdersDone polls the working orders until none of the given ones is
+// left or the timeout passes, returning those still working by setup key
+func waitOrdersDone(strategyNames []string, orders []handlers.WorkingOrder, timeout time.Duration) map[string]handlers.WorkingOrder {
+	pending := make(map[int64]bool, len(orders))
+	for _, order := range orders {
+		pending[order.ID] = true
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		working := make(map[string]handlers.WorkingOrder)
+		current, err := handlers.WorkingOrders(strategyNames)
+		if err != nil {
+			log.Printf("[ERROR] Failed to read working orders: %v", err)
+			current = orders
+		}
+		for _, order := range current {
+			if pending[order.ID] {
+				working[order.StrategyName+"|"+order.SetupName] = order
+			}
+		}
+		if len(working) == 0 || time.Now().After(deadline) {
+			return working
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// waitOrdersInFlight polls until the backend is done with every order of a
+// strategy in a symbol, failing when the timeout passes first
+func waitOrdersInFlight(strategyName, symbol string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		// The backend records a fill before it clears the pending order, so
+		// always leave it a moment
+		time.Sleep(time.Second)
+		count, err := handlers.OrdersInFlight(strategyName, symbol)
+		if err == nil && count == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("unable to read orders in flight: %v", err)
+			}
+			return fmt.Errorf("the previous %s order of %s is still in flight", symbol, strategyName)
+		}
+	}
+}
+
+// auditBulkFlatten records a bulk flatten, failing when any position could
+// not be closed
+func auditBulkFlatten(actor identity, report flattenReport, err error) {
+	sent, notSent := 0, 0
+	for _, result := range report.Positions {
+		if result.Status == "sent" {
+			sent++
+		} else {
+			notSent++
+		}
+	}
+	if err == nil && notSent > 0 {
+		err = fmt.Errorf("%d of %d positions not closed", notSent, len(report.Positions))
+	}
+	changes := map[string]handlers.AuditChange{
+		"orders_cancelled": {Before: nil, After: len(report.CancelledOrders)},
+		"positions_sent":   {Before: nil, After: sent},
+	}
+	action, strategyName := report.Scope+".flatten", ""
+	switch report.Scope {
+	case "strategy":
+		strategyName = report.Name
+	case "group":
+		action = "strategy_group.flatten"
+		changes["group"] = handlers.AuditChange{Before: nil, After: report.Name}
+	}
+	recordAudit(actor, action, strategyName, "", changes, err)
+}
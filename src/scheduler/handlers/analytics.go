@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Performance analytics are worked out from the round trips of the PnL
+// engine. A trip counts in the period its closing fill falls in; daily series
+// cover every weekday of the period, days without a closed trip being 0.
+//
+// Capital is not allocated to strategies, so returns of a strategy or setup
+// are its PnL over the account's net liquidation at the close before the
+// period: the share of the account it earned, comparable across strategies
+// but not a return on the capital the strategy used.
+
+// PerformanceMetrics describes a strategy or setup over a period. Ratios that
+// cannot be computed, e.g. a Sharpe ratio over a single day, are null.
+type PerformanceMetrics struct {
+	NetPnL       float64  `json:"net_pnl"`
+	ReturnPct    *float64 `json:"return_pct"` // of the account's net liquidation before the period
+	Sharpe       *float64 `json:"sharpe"`     // annualized from daily PnL
+	Sortino      *float64 `json:"sortino"`    // annualized from daily PnL
+	MaxDrawdown  float64  `json:"max_drawdown"`
+	WinRate      *float64 `json:"win_rate"` // percent of trades
+	AverageWin   float64  `json:"average_win"`
+	AverageLoss  float64  `json:"average_loss"` // negative
+	ProfitFactor *float64 `json:"profit_factor"`
+	ExposurePct  float64  `json:"exposure_pct"` // of the period with a position open
+	TradeCount   int      `json:"trade_count"`
+}
+
+// SetupAnalytics is the performance of one setup
+type SetupAnalytics struct {
+	SetupName string `json:"setup_name"`
+	PerformanceMetrics
+}
+
+// StrategyAnalytics is the performance of a strategy and each of its setups
+type StrategyAnalytics struct {
+	StrategyName string `json:"strategy_name"`
+	PerformanceMetrics
+	Setups []SetupAnalytics `json:"setups"`
+}
+
+// AnalyticsQuery selects the strategies and period to analyse. From and To
+// are inclusive trading dates (YYYY-MM-DD).
+type AnalyticsQuery struct {
+	StrategyName string
+	SetupName    string
+	From         string
+	To           string
+}
+
+const tradingDaysPerYear = 252
+
+// ComputeAnalytics returns the performance of every strategy with trades,
+// or of the one asked for, over the period
+func ComputeAnalytics(q AnalyticsQuery) ([]StrategyAnalytics, error) {
+	from, err := time.ParseInLocation("2006-01-02", q.From, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.ParseInLocation("2006-01-02", q.To, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	periodEnd := to.AddDate(0, 0, 1)
+	if now := time.Now(); periodEnd.After(now) {
+		periodEnd = now
+	}
+
+	// Fills after the period cannot change it, trips closed later count as
+	// positions still open at its end
+	fills, _, err := fetchFills(q.StrategyName, "", q.To)
+	if err != nil {
+		return nil, err
+	}
+	_, trips, positions := MatchFills(fills, multiplierLookup())
+
+	var capital float64
+	if snapshot, ok, err := PreviousClose(from); err != nil {
+		return nil, err
+	} else if ok {
+		capital = snapshot.NetLiquidation
+	}
+
+	// Group the trips closed in the period, and the positions still open, by
+	// strategy and setup
+	type group struct {
+		trips     []RoundTrip
+		intervals [][2]time.Time
+	}
+	strategyGroups := make(map[string]*group)
+	setupGroups := make(map[string]map[string]*group)
+	add := func(strategy, setup string, trip *RoundTrip, opened, closed time.Time) {
+		if q.SetupName != "" && setup != q.SetupName {
+			return
+		}
+		if strategyGroups[strategy] == nil {
+			strategyGroups[strategy] = &group{}
+			setupGroups[strategy] = make(map[string]*group)
+		}
+		if setupGroups[strategy][setup] == nil {
+			setupGroups[strategy][setup] = &group{}
+		}
+		for _, g := range []*group{strategyGroups[strategy], setupGroups[strategy][setup]} {
+			if trip != nil {
+				g.trips = append(g.trips, *trip)
+			}
+			g.intervals = append(g.intervals, [2]time.Time{opened, closed})
+		}
+	}
+	for i := range trips {
+		trip := &trips[i]
+		if trip.TradingDate >= q.From && trip.TradingDate <= q.To {
+			add(trip.StrategyName, trip.SetupName, trip, trip.OpenedAt, trip.ClosedAt)
+		} else if trip.ClosedAt.After(from) && trip.OpenedAt.Before(periodEnd) {
+			// Closed outside the period but held during it
+			add(trip.StrategyName, trip.SetupName, nil, trip.OpenedAt, trip.ClosedAt)
+		}
+	}
+	for _, p := range positions {
+		if p.OpenedAt.Before(periodEnd) {
+			add(p.StrategyName, p.SetupName, nil, p.OpenedAt, periodEnd)
+		}
+	}
+
+	days := weekdays(from, periodEnd)
+	results := []StrategyAnalytics{}
+	for strategy, g := range strategyGroups {
+		result := StrategyAnalytics{
+			StrategyName:       strategy,
+			PerformanceMetrics: performance(g.trips, g.intervals, days, from, periodEnd, capital),
+			Setups:             []SetupAnalytics{},
+		}
+		for setup, sg := range setupGroups[strategy] {
+			result.Setups = append(result.Setups, SetupAnalytics{
+				SetupName:          setup,
+				PerformanceMetrics: performance(sg.trips, sg.intervals, days, from, periodEnd, capital),
+			})
+		}
+		sort.Slice(result.Setups, func(i, j int) bool { return result.Setups[i].SetupName < result.Setups[j].SetupName })
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].StrategyName < results[j].StrategyName })
+	return results, nil
+}
+
+// performance computes the metrics of the trips closed in a period. intervals
+// are the times a position was open, days the trading dates of the period.
+func performance(trips []RoundTrip, intervals [][2]time.Time, days []string, start, end time.Time, capital float64) PerformanceMetrics {
+	var m PerformanceMetrics
+	sort.Slice(trips, func(i, j int) bool { return trips[i].ClosedAt.Before(trips[j].ClosedAt) })
+
+	var grossProfit, grossLoss, equity, peak float64
+	var wins, losses int
+	daily := make(map[string]float64)
+	for _, trip := range trips {
+		m.NetPnL += trip.PnL
+		daily[trip.TradingDate] += trip.PnL
+		if trip.PnL > 0 {
+			wins++
+			grossProfit += trip.PnL
+		} else if trip.PnL < 0 {
+			losses++
+			grossLoss += trip.PnL
+		}
+		equity += trip.PnL
+		peak = math.Max(peak, equity)
+		m.MaxDrawdown = math.Max(m.MaxDrawdown, peak-equity)
+	}
+	m.TradeCount = len(trips)
+
+	if m.TradeCount > 0 {
+		m.WinRate = ratio(float64(wins)*100, float64(m.TradeCount))
+	}
+	if wins > 0 {
+		m.AverageWin = grossProfit / float64(wins)
+	}
+	if losses > 0 {
+		m.AverageLoss = grossLoss / float64(losses)
+		m.ProfitFactor = ratio(grossProfit, -grossLoss)
+	}
+	if capital > 0 {
+		m.ReturnPct = ratio(m.NetPnL*100, capital)
+	}
+
+	// Sharpe and Sortino over daily PnL, which is proportional to daily
+	// returns on a fixed capital. Trips closed on a weekend session add a day.
+	days = append([]string(nil), days...)
+	listed := make(map[string]bool, len(days))
+	for _, day := range days {
+		listed[day] = true
+	}
+	for day := range daily {
+		if !listed[day] {
+			days = append(days, day)
+		}
+	}
+	if len(days) > 1 {
+		var mean, variance, downside float64
+		for _, day := range days {
+			mean += daily[day]
+		}
+		mean /= float64(len(days))
+		for _, day := range days {
+			variance += (daily[day] - mean) * (daily[day] - mean)
+			if daily[day] < 0 {
+				downside += daily[day] * daily[day]
+			}
+		}
+		annualize := math.Sqrt(tradingDaysPerYear)
+		if std := math.Sqrt(variance / float64(len(days)-1)); std > 0 {
+			m.Sharpe = ratio(mean*annualize, std)
+		}
+		if dd := math.Sqrt(downside / float64(len(days))); dd > 0 {
+			m.Sortino = ratio(mean*annualize, dd)
+		}
+	}
+
+	if period := end.Sub(start); period > 0 {
+		m.ExposurePct = float64(exposure(intervals, start, end)) / float64(period) * 100
+	}
+	return m
+}
+
+// exposure returns how long any of the intervals overlaps [start, end)
+func exposure(intervals [][2]time.Time, start, end time.Time) time.Duration {
+	clipped := make([][2]time.Time, 0, len(intervals))
+	for _, iv := range intervals {
+		if iv[0].Before(start) {
+			iv[0] = start
+		}
+		if iv[1].After(end) {
+			iv[1] = end
+		}
+		if iv[1].After(iv[0]) {
+			clipped = append(clipped, iv)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i][0].Before(clipped[j][0]) })
+
+	var total time.Duration
+	var current [2]time.Time
+	for i, iv := range clipped {
+		if i > 0 && !iv[0].After(current[1]) {
+			if iv[1].After(current[1]) {
+				current[1] = iv[1]
+			}
+			continue
+		}
+		if i > 0 {
+			total += current[1].Sub(current[0])
+		}
+		current = iv
+	}
+	if len(clipped) > 0 {
+		total += current[1].Sub(current[0])
+	}
+	return total
+}
+
+// weekdays lists the dates from start up to end, weekends left out
+func weekdays(start, end time.Time) []string {
+	var days []string
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			days = append(days, day.Format("2006-01-02"))
+		}
+	}
+	return days
+}
+
+func ratio(numerator, denominator float64) *float64 {
+	r := numerator / denominator
+	return &r
+}
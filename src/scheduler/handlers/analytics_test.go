@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPerformance(t *testing.T) {
+	// Monday 3 to Friday 7 March 2025
+	start := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 5)
+	days := weekdays(start, end)
+	trip := func(day, hour int, pnl float64) RoundTrip {
+		closed := start.AddDate(0, 0, day).Add(time.Duration(hour) * time.Hour)
+		return RoundTrip{
+			StrategyName: "S", SetupName: "A", PnL: pnl,
+			TradingDate: closed.Format("2006-01-02"), OpenedAt: closed.Add(-time.Hour), ClosedAt: closed,
+		}
+	}
+	trips := []RoundTrip{trip(0, 15, 100), trip(1, 16, 150), trip(1, 15, -50), trip(3, 15, -100)}
+	var intervals [][2]time.Time
+	for _, trip := range trips {
+		intervals = append(intervals, [2]time.Time{trip.OpenedAt, trip.ClosedAt})
+	}
+
+	m := performance(trips, intervals, days, start, end, 10000)
+	approx := func(name string, got, want float64) {
+		t.Helper()
+		if math.Abs(got-want) > 1e-6 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	value := func(name string, got *float64, want float64) {
+		t.Helper()
+		if got == nil {
+			t.Errorf("%s = null, want %v", name, want)
+			return
+		}
+		approx(name, *got, want)
+	}
+	approx("net PnL", m.NetPnL, 100)
+	value("return", m.ReturnPct, 1)
+	approx("max drawdown", m.MaxDrawdown, 100) // from 200 on day 1 to 100 on day 3
+	value("win rate", m.WinRate, 50)
+	approx("average win", m.AverageWin, 125)
+	approx("average loss", m.AverageLoss, -75)
+	value("profit factor", m.ProfitFactor, 250.0/150)
+	approx("exposure", m.ExposurePct, 4.0/(5*24)*100)
+	if m.TradeCount != 4 {
+		t.Errorf("trade count = %d, want 4", m.TradeCount)
+	}
+
+	// Daily PnL 100, 100, 0, -100, 0: mean 20, sample deviation sqrt(7000),
+	// downside deviation sqrt(10000 / 5)
+	annualize := math.Sqrt(tradingDaysPerYear)
+	value("sharpe", m.Sharpe, 20*annualize/math.Sqrt(7000))
+	value("sortino", m.Sortino, 20*annualize/math.Sqrt(2000))
+}
+
+func TestPerformanceWithoutData(t *testing.T) {
+	start := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	m := performance(nil, nil, weekdays(start, end), start, end, 0)
+	if m.ReturnPct != nil || m.Sharpe != nil || m.Sortino != nil || m.WinRate != nil || m.ProfitFactor != nil {
+		t.Errorf("ratios without trades or capital = %+v, want null", m)
+	}
+	if m.NetPnL != 0 || m.ExposurePct != 0 || m.TradeCount != 0 {
+		t.Errorf("metrics without trades = %+v, want zero", m)
+	}
+
+	// A single winning day has no deviation to divide by
+	trips := []RoundTrip{{PnL: 100, TradingDate: "2025-03-03", ClosedAt: start.Add(time.Hour)}}
+	m = performance(trips, nil, weekdays(start, end), start, end, 0)
+	if m.Sharpe != nil || m.Sortino != nil || m.ProfitFactor != nil {
+		t.Errorf("ratios over one winning day = %+v, want null", m)
+	}
+}
+
+func TestPerformanceCountsWeekendSessions(t *testing.T) {
+	// Monday and Tuesday, with a trip closed in the Sunday evening session
+	start := time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 3, 5, 0, 0, 0, 0, time.UTC)
+	trips := []RoundTrip{
+		{PnL: 30, TradingDate: "2025-03-02", ClosedAt: start.Add(20 * time.Hour)},
+		{PnL: 60, TradingDate: "2025-03-03", ClosedAt: start.Add(30 * time.Hour)},
+	}
+	m := performance(trips, nil, weekdays(start, end), start, end, 0)
+	// Daily PnL 30, 60, 0: mean 30, sample deviation 30
+	want := 30 * math.Sqrt(tradingDaysPerYear) / 30
+	if m.Sharpe == nil || math.Abs(*m.Sharpe-want) > 1e-6 {
+		t.Errorf("sharpe = %v, want %v", m.Sharpe, want)
+	}
+}
+
+func TestExposure(t *testing.T) {
+	start := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time { return start.Add(time.Duration(hour) * time.Hour) }
+	end := at(24)
+
+	tests := []struct {
+		name      string
+		intervals [][2]time.Time
+		want      time.Duration
+	}{
+		{"none", nil, 0},
+		{"inside", [][2]time.Time{{at(1), at(3)}}, 2 * time.Hour},
+		{"overlapping are counted once", [][2]time.Time{{at(1), at(4)}, {at(2), at(5)}}, 4 * time.Hour},
+		{"nested", [][2]time.Time{{at(1), at(6)}, {at(2), at(3)}}, 5 * time.Hour},
+		{"touching", [][2]time.Time{{at(1), at(2)}, {at(2), at(3)}}, 2 * time.Hour},
+		{"apart", [][2]time.Time{{at(5), at(6)}, {at(1), at(2)}}, 2 * time.Hour},
+		{"clipped to the period", [][2]time.Time{{at(-5), at(2)}, {at(23), at(30)}}, 3 * time.Hour},
+		{"outside the period", [][2]time.Time{{at(-5), at(-1)}, {at(25), at(30)}}, 0},
+		{"spanning the period", [][2]time.Time{{at(-5), at(30)}}, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exposure(tt.intervals, start, end); got != tt.want {
+				t.Errorf("exposure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeekdays(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end time.Time
+		want       []string
+	}{
+		{
+			name:  "week",
+			start: time.Date(2025, 3, 3, 0, 0, 0, 0, time.Local),
+			end:   time.Date(2025, 3, 10, 0, 0, 0, 0, time.Local),
+			want:  []string{"2025-03-03", "2025-03-04", "2025-03-05", "2025-03-06", "2025-03-07"},
+		},
+		{
+			name:  "weekend only",
+			start: time.Date(2025, 3, 8, 0, 0, 0, 0, time.Local),
+			end:   time.Date(2025, 3, 10, 0, 0, 0, 0, time.Local),
+		},
+		{
+			name:  "end excluded",
+			start: time.Date(2025, 3, 7, 0, 0, 0, 0, time.Local),
+			end:   time.Date(2025, 3, 11, 0, 0, 0, 0, time.Local),
+			want:  []string{"2025-03-07", "2025-03-10"},
+		},
+		{
+			name:  "period ending today includes today",
+			start: time.Date(2025, 3, 3, 0, 0, 0, 0, time.Local),
+			end:   time.Date(2025, 3, 4, 9, 30, 0, 0, time.Local),
+			want:  []string{"2025-03-03", "2025-03-04"},
+		},
+		{
+			name:  "empty period",
+			start: time.Date(2025, 3, 3, 0, 0, 0, 0, time.Local),
+			end:   time.Date(2025, 3, 3, 0, 0, 0, 0, time.Local),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := weekdays(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("weekdays = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditChange is the before and after value of one changed field
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEvent records one operator action taken through the scheduler
+type AuditEvent struct {
+	ID           int64                  `json:"id"`
+	OccurredAt   time.Time              `json:"occurred_at"`
+	Actor        string                 `json:"actor"`
+	ActorKind    string                 `json:"actor_kind"`
+	Action       string                 `json:"action"`
+	StrategyName string                 `json:"strategy_name"`
+	SetupName    string                 `json:"setup_name"`
+	Changes      map[string]AuditChange `json:"changes"`
+	Result       string                 `json:"result"`
+	Error        string                 `json:"error"`
+}
+
+// AuditFilter narrows QueryAuditEvents. Zero values match everything.
+type AuditFilter struct {
+	Actor        string
+	Action       string
+	StrategyName string
+	SetupName    string
+	Result       string
+	From         time.Time
+	To           time.Time
+	BeforeID     int64 // only events older than this ID, for paging
+	Limit        int
+}
+
+// InitAuditLog creates the audit_events table. Rows can only be inserted,
+// a trigger rejects updates and deletes.
+func InitAuditLog() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		actor VARCHAR(100) NOT NULL,
+		actor_kind VARCHAR(20) NOT NULL DEFAULT '',
+		action VARCHAR(50) NOT NULL,
+		strategy_name VARCHAR(100) NOT NULL DEFAULT '',
+		setup_name VARCHAR(100) NOT NULL DEFAULT '',
+		changes JSONB NOT NULL DEFAULT '{}',
+		result VARCHAR(20) NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_occurred_at_idx ON audit_events (occurred_at);
+	CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (strategy_name, setup_name);
+
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only
+		BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit_events table: %v", err)
+	}
+	return nil
+}
+
+// RecordAuditEvent appends an event to audit_events
+func RecordAuditEvent(e AuditEvent) error {
+	if e.Changes == nil {
+		e.Changes = map[string]AuditChange{}
+	}
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO audit_events (occurred_at, actor, actor_kind, action, strategy_name, setup_name, changes, result, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, e.OccurredAt, e.Actor, e.ActorKind, e.Action, e.StrategyName, e.SetupName, string(changes), e.Result, e.Error)
+	return err
+}
+
+// QueryAuditEvents returns matching events, newest first
+func QueryAuditEvents(f AuditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if f.Actor != "" {
+		where("actor = $%d", f.Actor)
+	}
+	if f.Action != "" {
+		where("action = $%d", f.Action)
+	}
+	if f.StrategyName != "" {
+		where("strategy_name = $%d", f.StrategyName)
+	}
+	if f.SetupName != "" {
+		where("setup_name = $%d", f.SetupName)
+	}
+	if f.Result != "" {
+		where("result = $%d", f.Result)
+	}
+	if !f.From.IsZero() {
+		where("occurred_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		where("occurred_at < $%d", f.To)
+	}
+	if f.BeforeID > 0 {
+		where("id < $%d", f.BeforeID)
+	}
+
+	query := `
+		SELECT id, occurred_at, actor, actor_kind, action, strategy_name,
+			setup_name, changes, result, error
+		FROM audit_events`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf("\n\t\tORDER BY id DESC\n\t\tLIMIT $%d", len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var changes []byte
+		err := rows.Scan(
+			&e.ID, &e.OccurredAt, &e.Actor, &e.ActorKind, &e.Action,
+			&e.StrategyName, &e.SetupName, &changes, &e.Result, &e.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, fmt.Errorf("invalid changes for audit event %d: %v", e.ID, err)
+		}
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
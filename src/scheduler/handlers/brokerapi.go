@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"scheduler/logging"
+
+	"github.com/lib/pq"
+)
+
+// -----------------------------------------------------------------
+// broker_api Client
+// -----------------------------------------------------------------
+
+// Every call to broker_api has a timeout, which also covers reading the
+// response body. Reads are idempotent and retried a few times with jittered
+// backoff; requests that change state at the broker, like cancelling
+// orders, are sent once.
+//
+// Each broker has two circuit breakers, one for reads and one for calls that
+// change state at the broker, so failing quote reads cannot hold back the
+// orders closing a position. After circuitFailureThreshold calls in a row
+// fail, with an error or a 5xx response, the circuit opens and calls fail
+// fast with ErrCircuitOpen for circuitOpenDuration. The circuit is then half
+// open: one trial call goes through, closing the circuit when it succeeds and
+// opening it again when it fails. The backend has the same client in
+// package brokerapi, kept in step with this one, and publishes its circuits
+// to broker_circuits.
+
+const (
+	// BrokerReadTimeout is the timeout of a call when none is given
+	BrokerReadTimeout = 10 * time.Second
+	// BrokerHistoryTimeout leaves IB time to page through historical bars
+	BrokerHistoryTimeout = 60 * time.Second
+
+	brokerReadAttempts      = 3
+	circuitFailureThreshold = 5
+)
+
+// Variables so tests can shorten them
+var (
+	brokerRetryBaseDelay = 250 * time.Millisecond
+	circuitOpenDuration  = 30 * time.Second
+)
+
+// Kinds of calls, each with its own circuit
+const (
+	CallRead  = "read"  // idempotent calls
+	CallOrder = "order" // calls that change state at the broker
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned for calls to a broker whose circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+var (
+	brokerClient = &http.Client{}
+	brokerLog    = logging.For("broker")
+)
+
+// BrokerAPIBase returns broker_api's URL: BROKER_API_URL when set, otherwise
+// the one for the environment
+func BrokerAPIBase() string {
+	if url := os.Getenv("BROKER_API_URL"); url != "" {
+		return url
+	}
+	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
+		return "http://broker_api:8000"
+	}
+	return "http://127.0.0.1:8000"
+}
+
+// BrokerCall is one request to broker_api
+type BrokerCall struct {
+	Broker     string // the circuit the call counts against
+	Method     string
+	Path       string // below BrokerAPIBase, with the query
+	Body       []byte
+	Header     http.Header
+	Timeout    time.Duration // BrokerReadTimeout when zero
+	Idempotent bool          // retried when set
+}
+
+// DoBrokerAPI sends a call and returns the response of its last attempt.
+// Responses with a 5xx status count as failures but are returned like any
+// other; the caller must close the body.
+func DoBrokerAPI(call BrokerCall) (*http.Response, error) {
+	attempts, kind := 1, CallOrder
+	if call.Idempotent {
+		attempts, kind = brokerReadAttempts, CallRead
+	}
+	log := brokerLog.With("broker", call.Broker, "method", call.Method, "path", call.Path)
+	breaker := circuitFor(call.Broker, kind)
+	for attempt := 1; ; attempt++ {
+		if err := breaker.allow(); err != nil {
+			log.Warn("Call not sent", "error", err)
+			return nil, err
+		}
+		started := time.Now()
+		resp, err := sendBrokerCall(call)
+		elapsed := time.Since(started)
+		brokerRequestDuration.WithLabelValues(call.Broker, brokerEndpoint(call.Path)).Observe(elapsed.Seconds())
+		switch {
+		case err != nil:
+			brokerRequestErrors.WithLabelValues(call.Broker, brokerEndpoint(call.Path)).Inc()
+			breaker.record(err.Error())
+			log.Warn("Call failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "error", err)
+		case resp.StatusCode >= 500:
+			brokerRequestErrors.WithLabelValues(call.Broker, brokerEndpoint(call.Path)).Inc()
+			breaker.record(fmt.Sprintf("%s returned %s", call.Path, resp.Status))
+			log.Warn("Call failed", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "status", resp.StatusCode)
+		default:
+			breaker.record("")
+			log.Debug("Call done", "attempt", attempt, "duration_ms", elapsed.Milliseconds(), "status", resp.StatusCode)
+			return resp, nil
+		}
+		if attempt == attempts {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// Full jitter keeps retries of concurrent callers apart
+		time.Sleep(time.Duration(rand.Int63n(int64(brokerRetryBaseDelay) << attempt)))
+	}
+}
+
+// getBrokerAPI reads a broker_api resource into out
+func getBrokerAPI(broker, path string, out interface{}) error {
+	return brokerAPIJSON(BrokerCall{Broker: broker, Method: http.MethodGet, Path: path, Idempotent: true}, out)
+}
+
+// queryBrokerAPI posts a request that reads from the broker, retried like
+// getBrokerAPI
+func queryBrokerAPI(broker, path string, body, out interface{}) error {
+	return postBrokerJSON(BrokerCall{Broker: broker, Path: path, Idempotent: true}, body, out)
+}
+
+// postBrokerAPI sends a request that changes state at the broker, once
+func postBrokerAPI(broker, path string, body, out interface{}) error {
+	return postBrokerJSON(BrokerCall{Broker: broker, Path: path}, body, out)
+}
+
+func postBrokerJSON(call BrokerCall, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	call.Method = http.MethodPost
+	call.Body = data
+	call.Header = http.Header{"Content-Type": {"application/json"}}
+	return brokerAPIJSON(call, out)
+}
+
+func brokerAPIJSON(call BrokerCall, out interface{}) error {
+	resp, err := DoBrokerAPI(call)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", call.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// sendBrokerCall makes one attempt of a call
+func sendBrokerCall(call BrokerCall) (*http.Response, error) {
+	timeout := call.Timeout
+	if timeout == 0 {
+		timeout = BrokerReadTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, call.Method, BrokerAPIBase()+call.Path, bytes.NewReader(call.Body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range call.Header {
+		req.Header[name] = values
+	}
+	resp, err := brokerClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the timeout of a call once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// -----------------------------------------------------------------
+// Circuit Breakers
+// -----------------------------------------------------------------
+
+// BrokerCircuit is the circuit breaker of a service's reads from or orders
+// to one broker. UpdatedAt is when the backend last published its state.
+type BrokerCircuit struct {
+	Service             string     `json:"service"` // scheduler or backend
+	Broker              string     `json:"broker"`
+	Kind                string     `json:"kind"` // read or order
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+type circuit struct {
+	mu        sync.Mutex
+	broker    string
+	kind      string
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool // a half open circuit let its trial call through
+	lastError string
+}
+
+var (
+	circuitsMu sync.Mutex
+	circuits   = make(map[string]*circuit) // by broker and kind
+)
+
+func circuitFor(broker, kind string) *circuit {
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+	key := broker + "|" + kind
+	c, ok := circuits[key]
+	if !ok {
+		c = &circuit{broker: broker, kind: kind, state: CircuitClosed}
+		circuits[key] = c
+	}
+	return c
+}
+
+// allow reports whether a call may go out
+func (c *circuit) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= circuitOpenDuration {
+		c.state, c.trial = CircuitHalfOpen, false
+	}
+	switch {
+	case c.state == CircuitOpen, c.state == CircuitHalfOpen && c.trial:
+		return fmt.Errorf("broker_api %s %ss: %w", c.broker, c.kind, ErrCircuitOpen)
+	case c.state == CircuitHalfOpen:
+		c.trial = true
+	}
+	return nil
+}
+
+// record counts the outcome of a call, failed when failure is not empty
+func (c *circuit) record(failure string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if failure == "" {
+		if c.state != CircuitClosed {
+			brokerLog.Info("Circuit closed", "broker", c.broker, "kind", c.kind)
+		}
+		c.state, c.failures, c.trial = CircuitClosed, 0, false
+		return
+	}
+	c.failures++
+	c.lastError = failure
+	if c.state == CircuitHalfOpen || c.failures >= circuitFailureThreshold {
+		if c.state != CircuitOpen {
+			brokerLog.Warn("Circuit opened", "broker", c.broker, "kind", c.kind, "failures", c.failures, "error", failure)
+		}
+		c.state, c.openedAt, c.trial = CircuitOpen, time.Now(), false
+	}
+}
+
+func (c *circuit) snapshot(now time.Time) BrokerCircuit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := BrokerCircuit{Service: "scheduler", Broker: c.broker, Kind: c.kind, State: c.state,
+		ConsecutiveFailures: c.failures, LastError: c.lastError, UpdatedAt: now}
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= circuitOpenDuration {
+		s.State = CircuitHalfOpen
+	}
+	if s.State != CircuitClosed {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// BrokerCircuits returns the circuit breakers of the scheduler and the
+// backend, for the brokers and kinds of calls each has made so far
+func BrokerCircuits() ([]BrokerCircuit, error) {
+	now := time.Now()
+	circuitsMu.Lock()
+	states := make([]BrokerCircuit, 0, len(circuits))
+	for _, c := range circuits {
+		states = append(states, c.snapshot(now))
+	}
+	circuitsMu.Unlock()
+
+	backend, err := fetchBackendCircuits()
+	if err != nil {
+		return nil, err
+	}
+	states = append(states, backend...)
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Broker != states[j].Broker {
+			return states[i].Broker < states[j].Broker
+		}
+		if states[i].Service != states[j].Service {
+			return states[i].Service < states[j].Service
+		}
+		return states[i].Kind < states[j].Kind
+	})
+	return states, nil
+}
+
+// fetchBackendCircuits reads the circuits the backend published, none when
+// it has not created broker_circuits yet
+func fetchBackendCircuits() ([]BrokerCircuit, error) {
+	rows, err := db.Query(`
+		SELECT service, broker, kind, state, consecutive_failures, opened_at, last_error, updated_at
+		FROM broker_circuits
+		ORDER BY service, broker, kind
+	`)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broker circuits: %v", err)
+	}
+	defer rows.Close()
+
+	var states []BrokerCircuit
+	for rows.Next() {
+		var s BrokerCircuit
+		if err := rows.Scan(&s.Service, &s.Broker, &s.Kind, &s.State, &s.ConsecutiveFailures,
+			&s.OpenedAt, &s.LastError, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, rows.Err()
+}
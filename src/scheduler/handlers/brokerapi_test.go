@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBrokerAPI serves handler as broker_api, with short retry delays and
+// open circuits
+func fakeBrokerAPI(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Setenv("BROKER_API_URL", server.URL)
+	delay, open := brokerRetryBaseDelay, circuitOpenDuration
+	brokerRetryBaseDelay, circuitOpenDuration = time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		server.Close()
+		brokerRetryBaseDelay, circuitOpenDuration = delay, open
+		circuitsMu.Lock()
+		circuits = make(map[string]*circuit)
+		circuitsMu.Unlock()
+	})
+}
+
+// statusServer answers every request with the status in code and counts them
+func statusServer(t *testing.T, code *atomic.Int32) *atomic.Int32 {
+	var requests atomic.Int32
+	fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(code.Load()))
+		fmt.Fprint(w, `{}`)
+	})
+	return &requests
+}
+
+func circuitState(broker, kind string) string {
+	return circuitFor(broker, kind).snapshot(time.Now()).State
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     bool
+		statuses []int
+		wantErr  bool
+		want     int32 // requests sent
+	}{
+		{"read retried until it succeeds", true, []int{503, 503, 200}, false, 3},
+		{"read gives up after three attempts", true, []int{503, 503, 503, 200}, true, 3},
+		{"client errors are not retried", true, []int{404, 200}, true, 1},
+		{"order sent once", false, []int{503, 200}, true, 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				w.WriteHeader(tt.statuses[n-1])
+				fmt.Fprint(w, `{}`)
+			})
+			broker := fmt.Sprintf("retries-%d", i)
+			var out map[string]interface{}
+			var err error
+			if tt.read {
+				err = getBrokerAPI(broker, "/api/x/quote", &out)
+			} else {
+				err = postBrokerAPI(broker, "/api/x/order", struct{}{}, &out)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.want {
+				t.Errorf("sent %d requests, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitOpensAndRecovers(t *testing.T) {
+	var code atomic.Int32
+	code.Store(http.StatusServiceUnavailable)
+	requests := statusServer(t, &code)
+	const broker = "circuit"
+	var out map[string]interface{}
+	order := func() error { return postBrokerAPI(broker, "/api/x/order", struct{}{}, &out) }
+
+	for i := 0; i < circuitFailureThreshold; i++ {
+		if err := order(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d = %v, want a failure from broker_api", i+1, err)
+		}
+	}
+	if got := circuitState(broker, CallOrder); got != CircuitOpen {
+		t.Fatalf("circuit %s after %d failures, want open", got, circuitFailureThreshold)
+	}
+	if err := order(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("call on an open circuit = %v, want ErrCircuitOpen", err)
+	}
+	if got := requests.Load(); got != circuitFailureThreshold {
+		t.Errorf("sent %d requests, want %d", got, circuitFailureThreshold)
+	}
+
+	// Half open: a failed trial opens the circuit again
+	time.Sleep(circuitOpenDuration)
+	if got := circuitState(broker, CallOrder); got != CircuitHalfOpen {
+		t.Fatalf("circuit %s after the open duration, want half_open", got)
+	}
+	if err := order(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("trial call = %v, want it sent and failed", err)
+	}
+	if err := order(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("call after a failed trial = %v, want ErrCircuitOpen", err)
+	}
+
+	// and a successful one closes it
+	time.Sleep(circuitOpenDuration)
+	code.Store(http.StatusOK)
+	if err := order(); err != nil {
+		t.Errorf("trial call = %v, want success", err)
+	}
+	if got := circuitState(broker, CallOrder); got != CircuitClosed {
+		t.Errorf("circuit %s after a successful trial, want closed", got)
+	}
+}
+
+func TestHalfOpenLetsOneTrialThrough(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		fmt.Fprint(w, `{}`)
+	})
+	const broker = "trial"
+	c := circuitFor(broker, CallRead)
+	for i := 0; i < circuitFailureThreshold; i++ {
+		c.record("failed")
+	}
+	time.Sleep(circuitOpenDuration)
+
+	var out map[string]interface{}
+	trial := make(chan error)
+	go func() { trial <- getBrokerAPI(broker, "/api/x/quote", &out) }()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := getBrokerAPI(broker, "/api/x/quote", &out); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("call during the trial = %v, want ErrCircuitOpen", err)
+	}
+	close(release)
+	if err := <-trial; err != nil {
+		t.Errorf("trial call = %v, want success", err)
+	}
+	if got := circuitState(broker, CallRead); got != CircuitClosed {
+		t.Errorf("circuit %s after a successful trial, want closed", got)
+	}
+}
+
+func TestReadFailuresDoNotBlockOrders(t *testing.T) {
+	var code atomic.Int32
+	code.Store(http.StatusServiceUnavailable)
+	statusServer(t, &code)
+	const broker = "separate"
+	var out map[string]interface{}
+	for i := 0; i < circuitFailureThreshold; i++ {
+		getBrokerAPI(broker, "/api/x/quote", &out)
+	}
+	if got := circuitState(broker, CallRead); got != CircuitOpen {
+		t.Fatalf("read circuit %s, want open", got)
+	}
+
+	code.Store(http.StatusOK)
+	if err := postBrokerAPI(broker, "/api/x/order", struct{}{}, &out); err != nil {
+		t.Errorf("order with the read circuit open = %v, want it sent", err)
+	}
+	if err := getBrokerAPI(broker, "/api/x/quote", &out); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("read = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerLate bool // false: headers at once, body late
+	}{
+		{"no response", true},
+		{"body not read in time", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			fakeBrokerAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if !tt.headerLate {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+				}
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			})
+			var out map[string]interface{}
+			started := time.Now()
+			call := BrokerCall{Broker: fmt.Sprintf("timeout-%d", i), Path: "/api/x/order", Timeout: 50 * time.Millisecond}
+			err := postBrokerJSON(call, struct{}{}, &out)
+			if err == nil {
+				t.Fatal("call succeeded, want a timeout")
+			}
+			if elapsed := time.Since(started); elapsed >= time.Second {
+				t.Errorf("call took %v, want about 50ms", elapsed)
+			}
+			if got := requests.Load(); got != 1 {
+				t.Errorf("sent %d requests, want 1", got)
+			}
+		})
+	}
+}
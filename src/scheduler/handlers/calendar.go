@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The backend publishes the sessions of the exchanges it has a calendar for
+// to trading_calendar. Exchanges it has no calendar for are never closed.
+
+// ExchangeHoliday returns the holiday closing an exchange at t, ok is false
+// when the exchange trades on the trading date of t or has no calendar.
+// The trading date is that of the session open at t, or between sessions
+// the next date the calendar lists after the last close. CME at 18:00 CT on
+// December 24 is on December 25, and the weekend before a Monday holiday
+// already counts as the holiday.
+func ExchangeHoliday(exchange string, t time.Time) (name string, ok bool, err error) {
+	var closed bool
+	err = db.QueryRow(`
+	SELECT note, opens_at IS NULL FROM trading_calendar
+	WHERE exchange = $1
+		AND trading_date > COALESCE((
+			SELECT MAX(trading_date) FROM trading_calendar
+			WHERE exchange = $1 AND closes_at <= $2
+		), '-infinity'::date)
+		AND (opens_at IS NOT NULL OR NOT EXISTS (
+			SELECT 1 FROM trading_calendar
+			WHERE exchange = $1 AND opens_at <= $2 AND closes_at > $2
+		))
+	ORDER BY trading_date
+	LIMIT 1
+	`, strings.ToUpper(exchange), t).Scan(&name, &closed)
+	var pqErr *pq.Error
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &pqErr) && pqErr.Code == "42P01") {
+		// A trading day, or the backend has not published the calendar yet
+		return "", false, nil
+	}
+	if err != nil || !closed {
+		return "", false, err
+	}
+	return name, true, nil
+}
+
+// ExchangeOpen reports whether a session of an exchange is open at t.
+// Exchanges without a calendar are always open.
+func ExchangeOpen(exchange string, t time.Time) (bool, error) {
+	var published, open bool
+	err := db.QueryRow(`
+	SELECT COUNT(*) > 0, COUNT(*) FILTER (WHERE opens_at <= $2 AND closes_at > $2) > 0
+	FROM trading_calendar
+	WHERE exchange = $1
+	`, strings.ToUpper(exchange), t).Scan(&published, &open)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	return open || !published, nil
+}
+
+// NextSessionClose returns when the session of an exchange open at t, or
+// the next one, closes. ok is false when no session is published.
+func NextSessionClose(exchange string, t time.Time) (closes time.Time, ok bool, err error) {
+	err = db.QueryRow(`
+	SELECT closes_at FROM trading_calendar
+	WHERE exchange = $1 AND closes_at > $2
+	ORDER BY closes_at
+	LIMIT 1
+	`, strings.ToUpper(exchange), t).Scan(&closes)
+	var pqErr *pq.Error
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &pqErr) && pqErr.Code == "42P01") {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return closes, true, nil
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The contract master holds what the rest of the system needs to know about
+// a traded contract: its IB conId, point value, tick size, trading hours and
+// the fees charged per contract when the broker does not report them.
+// Rows are entered by hand or by the sync job, which qualifies them through
+// broker_api.
+
+// Contract is a row of the contract master
+type Contract struct {
+	ID           int64      `json:"id"`
+	ConID        int        `json:"con_id"` // IB conId, 0 until qualified
+	Symbol       string     `json:"symbol"`
+	ContractType string     `json:"contract_type"` // FUT, STK or ETF
+	Exchange     string     `json:"exchange"`
+	Currency     string     `json:"currency"`
+	Expiry       string     `json:"expiry"` // YYYYMM or YYYYMMDD, empty for stocks
+	Multiplier   float64    `json:"multiplier"` // 0 when unknown
+	TickSize     float64    `json:"tick_size"`
+	TradingHours string     `json:"trading_hours"` // as IB reports them, e.g. 20250101:1700-20250102:1600;...
+	LiquidHours  string     `json:"liquid_hours"`
+	TimeZone     string     `json:"time_zone"`
+	Description  string     `json:"description"`
+	Commission   float64    `json:"commission"`   // per contract and side
+	ExchangeFee  float64    `json:"exchange_fee"` // per contract and side, incl. regulatory fees
+	SyncedAt     *time.Time `json:"synced_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// ErrDuplicateContract is returned when a contract with the same conId, or
+// symbol, type, exchange and expiry, already exists
+var ErrDuplicateContract = errors.New("contract already exists")
+
+// InitContracts creates the contracts table
+func InitContracts() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS contracts (
+		id BIGSERIAL PRIMARY KEY,
+		con_id INTEGER UNIQUE,
+		symbol VARCHAR(50) NOT NULL,
+		contract_type VARCHAR(10) NOT NULL DEFAULT 'FUT',
+		exchange VARCHAR(50) NOT NULL DEFAULT '',
+		currency VARCHAR(10) NOT NULL DEFAULT 'USD',
+		expiry VARCHAR(8) NOT NULL DEFAULT '',
+		multiplier FLOAT NOT NULL DEFAULT 0,
+		tick_size FLOAT NOT NULL DEFAULT 0,
+		trading_hours TEXT NOT NULL DEFAULT '',
+		liquid_hours TEXT NOT NULL DEFAULT '',
+		time_zone VARCHAR(50) NOT NULL DEFAULT '',
+		description VARCHAR(200) NOT NULL DEFAULT '',
+		synced_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (symbol, contract_type, exchange, expiry)
+	);
+	CREATE INDEX IF NOT EXISTS contracts_symbol_idx ON contracts (symbol);
+
+	ALTER TABLE contracts ADD COLUMN IF NOT EXISTS commission FLOAT NOT NULL DEFAULT 0;
+	ALTER TABLE contracts ADD COLUMN IF NOT EXISTS exchange_fee FLOAT NOT NULL DEFAULT 0;
+	-- 0 is an unknown multiplier, looked up elsewhere instead of taken as 1
+	ALTER TABLE contracts ALTER COLUMN multiplier SET DEFAULT 0;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create contracts table: %v", err)
+	}
+	return nil
+}
+
+const contractColumns = `id, COALESCE(con_id, 0), symbol, contract_type, exchange, currency, expiry,
+	multiplier, tick_size, trading_hours, liquid_hours, time_zone, description, commission, exchange_fee,
+	synced_at, updated_at`
+
+func scanContract(row interface{ Scan(...interface{}) error }) (Contract, error) {
+	var c Contract
+	var syncedAt sql.NullTime
+	err := row.Scan(&c.ID, &c.ConID, &c.Symbol, &c.ContractType, &c.Exchange, &c.Currency, &c.Expiry,
+		&c.Multiplier, &c.TickSize, &c.TradingHours, &c.LiquidHours, &c.TimeZone, &c.Description,
+		&c.Commission, &c.ExchangeFee, &syncedAt, &c.UpdatedAt)
+	if syncedAt.Valid {
+		c.SyncedAt = &syncedAt.Time
+	}
+	return c, err
+}
+
+// ContractQuery searches the contract master. Search matches the symbol or
+// description, or the conId when it is a number. Empty filters match
+// everything.
+type ContractQuery struct {
+	Search       string
+	Symbol       string
+	ContractType string
+	Exchange     string
+	Limit        int // 0 for every match
+}
+
+// ListContracts returns the matching contracts by symbol and expiry
+func ListContracts(q ContractQuery) ([]Contract, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if q.Search != "" {
+		if conID, err := strconv.Atoi(q.Search); err == nil {
+			where("con_id = $%d", conID)
+		} else {
+			where("(symbol ILIKE $%[1]d OR description ILIKE $%[1]d)", "%"+q.Search+"%")
+		}
+	}
+	if q.Symbol != "" {
+		where("symbol = $%d", q.Symbol)
+	}
+	if q.ContractType != "" {
+		where("contract_type = $%d", q.ContractType)
+	}
+	if q.Exchange != "" {
+		where("exchange = $%d", q.Exchange)
+	}
+
+	query := `SELECT ` + contractColumns + ` FROM contracts`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY symbol, expiry, id"
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	contracts := []Contract{}
+	for rows.Next() {
+		c, err := scanContract(rows)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, c)
+	}
+	return contracts, rows.Err()
+}
+
+// GetContract returns a contract by id. ok is false when there is none.
+func GetContract(id int64) (c Contract, ok bool, err error) {
+	c, err = scanContract(db.QueryRow(`SELECT `+contractColumns+` FROM contracts WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, false, nil
+	}
+	return c, err == nil, err
+}
+
+// CreateContract inserts a contract and returns it as stored
+func CreateContract(c Contract) (Contract, error) {
+	row := db.QueryRow(`
+		INSERT INTO contracts (con_id, symbol, contract_type, exchange, currency, expiry,
+			multiplier, tick_size, trading_hours, liquid_hours, time_zone, description, commission, exchange_fee)
+		VALUES (NULLIF($1, 0), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING `+contractColumns,
+		c.ConID, c.Symbol, c.ContractType, c.Exchange, c.Currency, c.Expiry,
+		c.Multiplier, c.TickSize, c.TradingHours, c.LiquidHours, c.TimeZone, c.Description, c.Commission, c.ExchangeFee)
+	stored, err := scanContract(row)
+	return stored, contractError(err)
+}
+
+// UpdateContract overwrites a contract. ok is false when it does not exist.
+func UpdateContract(c Contract) (stored Contract, ok bool, err error) {
+	row := db.QueryRow(`
+		UPDATE contracts SET con_id = NULLIF($2, 0), symbol = $3, contract_type = $4, exchange = $5,
+			currency = $6, expiry = $7, multiplier = $8, tick_size = $9, trading_hours = $10,
+			liquid_hours = $11, time_zone = $12, description = $13, commission = $14, exchange_fee = $15,
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+contractColumns,
+		c.ID, c.ConID, c.Symbol, c.ContractType, c.Exchange, c.Currency, c.Expiry,
+		c.Multiplier, c.TickSize, c.TradingHours, c.LiquidHours, c.TimeZone, c.Description, c.Commission, c.ExchangeFee)
+	stored, err = scanContract(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stored, false, nil
+	}
+	return stored, err == nil, contractError(err)
+}
+
+// DeleteContract removes a contract. ok is false when it did not exist.
+func DeleteContract(id int64) (ok bool, err error) {
+	result, err := db.Exec(`DELETE FROM contracts WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// contractError turns unique violations into ErrDuplicateContract
+func contractError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateContract
+	}
+	return err
+}
+
+// ContractMultipliers returns the point value of each contract by conId, and
+// of each future by symbol, which all its expiries share
+func ContractMultipliers() (byConID map[int]float64, bySymbol map[string]float64, err error) {
+	return contractValues("multiplier")
+}
+
+// ContractTickSizes returns the tick size of each contract by conId, and of
+// each future by symbol
+func ContractTickSizes() (byConID map[int]float64, bySymbol map[string]float64, err error) {
+	return contractValues("tick_size")
+}
+
+// contractValues reads a positive numeric column of the contract master by
+// conId, and by symbol for futures only, so a stock or ETF sharing a
+// future's symbol does not stand in for it
+func contractValues(column string) (byConID map[int]float64, bySymbol map[string]float64, err error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(con_id, 0), symbol, contract_type, ` + column + ` FROM contracts
+		WHERE ` + column + ` > 0
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	byConID, bySymbol = make(map[int]float64), make(map[string]float64)
+	for rows.Next() {
+		var conID int
+		var symbol, contractType string
+		var m float64
+		if err := rows.Scan(&conID, &symbol, &contractType, &m); err != nil {
+			return nil, nil, err
+		}
+		if conID > 0 {
+			byConID[conID] = m
+		}
+		if contractType == "FUT" {
+			bySymbol[symbol] = m
+		}
+	}
+	return byConID, bySymbol, rows.Err()
+}
+
+// -----------------------------------------------------------------
+// Sync from broker_api
+// -----------------------------------------------------------------
+
+// brokerContract is the contract body of broker_api
+type brokerContract struct {
+	Symbol       string `json:"symbol,omitempty"`
+	ContractType string `json:"contract_type,omitempty"`
+	ContractID   int    `json:"contract_id,omitempty"`
+	Exchange     string `json:"exchange,omitempty"`
+	Currency     string `json:"currency,omitempty"`
+	Expiry       string `json:"expiry,omitempty"`
+}
+
+// brokerContractDetails is what broker_api /contract-details returns
+type brokerContractDetails struct {
+	ContractID   int     `json:"contract_id"`
+	Symbol       string  `json:"symbol"`
+	ContractType string  `json:"contract_type"`
+	Exchange     string  `json:"exchange"`
+	Currency     string  `json:"currency"`
+	Expiry       string  `json:"expiry"`
+	Multiplier   float64 `json:"multiplier"`
+	TickSize     float64 `json:"tick_size"`
+	TradingHours string  `json:"trading_hours"`
+	LiquidHours  string  `json:"liquid_hours"`
+	TimeZone     string  `json:"time_zone"`
+	Description  string  `json:"description"`
+}
+
+// SyncContracts qualifies every contract of the master, plus the conIds
+// given, through broker_api: rows without a conId get one from /contract-id,
+// then multiplier, tick size and hours are refreshed from /contract-details.
+// Returns how many contracts were updated; failures are logged and skipped.
+func SyncContracts(conIDs []int) (int, error) {
+	contracts, err := ListContracts(ContractQuery{})
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[int]bool)
+	for _, c := range contracts {
+		if c.ConID > 0 {
+			known[c.ConID] = true
+		}
+	}
+	for _, conID := range conIDs {
+		if conID > 0 && !known[conID] {
+			known[conID] = true
+			contracts = append(contracts, Contract{ConID: conID})
+		}
+	}
+
+	synced := 0
+	for _, c := range contracts {
+		if c.ConID == 0 {
+			conID, err := lookupContractID(brokerContract{
+				Symbol: c.Symbol, ContractType: c.ContractType, Exchange: c.Exchange,
+				Currency: c.Currency, Expiry: c.Expiry,
+			})
+			if err != nil {
+				log.Printf("Contract sync: no conId for %s %s %s: %v\n", c.Symbol, c.Exchange, c.Expiry, err)
+				continue
+			}
+			c.ConID = conID
+		}
+		details, err := fetchContractDetails(brokerContract{ContractID: c.ConID, Exchange: c.Exchange})
+		if err != nil {
+			log.Printf("Contract sync: no details for conId %d: %v\n", c.ConID, err)
+			continue
+		}
+		if err := upsertSyncedContract(c.ID, details); err != nil {
+			log.Printf("Contract sync: failed to store conId %d: %v\n", c.ConID, err)
+			continue
+		}
+		synced++
+	}
+	return synced, nil
+}
+
+// StartContractSync syncs the contract master every interval until the
+// process exits. conIDs lists the contracts in use, e.g. by setups.
+func StartContractSync(interval time.Duration, conIDs func() []int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if n, err := SyncContracts(conIDs()); err != nil {
+				log.Printf("Contract sync failed: %v\n", err)
+			} else {
+				log.Printf("Contract sync updated %d contracts\n", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func upsertSyncedContract(id int64, d brokerContractDetails) error {
+	if id == 0 {
+		_, err := db.Exec(`
+			INSERT INTO contracts (con_id, symbol, contract_type, exchange, currency, expiry,
+				multiplier, tick_size, trading_hours, liquid_hours, time_zone, description, synced_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NOW())
+			ON CONFLICT DO NOTHING
+		`, d.ContractID, d.Symbol, d.ContractType, d.Exchange, d.Currency, d.Expiry,
+			d.Multiplier, d.TickSize, d.TradingHours, d.LiquidHours, d.TimeZone, d.Description)
+		return err
+	}
+	// Keep what was entered by hand where the broker has nothing to say
+	_, err := db.Exec(`
+		UPDATE contracts SET con_id = $2,
+			currency = COALESCE(NULLIF($3, ''), currency),
+			expiry = COALESCE(NULLIF($4, ''), expiry),
+			multiplier = CASE WHEN $5::float8 > 0 THEN $5::float8 ELSE multiplier END,
+			tick_size = CASE WHEN $6::float8 > 0 THEN $6::float8 ELSE tick_size END,
+			trading_hours = COALESCE(NULLIF($7, ''), trading_hours),
+			liquid_hours = COALESCE(NULLIF($8, ''), liquid_hours),
+			time_zone = COALESCE(NULLIF($9, ''), time_zone),
+			description = COALESCE(NULLIF($10, ''), description),
+			synced_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+	`, id, d.ContractID, d.Currency, d.Expiry, d.Multiplier, d.TickSize,
+		d.TradingHours, d.LiquidHours, d.TimeZone, d.Description)
+	return err
+}
+
+// lookupContractID asks broker_api for the conId of a contract
+func lookupContractID(c brokerContract) (int, error) {
+	var conID int
+	if err := queryBrokerAPI("IB", "/api/IB/contract-id", c, &conID); err != nil {
+		return 0, err
+	}
+	if conID == 0 {
+		return 0, errors.New("contract is ambiguous or unknown")
+	}
+	return conID, nil
+}
+
+// fetchContractDetails asks broker_api for the details of a contract
+func fetchContractDetails(c brokerContract) (brokerContractDetails, error) {
+	var details []brokerContractDetails
+	if err := queryBrokerAPI("IB", "/api/IB/contract-details", c, &details); err != nil {
+		return brokerContractDetails{}, err
+	}
+	if len(details) != 1 {
+		return brokerContractDetails{}, fmt.Errorf("%d contracts matched", len(details))
+	}
+	return details[0], nil
+}
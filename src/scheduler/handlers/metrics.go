@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Every attempt of a broker_api call is timed, retries included. Errors are
+// attempts that failed or got a 5xx response, the same failures the circuit
+// counts.
+var (
+	brokerRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "scheduler",
+		Name:      "broker_api_request_duration_seconds",
+		Help:      "Duration of broker_api requests by broker and endpoint.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"broker", "endpoint"})
+	brokerRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scheduler",
+		Name:      "broker_api_errors_total",
+		Help:      "broker_api requests that failed or returned a 5xx status.",
+	}, []string{"broker", "endpoint"})
+)
+
+// brokerEndpoint names a call by the resource after /api/{broker}/, leaving
+// out the contract IDs and query in the rest of the path
+func brokerEndpoint(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) >= 3 && parts[0] == "api" {
+		return parts[2]
+	}
+	return path
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+)
+
+// The trades table is the authoritative record of what the strategies hold:
+// open positions are what is left of the filled trades once matched, and
+// working orders are the trades the broker accepted but has not filled yet.
+
+// WorkingOrder is a trade sent to the broker that is neither filled nor
+// cancelled
+type WorkingOrder struct {
+	ID            int64  `json:"id"`
+	BrokerOrderID int    `json:"broker_order_id"`
+	Broker        string `json:"broker"`
+	StrategyName  string `json:"strategy_name"`
+	SetupName     string `json:"setup_name"`
+	Symbol        string `json:"symbol"`
+}
+
+// CancelResult is broker_api's answer for one order it was asked to cancel
+type CancelResult struct {
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status"` // Cancelled, NotFound or Failed
+	Error   string `json:"error,omitempty"`
+}
+
+// OpenPositions returns the open positions of the given strategies, or of
+// every strategy when none are given, and the broker each contract is
+// traded through
+func OpenPositions(strategies []string) ([]PositionPnL, map[int]string, error) {
+	fills, brokers, err := fetchFills("", "", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(strategies) > 0 {
+		wanted := make(map[string]bool, len(strategies))
+		for _, name := range strategies {
+			wanted[name] = true
+		}
+		kept := fills[:0]
+		for _, f := range fills {
+			if wanted[f.StrategyName] {
+				kept = append(kept, f)
+			}
+		}
+		fills = kept
+	}
+	_, _, positions := MatchFills(fills, multiplierLookup())
+	return positions, brokers, nil
+}
+
+// WorkingOrders returns the orders of the given strategies, or of every
+// strategy when none are given, still working at the broker
+func WorkingOrders(strategies []string) ([]WorkingOrder, error) {
+	query := `
+		SELECT id, broker_order_id, broker, strategy_name, setup_name, symbol
+		FROM trades
+		WHERE status = 'Submitted' AND broker_order_id > 0
+		ORDER BY id
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	wanted := make(map[string]bool, len(strategies))
+	for _, name := range strategies {
+		wanted[name] = true
+	}
+	var orders []WorkingOrder
+	for rows.Next() {
+		var o WorkingOrder
+		if err := rows.Scan(&o.ID, &o.BrokerOrderID, &o.Broker, &o.StrategyName, &o.SetupName, &o.Symbol); err != nil {
+			return nil, err
+		}
+		if len(wanted) == 0 || wanted[o.StrategyName] {
+			orders = append(orders, o)
+		}
+	}
+	return orders, rows.Err()
+}
+
+// OrdersInFlight counts the orders of a strategy in a symbol the backend has
+// not finished with: waiting to be sent, or working at the broker
+func OrdersInFlight(strategy, symbol string) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM trades
+		WHERE strategy_name = $1 AND symbol = $2 AND status IN ('Pending', 'Submitted')
+	`, strategy, symbol).Scan(&count)
+	return count, err
+}
+
+// CancelOrders asks broker_api to cancel orders at a broker, or every open
+// order of the account when all is set
+func CancelOrders(broker string, orderIDs []int, all bool) ([]CancelResult, error) {
+	request := struct {
+		OrderIDs []int `json:"order_ids"`
+		All      bool  `json:"all"`
+	}{orderIDs, all}
+	if request.OrderIDs == nil {
+		request.OrderIDs = []int{}
+	}
+	var results []CancelResult
+	if err := postBrokerAPI(broker, fmt.Sprintf("/api/%s/cancel-orders", broker), request, &results); err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if result.Status == "Failed" {
+			log.Printf("[WARN] %s failed to cancel order %d: %s", broker, result.OrderID, result.Error)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// PnL is worked out from the filled trades: fills are matched first in, first
+// out within each strategy, setup and contract, and whatever is left open is
+// marked to the latest quote from broker_api. Realized PnL is net of the
+// commissions and fees paid, on the trading date they were paid.
+
+// Fill is a filled trade as the PnL engine sees it
+type Fill struct {
+	ID           int64
+	StrategyName string
+	SetupName    string
+	ContractID   int
+	Exchange     string
+	Symbol       string
+	Broker       string
+	Side         string // BUY or SELL
+	Quantity     float64
+	Price        float64
+	Commission   float64 // commission and fees of the whole fill
+	TradingDate  string
+	FilledAt     time.Time
+}
+
+// PositionPnL is the open position of a strategy setup in one contract
+type PositionPnL struct {
+	StrategyName  string    `json:"strategy_name"`
+	SetupName     string    `json:"setup_name"`
+	ContractID    int       `json:"contract_id"`
+	Exchange      string    `json:"exchange"`
+	Symbol        string    `json:"symbol"`
+	Quantity      float64   `json:"quantity"` // negative when short
+	AvgPrice      float64   `json:"avg_price"`
+	OpenedAt      time.Time `json:"opened_at"`
+	MarkPrice     float64   `json:"mark_price"`
+	Marked        bool      `json:"marked"` // false when no quote was available
+	Multiplier    float64   `json:"multiplier"`
+	UnrealizedPnL float64   `json:"unrealized_pnl"`
+}
+
+// StrategyPnL sums up one strategy
+type StrategyPnL struct {
+	StrategyName  string  `json:"strategy_name"`
+	Commissions   float64 `json:"commissions"` // included in realized_pnl
+	RealizedPnL   float64 `json:"realized_pnl"`
+	UnrealizedPnL float64 `json:"unrealized_pnl"`
+	TotalPnL      float64 `json:"total_pnl"`
+}
+
+// DailyPnL is the PnL a strategy realized on one trading date
+type DailyPnL struct {
+	TradingDate  string  `json:"trading_date"`
+	StrategyName string  `json:"strategy_name"`
+	RealizedPnL  float64 `json:"realized_pnl"`
+}
+
+// RoundTrip is a position in one contract from flat back to flat, or until
+// it flipped sides
+type RoundTrip struct {
+	StrategyName string
+	SetupName    string
+	ContractID   int
+	Symbol       string
+	Long         bool
+	OpenedAt     time.Time
+	ClosedAt     time.Time
+	TradingDate  string  // of the closing fill
+	PnL          float64 // net of the commissions of its fills
+}
+
+// PnLReport is the output of the PnL engine
+type PnLReport struct {
+	AsOf          time.Time     `json:"as_of"`
+	Commissions   float64       `json:"commissions"` // included in realized_pnl
+	RealizedPnL   float64       `json:"realized_pnl"`
+	UnrealizedPnL float64       `json:"unrealized_pnl"`
+	TotalPnL      float64       `json:"total_pnl"`
+	Strategies    []StrategyPnL `json:"strategies"`
+	Days          []DailyPnL    `json:"days"`
+	Positions     []PositionPnL `json:"positions"`
+}
+
+// Quantities below this are treated as flat
+const quantityEpsilon = 1e-9
+
+type pnlKey struct {
+	strategy   string
+	setup      string
+	contractID int
+}
+
+type openLot struct {
+	quantity float64 // negative when short
+	price    float64
+}
+
+// MatchFills matches fills, oldest first, into realized PnL per trading date,
+// the round trips closed and the lots still open. Each closing fill realizes
+// (exit - entry) * quantity * multiplier against the oldest opposite lots,
+// and every fill its commission. A round trip is charged the commissions of
+// the part of each fill that opened or closed it.
+func MatchFills(fills []Fill, multiplier func(contractID int, symbol string) float64) (realized map[string]map[string]float64, trips []RoundTrip, positions []PositionPnL) {
+	sorted := append([]Fill(nil), fills...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].FilledAt.Equal(sorted[j].FilledAt) {
+			return sorted[i].FilledAt.Before(sorted[j].FilledAt)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	realized = make(map[string]map[string]float64) // strategy -> trading date -> PnL
+	lots := make(map[pnlKey][]openLot)
+	open := make(map[pnlKey]*RoundTrip)
+	last := make(map[pnlKey]Fill)
+	var order []pnlKey
+	for _, fill := range sorted {
+		key := pnlKey{fill.StrategyName, fill.SetupName, fill.ContractID}
+		if _, seen := last[key]; !seen {
+			order = append(order, key)
+		}
+		last[key] = fill
+
+		remaining := fill.Quantity
+		if fill.Side == "SELL" {
+			remaining = -remaining
+		}
+		commissionPerUnit := 0.0
+		if fill.Quantity > 0 {
+			commissionPerUnit = fill.Commission / fill.Quantity
+		}
+		if realized[fill.StrategyName] == nil {
+			realized[fill.StrategyName] = make(map[string]float64)
+		}
+		if fill.Commission != 0 {
+			realized[fill.StrategyName][fill.TradingDate] -= fill.Commission
+		}
+		mult := multiplier(fill.ContractID, fill.Symbol)
+		book := lots[key]
+		for len(book) > 0 && math.Abs(remaining) > quantityEpsilon && (book[0].quantity > 0) != (remaining > 0) {
+			matched := math.Min(math.Abs(remaining), math.Abs(book[0].quantity))
+			direction := math.Copysign(1, book[0].quantity)
+			pnl := (fill.Price - book[0].price) * matched * direction * mult
+			realized[fill.StrategyName][fill.TradingDate] += pnl
+			open[key].PnL += pnl - commissionPerUnit*matched
+
+			book[0].quantity -= direction * matched
+			remaining += direction * matched
+			if math.Abs(book[0].quantity) <= quantityEpsilon {
+				book = book[1:]
+			}
+			if len(book) == 0 {
+				trip := open[key]
+				trip.ClosedAt, trip.TradingDate = fill.FilledAt, fill.TradingDate
+				trips = append(trips, *trip)
+				delete(open, key)
+			}
+		}
+		if math.Abs(remaining) > quantityEpsilon {
+			book = append(book, openLot{quantity: remaining, price: fill.Price})
+			if open[key] == nil {
+				open[key] = &RoundTrip{
+					StrategyName: fill.StrategyName,
+					SetupName:    fill.SetupName,
+					ContractID:   fill.ContractID,
+					Symbol:       fill.Symbol,
+					Long:         remaining > 0,
+					OpenedAt:     fill.FilledAt,
+				}
+			}
+			open[key].PnL -= commissionPerUnit * math.Abs(remaining)
+		}
+		lots[key] = book
+	}
+
+	for _, key := range order {
+		var quantity, cost float64
+		for _, lot := range lots[key] {
+			quantity += lot.quantity
+			cost += lot.quantity * lot.price
+		}
+		if math.Abs(quantity) <= quantityEpsilon {
+			continue
+		}
+		fill := last[key]
+		positions = append(positions, PositionPnL{
+			StrategyName: key.strategy,
+			SetupName:    key.setup,
+			ContractID:   key.contractID,
+			Exchange:     fill.Exchange,
+			Symbol:       fill.Symbol,
+			Quantity:     quantity,
+			AvgPrice:     cost / quantity,
+			OpenedAt:     open[key].OpenedAt,
+			Multiplier:   multiplier(key.contractID, fill.Symbol),
+		})
+	}
+	return realized, trips, positions
+}
+
+// ComputePnL runs the engine over the filled trades, or those of one
+// strategy, and marks the positions open at the end to market. Realized PnL
+// and commissions cover the trading dates from..to, either of which may be
+// empty for an open range.
+func ComputePnL(strategy, from, to string) (PnLReport, error) {
+	report := PnLReport{AsOf: time.Now(), Strategies: []StrategyPnL{}, Days: []DailyPnL{}, Positions: []PositionPnL{}}
+
+	fills, brokers, err := fetchFills(strategy, from, to)
+	if err != nil {
+		return report, err
+	}
+	realized, _, positions := MatchFills(fills, multiplierLookup())
+	inRange := func(date string) bool {
+		return (from == "" || date >= from) && (to == "" || date <= to)
+	}
+
+	totals := make(map[string]*StrategyPnL)
+	strategyTotal := func(name string) *StrategyPnL {
+		if totals[name] == nil {
+			totals[name] = &StrategyPnL{StrategyName: name}
+		}
+		return totals[name]
+	}
+	for _, fill := range fills {
+		if inRange(fill.TradingDate) {
+			strategyTotal(fill.StrategyName).Commissions += fill.Commission
+		}
+	}
+	for name, days := range realized {
+		for date, pnl := range days {
+			if !inRange(date) {
+				continue
+			}
+			report.Days = append(report.Days, DailyPnL{TradingDate: date, StrategyName: name, RealizedPnL: pnl})
+			strategyTotal(name).RealizedPnL += pnl
+		}
+	}
+
+	quotes := make(map[string]float64)
+	for i := range positions {
+		p := &positions[i]
+		quoteKey := fmt.Sprintf("%s/%s/%d", brokers[p.ContractID], p.Exchange, p.ContractID)
+		mark, ok := quotes[quoteKey]
+		if !ok {
+			mark, err = fetchMarkPrice(brokers[p.ContractID], p.Exchange, p.ContractID)
+			if err != nil {
+				log.Printf("Error marking %s (%d) to market: %v\n", p.Symbol, p.ContractID, err)
+			}
+			quotes[quoteKey] = mark
+		}
+		if mark > 0 {
+			p.MarkPrice, p.Marked = mark, true
+			p.UnrealizedPnL = (mark - p.AvgPrice) * p.Quantity * p.Multiplier
+		}
+		strategyTotal(p.StrategyName).UnrealizedPnL += p.UnrealizedPnL
+	}
+	report.Positions = append(report.Positions, positions...)
+
+	for _, total := range totals {
+		total.TotalPnL = total.RealizedPnL + total.UnrealizedPnL
+		report.Commissions += total.Commissions
+		report.RealizedPnL += total.RealizedPnL
+		report.UnrealizedPnL += total.UnrealizedPnL
+		report.Strategies = append(report.Strategies, *total)
+	}
+	report.TotalPnL = report.RealizedPnL + report.UnrealizedPnL
+	sort.Slice(report.Strategies, func(i, j int) bool {
+		return report.Strategies[i].StrategyName < report.Strategies[j].StrategyName
+	})
+	sort.Slice(report.Days, func(i, j int) bool {
+		if report.Days[i].TradingDate != report.Days[j].TradingDate {
+			return report.Days[i].TradingDate < report.Days[j].TradingDate
+		}
+		return report.Days[i].StrategyName < report.Days[j].StrategyName
+	})
+	return report, nil
+}
+
+// fetchFills reads the filled trades up to the trading date to, in the
+// order they were executed, and the broker each contract is traded through.
+// Fills are ordered by their execution time, or the row's last update for
+// fills recorded before execution times were. With a from date, the fills
+// of a contract before its last flat position ahead of from are left out, as
+// they cannot affect PnL from then on.
+func fetchFills(strategy, from, to string) ([]Fill, map[int]string, error) {
+	query := `
+		WITH fills AS (
+			SELECT t.id, t.strategy_name, t.setup_name, t.contract_id, t.exchange, t.symbol, t.broker,
+				UPPER(t.side) AS side, t.quantity, t.price, t.commission, t.trading_date,
+				COALESCE(c.filled_at, t.last_updated_at) AS filled_at
+			FROM trades t
+			LEFT JOIN trade_costs c ON c.trade_id = t.id
+			WHERE t.status = 'Filled' AND ($1 = '' OR t.strategy_name = $1)
+				AND ($3 = '' OR t.trading_date <= $3)
+		), positions AS (
+			SELECT *, SUM(CASE WHEN side = 'SELL' THEN -quantity ELSE quantity END) OVER (
+				PARTITION BY strategy_name, setup_name, contract_id ORDER BY filled_at, id
+			) AS position
+			FROM fills
+		), flat AS (
+			SELECT DISTINCT ON (strategy_name, setup_name, contract_id)
+				strategy_name, setup_name, contract_id, filled_at, id
+			FROM positions
+			WHERE $2 <> '' AND trading_date < $2 AND ABS(position) < 1e-9
+			ORDER BY strategy_name, setup_name, contract_id, filled_at DESC, id DESC
+		)
+		SELECT p.id, p.strategy_name, p.setup_name, p.contract_id, p.exchange, p.symbol, p.broker,
+			p.side, p.quantity, p.price, p.commission, p.trading_date, p.filled_at
+		FROM positions p
+		LEFT JOIN flat f ON f.strategy_name = p.strategy_name AND f.setup_name = p.setup_name
+			AND f.contract_id = p.contract_id
+		WHERE f.id IS NULL OR (p.filled_at, p.id) > (f.filled_at, f.id)
+		ORDER BY p.filled_at, p.id
+	`
+	rows, err := db.Query(query, strategy, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var fills []Fill
+	brokers := make(map[int]string)
+	for rows.Next() {
+		var f Fill
+		err := rows.Scan(&f.ID, &f.StrategyName, &f.SetupName, &f.ContractID, &f.Exchange, &f.Symbol,
+			&f.Broker, &f.Side, &f.Quantity, &f.Price, &f.Commission, &f.TradingDate, &f.FilledAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		fills = append(fills, f)
+		brokers[f.ContractID] = f.Broker
+	}
+	return fills, brokers, rows.Err()
+}
+
+// defaultMultipliers covers the usual CME contracts until the contract
+// master lists them
+var defaultMultipliers = map[string]float64{
+	"ES": 50, "MES": 5, "NQ": 20, "MNQ": 2, "YM": 5, "MYM": 0.5, "RTY": 50, "M2K": 5,
+	"CL": 1000, "MCL": 100, "GC": 100, "MGC": 10, "SI": 5000, "ZN": 1000, "ZB": 1000,
+}
+
+// multiplierLookup returns the point value of a contract from the contract
+// master, by conId and then by future symbol, 1 when unknown
+func multiplierLookup() func(contractID int, symbol string) float64 {
+	byConID, bySymbol, err := ContractMultipliers()
+	if err != nil {
+		log.Printf("Error reading contract multipliers: %v\n", err)
+	}
+	return multiplierFrom(byConID, bySymbol)
+}
+
+// multiplierFrom looks multipliers up by conId, then by symbol among the
+// futures of the contract master and then in defaultMultipliers
+func multiplierFrom(byConID map[int]float64, bySymbol map[string]float64) func(contractID int, symbol string) float64 {
+	return func(contractID int, symbol string) float64 {
+		if m, ok := byConID[contractID]; ok {
+			return m
+		}
+		if m, ok := bySymbol[symbol]; ok {
+			return m
+		}
+		if m, ok := defaultMultipliers[symbol]; ok {
+			return m
+		}
+		return 1
+	}
+}
+
+// fetchMarkPrice returns the last price of a contract, or the mid when there
+// has been no trade
+func fetchMarkPrice(broker, exchange string, contractID int) (float64, error) {
+	if broker == "" {
+		broker = "IB"
+	}
+	var quote struct {
+		Bid  float64 `json:"bid"`
+		Ask  float64 `json:"ask"`
+		Last float64 `json:"last"`
+	}
+	if err := getBrokerAPI(broker, fmt.Sprintf("/api/%s/quote/%s/%d", broker, exchange, contractID), &quote); err != nil {
+		return 0, err
+	}
+	if quote.Last > 0 {
+		return quote.Last, nil
+	}
+	if quote.Bid > 0 && quote.Ask > 0 {
+		return (quote.Bid + quote.Ask) / 2, nil
+	}
+	return 0, fmt.Errorf("no price in quote")
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMatchFills(t *testing.T) {
+	start := time.Date(2025, 3, 3, 14, 30, 0, 0, time.UTC)
+	fill := func(minute int, side string, quantity, price, commission float64) Fill {
+		return Fill{
+			ID: int64(minute), StrategyName: "S", SetupName: "A", ContractID: 1, Symbol: "MES",
+			Side: side, Quantity: quantity, Price: price, Commission: commission,
+			TradingDate: "2025-03-03", FilledAt: start.Add(time.Duration(minute) * time.Minute),
+		}
+	}
+	type position struct{ quantity, avgPrice float64 }
+
+	tests := []struct {
+		name     string
+		fills    []Fill
+		realized float64
+		trips    []float64 // PnL of each closed round trip
+		position *position
+	}{
+		{
+			name:     "round trip",
+			fills:    []Fill{fill(0, "BUY", 2, 100, 0), fill(1, "SELL", 2, 101, 0)},
+			realized: 2 * 1 * 5,
+			trips:    []float64{10},
+		},
+		{
+			name:     "partial close keeps the rest open at its entry price",
+			fills:    []Fill{fill(0, "BUY", 3, 100, 0), fill(1, "SELL", 1, 110, 0)},
+			realized: 10 * 5,
+			position: &position{2, 100},
+		},
+		{
+			name:     "closes the oldest lot first",
+			fills:    []Fill{fill(0, "BUY", 1, 100, 0), fill(1, "BUY", 1, 104, 0), fill(2, "SELL", 1, 106, 0)},
+			realized: 6 * 5,
+			position: &position{1, 104},
+		},
+		{
+			name:     "short round trip",
+			fills:    []Fill{fill(0, "SELL", 1, 100, 0), fill(1, "BUY", 1, 98, 0)},
+			realized: 2 * 5,
+			trips:    []float64{10},
+		},
+		{
+			name:     "reversal through zero opens the rest on the other side",
+			fills:    []Fill{fill(0, "BUY", 1, 100, 0), fill(1, "SELL", 3, 90, 0)},
+			realized: -10 * 5,
+			trips:    []float64{-50},
+			position: &position{-2, 90},
+		},
+		{
+			name:     "fills are matched in execution order, not as given",
+			fills:    []Fill{fill(1, "SELL", 1, 110, 0), fill(0, "BUY", 1, 100, 0)},
+			realized: 10 * 5,
+			trips:    []float64{50},
+		},
+		{
+			name:     "commissions are netted per unit",
+			fills:    []Fill{fill(0, "BUY", 2, 100, 4), fill(1, "SELL", 2, 101, 4)},
+			realized: 10 - 8,
+			trips:    []float64{2},
+		},
+		{
+			name:     "a partial close is charged its share of the commission",
+			fills:    []Fill{fill(0, "BUY", 2, 100, 4), fill(1, "SELL", 1, 101, 2), fill(2, "SELL", 1, 102, 2)},
+			realized: 5 + 10 - 8,
+			trips:    []float64{7},
+		},
+		{
+			name:     "a reversal splits its commission between the trips",
+			fills:    []Fill{fill(0, "BUY", 1, 100, 1), fill(1, "SELL", 2, 100, 2), fill(2, "BUY", 1, 99, 1)},
+			realized: 5 - 4,
+			trips:    []float64{-2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realized, trips, positions := MatchFills(tt.fills, func(int, string) float64 { return 5 })
+			if got := realized["S"]["2025-03-03"]; math.Abs(got-tt.realized) > 1e-9 {
+				t.Errorf("realized = %v, want %v", got, tt.realized)
+			}
+			if len(trips) != len(tt.trips) {
+				t.Fatalf("got %d round trips, want %d", len(trips), len(tt.trips))
+			}
+			for i, trip := range trips {
+				if math.Abs(trip.PnL-tt.trips[i]) > 1e-9 {
+					t.Errorf("round trip %d PnL = %v, want %v", i, trip.PnL, tt.trips[i])
+				}
+			}
+			switch {
+			case tt.position == nil && len(positions) > 0:
+				t.Errorf("got open positions %+v, want none", positions)
+			case tt.position != nil && len(positions) != 1:
+				t.Fatalf("got %d open positions, want 1", len(positions))
+			case tt.position != nil:
+				p := positions[0]
+				if p.Quantity != tt.position.quantity || p.AvgPrice != tt.position.avgPrice || p.Multiplier != 5 {
+					t.Errorf("position = %v @ %v x%v, want %v @ %v x5", p.Quantity, p.AvgPrice, p.Multiplier,
+						tt.position.quantity, tt.position.avgPrice)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchFillsKeepsSetupsApart(t *testing.T) {
+	at := time.Date(2025, 3, 3, 14, 30, 0, 0, time.UTC)
+	fills := []Fill{
+		{ID: 1, StrategyName: "S", SetupName: "A", ContractID: 1, Side: "BUY", Quantity: 1, Price: 100, TradingDate: "2025-03-03", FilledAt: at},
+		{ID: 2, StrategyName: "S", SetupName: "B", ContractID: 1, Side: "SELL", Quantity: 1, Price: 105, TradingDate: "2025-03-03", FilledAt: at.Add(time.Minute)},
+	}
+	realized, trips, positions := MatchFills(fills, func(int, string) float64 { return 1 })
+	if realized["S"]["2025-03-03"] != 0 || len(trips) != 0 || len(positions) != 2 {
+		t.Errorf("setups were netted: realized %v, %d trips, %d positions", realized, len(trips), len(positions))
+	}
+}
+
+func TestMultiplierFrom(t *testing.T) {
+	multiplier := multiplierFrom(map[int]float64{42: 12.5}, map[string]float64{"MES": 7})
+	tests := []struct {
+		contractID int
+		symbol     string
+		want       float64
+	}{
+		{42, "MES", 12.5}, // conId beats symbol
+		{1, "MES", 7},     // contract master beats the defaults
+		{1, "ES", 50},     // default
+		{7, "ES", 50},     // stored with an unknown multiplier, so not in byConID
+		{1, "XYZ", 1},     // unknown
+	}
+	for _, tt := range tests {
+		if got := multiplier(tt.contractID, tt.symbol); got != tt.want {
+			t.Errorf("multiplier(%d, %s) = %v, want %v", tt.contractID, tt.symbol, got, tt.want)
+		}
+	}
+	if got := multiplierFrom(nil, nil)(1, "ES"); got != 50 {
+		t.Errorf("without a contract master, multiplier(ES) = %v, want 50", got)
+	}
+}
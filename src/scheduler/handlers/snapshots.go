@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// AccountSnapshot is the account summary at one point in time
+type AccountSnapshot struct {
+	TakenAt        time.Time `json:"time"`
+	NetLiquidation float64   `json:"net_liquidation"`
+	MaintMargin    float64   `json:"maint_margin"`
+	RealizedPnL    float64   `json:"realized_pnl"`
+	UnrealizedPnL  float64   `json:"unrealized_pnl"`
+}
+
+// InitAccountSnapshots creates the account_snapshots table
+func InitAccountSnapshots() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS account_snapshots (
+		id BIGSERIAL PRIMARY KEY,
+		taken_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		net_liquidation FLOAT NOT NULL,
+		maint_margin FLOAT NOT NULL,
+		realized_pnl FLOAT NOT NULL,
+		unrealized_pnl FLOAT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS account_snapshots_taken_at_idx ON account_snapshots (taken_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create account_snapshots table: %v", err)
+	}
+	return nil
+}
+
+// StartAccountSnapshots records the account summary every interval until the
+// process exits
+func StartAccountSnapshots(interval time.Duration) {
+	log.Printf("Recording account snapshots every %s\n", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := recordAccountSnapshot(); err != nil {
+				log.Printf("Error recording account snapshot: %v\n", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func recordAccountSnapshot() error {
+	summary, err := fetchAccountSummary()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO account_snapshots (taken_at, net_liquidation, maint_margin, realized_pnl, unrealized_pnl)
+		VALUES ($1, $2, $3, $4, $5)
+	`, time.Now(), summary.NetLiquidation, summary.FullMaintMarginReq, summary.RealizedPnL, summary.UnrealizedPnL)
+	return err
+}
+
+// fetchAccountSummary asks broker_api for the current account values
+func fetchAccountSummary() (AccountSummaryResponse, error) {
+	var summary AccountSummaryResponse
+	if err := getBrokerAPI("IB", "/api/IB/accountSummary", &summary); err != nil {
+		log.Println("Error getting account summary")
+		return summary, err
+	}
+	return summary, nil
+}
+
+// PreviousClose returns the last snapshot taken before the start of the day
+// containing now, in the scheduler's time zone. ok is false when there is none.
+func PreviousClose(now time.Time) (snapshot AccountSnapshot, ok bool, err error) {
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	err = db.QueryRow(`
+		SELECT taken_at, net_liquidation, maint_margin, realized_pnl, unrealized_pnl
+		FROM account_snapshots
+		WHERE taken_at < $1
+		ORDER BY taken_at DESC
+		LIMIT 1
+	`, startOfDay).Scan(&snapshot.TakenAt, &snapshot.NetLiquidation, &snapshot.MaintMargin,
+		&snapshot.RealizedPnL, &snapshot.UnrealizedPnL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return snapshot, false, nil
+	}
+	return snapshot, err == nil, err
+}
+
+// EquityCurve returns snapshots taken in [from, to). With daily set only the
+// last snapshot of each day is kept, days being cut in the time zone tz
+// (e.g. America/New_York).
+func EquityCurve(from, to time.Time, daily bool, tz string) ([]AccountSnapshot, error) {
+	query := `
+		SELECT taken_at, net_liquidation, maint_margin, realized_pnl, unrealized_pnl
+		FROM account_snapshots
+		WHERE taken_at >= $1 AND taken_at < $2
+		ORDER BY taken_at
+	`
+	args := []interface{}{from, to}
+	if daily {
+		query = `
+		SELECT taken_at, net_liquidation, maint_margin, realized_pnl, unrealized_pnl
+		FROM (
+			SELECT DISTINCT ON ((taken_at AT TIME ZONE $3)::date) *
+			FROM account_snapshots
+			WHERE taken_at >= $1 AND taken_at < $2
+			ORDER BY (taken_at AT TIME ZONE $3)::date, taken_at DESC
+		) closes
+		ORDER BY taken_at
+		`
+		args = append(args, tz)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []AccountSnapshot{}
+	for rows.Next() {
+		var s AccountSnapshot
+		if err := rows.Scan(&s.TakenAt, &s.NetLiquidation, &s.MaintMargin, &s.RealizedPnL, &s.UnrealizedPnL); err != nil {
+			return nil, err
+		}
+		points = append(points, s)
+	}
+	return points, rows.Err()
+}
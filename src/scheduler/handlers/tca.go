@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Transaction cost analysis compares each filled order with the prices the
+// backend captured in trade_costs: the decision price, the quote mid when
+// the instruction came in, and the arrival price, the mid just before the order went
+// to the broker. Slippage is positive when it cost money, i.e. a buy filled
+// above the benchmark or a sell below it. Ticks use the tick size of the
+// contract master and dollars its multiplier; orders of contracts without a
+// tick size are left out of the tick averages. Commissions and fees are
+// reported next to slippage and both make up the total cost.
+
+// TCAQuery selects the orders to analyse. From and To are inclusive trading
+// dates (YYYY-MM-DD).
+type TCAQuery struct {
+	StrategyName string
+	From         string
+	To           string
+}
+
+// TCABucket sums up the costs of a group of filled orders. Tick figures are
+// averages per contract traded, dollar figures totals.
+type TCABucket struct {
+	Key                   string  `json:"key"`
+	Orders                int     `json:"orders"`
+	Quantity              float64 `json:"quantity"`
+	ArrivalSlippageTicks  float64 `json:"arrival_slippage_ticks"`
+	ArrivalSlippage       float64 `json:"arrival_slippage"`
+	DecisionSlippageTicks float64 `json:"decision_slippage_ticks"`
+	DecisionSlippage      float64 `json:"decision_slippage"`
+	SpreadTicks           float64 `json:"spread_ticks"`         // at submit
+	TimeToFill            float64 `json:"time_to_fill_seconds"` // average
+	Commissions           float64 `json:"commissions"`
+	TotalCost             float64 `json:"total_cost"` // arrival slippage and commissions
+
+	sums tcaSums
+}
+
+// tcaSums accumulates a bucket; each average has its own weight since a
+// benchmark or tick size can be missing for some orders
+type tcaSums struct {
+	arrivalTicks, arrivalQty   float64
+	decisionTicks, decisionQty float64
+	spreadTicks, spreadQty     float64
+	fillSeconds                float64
+	timedOrders                int
+}
+
+// TCAReport is the output of the TCA engine. Time of day buckets are the
+// hour the order was sent, in the scheduler's time zone.
+type TCAReport struct {
+	From        string      `json:"from"`
+	To          string      `json:"to"`
+	Overall     TCABucket   `json:"overall"`
+	ByStrategy  []TCABucket `json:"by_strategy"`
+	ByOrderType []TCABucket `json:"by_order_type"`
+	ByTimeOfDay []TCABucket `json:"by_time_of_day"`
+}
+
+// orderCost is a filled order with its benchmarks
+type orderCost struct {
+	StrategyName  string
+	ContractID    int
+	Symbol        string
+	Side          string
+	OrderType     string
+	Quantity      float64
+	DecisionPrice float64
+	ArrivalPrice  float64
+	Spread        float64
+	SubmittedAt   sql.NullTime
+	FillPrice     float64
+	FilledAt      sql.NullTime
+	Commission    float64
+}
+
+// ComputeTCA returns the transaction costs of the filled orders of the period
+func ComputeTCA(q TCAQuery) (TCAReport, error) {
+	report := TCAReport{
+		From: q.From, To: q.To,
+		Overall:     TCABucket{Key: "all"},
+		ByStrategy:  []TCABucket{},
+		ByOrderType: []TCABucket{},
+		ByTimeOfDay: []TCABucket{},
+	}
+	orders, err := fetchOrderCosts(q)
+	if err != nil {
+		return report, err
+	}
+
+	ticksByConID, ticksBySymbol, err := ContractTickSizes()
+	if err != nil {
+		log.Printf("Error reading contract tick sizes: %v\n", err)
+	}
+	multiplier := multiplierLookup()
+	byStrategy := make(map[string]*TCABucket)
+	byOrderType := make(map[string]*TCABucket)
+	byHour := make(map[string]*TCABucket)
+	bucket := func(buckets map[string]*TCABucket, key string) *TCABucket {
+		if buckets[key] == nil {
+			buckets[key] = &TCABucket{Key: key}
+		}
+		return buckets[key]
+	}
+
+	for _, o := range orders {
+		tick, ok := ticksByConID[o.ContractID]
+		if !ok {
+			tick = ticksBySymbol[o.Symbol]
+		}
+		hour := "unknown"
+		if o.SubmittedAt.Valid {
+			hour = o.SubmittedAt.Time.In(time.Local).Format("15:00")
+		}
+		for _, b := range []*TCABucket{
+			&report.Overall,
+			bucket(byStrategy, o.StrategyName),
+			bucket(byOrderType, o.OrderType),
+			bucket(byHour, hour),
+		} {
+			b.add(o, tick, multiplier(o.ContractID, o.Symbol))
+		}
+	}
+
+	report.Overall.finish()
+	for _, group := range []struct {
+		buckets map[string]*TCABucket
+		out     *[]TCABucket
+	}{{byStrategy, &report.ByStrategy}, {byOrderType, &report.ByOrderType}, {byHour, &report.ByTimeOfDay}} {
+		for _, b := range group.buckets {
+			b.finish()
+			*group.out = append(*group.out, *b)
+		}
+		sort.Slice(*group.out, func(i, j int) bool { return (*group.out)[i].Key < (*group.out)[j].Key })
+	}
+	return report, nil
+}
+
+// add counts a filled order into the bucket
+func (b *TCABucket) add(o orderCost, tick, multiplier float64) {
+	direction := 1.0
+	if o.Side == "SELL" {
+		direction = -1.0
+	}
+	b.Orders++
+	b.Quantity += o.Quantity
+	b.Commissions += o.Commission
+	if o.ArrivalPrice > 0 {
+		slippage := (o.FillPrice - o.ArrivalPrice) * direction
+		b.ArrivalSlippage += slippage * o.Quantity * multiplier
+		if tick > 0 {
+			b.sums.arrivalTicks += slippage / tick * o.Quantity
+			b.sums.arrivalQty += o.Quantity
+		}
+	}
+	if o.DecisionPrice > 0 {
+		slippage := (o.FillPrice - o.DecisionPrice) * direction
+		b.DecisionSlippage += slippage * o.Quantity * multiplier
+		if tick > 0 {
+			b.sums.decisionTicks += slippage / tick * o.Quantity
+			b.sums.decisionQty += o.Quantity
+		}
+	}
+	if o.ArrivalPrice > 0 && tick > 0 {
+		b.sums.spreadTicks += o.Spread / tick * o.Quantity
+		b.sums.spreadQty += o.Quantity
+	}
+	if o.SubmittedAt.Valid && o.FilledAt.Valid && !o.FilledAt.Time.Before(o.SubmittedAt.Time) {
+		b.sums.fillSeconds += o.FilledAt.Time.Sub(o.SubmittedAt.Time).Seconds()
+		b.sums.timedOrders++
+	}
+}
+
+// finish turns the sums of a bucket into averages
+func (b *TCABucket) finish() {
+	average := func(sum, weight float64) float64 {
+		if weight == 0 {
+			return 0
+		}
+		return sum / weight
+	}
+	b.ArrivalSlippageTicks = average(b.sums.arrivalTicks, b.sums.arrivalQty)
+	b.DecisionSlippageTicks = average(b.sums.decisionTicks, b.sums.decisionQty)
+	b.SpreadTicks = average(b.sums.spreadTicks, b.sums.spreadQty)
+	b.TimeToFill = average(b.sums.fillSeconds, float64(b.sums.timedOrders))
+	b.TotalCost = b.ArrivalSlippage + b.Commissions
+}
+
+// fetchOrderCosts reads the filled orders of the period with their
+// benchmarks, none when the backend has not created trade_costs yet
+func fetchOrderCosts(q TCAQuery) ([]orderCost, error) {
+	rows, err := db.Query(`
+		SELECT t.strategy_name, t.contract_id, t.symbol, UPPER(t.side), t.order_type, t.quantity,
+			c.decision_price, c.arrival_price, c.spread, c.submitted_at, c.fill_price, c.filled_at, t.commission
+		FROM trade_costs c
+		JOIN trades t ON t.id = c.trade_id
+		WHERE t.status = 'Filled' AND c.fill_price > 0
+			AND ($1 = '' OR t.strategy_name = $1)
+			AND t.trading_date BETWEEN $2 AND $3
+		ORDER BY t.id
+	`, q.StrategyName, q.From, q.To)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order costs: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []orderCost
+	for rows.Next() {
+		var o orderCost
+		err := rows.Scan(&o.StrategyName, &o.ContractID, &o.Symbol, &o.Side, &o.OrderType, &o.Quantity,
+			&o.DecisionPrice, &o.ArrivalPrice, &o.Spread, &o.SubmittedAt, &o.FillPrice, &o.FilledAt, &o.Commission)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
@@ -25,6 +25,9 @@ type Trade struct {
 	Status       string    `json:"status"`
 	BrokerOrderID int      `json:"broker_order_id"`
 	UpdatedAt 	  string `json:"updated_at"`
+	ScriptVersion string `json:"script_version"`
+	SetupName     string `json:"setup_name"`
+	ChangeSeq     int64  `json:"change_seq"`
 }
 
 // move these structs to models
@@ -39,6 +42,7 @@ type Position struct {
 }
 
 var db *sql.DB
+var dbConnStr string // kept for the LISTEN connection of the trade feed
 var positions map[string]Position
 
 // InitDB initializes the database connection
@@ -49,13 +53,13 @@ func InitDB() error {
 	password := getEnv("DB_PASSWORD", "tradepass")
 	dbname := getEnv("DB_NAME", "tradedb")
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+	dbConnStr = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 
 	var err error
 	// Connect with retries to allow database to initialize
 	for i := 0; i < 10; i++ {
-		db, err = sql.Open("postgres", connStr)
+		db, err = sql.Open("postgres", dbConnStr)
 		if err == nil {
 			err = db.Ping()
 			if err == nil {
@@ -85,71 +89,6 @@ func CloseDB() {
 	}
 }
 
-// SSETradesHandler handles the SSE endpoint for streaming recent trades
-func SSETradesHandler(w http.ResponseWriter, r *http.Request) {
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // For CORS
-
-	// Get the client's flusher to flush data in chunks
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
-	}
-
-	// Create a channel to signal client disconnection
-	clientClosed := r.Context().Done()
-
-	// Keep the connection open until client disconnects
-	for {
-		select {
-		case <-clientClosed:
-			log.Println("Client closed connection")
-			return
-		default:
-			// Fetch trades from the last 24 hours
-			trades, err := fetchRecentTrades()
-			if err != nil {
-				log.Printf("Error fetching trades: %v\n", err)
-				// Send error event to client
-				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
-				flusher.Flush()
-				time.Sleep(5 * time.Second) // Wait before retrying
-				continue
-			}
-
-			// Convert trades to a map with trade ID as key for the front-end
-			tradesMap := make(map[string]Trade)
-			for _, trade := range trades {
-				// Use ID as string key
-				key := fmt.Sprintf("trade-%d", trade.ID)
-				tradesMap[key] = trade
-			}
-
-			// Convert the map to JSON
-			tradesJSON, err := json.Marshal(tradesMap)
-			if err != nil {
-				log.Printf("Error marshaling trades map: %v\n", err)
-				continue
-			}
-
-			// Send the event with all trades at once
-			fmt.Fprintf(w, "data: %s\n\n", tradesJSON)
-			flusher.Flush()
-
-			// Send a heartbeat to keep connection alive
-			fmt.Fprintf(w, "event: heartbeat\ndata: %s\n\n", time.Now().Format(time.RFC3339))
-			flusher.Flush()
-
-			// Wait before polling again
-			time.Sleep(2 * time.Second)
-		}
-	}
-}
-
 // fetchRecentTrades retrieves trades from the last 24 hours
 func fetchRecentTrades() ([]Trade, error) {
 	// Calculate timestamp for 24 hours ago
@@ -158,7 +97,8 @@ func fetchRecentTrades() ([]Trade, error) {
 	// Query to get trades from the last 24 hours
 	query := `
 		SELECT id, strategy_name, exchange, symbol, side, quantity,
-			price, broker_order_id, status, last_updated_at
+			price, broker_order_id, status, last_updated_at, script_version,
+			setup_name, COALESCE(change_seq, 0)
 		FROM trades
 		WHERE last_updated_at >= $1
 		ORDER BY last_updated_at DESC
@@ -180,7 +120,8 @@ func fetchRecentTrades() ([]Trade, error) {
 		err := rows.Scan(
 			&t.ID, &t.StrategyName, &t.Exchange, &t.Symbol,
 			&t.Side, &t.Quantity, &t.Price, &t.BrokerOrderID,
-			&t.Status, &updatedAt,
+			&t.Status, &updatedAt, &t.ScriptVersion,
+			&t.SetupName, &t.ChangeSeq,
 		)
 		if err != nil {
 			return nil, err
@@ -203,6 +144,8 @@ type KPIMetrics struct {
 	NetLiquidation 		  KPIMetric `json:"netLiquidation"`
 	UnrealizedPnl    	  KPIMetric `json:"unrealizedPnl"`
 	RealizedPnL   	 	  KPIMetric `json:"realizedPnl"`
+	Commissions           KPIMetric `json:"commissions"` // paid today
+	StrategyPnL           []StrategyPnL `json:"strategyPnl,omitempty"`
 }
 
 // KPIMetric represents a single KPI metric with its value and change
@@ -220,12 +163,36 @@ type AccountSummaryResponse struct {
 	RealizedPnL        float64 `json:"RealizedPnL"`
 }
 
+// kpiMetric builds a metric whose change is measured against the previous
+// close, in percent or, for PnL that can sit at zero, in dollars
+func kpiMetric(title string, value float64, previous *AccountSnapshot, field func(*AccountSnapshot) float64, percent bool) KPIMetric {
+	metric := KPIMetric{
+		Title:      title,
+		Value:      fmt.Sprintf("%.2f", value),
+		IsPositive: value >= 0.,
+	}
+	if previous == nil {
+		return metric
+	}
+	change := value - field(previous)
+	metric.IsPositive = change >= 0
+	if !percent {
+		metric.Change = getChangePrefix(change) + formatCurrency(change)
+		return metric
+	}
+	if field(previous) == 0 {
+		return metric
+	}
+	pct := change / abs(field(previous)) * 100
+	metric.Change = fmt.Sprintf("%s%.1f%%", getChangePrefix(pct), pct)
+	return metric
+}
 func formatCurrency(value float64) string{
 
 	if value>=0{
-		return fmt.Sprintf("$%,.2f", value)
+		return fmt.Sprintf("$%.2f", value)
 	}
-	return fmt.Sprintf("-$%,.2f", math.Abs(value))
+	return fmt.Sprintf("-$%.2f", math.Abs(value))
 }
 
 
@@ -235,7 +202,6 @@ func SSEKPIMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // For CORS
 
 	// Get the client's flusher to flush data in chunks
 	flusher, ok := w.(http.Flusher)
@@ -303,58 +269,41 @@ func fetchKPIMetrics() (KPIMetrics, error) {
 			Title: "Realized PnL",
 		},
 	}
-	targetURL := "http://broker_api:8000/api/IB/accountSummary"
-	// Create a new request
-	resp, err := http.Get(targetURL)
+	apiResponse, err := fetchAccountSummary()
 	if err != nil {
-		log.Println("Error getting account summary")
 		return metrics, err
 	}
-	defer resp.Body.Close()
-	// Parse the raw API response
-	var apiResponse AccountSummaryResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		log.Println("Failed to parse Broker API response")
-		return metrics, err
+	// Changes are against the previous close, none until a day was recorded
+	var previous *AccountSnapshot
+	if snapshot, ok, err := PreviousClose(time.Now()); err != nil {
+		log.Printf("Error fetching previous close: %v\n", err)
+	} else if ok {
+		previous = &snapshot
 	}
 
 	// Convert to KPIMetrics structure
 	metrics = KPIMetrics{
-		FullMaintMarginReq: KPIMetric{
-			Title:      "Maint. Margin",
-			Value:      fmt.Sprintf("%.2f",apiResponse.FullMaintMarginReq),
-			Change:     "", // You'll need to calculate this based on previous values
-			IsPositive: apiResponse.FullMaintMarginReq >= 0.,
-		},
-		NetLiquidation: KPIMetric{
-			Title:      "Net Liquidation",
-			Value:      fmt.Sprintf("%.2f",apiResponse.NetLiquidation),
-			Change:     "",
-			IsPositive: apiResponse.NetLiquidation >= 0.,
-		},
-		UnrealizedPnl: KPIMetric{
-			Title:      "Unrealized PnL",
-			Value:      fmt.Sprintf("%.2f",apiResponse.UnrealizedPnL),
-			Change:     "",
-			IsPositive: apiResponse.UnrealizedPnL >= 0.,
-		},
-		RealizedPnL: KPIMetric{
-			Title:      "Realized PnL",
-			Value:      fmt.Sprintf("%.2f",apiResponse.RealizedPnL),
-			Change:     "",
-			IsPositive: apiResponse.RealizedPnL >= 0.,
-		},
+		FullMaintMarginReq: kpiMetric("Maint. Margin", apiResponse.FullMaintMarginReq, previous, func(s *AccountSnapshot) float64 { return s.MaintMargin }, true),
+		NetLiquidation:     kpiMetric("Net Liquidation", apiResponse.NetLiquidation, previous, func(s *AccountSnapshot) float64 { return s.NetLiquidation }, true),
+		UnrealizedPnl:      kpiMetric("Unrealized PnL", apiResponse.UnrealizedPnL, previous, func(s *AccountSnapshot) float64 { return s.UnrealizedPnL }, false),
+		RealizedPnL:        kpiMetric("Realized PnL", apiResponse.RealizedPnL, previous, func(s *AccountSnapshot) float64 { return s.RealizedPnL }, false),
 	}
 
-	// // Get real realized PnL for the last 7 days from database
-	// realizedPnL, pnlChange, err := fetchRealizedPnL()
-	// if err != nil {
-	// 	return metrics, err
-	// }
+	// Commissions and fees of today's fills
+	metrics.Commissions = KPIMetric{Title: "Commissions", Value: "0.00"}
+	if commissions, err := commissionsOn(time.Now().Format("2006-01-02")); err != nil {
+		log.Printf("Error fetching commissions: %v\n", err)
+	} else {
+		metrics.Commissions.Value = fmt.Sprintf("%.2f", commissions)
+	}
 
-	// metrics.RealizedPnL.Value = fmt.Sprintf("$%.2f", realizedPnL)
-	// metrics.RealizedPnL.Change = fmt.Sprintf("%s%.1f%%", getChangePrefix(pnlChange), abs(pnlChange))
-	// metrics.RealizedPnL.IsPositive = pnlChange >= 0
+	// PnL per strategy from the filled trades, net of commissions
+	pnl, err := ComputePnL("", "", "")
+	if err != nil {
+		log.Printf("Error computing strategy PnL: %v\n", err)
+	} else {
+		metrics.StrategyPnL = pnl.Strategies
+	}
 
 	// // Generate dummy data for other metrics
 	
@@ -382,64 +331,14 @@ func fetchKPIMetrics() (KPIMetrics, error) {
 	return metrics, nil
 }
 
-// fetchRealizedPnL retrieves the realized PnL from the last 7 days
-func fetchRealizedPnL() (float64, float64, error) {
-	// Calculate timestamps for current period and previous period
-	now := time.Now()
-	sevenDaysAgo := now.AddDate(0, 0, -7)
-	fourteenDaysAgo := now.AddDate(0, 0, -14)
-
-	// Query for current period (last 7 days)
-	currentQuery := `
-		SELECT 
-			coalesce(SUM(
-                (CASE WHEN t.side='BUY'
-				 	  THEN -1 * t.quantity*t.price
-				 	  ELSE t.quantity * t.price END) * fc.multiplier
-				),
-			0)  AS total_adjusted_pnl
-		FROM 
-			trades t
-		JOIN 
-			futures_contracts fc ON t.symbol = fc.symbol
-		WHERE
-			t.last_updated_at BETWEEN $1 AND $2
-	`
-	var currentPnL float64
-	err := db.QueryRow(currentQuery, sevenDaysAgo, now).Scan(&currentPnL)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error querying current period PnL: %v", err)
-	}
-	fmt.Println("Current Pnl:", currentPnL)
-
-	// Query for previous period (7-14 days ago)
-	previousQuery := `
-		SELECT 
-		coalesce(SUM(
-                (CASE WHEN t.side='BUY'
-				 THEN -1 * t.quantity*t.price
-				 ELSE t.quantity * t.price END) * fc.multiplier
-				),0)  AS total_adjusted_pnl
-                FROM 
-			trades t
-		JOIN 
-			futures_contracts fc ON t.symbol = fc.symbol
-		WHERE
-			t.last_updated_at BETWEEN $1 AND $2
-	`
-	var previousPnL float64
-	err = db.QueryRow(previousQuery, fourteenDaysAgo, sevenDaysAgo).Scan(&previousPnL)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error querying previous period PnL: %v", err)
-	}
-
-	// Calculate percentage change
-	percentChange := 0.0
-	if previousPnL != 0 {
-		percentChange = ((currentPnL - previousPnL) / abs(previousPnL)) * 100
-	}
-
-	return currentPnL, percentChange, nil
+// commissionsOn returns the commissions and fees of the fills of a trading date
+func commissionsOn(tradingDate string) (float64, error) {
+	var commissions float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(commission), 0) FROM trades
+		WHERE status = 'Filled' AND trading_date = $1
+	`, tradingDate).Scan(&commissions)
+	return commissions, err
 }
 
 // Helper functions
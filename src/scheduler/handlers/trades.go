@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TradeRecord is a full row of the trades table
+type TradeRecord struct {
+	ID            int64     `json:"id"`
+	StrategyName  string    `json:"strategy_name"`
+	SetupName     string    `json:"setup_name"`
+	ContractID    int       `json:"contract_id"`
+	Exchange      string    `json:"exchange"`
+	Symbol        string    `json:"symbol"`
+	Side          string    `json:"side"`
+	Quantity      float64   `json:"quantity"`
+	OrderType     string    `json:"order_type"`
+	Broker        string    `json:"broker"`
+	Price         float64   `json:"price"`
+	BrokerOrderID int       `json:"broker_order_id"`
+	TradingDate   string    `json:"trading_date"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUpdatedAt time.Time `json:"last_updated_at"`
+	ScriptVersion string    `json:"script_version"`
+}
+
+// TradeSortColumns are the columns trade history can be sorted by
+var TradeSortColumns = []string{
+	"created_at", "last_updated_at", "trading_date", "strategy_name",
+	"setup_name", "symbol", "status", "price", "quantity",
+}
+
+// TradeCursor marks the last row of a page: its sort column value, as
+// Postgres prints it, and its ID to break ties. Sort is the order the page
+// was read in, e.g. -created_at.
+type TradeCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int64  `json:"id"`
+}
+
+// Encode returns the cursor as an opaque string for clients
+func (c TradeCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeTradeCursor parses a cursor returned by Encode
+func DecodeTradeCursor(s string) (*TradeCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c TradeCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID <= 0 {
+		return nil, errors.New("malformed cursor")
+	}
+	return &c, nil
+}
+
+// TradeQuery selects a page of trade history. Empty filters match
+// everything, From and To are inclusive trading dates (YYYY-MM-DD).
+type TradeQuery struct {
+	StrategyName string
+	SetupName    string
+	Symbol       string
+	Status       string
+	From         string
+	To           string
+	SortBy       string // one of TradeSortColumns
+	Descending   bool
+	After        *TradeCursor // continue after this row
+	Limit        int          // 0 for every matching row
+}
+
+// QueryTrades returns a page of trades and the cursor of the next page, nil
+// on the last page
+func QueryTrades(q TradeQuery) ([]TradeRecord, *TradeCursor, error) {
+	sortBy := "created_at"
+	if q.SortBy != "" {
+		sortBy = q.SortBy
+	}
+	valid := false
+	for _, column := range TradeSortColumns {
+		valid = valid || column == sortBy
+	}
+	if !valid {
+		return nil, nil, fmt.Errorf("cannot sort by %q", sortBy)
+	}
+
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if q.StrategyName != "" {
+		where("strategy_name = $%d", q.StrategyName)
+	}
+	if q.SetupName != "" {
+		where("setup_name = $%d", q.SetupName)
+	}
+	if q.Symbol != "" {
+		where("symbol = $%d", q.Symbol)
+	}
+	if q.Status != "" {
+		where("LOWER(status) = LOWER($%d)", q.Status)
+	}
+	if q.From != "" {
+		where("trading_date >= $%d", q.From)
+	}
+	if q.To != "" {
+		where("trading_date <= $%d", q.To)
+	}
+	direction, compare, sortSpec := "ASC", ">", sortBy
+	if q.Descending {
+		direction, compare, sortSpec = "DESC", "<", "-"+sortBy
+	}
+	if q.After != nil {
+		if q.After.Sort != sortSpec {
+			return nil, nil, fmt.Errorf("cursor was issued for sort %q, not %q", q.After.Sort, sortSpec)
+		}
+		// Keyset pagination: rows strictly after the cursor in sort order
+		args = append(args, q.After.Key, q.After.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sortBy, compare, len(args)-1, len(args)))
+	}
+
+	query := `
+		SELECT id, strategy_name, setup_name, contract_id, exchange, symbol, side,
+			quantity, order_type, broker, price, broker_order_id, trading_date,
+			status, created_at, last_updated_at, script_version, ` + sortBy + `::text
+		FROM trades`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf("\n\t\tORDER BY %s %s, id %s", sortBy, direction, direction)
+	if q.Limit > 0 {
+		// One extra row tells whether there is a next page
+		args = append(args, q.Limit+1)
+		query += fmt.Sprintf("\n\t\tLIMIT $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	trades := []TradeRecord{}
+	var keys []string
+	for rows.Next() {
+		var t TradeRecord
+		var key string
+		err := rows.Scan(
+			&t.ID, &t.StrategyName, &t.SetupName, &t.ContractID, &t.Exchange, &t.Symbol, &t.Side,
+			&t.Quantity, &t.OrderType, &t.Broker, &t.Price, &t.BrokerOrderID, &t.TradingDate,
+			&t.Status, &t.CreatedAt, &t.LastUpdatedAt, &t.ScriptVersion, &key,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		trades = append(trades, t)
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if q.Limit > 0 && len(trades) > q.Limit {
+		trades = trades[:q.Limit]
+		last := len(trades) - 1
+		return trades, &TradeCursor{Sort: sortSpec, Key: keys[last], ID: trades[last].ID}, nil
+	}
+	return trades, nil, nil
+}
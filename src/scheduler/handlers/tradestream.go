@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The backend numbers every insert/update of a trade with change_seq and
+// notifies trades_changed (see createTables in the backend). One feed per
+// scheduler listens for those notifications and fans the changed rows out to
+// the connected SSE clients, which get a snapshot once and then only deltas.
+
+// TradeChange is one insert or update of a trade
+type TradeChange struct {
+	Seq   int64
+	Op    string // insert or update
+	Trade Trade
+}
+
+const (
+	// Changes are re-read this far behind the newest one, so a write that
+	// committed after a later change is still delivered
+	changeLookback = 100
+	// A client further behind than this gets a fresh snapshot instead
+	maxResumeChanges = 5000
+)
+
+type tradeChangeFeed struct {
+	mu          sync.Mutex
+	subs        map[chan TradeChange]struct{}
+	initialized bool
+	last        int64
+	delivered   map[int64]bool
+}
+
+var tradeFeed = &tradeChangeFeed{
+	subs:      make(map[chan TradeChange]struct{}),
+	delivered: make(map[int64]bool),
+}
+
+// StartTradeFeed listens for trade changes until the process exits. Polls
+// every 30 seconds as well, in case a notification is lost while the
+// listener reconnects.
+func StartTradeFeed() {
+	listener := pq.NewListener(dbConnStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Trade feed listener: %v\n", err)
+		}
+	})
+	if err := listener.Listen("trades_changed"); err != nil {
+		log.Printf("Trade feed failed to listen, polling only: %v\n", err)
+	}
+	// Start from the current change now, so the first change after startup
+	// is delivered rather than taken as the starting point
+	tradeFeed.poll()
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-listener.Notify: // nil after a reconnect, poll either way
+			case <-ticker.C:
+			}
+			tradeFeed.poll()
+		}
+	}()
+}
+
+// poll reads new changes and hands them to every subscriber
+func (f *tradeChangeFeed) poll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.initialized {
+		last, err := currentChangeSeq()
+		if err != nil {
+			log.Printf("Trade feed: %v\n", err)
+			return
+		}
+		f.last, f.initialized = last, true
+		return
+	}
+
+	changes, err := fetchTradeChanges(f.last-changeLookback, maxResumeChanges)
+	if err != nil {
+		log.Printf("Trade feed: %v\n", err)
+		return
+	}
+	for _, change := range changes {
+		if f.delivered[change.Seq] {
+			continue
+		}
+		f.delivered[change.Seq] = true
+		if change.Seq > f.last {
+			f.last = change.Seq
+		}
+		for ch := range f.subs {
+			select {
+			case ch <- change:
+			default:
+				// Too slow, the client reconnects and resumes from its last event
+				close(ch)
+				delete(f.subs, ch)
+			}
+		}
+	}
+	for seq := range f.delivered {
+		if seq <= f.last-changeLookback {
+			delete(f.delivered, seq)
+		}
+	}
+}
+
+func (f *tradeChangeFeed) subscribe() chan TradeChange {
+	ch := make(chan TradeChange, 256)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *tradeChangeFeed) unsubscribe(ch chan TradeChange) {
+	f.mu.Lock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+	f.mu.Unlock()
+}
+
+// currentChangeSeq returns the newest change number
+func currentChangeSeq() (int64, error) {
+	var seq int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(change_seq), 0) FROM trades`).Scan(&seq)
+	return seq, err
+}
+
+// fetchTradeChanges returns trades changed after seq, oldest change first
+func fetchTradeChanges(after int64, limit int) ([]TradeChange, error) {
+	query := `
+		SELECT id, strategy_name, exchange, symbol, side, quantity,
+			price, broker_order_id, status, last_updated_at, script_version,
+			setup_name, change_seq, last_change
+		FROM trades
+		WHERE change_seq > $1
+		ORDER BY change_seq
+		LIMIT $2
+	`
+	rows, err := db.Query(query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []TradeChange
+	for rows.Next() {
+		var c TradeChange
+		var updatedAt time.Time
+		err := rows.Scan(
+			&c.Trade.ID, &c.Trade.StrategyName, &c.Trade.Exchange, &c.Trade.Symbol,
+			&c.Trade.Side, &c.Trade.Quantity, &c.Trade.Price, &c.Trade.BrokerOrderID,
+			&c.Trade.Status, &updatedAt, &c.Trade.ScriptVersion,
+			&c.Trade.SetupName, &c.Seq, &c.Op,
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.Trade.UpdatedAt = updatedAt.Format(time.RFC3339)
+		c.Trade.ChangeSeq = c.Seq
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// SSETradesHandler streams trades. New clients get a "snapshot" event with
+// the last 24 hours keyed by trade-<id>, then "insert" and "update" events
+// carrying one trade each. Every event's id is a change number, so a client
+// reconnecting with Last-Event-ID (or ?lastEventId=) only receives what it
+// missed.
+func SSETradesHandler(w http.ResponseWriter, r *http.Request) {
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Get the client's flusher to flush data in chunks
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the snapshot so no change falls in between
+	changes := tradeFeed.subscribe()
+	defer tradeFeed.unsubscribe(changes)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	resumeFrom, _ := strconv.ParseInt(lastEventID, 10, 64)
+
+	// Changes up to here were already sent, either by a previous connection or
+	// in the snapshot. Later ones arrive once each from the feed.
+	var baseline int64
+	resumed := false
+	if resumeFrom > 0 {
+		backlog, err := fetchTradeChanges(resumeFrom, maxResumeChanges+1)
+		if err == nil && len(backlog) <= maxResumeChanges {
+			for _, change := range backlog {
+				writeTradeChange(w, change)
+			}
+			baseline, resumed = resumeFrom, true
+			if n := len(backlog); n > 0 {
+				baseline = backlog[n-1].Seq
+			}
+			flusher.Flush()
+		}
+	}
+	if !resumed {
+		seq, err := writeTradeSnapshot(w)
+		if err != nil {
+			log.Printf("Error fetching trades: %v\n", err)
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		baseline = seq
+		flusher.Flush()
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Println("Client closed connection")
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return // dropped for falling behind
+			}
+			if change.Seq <= baseline {
+				continue
+			}
+			writeTradeChange(w, change)
+			flusher.Flush()
+		case <-heartbeat.C:
+			// Send a heartbeat to keep connection alive
+			fmt.Fprintf(w, "event: heartbeat\ndata: %s\n\n", time.Now().Format(time.RFC3339))
+			flusher.Flush()
+		}
+	}
+}
+
+// writeTradeSnapshot sends the last 24 hours of trades and returns the change
+// number they are current to
+func writeTradeSnapshot(w http.ResponseWriter) (int64, error) {
+	// Read the change number first, later changes are sent as deltas
+	seq, err := currentChangeSeq()
+	if err != nil {
+		return 0, err
+	}
+	trades, err := fetchRecentTrades()
+	if err != nil {
+		return 0, err
+	}
+
+	// Convert trades to a map with trade ID as key for the front-end
+	tradesMap := make(map[string]Trade)
+	for _, trade := range trades {
+		tradesMap[fmt.Sprintf("trade-%d", trade.ID)] = trade
+	}
+	tradesJSON, err := json.Marshal(tradesMap)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(w, "id: %d\nevent: snapshot\ndata: %s\n\n", seq, tradesJSON)
+	return seq, nil
+}
+
+func writeTradeChange(w http.ResponseWriter, change TradeChange) {
+	tradeJSON, err := json.Marshal(change.Trade)
+	if err != nil {
+		log.Printf("Error marshaling trade %d: %v\n", change.Trade.ID, err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, tradeJSON)
+}
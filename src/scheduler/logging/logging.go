@@ -0,0 +1,137 @@
+// Package logging writes JSON log lines through log/slog.
+//
+// The scheduler logs through component loggers, the same as the backend.
+// LOG_LEVEL sets the level of every component, info by default, and
+// LOG_LEVELS overrides it for some, e.g. "strategy=warn,broker=debug". Lines
+// written with the standard log package are logged by the "main" component;
+// their "[INFO]", "[WARN]" or "[ERROR]" prefix sets their level.
+//
+// Trade instructions the scheduler sends to the backend carry a correlation
+// ID in their gRPC metadata, which the backend logs and forwards to
+// broker_api.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// MetadataKey is the gRPC metadata key of a trade's correlation ID
+	MetadataKey = "correlation-id"
+	// Header is the header of a trade's correlation ID on broker_api requests
+	Header = "X-Correlation-ID"
+	// Key is the attribute of the correlation ID in log lines
+	Key = "correlation_id"
+)
+
+var (
+	mu         sync.Mutex
+	baseLevel  = slog.LevelInfo
+	levels     = map[string]slog.Level{}
+	components = map[string]*component{}
+)
+
+type component struct {
+	logger *slog.Logger
+	level  *slog.LevelVar
+}
+
+// Setup reads the log levels from the environment and sends the standard
+// logger's lines to the "main" component. Loggers taken with For before
+// Setup change to the configured level. Invalid levels are reported and
+// left at the default.
+func Setup() {
+	mu.Lock()
+	var problems []string
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := baseLevel.UnmarshalText([]byte(value)); err != nil {
+			problems = append(problems, fmt.Sprintf("LOG_LEVEL: %v", err))
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv("LOG_LEVELS"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			if strings.TrimSpace(entry) != "" {
+				problems = append(problems, fmt.Sprintf("LOG_LEVELS: %q is not component=level", entry))
+			}
+			continue
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			problems = append(problems, fmt.Sprintf("LOG_LEVELS: %s: %v", name, err))
+			continue
+		}
+		levels[name] = level
+	}
+	for name, c := range components {
+		c.level.Set(levelOf(name))
+	}
+	mu.Unlock()
+
+	main := For("main")
+	slog.SetDefault(main)
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{main})
+	for _, problem := range problems {
+		main.Warn("Invalid log level", "error", problem)
+	}
+}
+
+// For returns the logger of a component
+func For(name string) *slog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	if c, ok := components[name]; ok {
+		return c.logger
+	}
+	c := &component{level: new(slog.LevelVar)}
+	c.level.Set(levelOf(name))
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: c.level})
+	c.logger = slog.New(handler).With("component", name)
+	components[name] = c
+	return c.logger
+}
+
+// levelOf returns the configured level of a component, mu held
+func levelOf(name string) slog.Level {
+	if level, ok := levels[name]; ok {
+		return level
+	}
+	return baseLevel
+}
+
+// NewCorrelationID returns a random correlation ID
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stdWriter logs the lines of the standard logger
+type stdWriter struct {
+	logger *slog.Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := slog.LevelInfo
+	for prefix, l := range map[string]slog.Level{
+		"[DEBUG]": slog.LevelDebug, "[INFO]": slog.LevelInfo,
+		"[WARN]": slog.LevelWarn, "[ERROR]": slog.LevelError,
+	} {
+		if strings.HasPrefix(msg, prefix) {
+			msg, level = strings.TrimSpace(strings.TrimPrefix(msg, prefix)), l
+			break
+		}
+	}
+	w.logger.Log(context.Background(), level, msg)
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -----------------------------------------------------------------
+// Metrics
+// -----------------------------------------------------------------
+
+// Prometheus metrics are served at /metrics on their own listener,
+// METRICS_ADDR (:2112 by default), without auth like the backend's, so keep
+// that port off public networks. broker_api call latency and errors are
+// recorded by the handlers package.
+
+var (
+	strategyRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scheduler",
+		Name:      "strategy_restarts_total",
+		Help:      "Strategy processes restarted for a config or version change.",
+	}, []string{"strategy"})
+	strategyExits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scheduler",
+		Name:      "strategy_unexpected_exits_total",
+		Help:      "Strategy processes that exited without being stopped.",
+	}, []string{"strategy"})
+	sseClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "scheduler",
+		Name:      "sse_clients",
+		Help:      "Connected server-sent event clients by stream.",
+	}, []string{"stream"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "scheduler",
+		Name:      "strategy_processes_running",
+		Help:      "Strategy processes the scheduler runs.",
+	}, func() float64 {
+		runningMu.Lock()
+		defer runningMu.Unlock()
+		return float64(len(runningProcs))
+	})
+}
+
+// serveMetrics serves /metrics until the process exits
+func serveMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":2112"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mainLog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		mainLog.Error("Metrics server stopped", "error", err)
+	}
+}
+
+// countSSEClients keeps sse_clients of a stream up to date while its
+// handler serves a client
+func countSSEClients(stream string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients := sseClients.WithLabelValues(stream)
+		clients.Inc()
+		defer clients.Dec()
+		next(w, r)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------
+// Setup Parameters
+// -----------------------------------------------------------------
+
+// ParamSpec declares one setup-level parameter a strategy accepts
+type ParamSpec struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"` // int, float, bool, string
+	Default interface{} `json:"default,omitempty"`
+	Min     *float64    `json:"min,omitempty"`
+	Max     *float64    `json:"max,omitempty"`
+}
+
+var allowedParamTypes = map[string]bool{
+	"int":    true,
+	"float":  true,
+	"bool":   true,
+	"string": true,
+}
+
+// Form fields carrying setup parameters are named "param.<name>"
+const paramFormPrefix = "param."
+
+// parseParamSchema decodes the JSON parameter schema uploaded with a strategy
+func parseParamSchema(raw string) ([]ParamSpec, ValidationErrors) {
+	var errs ValidationErrors
+	var specs []ParamSpec
+	if strings.TrimSpace(raw) == "" {
+		return specs, errs
+	}
+	if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+		errs.add("param_schema", "must be a JSON list of {name, type, default, min, max}: %v", err)
+	}
+	return specs, errs
+}
+
+// validateParamSchema checks a strategy's parameter declarations
+func validateParamSchema(specs []ParamSpec) ValidationErrors {
+	var errs ValidationErrors
+	seen := make(map[string]bool)
+	for i, spec := range specs {
+		field := fmt.Sprintf("param_schema[%d]", i)
+		if !paramNamePattern.MatchString(spec.Name) {
+			errs.add(field+".name", "invalid parameter name %q", spec.Name)
+		} else if seen[spec.Name] {
+			errs.add(field+".name", "duplicate parameter %q", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		if !allowedParamTypes[spec.Type] {
+			errs.add(field+".type", "must be one of %s", strings.Join(sortedKeys(allowedParamTypes), ", "))
+			continue
+		}
+		if (spec.Min != nil || spec.Max != nil) && spec.Type != "int" && spec.Type != "float" {
+			errs.add(field, "min/max only apply to int and float parameters")
+		}
+		if spec.Min != nil && spec.Max != nil && *spec.Min > *spec.Max {
+			errs.add(field, "min is greater than max")
+		}
+		if spec.Default != nil {
+			if _, err := checkParamValue(spec, spec.Default); err != nil {
+				errs.add(field+".default", "%v", err)
+			}
+		}
+	}
+	return errs
+}
+
+// checkParamValue verifies a decoded JSON value against its spec and returns
+// it in canonical form (ints as int64).
+func checkParamValue(spec ParamSpec, value interface{}) (interface{}, error) {
+	switch spec.Type {
+	case "string":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("must be a string")
+	case "bool":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("must be a boolean")
+	}
+
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case int:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	default:
+		return nil, fmt.Errorf("must be a number")
+	}
+	if spec.Min != nil && f < *spec.Min {
+		return nil, fmt.Errorf("must be >= %v", *spec.Min)
+	}
+	if spec.Max != nil && f > *spec.Max {
+		return nil, fmt.Errorf("must be <= %v", *spec.Max)
+	}
+	if spec.Type == "int" {
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return int64(f), nil
+	}
+	return f, nil
+}
+
+// coerceParam converts a raw form value to the spec's type
+func coerceParam(spec ParamSpec, raw string) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	switch spec.Type {
+	case "int":
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer, got %q", raw)
+		}
+		return checkParamValue(spec, n)
+	case "float":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number, got %q", raw)
+		}
+		return checkParamValue(spec, f)
+	case "bool":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false, got %q", raw)
+		}
+		return b, nil
+	}
+	return raw, nil
+}
+
+// paramsFromForm collects "param.<name>" form values. Values are raw strings
+// until they are resolved against a schema.
+func paramsFromForm(r *http.Request) map[string]string {
+	raw := make(map[string]string)
+	for key, values := range r.Form {
+		if strings.HasPrefix(key, paramFormPrefix) && len(values) > 0 {
+			raw[strings.TrimPrefix(key, paramFormPrefix)] = values[0]
+		}
+	}
+	return raw
+}
+
+// mergeParams overlays form values onto a setup's existing params and fills
+// defaults from the schema, so an update never drops values it didn't touch.
+// Form values are converted to their declared type, then merged like a JSON
+// body.
+func mergeParams(schema []ParamSpec, existing map[string]interface{}, updates map[string]string) (map[string]interface{}, ValidationErrors) {
+	specs := make(map[string]ParamSpec)
+	for _, spec := range schema {
+		specs[spec.Name] = spec
+	}
+
+	names := make([]string, 0, len(updates))
+	for name := range updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs ValidationErrors
+	typed := make(map[string]interface{}, len(updates))
+	for _, name := range names {
+		raw := updates[name]
+		spec, ok := specs[name]
+		if !ok {
+			// Undeclared params are reported by mergeJSONParams, strategies
+			// without a schema keep free-form string params
+			typed[name] = strings.TrimSpace(raw)
+			continue
+		}
+		value, err := coerceParam(spec, raw)
+		if err != nil {
+			errs.add("params."+name, "%v", err)
+			continue
+		}
+		typed[name] = value
+	}
+
+	merged, mergeErrs := mergeJSONParams(schema, existing, typed)
+	return merged, append(errs, mergeErrs...)
+}
+
+// mergeJSONParams is mergeParams for typed values decoded from a JSON body
+func mergeJSONParams(schema []ParamSpec, existing map[string]interface{}, updates map[string]interface{}) (map[string]interface{}, ValidationErrors) {
+	var errs ValidationErrors
+	merged := make(map[string]interface{})
+	for name, value := range existing {
+		merged[name] = value
+	}
+
+	specs := make(map[string]ParamSpec)
+	for _, spec := range schema {
+		specs[spec.Name] = spec
+	}
+
+	names := make([]string, 0, len(updates))
+	for name := range updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec, ok := specs[name]
+		if !ok {
+			if len(schema) > 0 {
+				errs.add("params."+name, "not declared by the strategy")
+				continue
+			}
+			// Without a schema any string, number or boolean is kept as sent
+			merged[name] = updates[name]
+			continue
+		}
+		value, err := checkParamValue(spec, updates[name])
+		if err != nil {
+			errs.add("params."+name, "%v", err)
+			continue
+		}
+		merged[name] = value
+	}
+
+	applyParamDefaults(schema, merged)
+	return merged, errs
+}
+
+// applyParamDefaults fills declared params that have no value with their default
+func applyParamDefaults(schema []ParamSpec, params map[string]interface{}) {
+	for _, spec := range schema {
+		if _, ok := params[spec.Name]; !ok && spec.Default != nil {
+			params[spec.Name], _ = checkParamValue(spec, spec.Default)
+		}
+	}
+}
+
+// validateParams checks stored setup params against the strategy schema
+func validateParams(schema []ParamSpec, params map[string]interface{}) ValidationErrors {
+	var errs ValidationErrors
+	if len(schema) == 0 {
+		for name, value := range params {
+			if !paramNamePattern.MatchString(name) {
+				errs.add("params."+name, "invalid parameter name")
+				continue
+			}
+			switch value.(type) {
+			case string, float64, int64, bool:
+			default:
+				errs.add("params."+name, "must be a string, number or boolean")
+			}
+		}
+		return errs
+	}
+
+	specs := make(map[string]ParamSpec)
+	for _, spec := range schema {
+		specs[spec.Name] = spec
+		value, ok := params[spec.Name]
+		if !ok {
+			if spec.Default == nil {
+				errs.add("params."+spec.Name, "is required")
+			}
+			continue
+		}
+		if _, err := checkParamValue(spec, value); err != nil {
+			errs.add("params."+spec.Name, "%v", err)
+		}
+	}
+	for name := range params {
+		if _, ok := specs[name]; !ok {
+			errs.add("params."+name, "not declared by the strategy")
+		}
+	}
+	return errs
+}
+
+// resolvedParams returns a setup's params with schema defaults applied, as
+// handed to the strategy process.
+func resolvedParams(schema []ParamSpec, params map[string]interface{}) map[string]interface{} {
+	resolved, _ := mergeParams(schema, params, nil)
+	return resolved
+}
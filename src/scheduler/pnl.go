@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// PnL
+// -----------------------------------------------------------------
+
+// apiPnL handles GET /api/v1/pnl. Returns realized and unrealized PnL overall
+// and per strategy, the open positions marked to market and the realized PnL
+// per trading date. strategy limits everything to one strategy, from and to
+// (inclusive trading dates) limit the realized PnL and commissions to those
+// days; positions are the ones open at the end of to.
+func apiPnL(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+
+	var errs ValidationErrors
+	for _, date := range []struct{ field, value string }{{"from", from}, {"to", to}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			errs.add(date.field, "must be a date like 2006-01-02, got %q", date.value)
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	report, err := handlers.ComputePnL(q.Get("strategy"), from, to)
+	if err != nil {
+		log.Println("[ERROR] Failed to compute PnL:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute PnL", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,22 +10,23 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"scheduler/handlers"
+	"scheduler/logging"
 	pb "scheduler/tradepb"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 // -----------------------------------------------------------------
@@ -33,21 +35,36 @@ import (
 
 // Setup represents one named setup in the config
 type Setup struct {
-	Market     string            `json:"market"`
-	ContractId int               `json:"contract_id"`
-	Enabled    bool              `json:"enabled"`
-	Timeframe  string            `json:"timeframe"`
-	Schedule   string            `json:"schedule"`
-	MarketData []string          `json:"market_data"`
-	Params     map[string]string `json:"params"`
+	Market     string                 `json:"market"`
+	ContractId int                    `json:"contract_id"`
+	Enabled    bool                   `json:"enabled"`
+	Timeframe  string                 `json:"timeframe"`
+	Schedule   string                 `json:"schedule"`
+	MarketData []string               `json:"market_data"`
+	Params     map[string]interface{} `json:"params"`
+	// Intraday setups are flattened and stopped at FlattenAt (HH:MM, local
+	// time) or FlattenBeforeClose minutes before their exchange's session close
+	FlattenAt          string `json:"flatten_at,omitempty"`
+	FlattenBeforeClose int    `json:"flatten_before_close,omitempty"`
+	// Pinned script version, 0 follows the strategy's current version
+	ScriptVersion int `json:"script_version,omitempty"`
+	// Archived setups are hidden from the active list but keep their trade history
+	Archived   bool       `json:"archived,omitempty"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
 	// StrategyGroup string           `json:"strategy_group"` future modification
 }
 
 // Strategy represents one strategy with multiple setups
 type Strategy struct {
-	ScriptPath   string           `json:"script_path"`
-	StrategyType string           `json:"strategy_type"`
-	Setups       map[string]Setup `json:"setups"`
+	ScriptPath     string           `json:"script_path"` // path of the current version
+	StrategyType   string           `json:"strategy_type"`
+	Group          string           `json:"group,omitempty"` // strategy group, for bulk actions
+	ParamSchema    []ParamSpec      `json:"param_schema,omitempty"`
+	Versions       []ScriptVersion  `json:"versions,omitempty"`
+	CurrentVersion int              `json:"current_version,omitempty"`
+	Archived       bool             `json:"archived,omitempty"`
+	ArchivedAt     *time.Time       `json:"archived_at,omitempty"`
+	Setups         map[string]Setup `json:"setups"`
 }
 type Position struct {
 	Symbol     string  `json:"symbol"`
@@ -61,6 +78,10 @@ type Position struct {
 
 // strategies is a map of "StrategyName" -> Strategy
 var strategies map[string]Strategy
+
+// strategiesMu guards strategies. It may be taken while holding runningMu,
+// so never call startScript/stopScript with it held.
+var strategiesMu sync.Mutex
 var positions map[string]Position
 
 // Used to signal frontend to refersh strategy config data to mirror backend.
@@ -69,7 +90,16 @@ var refreshStrategyConfigChan = make(chan string, 50) // Increase if needed
 // Keep track of running processes by "StrategyName|SetupName"
 var (
 	runningProcs = make(map[string]*exec.Cmd)
-	runningMu    sync.Mutex
+	// When the trade token of each running process was issued
+	tokenIssuedAt = make(map[string]time.Time)
+	runningMu     sync.Mutex
+)
+
+// Component loggers, see package logging
+var (
+	mainLog     = logging.For("main")
+	strategyLog = logging.For("strategy")
+	ordersLog   = logging.For("orders")
 )
 
 // -----------------------------------------------------------------
@@ -77,6 +107,9 @@ var (
 // -----------------------------------------------------------------
 
 func main() {
+	// LOG_LEVEL and LOG_LEVELS set the verbosity of each component
+	logging.Setup()
+
 	// 1. Load from JSON
 	shared_strategy_config := GetSharedFilePath("strategy-config.json")
 	if err := loadStrategies(shared_strategy_config); err != nil {
@@ -84,6 +117,14 @@ func main() {
 	}
 	setupShutdown("strategy-config.json")
 
+	// Setup processes are launched with a trade token for their strategy
+	if err := checkTradeAuthConfig(); err != nil {
+		log.Fatalf("Failed to configure trade credentials: %v", err)
+	}
+
+	// 1b. Pick up edits made directly to the config file on the shared volume
+	watchStrategyConfig(shared_strategy_config, 2*time.Second)
+
 	// 1a. Start process that checks for unexcpected Strategy Crashes
 	// Start monitoring every 30 seconds
 	monitorScripts(30 * time.Second)
@@ -94,46 +135,73 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer handlers.CloseDB()
+	if err := handlers.InitAuditLog(); err != nil {
+		log.Fatalf("Failed to initialize audit log: %v", err)
+	}
+	// Stream trade changes to the dashboard as the backend writes them
+	handlers.StartTradeFeed()
+	// Record the account summary for the equity curve and KPI changes
+	if err := handlers.InitAccountSnapshots(); err != nil {
+		log.Fatalf("Failed to initialize account snapshots: %v", err)
+	}
+	snapshotInterval := time.Minute
+	if interval, err := time.ParseDuration(os.Getenv("ACCOUNT_SNAPSHOT_INTERVAL")); err == nil && interval > 0 {
+		snapshotInterval = interval
+	}
+	handlers.StartAccountSnapshots(snapshotInterval)
+	// Contract master, synced from broker_api
+	if err := handlers.InitContracts(); err != nil {
+		log.Fatalf("Failed to initialize contracts: %v", err)
+	}
+	contractSyncInterval := 24 * time.Hour
+	if interval, err := time.ParseDuration(os.Getenv("CONTRACT_SYNC_INTERVAL")); err == nil && interval > 0 {
+		contractSyncInterval = interval
+	}
+	handlers.StartContractSync(contractSyncInterval, setupContractIDs)
+	// Flatten setups at their flatten time
+	runFlattens()
+	// and stop them when their exchange closes for a holiday
+	stopOnHolidays()
 
-	// 2. Handle endpoints
-	corsMiddleware := func(handler http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			handler.ServeHTTP(w, r)
-		})
+	// 1c. Load dashboard users and API tokens
+	if err := loadAuthStore(GetSharedFilePath("users.json")); err != nil {
+		log.Fatalf("Failed to load users: %v", err)
 	}
+
+	// 2. Handle endpoints
+	// Every route except the static frontend requires a role, see auth.go
 	// Server Sent Events
-	http.Handle("/streamPositions", corsMiddleware(http.HandlerFunc(positionStreamHandler)))       // handle positions
-	http.Handle("/streamTrades", corsMiddleware(http.HandlerFunc(handlers.SSETradesHandler)))      // handle positions
-	http.Handle("/streamKPIMetrics", corsMiddleware(http.HandlerFunc(handlers.SSEKPIMetricsHandler)))      // handle positions
-	http.Handle("/refreshStrategyConfig", corsMiddleware(http.HandlerFunc(refreshStrategyConfig))) // tells front end refresh strategies due to backend changes
-	
+	http.HandleFunc("/streamPositions", requireRole(roleViewer, countSSEClients("positions", positionStreamHandler)))
+	http.HandleFunc("/streamTrades", requireRole(roleViewer, countSSEClients("trades", handlers.SSETradesHandler)))
+	http.HandleFunc("/streamKPIMetrics", requireRole(roleViewer, countSSEClients("kpi", handlers.SSEKPIMetricsHandler)))
+	http.HandleFunc("/refreshStrategyConfig", requireRole(roleViewer, countSSEClients("strategy_config", refreshStrategyConfig))) // tells front end refresh strategies due to backend changes
+
 	// Strategy Configuration & Controls
-	http.Handle("/strategies", corsMiddleware(http.HandlerFunc(handleListStrategies)))
-	http.Handle("/strategies/", corsMiddleware(http.HandlerFunc(handleStrategyActions)))           // e.g. POST /strategies/{strategyName}/{setupName}/toggle
-	http.Handle("/uploadNewStrategy", corsMiddleware(http.HandlerFunc(newStrategyHandler)))
-	
+	http.HandleFunc("/strategies", requireRole(roleViewer, handleListStrategies))
+	http.HandleFunc("/strategies/", handleStrategyActions) // e.g. POST /strategies/{strategyName}/{setupName}/toggle, role checked per action
+	http.HandleFunc("/uploadNewStrategy", requireRole(roleAdmin, newStrategyHandler))
+
 	// Add or Change Setups
-	http.Handle("/updateSetup", corsMiddleware(http.HandlerFunc(updateSetup)))
-	http.Handle("/addSetup", corsMiddleware(http.HandlerFunc(addSetupHandler)))
+	http.HandleFunc("/updateSetup", requireRole(roleTrader, updateSetup))
+	http.HandleFunc("/addSetup", requireRole(roleTrader, addSetupHandler))
+
+	// Versioned JSON API, see /api/v1/openapi.json
+	http.Handle("/api/v1/", newAPIv1Handler())
 
 	// Broker API endpoints
-	http.Handle("/proxy/quote/", corsMiddleware(http.HandlerFunc(proxyQuote)))
-	http.Handle("/proxy/historicalData", corsMiddleware(http.HandlerFunc(proxyHistoricalData)))
-	http.Handle("/proxy/contractId", corsMiddleware(http.HandlerFunc(proxyContractId)))
+	http.HandleFunc("/proxy/quote/", requireRole(roleViewer, proxyQuote))
+	http.HandleFunc("/proxy/historicalData", requireRole(roleViewer, proxyHistoricalData))
+	http.HandleFunc("/proxy/contractId", requireRole(roleViewer, proxyContractId))
+
+	// Prometheus metrics, on their own listener
+	go serveMetrics()
 
 	// 3. Serve frontend from ./static/
 	http.Handle("/", http.FileServer(http.Dir("./static/react-app/build")))
 
 	// Start server
 	log.Println("Server running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", corsHandler(http.DefaultServeMux)))
 
 	// Set up graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -149,26 +217,37 @@ func main() {
 
 // load to strategy config state
 func loadStrategyFile(filePath string) (map[string]Strategy, error) {
-	temp := make(map[string]Strategy)
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		return temp, err
+		return make(map[string]Strategy), err
 	}
+	return parseStrategyConfig(data)
+}
+
+// parseStrategyConfig decodes the raw strategy config JSON
+func parseStrategyConfig(data []byte) (map[string]Strategy, error) {
+	temp := make(map[string]Strategy)
 	if err := json.Unmarshal(data, &temp); err != nil {
 		return temp, err
 	}
 	return temp, nil
-
 }
 
 // load strategy config from file (JSON)
 func loadStrategies(filePath string) error {
-	temp, err := loadStrategyFile(filePath)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	temp, err := parseStrategyConfig(data)
 	if err != nil {
 		return err
 	}
+	strategiesMu.Lock()
 	strategies = temp
-	fmt.Println(strategies)
+	lastConfigHash = configHash(data)
+	strategiesMu.Unlock()
+	mainLog.Debug("Loaded strategies", "file", filePath, "strategies", len(temp))
 	return nil
 }
 
@@ -183,45 +262,40 @@ func loadPositions(filePath string) error {
 		return err
 	}
 	positions = temp
-	fmt.Println(positions)
+	mainLog.Debug("Loaded positions", "file", filePath, "positions", len(temp))
 	return nil
 }
 
-// Save updated 'strategies' map to the JSON file
+// Save updated 'strategies' map to the JSON file.
+// Callers must hold strategiesMu.
 func saveStrategies(filePath string) error {
 	data, err := json.MarshalIndent(strategies, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filePath, data, 0644)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return err
+	}
+	lastConfigHash = configHash(data)
+	return nil
 }
 
-func addStrategyToConfigFile(scriptPath, strategyName, typeVal, setupName, market, timeframe, schedule, additionalData string, contractId int) {
-	_, ok := strategies[strategyName]
-	if ok {
-		log.Print("Strategy already exists, select differnt name.")
-		return
-	}
-	setup := Setup{
-		Market:     market,
-		ContractId: contractId,
-		Enabled:    false,
-		Timeframe:  timeframe,
-		Schedule:   schedule,
-		MarketData: strings.Split(additionalData, ","),
-	}
-	setups := map[string]Setup{setupName: setup}
-	strategies[strategyName] = Strategy{
-		ScriptPath:   scriptPath,
-		StrategyType: typeVal,
-		Setups:       setups,
+// addStrategyToConfigFile registers a validated strategy and persists the config
+func addStrategyToConfigFile(strategyName string, strat Strategy) error {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	if _, ok := strategies[strategyName]; ok {
+		return fmt.Errorf("strategy %s already exists", strategyName)
 	}
+	strategies[strategyName] = strat
 	shared_strategy_config := GetSharedFilePath("strategy-config.json")
 	// 4) Persist to JSON
 	if err := saveStrategies(shared_strategy_config); err != nil {
-		log.Println("Failed to save config: ", err.Error())
-		return
+		delete(strategies, strategyName)
+		return fmt.Errorf("failed to save config: %v", err)
 	}
+	return nil
 }
 
 func setupShutdown(strategyFilename string) {
@@ -229,9 +303,11 @@ func setupShutdown(strategyFilename string) {
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-c
+		strategiesMu.Lock()
 		err := saveStrategies(strategyFilename)
+		strategiesMu.Unlock()
 		if err != nil {
-			fmt.Println("Error saving Strategy config to file before shutdown..")
+			mainLog.Error("Failed to save strategy config before shutdown", "error", err)
 		}
 		os.Exit(0)
 	}()
@@ -241,14 +317,21 @@ func setupShutdown(strategyFilename string) {
 // Route Handlers
 // -----------------------------------------------------------------
 
-// handleListStrategies GET /strategies -> returns entire strategies map as JSON
+// handleListStrategies GET /strategies -> returns active strategies map as JSON
+// GET /strategies?include_archived=true -> also returns archived entries
 func handleListStrategies(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(strategies)
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	if r.URL.Query().Get("include_archived") == "true" {
+		json.NewEncoder(w).Encode(strategies)
+		return
+	}
+	json.NewEncoder(w).Encode(activeStrategies())
 	// fmt.Println("strategies")
 }
 
@@ -292,7 +375,11 @@ func monitorScripts(checkInterval time.Duration) {
 			time.Sleep(checkInterval)
 
 			runningMu.Lock()
+			renew := make(map[string]time.Time)
 			for key, cmd := range runningProcs {
+				if issuedAt, ok := tokenIssuedAt[key]; ok && cmd != nil && cmd.ProcessState == nil && tokenNeedsRenewal(issuedAt, tokenRenewFrom) {
+					renew[key] = issuedAt
+				}
 				if cmd == nil || cmd.ProcessState == nil {
 					// fmt.Println(cmd, cmd.Process, cmd.Process.Pid)
 					continue
@@ -300,8 +387,7 @@ func monitorScripts(checkInterval time.Duration) {
 
 				// Check if process is still running
 				if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
-					fmt.Printf("process info:\n CMD: %s\n Process:%+v\n State:%s", cmd, cmd.Process, cmd.ProcessState)
-					log.Printf("Script %s has stopped unexpectedly", key)
+					strategyLog.Warn("Script has stopped unexpectedly", "script", key, "state", cmd.ProcessState.String())
 
 					// Get strategy and setup names
 					parts := strings.Split(key, "|")
@@ -310,32 +396,28 @@ func monitorScripts(checkInterval time.Duration) {
 					}
 					strategyName := parts[0]
 					setupName := parts[1]
-					strat, ok := strategies[strategyName]
-					if !ok {
-						return
-					}
-					setup, ok := strat.Setups[setupName]
-					if !ok {
-						return
-					}
-
-					setup.Enabled = false
-
-					// 3) Update the local strategies map
-					strat.Setups[setupName] = setup
-					strategies[strategyName] = strat
-					shared_strategy_config := GetSharedFilePath("strategy-config.json")
-					// 4) Persist to JSON
-					if err := saveStrategies(shared_strategy_config); err != nil {
-						// http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
-						return
-					}
-					refreshStrategyConfigChan <- key
+					disableSetup(strategyName, setupName)
+					notifyStrategyConfigChanged(key)
 					// Remove from running processes
 					delete(runningProcs, key)
 				}
 			}
 			runningMu.Unlock()
+
+			// Restart with a fresh token before the backend rejects the old one,
+			// between sessions unless it is about to expire
+			for key, issuedAt := range renew {
+				strategyName, setupName, _ := strings.Cut(key, "|")
+				if !tokenNeedsRenewal(issuedAt, tokenRenewAt) && inSession(strategyName, setupName) {
+					continue
+				}
+				strategyLog.Info("Restarting script to renew its trade token", "strategy", strategyName, "setup", setupName)
+				if err := restartScript(strategyName, setupName); err != nil {
+					strategyLog.Error("Failed to restart script", "strategy", strategyName, "setup", setupName, "error", err)
+					disableSetup(strategyName, setupName)
+				}
+				notifyStrategyConfigChanged(key)
+			}
 		}
 	}()
 }
@@ -364,12 +446,45 @@ func refreshStrategyConfig(w http.ResponseWriter, r *http.Request) {
 
 // handleStrategyActions handles requests like:
 // POST /strategies/{strategyName}/{setupName}/toggle
+// POST /strategies/{strategyName}/{setupName}/archive
+// GET|POST /strategies/{strategyName}/versions
+// POST /strategies/{strategyName}/rollback
+// POST /strategies/{strategyName}/archive
+// DELETE /strategies/{strategyName}[/{setupName}]
 func handleStrategyActions(w http.ResponseWriter, r *http.Request) {
 	parts := splitPath(r.URL.Path) // e.g. ["strategies","StrategyA","StrategyA-ZF","toggle"]
 	if len(parts) < 2 {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
+	r, ok := authorize(w, r, strategyActionRole(r.Method, parts))
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodDelete && len(parts) <= 3 {
+		setupName := ""
+		if len(parts) == 3 {
+			setupName = parts[2]
+		}
+		deleteHandler(parts[1], setupName, w, r)
+		return
+	}
+
+	// Strategy-level actions
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "versions":
+			handleStrategyVersions(parts[1], w, r)
+			return
+		case "rollback":
+			rollbackStrategy(parts[1], w, r)
+			return
+		case "archive", "unarchive":
+			archiveHandler(parts[1], "", parts[2] == "archive", w, r)
+			return
+		}
+	}
 	// parts[0] = "strategies"
 	// parts[1] = strategyName
 	// parts[2] = setupName
@@ -398,6 +513,8 @@ func handleStrategyActions(w http.ResponseWriter, r *http.Request) {
 		toggleSetup(strategyName, setupName, w, r)
 	case "close-position":
 		closePosition(strategyName, setupName, w, r)
+	case "archive", "unarchive":
+		archiveHandler(strategyName, setupName, action == "archive", w, r)
 	default:
 		http.Error(w, "Unknown action", http.StatusNotFound)
 	}
@@ -405,161 +522,81 @@ func handleStrategyActions(w http.ResponseWriter, r *http.Request) {
 
 func newStrategyHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
 		return
 	}
 
 	// Parse the incoming multipart/form-data (up to 10MB here)
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Error parsing form data", nil)
 		return
 	}
 
 	// Grab form fields (non-file)
 	strategyName := r.FormValue("strategyName")
-	typeVal := r.FormValue("type")
 	setupName := r.FormValue("setupName")
-	market := r.FormValue("market")
-	contractIdString := r.FormValue("contract_id")
-	timeframe := r.FormValue("timeframe")
-	schedule := r.FormValue("schedule")
-	additionalData := r.FormValue("otherMarketData")
-
-	contractId, err := strconv.Atoi(contractIdString)
-	if err != nil {
-		fmt.Println("Error converting string:", err)
-		contractId = 999999
+	setup, errs := parseSetupForm(r, "otherMarketData")
+	paramSchema, schemaErrs := parseParamSchema(r.FormValue("param_schema"))
+	errs = append(errs, schemaErrs...)
+	params, paramErrs := mergeParams(paramSchema, nil, paramsFromForm(r))
+	errs = append(errs, paramErrs...)
+	setup.Params = params
+	strat := Strategy{
+		StrategyType: r.FormValue("type"),
+		Group:        strings.TrimSpace(r.FormValue("group")),
+		ParamSchema:  paramSchema,
+		Setups:       map[string]Setup{setupName: setup},
 	}
 
 	// Grab the file from the form data
+	var script *scriptUpload
 	file, handler, err := r.FormFile("uploaded_file")
 	if err != nil {
-		// The user may or may not have uploaded a file. Handle accordingly.
-		// If a file is required, respond with an error:
-		http.Error(w, "File not found in form data", http.StatusBadRequest)
-		return
-
-		// Or if file is optional, you can just set file=nil and skip storing.
-		// log.Println("[INFO] No file was uploaded.")
+		errs.add("uploaded_file", "is required")
 	} else {
 		defer file.Close()
-
-		// Create a local directory (inside container) to store the upload.
-		uploadDir := "C:/Users/Jon/Projects/pyquant/src/scheduler/shared_files/strategies"
-
-		if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
-			uploadDir = "/app/strategies"
-		}
-
-		// if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		// Check if local directory exists - it should
-		if _, err := exists(uploadDir); err != nil {
-			http.Error(w, "Unable to find directory", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("[INFO] Found directory: %s\n", uploadDir)
-
-		// Build a full path
-		filePath := filepath.Join(uploadDir, handler.Filename)
-		log.Printf("[INFO] Saving file to: %s\n", filePath)
-		// Create the file on disk
-		dst, err := os.Create(filePath)
-		log.Println("[INFO] Destination:", dst)
-
-		if err != nil {
-			log.Println("[ERROR] Unable to create file:", err)
-			http.Error(w, "Unable to create file", http.StatusInternalServerError)
-			return
+		if filepath.Ext(handler.Filename) != ".py" {
+			errs.add("uploaded_file", "must be a .py script")
 		}
-		defer dst.Close()
+		script = &scriptUpload{Filename: handler.Filename, Src: file, UploadedBy: uploadedBy(r)}
+	}
 
-		// Copy the uploaded file to the created file on disk
-		_, err = io.Copy(dst, file)
-		if err != nil {
-			http.Error(w, "Error saving file", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("[INFO] File uploaded successfully: %s\n", handler.Filename)
-		// (Optional) Do something with these fields—e.g., store them in a DB:
-		log.Printf("[INFO] strategyName=%s, type=%s, setupName=%s, market=%s, contractId=%d, timeframe=%s, schedule=%s, additionalData=%s",
-			strategyName, typeVal, setupName, market, contractId, timeframe, schedule, additionalData,
-		)
-		addStrategyToConfigFile(filePath, strategyName, typeVal, setupName, market, timeframe, schedule, additionalData, contractId)
+	if _, err := createStrategy(callerIdentity(r), strategyName, strat, script, errs); err != nil {
+		writeError(w, err)
+		return
 	}
 
 	// Return a success response
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "Data received and processed!")
-
 }
 
 func addSetupHandler(w http.ResponseWriter, r *http.Request) {
 	// 1) Parse the request body
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Failed to parse form data: "+err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Failed to parse form data: "+err.Error(), nil)
 		return
 	}
 
-	// Get setupName from form data
 	newSetupName := r.FormValue("setupName")
-	if newSetupName == "" {
-		http.Error(w, "Setup name is required", http.StatusBadRequest)
-		return
-	}
-
-	// 2) Find the strategy & setup
-	//var foundStrategy string
-	//var foundSetup Setup
-	//mvar strategyFound bool
-
 	strategyName := r.FormValue("strategyName")
-	if _, ok := strategies[strategyName].Setups[newSetupName]; ok {
-		http.Error(w, "Setup name already exists, enter a different name.", http.StatusBadRequest)
-		return
-	}
 
-	//for stratName, strat := range strategies {
-	// 	if setup, ok := strat.Setups[setupName]; ok {
-	// 		foundStrategy = stratName
-	// 		foundSetup = setup
-	// 		strategyFound = true
-	// 		break
-	// 	}
-	// }
-
-	//if !strategyFound {
-	//http.Error(w, "Setup not found in any strategy", http.StatusNotFound)
-	//return
-	//}
-	contractIdFmtd, _ := strconv.Atoi(r.FormValue("contract_id"))
-	// 3) Update setup fields from form data
-	// Preserve existing values that we don't want to modify
-	newSetup := Setup{
-		Market:     r.FormValue("market"),
-		ContractId: contractIdFmtd,
-		Timeframe:  r.FormValue("timeframe"),
-		Schedule:   r.FormValue("schedule"),
-		MarketData: strings.Split(r.FormValue("market_data"), ","),
-		Enabled:    false,
-	}
-	fmt.Println(r.FormValue("market_data"))
-	fmt.Println(newSetup)
-
-	// 4) Update the local strategies map
-	//strat := strategies[foundStrategy]
-	//strat.Setups[setupName] = foundSetup
-	strategies[strategyName].Setups[newSetupName] = newSetup
-
-	// 5) Persist to JSON
-	shared_strategy_config := GetSharedFilePath("strategy-config.json")
-	if err := saveStrategies(shared_strategy_config); err != nil {
-		http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+	// 2) Build the setup from form data
+	newSetup, errs := parseSetupForm(r, "market_data")
+	params, paramErrs := mergeParams(strategyParamSchema(strategyName), nil, paramsFromForm(r))
+	errs = append(errs, paramErrs...)
+	newSetup.Params = params
+
+	// 3) Validate it and add it to the strategy
+	newSetup, err := addSetup(callerIdentity(r), strategyName, newSetupName, newSetup, errs)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	fmt.Println(strategyName, newSetup)
+	mainLog.Debug("Added setup", "strategy", strategyName, "setup", newSetupName)
 }
 
 func proxyQuote(w http.ResponseWriter, r *http.Request) {
@@ -574,100 +611,44 @@ func proxyQuote(w http.ResponseWriter, r *http.Request) {
 	// parts[2] = exchange
 	// parts[3] = contractId
 
-	if len(parts) < 3 {
+	if len(parts) < 4 {
 		http.Error(w, "Contract ID required", http.StatusBadRequest)
 		return
 	}
 	exchange := parts[2]   //string
 	contractId := parts[3] //int
-	// targetURL := fmt.Sprintf("http://localhost:8000/api/IB/quote/%s/%s", exchange, contractId)
-	targetURL := fmt.Sprintf("http://broker_api:8000/api/IB/quote/%s/%s", exchange, contractId)
-	// Create a new request
-	resp, err := http.Get(targetURL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body directly to the response writer
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		log.Printf("Error copying response: %v", err)
-	}
+	proxyBrokerAPI(w, r, fmt.Sprintf("/api/IB/quote/%s/%s", exchange, contractId), 0)
 }
 
 func proxyHistoricalData(w http.ResponseWriter, r *http.Request) {
-	// Get query params from original request
-	// targetURL := "http://localhost:8000/api/IB/historicalData?" + r.URL.RawQuery
-	targetURL := "http://broker_api:8000/api/IB/historicalData?" + r.URL.RawQuery
-
-	// Create a new request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("Error: ", err)
-		fmt.Println("Request: ", proxyReq)
-		return
-	}
-
-	// Copy headers
-	for header, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(header, value)
-		}
-	}
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for header, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(header, value)
-		}
-	}
-
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body
-	io.Copy(w, resp.Body)
-	fmt.Println(resp.Body)
+	proxyBrokerAPI(w, r, "/api/IB/historicalData?"+r.URL.RawQuery, handlers.BrokerHistoryTimeout)
 }
 
 func proxyContractId(w http.ResponseWriter, r *http.Request) {
-	// Get query params from original request
-	// targetURL := "http://localhost:8000/api/IB/contract-id"
-	targetURL := "http://broker_api:8000/api/IB/contract-id"
-	// Create a new request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	proxyBrokerAPI(w, r, "/api/IB/contract-id", 0)
+}
+
+// proxyBrokerAPI forwards a dashboard request to broker_api. The proxied
+// calls only read from the broker, so they are retried like any other read.
+func proxyBrokerAPI(w http.ResponseWriter, r *http.Request, path string, timeout time.Duration) {
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("Error: ", err)
-		fmt.Println("Request: ", proxyReq)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Copy headers
-	for header, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(header, value)
-		}
-	}
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	header := http.Header{}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := handlers.DoBrokerAPI(handlers.BrokerCall{
+		Broker:     "IB",
+		Method:     r.Method,
+		Path:       path,
+		Body:       body,
+		Header:     header,
+		Timeout:    timeout,
+		Idempotent: true,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -684,9 +665,10 @@ func proxyContractId(w http.ResponseWriter, r *http.Request) {
 	// Set status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	io.Copy(w, resp.Body)
-	fmt.Println(resp.Body)
+	// Copy response body directly to the response writer
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("Error copying response: %v", err)
+	}
 }
 
 // -----------------------------------------------------------------
@@ -696,7 +678,6 @@ func proxyContractId(w http.ResponseWriter, r *http.Request) {
 // createTradeServiceClient creates a gRPC client to communicate with the backend service
 func createTradeServiceClient() (pb.TradeServiceClient, *grpc.ClientConn, error) {
 	// Determine the URL based on environment
-	fmt.Println(os.Getenv("ENVIRONMENT"))
 	var serverAddr string
 	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
 		serverAddr = "backend:50051"
@@ -704,13 +685,17 @@ func createTradeServiceClient() (pb.TradeServiceClient, *grpc.ClientConn, error)
 		serverAddr = "localhost:50051"
 	}
 
-	fmt.Println("Connecting to backend at: ", serverAddr)
+	mainLog.Debug("Connecting to backend", "addr", serverAddr)
 	// Create a connection to the gRPC server
-	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	transportCreds, err := tradeTransportCredentials()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load TLS credentials: %v", err)
+	}
+	conn, err := grpc.Dial(serverAddr, transportCreds)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to connect to backend: %v", err)
 	}
-	fmt.Println("Connected to backend")
+	mainLog.Debug("Connected to backend", "addr", serverAddr)
 	// Create a client using the connection
 	client := pb.NewTradeServiceClient(conn)
 	return client, conn, nil
@@ -718,67 +703,14 @@ func createTradeServiceClient() (pb.TradeServiceClient, *grpc.ClientConn, error)
 
 // closePosition handles the close-position endpoint
 func closePosition(strategyName, setupName string, w http.ResponseWriter, r *http.Request) {
-	// 1) Find the position in the positions map
-	// positionId := fmt.Sprintf("%s-%s", strategyName, setupName)
-	position, ok := positions[setupName]
-	if !ok {
-		http.Error(w, "Position not found", http.StatusNotFound)
-		return
-	}
-
-	// 2) Check if there's an active position to close
-	if position.Quantity == 0 {
-		http.Error(w, "No active position to close", http.StatusBadRequest)
-		return
-	}
-
-	// 3) Determine the side for the close order (opposite of current position)
-	side := "SELL"
-	if position.Quantity < 0 {
-		side = "BUY"
-	}
-
-	// 4) Create a gRPC client to communicate with the backend
-	client, conn, err := createTradeServiceClient()
+	status, err := closeSetupPosition(callerIdentity(r), strategyName, setupName)
 	if err != nil {
-		http.Error(w, "Failed to connect to backend: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	defer conn.Close()
-
-	// 5) Create a trade message
-	trade := &pb.Trade{
-		StrategyName: strategyName,
-		ContractId:   int32(position.ContractId),
-		Exchange:     position.Exchange,
-		Symbol:       position.Symbol,
-		Side:         side,
-		Quantity:     strconv.Itoa(abs(position.Quantity)),
-		OrderType:    "MKT", // Use market order for closing positions
-		Broker:       "IB",  // Default broker
-	}
 
-	// 6) Send the trade to the backend service
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := client.SendTrade(ctx, trade)
-	if err != nil {
-		http.Error(w, "Failed to send trade to backend: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// 7) Return success response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": resp.Status})
-}
-
-// abs returns the absolute value of an integer
-func abs(x int) int {
-	if x < 0 {
-		return -x
-	}
-	return x
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
 }
 
 // -----------------------------------------------------------------
@@ -787,41 +719,18 @@ func abs(x int) int {
 
 func toggleSetup(strategyName, setupName string, w http.ResponseWriter, r *http.Request) {
 	// 1) Find the strategy & setup
-	strat, ok := strategies[strategyName]
-	if !ok {
-		http.Error(w, "Strategy not found", http.StatusNotFound)
-		return
-	}
-	setup, ok := strat.Setups[setupName]
-	if !ok {
-		http.Error(w, "Setup not found", http.StatusNotFound)
+	strategiesMu.Lock()
+	setup, found := strategies[strategyName].Setups[setupName]
+	strategiesMu.Unlock()
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Setup not found", nil)
 		return
 	}
 
 	// 2) If setup.Enabled == true, we want to stop it
 	//    If setup.Enabled == false, we want to start it
-	if setup.Enabled {
-		// Stop
-		stopScript(strategyName, setupName)
-		// Mark as inactive
-		setup.Enabled = false
-	} else {
-		// Start
-		if err := startScript(strat.ScriptPath, strategyName, setupName); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Mark as active
-		setup.Enabled = true
-	}
-
-	// 3) Update the local strategies map
-	strat.Setups[setupName] = setup
-	strategies[strategyName] = strat
-	shared_strategy_config := GetSharedFilePath("strategy-config.json")
-	// 4) Persist to JSON
-	if err := saveStrategies(shared_strategy_config); err != nil {
-		http.Error(w, "Failed to save config: " + err.Error(), http.StatusInternalServerError)
+	if _, err := setSetupEnabled(callerIdentity(r), strategyName, setupName, !setup.Enabled); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -831,77 +740,157 @@ func toggleSetup(strategyName, setupName string, w http.ResponseWriter, r *http.
 func updateSetup(w http.ResponseWriter, r *http.Request) {
 	// 1) Parse the request body
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Failed to parse form data: "+err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Failed to parse form data: "+err.Error(), nil)
 		return
 	}
 
 	// Get setupName from form data
 	setupName := r.FormValue("setupName")
 	if setupName == "" {
-		http.Error(w, "Setup name is required", http.StatusBadRequest)
+		writeValidationError(w, ValidationErrors{{Field: "setupName", Message: "is required"}})
 		return
 	}
 
-	// 2) Find the strategy & setup
-	var foundStrategy string
-	var foundSetup Setup
-	var strategyFound bool
-
-	for stratName, strat := range strategies {
-		if setup, ok := strat.Setups[setupName]; ok {
-			foundStrategy = stratName
-			foundSetup = setup
-			strategyFound = true
-			break
-		}
+	// 2) Find the strategy the setup belongs to
+	strategyName, found := findSetupStrategy(setupName)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Setup not found in any strategy",
+			ValidationErrors{{Field: "setupName", Message: "unknown setup " + setupName}})
+		return
 	}
 
-	if !strategyFound {
-		http.Error(w, "Setup not found in any strategy", http.StatusNotFound)
+	// 3) Update setup fields from form data, then validate, save and restart
+	_, err := updateSetupConfig(callerIdentity(r), strategyName, setupName, func(setup *Setup, paramSchema []ParamSpec) ValidationErrors {
+		formSetup, errs := parseSetupForm(r, "market_data")
+		setup.Market = formSetup.Market
+		setup.ContractId = formSetup.ContractId
+		setup.Timeframe = formSetup.Timeframe
+		setup.Schedule = formSetup.Schedule
+		setup.MarketData = formSetup.MarketData
+		if _, ok := r.Form["flatten_at"]; ok {
+			setup.FlattenAt = formSetup.FlattenAt
+			setup.FlattenBeforeClose = formSetup.FlattenBeforeClose
+		}
+		if _, ok := r.Form["script_version"]; ok {
+			version, err := parseVersionField(r.FormValue("script_version"))
+			if err != nil {
+				errs.add("script_version", "%v", err)
+			}
+			setup.ScriptVersion = version
+		}
+		// Merge submitted params into the stored ones rather than replacing them
+		params, paramErrs := mergeParams(paramSchema, setup.Params, paramsFromForm(r))
+		setup.Params = params
+		return append(errs, paramErrs...)
+	})
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// 3) Update setup fields from form data
-	// Preserve existing values that we don't want to modify
-	foundSetup.Market = r.FormValue("market")
-	foundSetup.ContractId, _ = strconv.Atoi(r.FormValue("contract_id"))
-	foundSetup.Timeframe = r.FormValue("timeframe")
-	foundSetup.Schedule = r.FormValue("schedule")
-	foundSetup.MarketData = strings.Split(r.FormValue("market_data"), ",")
-	// foundSetup.Enabled = r.FormValue("enabled") == "true"
-	foundSetup.Params = make(map[string]string)
+	w.WriteHeader(http.StatusOK)
+}
+
+// -----------------------------------------------------------------
+// Start / Stop Script
+// -----------------------------------------------------------------
 
-	// 4) Update the local strategies map
-	strat := strategies[foundStrategy]
-	strat.Setups[setupName] = foundSetup
-	strategies[foundStrategy] = strat
+// errExchangeClosed is returned when a setup is started on a day its
+// exchange is closed
+var errExchangeClosed = errors.New("setups do not start on exchange holidays")
 
-	// 5) Persist to JSON
-	shared_strategy_config := GetSharedFilePath("strategy-config.json")
-	if err := saveStrategies(shared_strategy_config); err != nil {
-		http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
-		return
+// checkExchangeOpen fails with errExchangeClosed on the holidays of an
+// exchange. A calendar that cannot be read stops the start as well, rather
+// than letting a setup trade into a holiday.
+func checkExchangeOpen(exchange string, at time.Time) error {
+	holiday, closed, err := handlers.ExchangeHoliday(exchange, at)
+	if err != nil {
+		return fmt.Errorf("unable to check the %s calendar: %v", exchange, err)
 	}
+	if closed {
+		return fmt.Errorf("%s is closed for %s: %w", exchange, holiday, errExchangeClosed)
+	}
+	return nil
+}
 
-	// 6) If the setup is currently active, restart it with new configuration
-	if foundSetup.Enabled {
-		stopScript(foundStrategy, setupName)
+// inSession reports whether the exchange of a setup is in a session now.
+// When the calendar cannot be read it assumes so.
+func inSession(strategyName, setupName string) bool {
+	strategiesMu.Lock()
+	exchange, _, _ := strings.Cut(strategies[strategyName].Setups[setupName].Market, ":")
+	strategiesMu.Unlock()
+	open, err := handlers.ExchangeOpen(exchange, time.Now())
+	if err != nil {
+		log.Printf("[ERROR] Failed to check the %s calendar: %v", exchange, err)
+		return true
+	}
+	return open
+}
 
-		if err := startScript(strat.ScriptPath, foundStrategy, setupName); err != nil {
-			http.Error(w, "Failed to restart script: "+err.Error(), http.StatusInternalServerError)
-			return
+// stopOnHolidays disables, every minute, the running setups whose exchange
+// is closed for a holiday. Like a flattened setup they stay disabled until
+// someone enables them again.
+func stopOnHolidays() {
+	go func() {
+		for {
+			next := time.Now().Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(time.Until(next))
+			disableHolidaySetups(next)
+		}
+	}()
+}
+
+// disableHolidaySetups disables the enabled setups whose exchange is closed
+// for a holiday at a minute
+func disableHolidaySetups(at time.Time) {
+	type target struct {
+		setupTarget
+		exchange string
+	}
+	var targets []target
+	strategiesMu.Lock()
+	for strategyName, strat := range strategies {
+		for setupName, setup := range strat.Setups {
+			if !setup.Enabled {
+				continue
+			}
+			exchange, _, _ := strings.Cut(setup.Market, ":")
+			targets = append(targets, target{setupTarget{strategyName, setupName}, exchange})
 		}
 	}
+	strategiesMu.Unlock()
 
-	w.WriteHeader(http.StatusOK)
+	type calendarDay struct {
+		holiday string
+		closed  bool
+	}
+	days := make(map[string]calendarDay)
+	for _, t := range targets {
+		day, checked := days[t.exchange]
+		if !checked {
+			holiday, closed, err := handlers.ExchangeHoliday(t.exchange, at)
+			if err != nil {
+				log.Printf("[ERROR] Failed to check the %s calendar: %v", t.exchange, err)
+				continue
+			}
+			day = calendarDay{holiday, closed}
+			days[t.exchange] = day
+		}
+		if !day.closed {
+			continue
+		}
+		holiday := day.holiday
+		log.Printf("[INFO] Stopping %s %s, %s is closed for %s", t.StrategyName, t.SetupName, t.exchange, holiday)
+		if _, err := setSetupEnabled(schedulerIdentity, t.StrategyName, t.SetupName, false); err != nil {
+			log.Printf("[ERROR] Failed to disable %s %s for %s: %v", t.StrategyName, t.SetupName, holiday, err)
+		}
+		notifyStrategyConfigChanged(t.key())
+	}
 }
 
-// -----------------------------------------------------------------
-// Start / Stop Script
-// -----------------------------------------------------------------
-
-// startScript spawns a python process for the given setup
-func startScript(scriptPath, strategyName, setupName string) error {
+// startScript spawns a python process for the given setup, running the
+// script version it is pinned to or the strategy's current one
+func startScript(strategyName, setupName string) error {
 	runningMu.Lock()
 	key := strategyName + "|" + setupName
 	if _, exists := runningProcs[key]; exists {
@@ -910,37 +899,81 @@ func startScript(scriptPath, strategyName, setupName string) error {
 	}
 	runningMu.Unlock()
 
+	strategiesMu.Lock()
+	strat := strategies[strategyName]
+	setup := strat.Setups[setupName]
+	scriptPath, scriptVersion, err := resolveScript(strat, setup)
+	// Hand the resolved setup params to the script alongside the config file
+	params := resolvedParams(strat.ParamSchema, setup.Params)
+	strategiesMu.Unlock()
+	if err != nil {
+		return err
+	}
+	exchange, _, _ := strings.Cut(setup.Market, ":")
+	if err := checkExchangeOpen(exchange, time.Now()); err != nil {
+		return err
+	}
+
 	venvPythonPath, err := GetSharedVenvPath()
 	if err != nil {
 		return err
 	}
 	// First, verify the Python interpreter and the script exist
 	if err := checkPythonAndScript(venvPythonPath, scriptPath); err != nil {
-		fmt.Println(err)
+		strategyLog.Error("Unable to run script", "strategy", strategyName, "setup", setupName, "error", err)
+		return err
+	}
+
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	// Each process may only trade for its own strategy
+	issuedAt := time.Now()
+	env, err := strategyEnv(strategyName)
+	if err != nil {
 		return err
 	}
 
 	cmd := exec.Command(venvPythonPath, scriptPath, setupName)
+	cmd.Env = append(env,
+		"SETUP_PARAMS="+string(paramsJSON),
+		// Reported with every trade so the DB records which script produced it
+		"SCRIPT_VERSION="+scriptVersion,
+		// Reported with every trade so history can be filtered by setup
+		"SETUP_NAME="+setupName,
+		// Versioned scripts live outside the strategies dir but still import utils
+		"PYTHONPATH="+getStrategyUploadDir(),
+	)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 							Setpgid: true, // Create new process group
 						}
-	fmt.Println(cmd.Process)
+	// Scripts run as their own user, away from the scheduler's secrets
+	if cmd.SysProcAttr.Credential, err = strategyCredential(); err != nil {
+		return err
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	// Pipe stdout to server log
+	// Log each line the script prints
+	logger := strategyLog.With("strategy", strategyName, "setup", setupName)
 	go func() {
-		io.Copy(log.Writer(), stdout)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			logScriptLine(logger, scanner.Text())
+		}
 	}()
 
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	fmt.Println("Running", scriptPath, setupName)
+	logger.Info("Started script", "script", scriptPath, "pid", cmd.Process.Pid)
 
 	runningMu.Lock()
 	runningProcs[key] = cmd
+	tokenIssuedAt[key] = issuedAt
 	runningMu.Unlock()
     
 	// Wait for the process in a separate goroutine to prevent zombies
@@ -948,17 +981,61 @@ func startScript(scriptPath, strategyName, setupName string) error {
         defer func() {
             // Clean up when process exits
             runningMu.Lock()
-            delete(runningProcs, key)
+            // A restart may already have registered a new process under this key
+            if runningProcs[key] == cmd {
+                // Still registered, so stopScript did not stop it
+                strategyExits.WithLabelValues(strategyName).Inc()
+                delete(runningProcs, key)
+            }
             runningMu.Unlock()
         }()
         
         cmd.Wait() // This will block until process exits, but won't block HTTP response
-        fmt.Printf("Process %s has exited\n", key)
+        logger.Info("Script exited", "state", cmd.ProcessState.String())
     }()
 
 	return nil
 }
 
+// logScriptLine logs a line a script printed. JSON lines with a "msg", like
+// the ones utils.trade_client prints, keep their level and fields.
+func logScriptLine(logger *slog.Logger, line string) {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		logger.Info(line)
+		return
+	}
+	msg, ok := record["msg"].(string)
+	if !ok {
+		logger.Info(line)
+		return
+	}
+	level := slog.LevelInfo
+	if name, ok := record["level"].(string); ok {
+		level.UnmarshalText([]byte(name))
+	}
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		if key != "msg" && key != "level" && key != "time" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	attrs := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, key, record[key])
+	}
+	logger.Log(context.Background(), level, msg, attrs...)
+}
+
+// restartScript stops a setup's process and starts it again, e.g. on a new
+// config or script version
+func restartScript(strategyName, setupName string) error {
+	stopScript(strategyName, setupName)
+	strategyRestarts.WithLabelValues(strategyName).Inc()
+	return startScript(strategyName, setupName)
+}
+
 // stopScript kills the process if it's running
 func stopScript(strategyName, setupName string) {
 	runningMu.Lock()
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"scheduler/handlers"
+	"scheduler/logging"
+	pb "scheduler/tradepb"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// -----------------------------------------------------------------
+// Strategy & Setup Operations
+// -----------------------------------------------------------------
+
+// These back both the form-based routes used by the dashboard and the
+// /api/v1 JSON routes. Failures are returned as *apiError so each surface
+// reports them with the same status and fields.
+
+// scriptUpload is a strategy script received with a request
+type scriptUpload struct {
+	Filename   string
+	Src        io.Reader
+	UploadedBy string
+}
+
+// strategyParamSchema returns the parameter declarations of a strategy
+func strategyParamSchema(strategyName string) []ParamSpec {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	return strategies[strategyName].ParamSchema
+}
+
+// findSetupStrategy returns the strategy a setup belongs to
+func findSetupStrategy(setupName string) (string, bool) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	for strategyName, strat := range strategies {
+		if _, ok := strat.Setups[setupName]; ok {
+			return strategyName, true
+		}
+	}
+	return "", false
+}
+
+// checkPinnedVersion reports a setup pinned to a version its strategy lacks
+func checkPinnedVersion(strategyName string, setup Setup) ValidationErrors {
+	var errs ValidationErrors
+	if setup.ScriptVersion == 0 {
+		return errs
+	}
+	strategiesMu.Lock()
+	_, found := strategies[strategyName].findVersion(setup.ScriptVersion)
+	strategiesMu.Unlock()
+	if !found {
+		errs.add("script_version", "version %d not found", setup.ScriptVersion)
+	}
+	return errs
+}
+
+// createStrategy validates a new strategy, stores its script as version 1 and
+// adds it to the config. errs carries problems already found while decoding
+// the request so every field is reported in one response.
+func createStrategy(actor identity, strategyName string, strat Strategy, script *scriptUpload, errs ValidationErrors) (created Strategy, err error) {
+	defer auditChange(actor, "strategy.create", strategyName, "")(&err)
+	uploadDir := getStrategyUploadDir()
+	if script != nil {
+		// Placeholder until the upload is stored as version 1
+		strat.ScriptPath = filepath.Join(uploadDir, filepath.Base(script.Filename))
+	}
+
+	// Schema checks first, the broker lookup only once everything else is valid
+	errs = append(errs, validateStrategy(strategyName, strat)...)
+	if len(errs) == 0 {
+		setupNames := make([]string, 0, len(strat.Setups))
+		for setupName := range strat.Setups {
+			setupNames = append(setupNames, setupName)
+		}
+		sort.Strings(setupNames)
+		for _, setupName := range setupNames {
+			for _, fe := range validateContractAtBroker(strat.Setups[setupName]) {
+				errs.add("setups."+setupName+"."+fe.Field, "%s", fe.Message)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return strat, validationFailed(errs)
+	}
+
+	strategiesMu.Lock()
+	_, taken := strategies[strategyName]
+	strategiesMu.Unlock()
+	if taken {
+		return strat, newAPIError(http.StatusConflict, "Strategy already exists, select a different name.",
+			ValidationErrors{{Field: "strategyName", Message: "already exists"}})
+	}
+
+	// Check if local directory exists - it should
+	if _, err := exists(uploadDir); err != nil {
+		return strat, newAPIError(http.StatusInternalServerError, "Unable to find directory", nil)
+	}
+	log.Printf("[INFO] Found directory: %s\n", uploadDir)
+
+	// Store the upload as the strategy's first immutable version
+	version, _, err := storeScriptVersion(strategyName, strat, script.Filename, script.Src, script.UploadedBy)
+	if err != nil {
+		log.Println("[ERROR] Unable to store script:", err)
+		return strat, newAPIError(http.StatusInternalServerError, "Error saving file", nil)
+	}
+	strat.Versions = []ScriptVersion{version}
+	strat.CurrentVersion = version.Version
+	strat.ScriptPath = version.Path
+	log.Printf("[INFO] File uploaded successfully: %s (%s)\n", script.Filename, version.Label())
+	log.Printf("[INFO] strategyName=%s, type=%s, setups=%d", strategyName, strat.StrategyType, len(strat.Setups))
+
+	if err := addStrategyToConfigFile(strategyName, strat); err != nil {
+		return strat, newAPIError(http.StatusInternalServerError, err.Error(), nil)
+	}
+	return strat, nil
+}
+
+// addSetup validates a new setup and adds it, stopped, to an existing strategy
+func addSetup(actor identity, strategyName, setupName string, setup Setup, errs ValidationErrors) (added Setup, err error) {
+	defer auditChange(actor, "setup.create", strategyName, setupName)(&err)
+	setup.Enabled = false
+	setup.Archived = false
+	setup.ArchivedAt = nil
+	errs = append(errs, validateSetup(strategyName, setupName, setup, strategyParamSchema(strategyName))...)
+	errs = append(errs, checkPinnedVersion(strategyName, setup)...)
+	if len(errs) == 0 {
+		errs = validateContractAtBroker(setup)
+	}
+	if len(errs) > 0 {
+		return setup, validationFailed(errs)
+	}
+
+	// Find the strategy & make sure the setup name is free
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strat, ok := strategies[strategyName]
+	if !ok {
+		return setup, newAPIError(http.StatusNotFound, "Strategy not found",
+			ValidationErrors{{Field: "strategyName", Message: "unknown strategy " + strategyName}})
+	}
+	if _, ok := strat.Setups[setupName]; ok {
+		return setup, newAPIError(http.StatusConflict, "Setup name already exists, enter a different name.",
+			ValidationErrors{{Field: "setupName", Message: "already exists"}})
+	}
+
+	if strat.Setups == nil {
+		strat.Setups = make(map[string]Setup)
+	}
+	strat.Setups[setupName] = setup
+	strategies[strategyName] = strat
+
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	if err := saveStrategies(shared_strategy_config); err != nil {
+		delete(strat.Setups, setupName)
+		return setup, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+	return setup, nil
+}
+
+// updateStrategy applies update to the strategy-level fields of a strategy,
+// validates them and saves the config
+func updateStrategy(actor identity, strategyName string, update func(strat *Strategy)) (updated Strategy, err error) {
+	defer auditChange(actor, "strategy.update", strategyName, "")(&err)
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strat, ok := strategies[strategyName]
+	if !ok {
+		return strat, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	update(&strat)
+	var errs ValidationErrors
+	if strat.Group != "" && !setupNamePattern.MatchString(strat.Group) {
+		errs.add("group", "may only contain letters, digits, '_' and '-'")
+	}
+	if len(errs) > 0 {
+		return strat, validationFailed(errs)
+	}
+
+	strategies[strategyName] = strat
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	if err := saveStrategies(shared_strategy_config); err != nil {
+		return strat, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+	return strat, nil
+}
+
+// updateSetupConfig applies update to a copy of the setup, validates the
+// result and saves it. A running setup is restarted with the new config.
+func updateSetupConfig(actor identity, strategyName, setupName string, update func(setup *Setup, paramSchema []ParamSpec) ValidationErrors) (updated Setup, err error) {
+	defer auditChange(actor, "setup.update", strategyName, setupName)(&err)
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	current, found := strat.Setups[setupName]
+	paramSchema := strat.ParamSchema
+	strategiesMu.Unlock()
+	if !ok {
+		return current, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	if !found {
+		return current, newAPIError(http.StatusNotFound, "Setup not found",
+			ValidationErrors{{Field: "setupName", Message: "unknown setup " + setupName}})
+	}
+
+	setup := current
+	setup.Params = make(map[string]interface{}, len(current.Params))
+	for name, value := range current.Params {
+		setup.Params[name] = value
+	}
+	errs := update(&setup, paramSchema)
+	contractChanged := setup.ContractId != current.ContractId || setup.Market != current.Market
+
+	errs = append(errs, validateSetup(strategyName, setupName, setup, paramSchema)...)
+	errs = append(errs, checkPinnedVersion(strategyName, setup)...)
+	if len(errs) == 0 && contractChanged {
+		errs = validateContractAtBroker(setup)
+	}
+	if len(errs) > 0 {
+		return setup, validationFailed(errs)
+	}
+
+	// Validation ran unlocked, so only the edited fields go onto the setup as
+	// it is now, keeping e.g. an Enabled toggle made in the meantime
+	strategiesMu.Lock()
+	strat, ok = strategies[strategyName]
+	latest, found := strat.Setups[setupName]
+	if !ok || !found {
+		strategiesMu.Unlock()
+		return setup, newAPIError(http.StatusNotFound, "Setup not found", nil)
+	}
+	setup = applyEdits(latest, current, setup)
+	strat.Setups[setupName] = setup
+	strategies[strategyName] = strat
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	strategiesMu.Unlock()
+	if err != nil {
+		return setup, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+
+	// If the setup is currently active, restart it with new configuration
+	if setup.Enabled {
+		if err := restartScript(strategyName, setupName); err != nil {
+			return setup, newAPIError(http.StatusInternalServerError, "Failed to restart script: "+err.Error(), nil)
+		}
+	}
+	return setup, nil
+}
+
+// setSetupEnabled starts or stops a setup and records the new state
+func setSetupEnabled(actor identity, strategyName, setupName string, enabled bool) (updated Setup, err error) {
+	action := "setup.stop"
+	if enabled {
+		action = "setup.start"
+	}
+	defer auditChange(actor, action, strategyName, setupName)(&err)
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	setup, found := strat.Setups[setupName]
+	strategiesMu.Unlock()
+	if !ok {
+		return setup, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	if !found {
+		return setup, newAPIError(http.StatusNotFound, "Setup not found", nil)
+	}
+
+	if enabled {
+		if err := archivedError(strategyName, setupName); err != nil {
+			return setup, newAPIError(http.StatusConflict, err.Error(), nil)
+		}
+		if err := startScript(strategyName, setupName); errors.Is(err, errExchangeClosed) {
+			return setup, newAPIError(http.StatusConflict, err.Error(), nil)
+		} else if err != nil {
+			return setup, newAPIError(http.StatusInternalServerError, err.Error(), nil)
+		}
+	} else {
+		stopScript(strategyName, setupName)
+	}
+
+	strategiesMu.Lock()
+	strat, ok = strategies[strategyName]
+	setup, found = strat.Setups[setupName]
+	if !ok || !found {
+		strategiesMu.Unlock()
+		// Deleted while it was starting
+		if enabled {
+			stopScript(strategyName, setupName)
+		}
+		return setup, newAPIError(http.StatusNotFound, "Setup not found", nil)
+	}
+	setup.Enabled = enabled
+	strat.Setups[setupName] = setup
+	strategies[strategyName] = strat
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	strategiesMu.Unlock()
+	if err != nil {
+		return setup, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+	return setup, nil
+}
+
+// applyEdits returns latest with the fields that differ between before and
+// edited set as in edited. Params are merged by name.
+func applyEdits(latest, before, edited Setup) Setup {
+	params := make(map[string]interface{}, len(latest.Params))
+	for name, value := range latest.Params {
+		params[name] = value
+	}
+	for name := range before.Params {
+		if _, kept := edited.Params[name]; !kept {
+			delete(params, name)
+		}
+	}
+	for name, value := range edited.Params {
+		if old, ok := before.Params[name]; !ok || !reflect.DeepEqual(old, value) {
+			params[name] = value
+		}
+	}
+
+	merged := reflect.ValueOf(&latest).Elem()
+	b, e := reflect.ValueOf(before), reflect.ValueOf(edited)
+	for i := 0; i < merged.NumField(); i++ {
+		if !reflect.DeepEqual(b.Field(i).Interface(), e.Field(i).Interface()) {
+			merged.Field(i).Set(e.Field(i))
+		}
+	}
+	latest.Params = params
+	return latest
+}
+
+// closeSetupPosition sends a market order to flatten a setup's position and
+// returns the backend's response status
+func closeSetupPosition(actor identity, strategyName, setupName string) (status string, err error) {
+	// 1) Find the position in the positions file
+	current, err := readPositions()
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Unable to read positions: "+err.Error(), nil)
+	}
+	position, ok := current[setupName]
+	defer func() {
+		recordAudit(actor, "setup.close_position", strategyName, setupName, map[string]handlers.AuditChange{
+			"position.quantity": {Before: position.Quantity, After: 0},
+			"order_status":      {Before: nil, After: status},
+		}, err)
+	}()
+	if !ok {
+		return "", newAPIError(http.StatusNotFound, "Position not found", nil)
+	}
+
+	// 2) Check if there's an active position to close
+	if position.Quantity == 0 {
+		return "", newAPIError(http.StatusBadRequest, "No active position to close", nil)
+	}
+
+	return sendClosingOrder(strategyName, setupName, "IB", position.ContractId, position.Exchange, position.Symbol, float64(position.Quantity))
+}
+
+// sendClosingOrder sends the backend a market order for the opposite side of
+// a position and returns the backend's response status
+func sendClosingOrder(strategyName, setupName, broker string, contractID int, exchange, symbol string, quantity float64) (string, error) {
+	// 1) Determine the side for the close order (opposite of current position)
+	side := "SELL"
+	if quantity < 0 {
+		side = "BUY"
+	}
+
+	// 2) Create a gRPC client to communicate with the backend
+	client, conn, err := createTradeServiceClient()
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Failed to connect to backend: "+err.Error(), nil)
+	}
+	defer conn.Close()
+
+	// 3) Create a trade message
+	trade := &pb.Trade{
+		StrategyName: strategyName,
+		ContractId:   int32(contractID),
+		Exchange:     exchange,
+		Symbol:       symbol,
+		Side:         side,
+		Quantity:     strconv.FormatFloat(math.Abs(quantity), 'f', -1, 64),
+		OrderType:    "MKT", // Use market order for closing positions
+		Broker:       broker,
+	}
+
+	// 4) Send the trade to the backend service
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx, err = withTradeToken(ctx, strategyName)
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, "Failed to sign trade: "+err.Error(), nil)
+	}
+	// The backend logs the trade and its broker_api calls under this ID
+	correlationID := logging.NewCorrelationID()
+	ctx = metadata.AppendToOutgoingContext(ctx, "setup-name", setupName, logging.MetadataKey, correlationID)
+	log := ordersLog.With(logging.Key, correlationID, "strategy", strategyName, "setup", setupName)
+	log.Info("Sending closing order", "symbol", symbol, "side", side, "quantity", trade.Quantity)
+
+	resp, err := client.SendTrade(ctx, trade)
+	if err != nil {
+		log.Error("Failed to send closing order", "error", err)
+		return "", newAPIError(http.StatusInternalServerError, "Failed to send trade to backend: "+err.Error(), nil)
+	}
+	return resp.Status, nil
+}
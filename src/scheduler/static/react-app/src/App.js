@@ -1,13 +1,33 @@
 // import logo from './logo.svg';
 // import './App.css';
+import { useEffect, useState } from 'react';
 import TradingDashboard from './components/TradingDashboard';
+import Login from './components/Login';
+
+const SCHEDULER_API_BASE = window.location.hostname === 'localhost' ? 'http://localhost:8080' : '';
 
 function App() {
+  const [user, setUser] = useState(null);
+  const [checked, setChecked] = useState(false);
+
+  // Resume an existing session if the cookie is still valid
+  useEffect(() => {
+    fetch(`${SCHEDULER_API_BASE}/api/v1/auth/me`, { credentials: 'include' })
+      .then((response) => (response.ok ? response.json() : null))
+      .then(setUser)
+      .catch(() => setUser(null))
+      .finally(() => setChecked(true));
+  }, []);
+
+  if (!checked) {
+    return null;
+  }
+
   return (
     <div className="App">
-      <TradingDashboard />
+      {user ? <TradingDashboard /> : <Login onLogin={setUser} />}
     </div>
   );
 }
 
-export default App;
\ No newline at end of file
+export default App;
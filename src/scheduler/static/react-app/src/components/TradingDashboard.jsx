@@ -74,19 +74,21 @@ export default function TradingDashboard() {
   const [chartData, setChartData] = useState([]);
   const [chartLoading, setChartLoading] = useState(false);
   const [contractResult, setContractResult] = useState(null);
+  const [brokerCircuits, setBrokerCircuits] = useState([]);
   const SCHEDULER_API_BASE = window.location.hostname === 'localhost' ? 'http://localhost:8080' : '';
   const [kpiMetrics, setKPIMetrics] = useState({
     maintMarginReq: { title: '', value: '', change: '', isPositive: false },
     netLiquidation: { title: '', value: '', change: '', isPositive: false },
     unrealizedPnl: { title: '', value: '', change: '', isPositive: false },
-    realizedPnL: { title: '', value: '', change: '', isPositive: false }
+    realizedPnL: { title: '', value: '', change: '', isPositive: false },
+    commissions: { title: '', value: '', change: '', isPositive: false }
   });
   // Fetch strategies on component mount
   useEffect(() => {
     fetchStrategies();
 
     // Set up position streaming
-    const positionSource = new EventSource(`${SCHEDULER_API_BASE}/streamPositions`);
+    const positionSource = new EventSource(`${SCHEDULER_API_BASE}/streamPositions`, { withCredentials: true });
 
     positionSource.onmessage = async (event) => {
       const newPositions = JSON.parse(event.data);
@@ -100,7 +102,7 @@ export default function TradingDashboard() {
           if (!priceMap.has(conId)) {
             try {
               const exchange = position.exchange;
-              const response = await fetch(`${SCHEDULER_API_BASE}/proxy/quote/${exchange}/${conId}`);
+              const response = await fetch(`${SCHEDULER_API_BASE}/proxy/quote/${exchange}/${conId}`, { credentials: 'include' });
               const data = await response.json();
               priceMap.set(conId, data.last);
               // Calculate unrealized value
@@ -120,15 +122,22 @@ export default function TradingDashboard() {
     };
 
     // Set up trade streaming
-    const tradeSource = new EventSource(`${SCHEDULER_API_BASE}/streamTrades`);
-    tradeSource.onmessage = (event) => {
-      const newTrades = JSON.parse(event.data);
-      setTrades(newTrades);
+    const tradeSource = new EventSource(`${SCHEDULER_API_BASE}/streamTrades`, { withCredentials: true });
+    // A full snapshot on connect, then one event per inserted/updated trade.
+    // The browser resumes from the last event id after a reconnect.
+    tradeSource.addEventListener('snapshot', (event) => {
+      setTrades(JSON.parse(event.data));
+    });
+    const applyTradeChange = (event) => {
+      const trade = JSON.parse(event.data);
+      setTrades(prev => ({ ...prev, [`trade-${trade.id}`]: trade }));
     };
+    tradeSource.addEventListener('insert', applyTradeChange);
+    tradeSource.addEventListener('update', applyTradeChange);
 
 
     // Set up strategy config refresh streaming
-    const refreshSource = new EventSource(`${SCHEDULER_API_BASE}/refreshStrategyConfig`);
+    const refreshSource = new EventSource(`${SCHEDULER_API_BASE}/refreshStrategyConfig`, { withCredentials: true });
     refreshSource.onmessage = (event) => {
       console.log("Strategy update notification:", event.data);
       fetchStrategies();
@@ -136,7 +145,7 @@ export default function TradingDashboard() {
 
     // const { title, value, change, isPositive } = metric;
     // Set up KPI metrics streaming
-    const kpiSource = new EventSource(`${SCHEDULER_API_BASE}/streamKPIMetrics`);
+    const kpiSource = new EventSource(`${SCHEDULER_API_BASE}/streamKPIMetrics`, { withCredentials: true });
     kpiSource.onmessage = (event) => {
       console.log('Raw event data:', event.data); // Add this line
       try {
@@ -148,7 +157,12 @@ export default function TradingDashboard() {
       }
     };
 
+    // Poll the broker_api circuit breakers of the scheduler and the backend
+    fetchBrokerCircuits();
+    const circuitTimer = setInterval(fetchBrokerCircuits, 10000);
+
     return () => {
+      clearInterval(circuitTimer);
       positionSource.close();
       refreshSource.close();
       kpiSource.close();
@@ -160,7 +174,7 @@ export default function TradingDashboard() {
   const fetchStrategies = async () => {
     setLoading(true);
     try {
-      const response = await fetch(`${SCHEDULER_API_BASE}/strategies`);
+      const response = await fetch(`${SCHEDULER_API_BASE}/strategies`, { credentials: 'include' });
       const data = await response.json();
       console.log(data);
       setStrategies(data);
@@ -171,6 +185,17 @@ export default function TradingDashboard() {
     }
   };
 
+  const fetchBrokerCircuits = async () => {
+    try {
+      const response = await fetch(`${SCHEDULER_API_BASE}/api/v1/broker-circuits`, { credentials: 'include' });
+      if (response.ok) {
+        setBrokerCircuits(await response.json());
+      }
+    } catch (error) {
+      console.error("Failed to fetch broker circuits:", error);
+    }
+  };
+
   // Fetch historical data for selected setup
   const fetchHistoricalData = async (strategyName, setupName) => {
     setChartLoading(true);
@@ -207,6 +232,7 @@ export default function TradingDashboard() {
       console.log(url);
       const response = await fetch(url, {
         method: 'POST',
+        credentials: 'include',
         headers: {
           'Content-Type': 'application/json'
         },
@@ -251,7 +277,7 @@ export default function TradingDashboard() {
 
     try {
       // Make API call in background
-      await fetch(`${SCHEDULER_API_BASE}/strategies/${strategyName}/${setupName}/toggle`, { method: 'POST' });
+      await fetch(`${SCHEDULER_API_BASE}/strategies/${strategyName}/${setupName}/toggle`, { method: 'POST', credentials: 'include' });
     } catch (error) {
       console.error("Failed to toggle setup:", error);
       // Revert the change if the API call fails
@@ -288,6 +314,18 @@ export default function TradingDashboard() {
     setIsAddSetupModalOpen(true);
   };
 
+  // Turn a scheduler error response into a readable message
+  const readError = async (response) => {
+    const text = await response.text();
+    try {
+      const body = JSON.parse(text);
+      const fields = (body.fields || []).map(f => `\n - ${f.field}: ${f.message}`).join('');
+      return `${body.error}${fields}`;
+    } catch {
+      return text;
+    }
+  };
+
   // Handle new strategy form submission
   const handleNewStrategySubmit = async (e) => {
     e.preventDefault();
@@ -297,6 +335,7 @@ export default function TradingDashboard() {
     try {
       const response = await fetch(`${SCHEDULER_API_BASE}/uploadNewStrategy`, {
         method: 'POST',
+        credentials: 'include',
         body: formData
       });
 
@@ -304,7 +343,7 @@ export default function TradingDashboard() {
         setIsNewStrategyModalOpen(false);
         fetchStrategies();
       } else {
-        const errorText = await response.text();
+        const errorText = await readError(response);
         alert("Failed to add strategy: " + errorText);
       }
     } catch (error) {
@@ -322,6 +361,7 @@ export default function TradingDashboard() {
     try {
       const response = await fetch(`${SCHEDULER_API_BASE}/updateSetup`, {
         method: 'POST',
+        credentials: 'include',
         headers: {'Content-Type': 'application/x-www-form-urlencoded'},
         body: urlEncodedData
       });
@@ -330,7 +370,7 @@ export default function TradingDashboard() {
         setIsEditSetupModalOpen(false);
         fetchStrategies();
       } else {
-        const errorText = await response.text();
+        const errorText = await readError(response);
         alert("Failed to update setup: " + errorText);
       }
     } catch (error) {
@@ -348,6 +388,7 @@ export default function TradingDashboard() {
     try {
       const response = await fetch(`${SCHEDULER_API_BASE}/addSetup`, {
         method: 'POST',
+        credentials: 'include',
         headers: {'Content-Type': 'application/x-www-form-urlencoded'},
         body: urlEncodedData
       });
@@ -356,7 +397,7 @@ export default function TradingDashboard() {
         setIsAddSetupModalOpen(false);
         fetchStrategies();
       } else {
-        const errorText = await response.text();
+        const errorText = await readError(response);
         alert("Failed to add setup: " + errorText);
       }
     } catch (error) {
@@ -375,6 +416,7 @@ export default function TradingDashboard() {
     try {
       const response = await fetch(`${SCHEDULER_API_BASE}/proxy/contractId`, {
         method: 'POST',
+        credentials: 'include',
         headers: { 'Content-Type': 'application/json' },
         // credentials: 'include',
         body: JSON.stringify(payload)
@@ -396,7 +438,8 @@ export default function TradingDashboard() {
 
     try {
       const response = await fetch(`${SCHEDULER_API_BASE}/strategies/${strategyName}/${setupName}/close-position`, {
-        method: 'POST'
+        method: 'POST',
+        credentials: 'include'
       });
 
       if (response.ok) {
@@ -414,10 +457,34 @@ export default function TradingDashboard() {
     }
   };
 
+  // Archive a setup: hides it from the list but keeps its trade history
+  const archiveSetup = async (strategyName, setupName) => {
+    if (!window.confirm(`Archive ${setupName}? It must be stopped with no open position.`)) {
+      return;
+    }
+
+    try {
+      const response = await fetch(`${SCHEDULER_API_BASE}/strategies/${strategyName}/${setupName}/archive`, {
+        method: 'POST',
+        credentials: 'include'
+      });
+
+      if (response.ok) {
+        fetchStrategies();
+      } else {
+        alert(`Failed to archive setup: ${await readError(response)}`);
+      }
+    } catch (error) {
+      console.error('Error archiving setup:', error);
+      alert(`Error archiving setup: ${error.message}`);
+    }
+  };
+
   return (
     <div className="min-h-screen bg-gradient-to-br from-gray-50 to-gray-200 text-gray-800">
       {/* Header */}
       <Header
+        brokerCircuits={brokerCircuits}
         onAddStrategy={() => setIsNewStrategyModalOpen(true)}
         onOpenContractTool={() => {
           setIsSidebarOpen(true);
@@ -433,7 +500,8 @@ export default function TradingDashboard() {
             kpiMetrics.netLiquidation,
             kpiMetrics.maintMarginReq,
             kpiMetrics.realizedPnl,
-            kpiMetrics.unrealizedPnl
+            kpiMetrics.unrealizedPnl,
+            kpiMetrics.commissions
           ]} 
         />
 
@@ -468,6 +536,7 @@ export default function TradingDashboard() {
           onEditSetup={openEditSetupModal}
           onAddSetup={openAddSetupModal}
           onClosePosition={closePosition}
+          onArchiveSetup={archiveSetup}
         />
       </main>
 
@@ -484,6 +553,7 @@ export default function TradingDashboard() {
         onSubmit={handleEditSetupSubmit}
         setup={selectedSetup}
         strategyName={selectedStrategy}
+        paramSchema={selectedSetup && strategies[selectedSetup.strategyName]?.param_schema}
       />
 
       <AddSetupModal
@@ -491,6 +561,7 @@ export default function TradingDashboard() {
         onClose={() => setIsAddSetupModalOpen(false)}
         onSubmit={handleAddSetupSubmit}
         strategyName={selectedStrategy}
+        paramSchema={strategies[selectedStrategy]?.param_schema}
       />
 
       <ContractIdSidebar
@@ -1,7 +1,28 @@
 import React from 'react';
 import { BarChart2, Plus } from 'lucide-react';
 
-const Header = ({ onAddStrategy, onOpenContractTool }) => {
+const CIRCUIT_STYLES = {
+  closed: 'bg-green-100 text-green-800',
+  half_open: 'bg-yellow-100 text-yellow-800',
+  open: 'bg-red-100 text-red-800',
+};
+
+// One badge per broker and service calling broker_api, from its circuit breaker
+const BrokerCircuits = ({ circuits }) => (
+  <div className="flex flex-wrap gap-1">
+    {circuits.map(circuit => (
+      <span
+        key={`${circuit.service}-${circuit.broker}`}
+        title={circuit.last_error || 'No recent failures'}
+        className={`px-2 py-1 rounded text-xs font-medium ${CIRCUIT_STYLES[circuit.state] || 'bg-gray-100 text-gray-800'}`}
+      >
+        {circuit.broker} · {circuit.service}: {circuit.state.replace('_', ' ')}
+      </span>
+    ))}
+  </div>
+);
+
+const Header = ({ brokerCircuits = [], onAddStrategy, onOpenContractTool }) => {
   return (
     <header className="bg-white shadow-md">
       <div className="max-w-7xl mx-auto px-4 py-4 sm:px-6 lg:px-8 flex justify-between items-center">
@@ -9,7 +30,8 @@ const Header = ({ onAddStrategy, onOpenContractTool }) => {
           <BarChart2 className="mr-2" /> 
           Dashboard
         </h1>
-        <div className="flex space-x-2">
+        <div className="flex items-center space-x-2">
+          <BrokerCircuits circuits={brokerCircuits} />
           <button 
             onClick={onAddStrategy} 
             className="px-4 py-2 bg-blue-600 text-white rounded-md hover:bg-blue-700 transition flex items-center"
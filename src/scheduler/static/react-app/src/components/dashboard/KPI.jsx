@@ -6,7 +6,7 @@ import React from 'react';
  */
 export const KPIMetricsDashboard = ({ metrics }) => {
   return (
-    <div className="grid grid-cols-2 sm:grid-cols-4 gap-4 mb-6">
+    <div className="grid grid-cols-2 sm:grid-cols-5 gap-4 mb-6">
       {metrics.map((metric, index) => (
         <KPIMetricCard key={index} metric={metric} />
       ))}
@@ -1,6 +1,78 @@
 import React from 'react';
 import { X } from 'lucide-react';
 
+// Setup parameter inputs, one per entry in the strategy's param_schema
+const ParamInputs = ({ schema, values, idPrefix }) => {
+  if (!schema || schema.length === 0) return null;
+
+  return (
+    <div className="space-y-4">
+      <h3 className="font-semibold text-lg mt-6">Parameters</h3>
+      {schema.map((param) => {
+        const current = values && values[param.name] !== undefined ? values[param.name] : param.default;
+        const id = `${idPrefix}Param-${param.name}`;
+        const range = [param.min !== undefined ? `min ${param.min}` : null, param.max !== undefined ? `max ${param.max}` : null]
+          .filter(Boolean).join(', ');
+        return (
+          <div key={param.name}>
+            <label className="block font-medium mb-1" htmlFor={id}>
+              {param.name} <span className="text-gray-500 text-sm">({param.type}{range ? `, ${range}` : ''})</span>
+            </label>
+            {param.type === 'bool' ? (
+              <select className="block w-full border rounded p-2" id={id} name={`param.${param.name}`}
+                defaultValue={current === undefined ? '' : String(current)}>
+                <option value="true">true</option>
+                <option value="false">false</option>
+              </select>
+            ) : (
+              <input
+                className="block w-full border rounded p-2"
+                type={param.type === 'string' ? 'text' : 'number'}
+                step={param.type === 'float' ? 'any' : '1'}
+                min={param.min}
+                max={param.max}
+                id={id}
+                name={`param.${param.name}`}
+                defaultValue={current === undefined ? '' : current}
+                required={param.default === undefined && (!values || values[param.name] === undefined)}
+              />
+            )}
+          </div>
+        );
+      })}
+    </div>
+  );
+};
+
+// End-of-day flatten: a fixed time, or minutes before the session close
+const FlattenInputs = ({ setup, idPrefix }) => (
+  <div className="grid grid-cols-2 gap-4 mt-4">
+    <div>
+      <label className="block font-medium mb-1" htmlFor={`${idPrefix}FlattenAt`}>Flatten At</label>
+      <input
+        className="block w-full border rounded p-2"
+        type="time"
+        id={`${idPrefix}FlattenAt`}
+        name="flatten_at"
+        defaultValue={(setup && setup.flatten_at) || ''}
+      />
+    </div>
+    <div>
+      <label className="block font-medium mb-1" htmlFor={`${idPrefix}FlattenBeforeClose`}>Or Minutes Before Close</label>
+      <input
+        className="block w-full border rounded p-2"
+        type="number"
+        min="0"
+        max="720"
+        step="1"
+        id={`${idPrefix}FlattenBeforeClose`}
+        name="flatten_before_close"
+        defaultValue={(setup && setup.flatten_before_close) || ''}
+      />
+    </div>
+  </div>
+);
+
 // New Strategy Modal
 export const NewStrategyModal = ({ isOpen, onClose, onSubmit }) => {
   if (!isOpen) return null;
@@ -52,7 +124,17 @@ export const NewStrategyModal = ({ isOpen, onClose, onSubmit }) => {
                 <option value="Other">Other</option>
               </select>
             </div>
-            
+
+            <div className="mt-4">
+              <label className="block font-medium mb-1" htmlFor="strategyGroup">Group (optional)</label>
+              <input
+                className="block w-full border rounded p-2"
+                type="text"
+                id="strategyGroup"
+                name="group"
+              />
+            </div>
+
             <h3 className="font-semibold text-lg mt-6">Initial Setup</h3>
             
             <div>
@@ -119,6 +201,17 @@ export const NewStrategyModal = ({ isOpen, onClose, onSubmit }) => {
                 name="otherMarketData"
               />
             </div>
+
+            <div>
+              <label className="block font-medium mb-1" htmlFor="paramSchema">Parameter Schema (JSON, optional)</label>
+              <textarea
+                className="block w-full border rounded p-2 font-mono text-sm"
+                id="paramSchema"
+                name="param_schema"
+                rows={4}
+                placeholder='[{"name": "fast_ma", "type": "int", "default": 20, "min": 1, "max": 200}]'
+              />
+            </div>
             <button 
               type="submit" 
               className="w-full py-2 bg-blue-600 text-white rounded hover:bg-blue-700 transition mt-6"
@@ -133,7 +226,7 @@ export const NewStrategyModal = ({ isOpen, onClose, onSubmit }) => {
 };
 
 // Add Setup Modal
-export const AddSetupModal = ({ isOpen, onClose, onSubmit, strategyName }) => {
+export const AddSetupModal = ({ isOpen, onClose, onSubmit, strategyName, paramSchema }) => {
   if (!isOpen) return null;
   console.log(strategyName);
   return (
@@ -222,10 +315,12 @@ export const AddSetupModal = ({ isOpen, onClose, onSubmit, strategyName }) => {
               type="text" 
               id="addSchedule" 
               name="schedule"
-              placeholder='e.g. Intraday'
+              placeholder="e.g. 0 9 * * 1-5 (9am weekdays)"
               required
             />
           </div>
+
+          <FlattenInputs idPrefix="add" />
           
           <div>
             <label className="block font-medium mb-1" htmlFor="addOtherMarketData">Other Market Data</label>
@@ -237,6 +332,8 @@ export const AddSetupModal = ({ isOpen, onClose, onSubmit, strategyName }) => {
               placeholder='e.g. 1111111:CME:1 day, 2222222:CBOT:1 min'
             />
           </div>
+
+          <ParamInputs schema={paramSchema} idPrefix="add" />
           
           <button 
             type="submit" 
@@ -251,7 +348,7 @@ export const AddSetupModal = ({ isOpen, onClose, onSubmit, strategyName }) => {
 };
 
 // Edit Setup Modal
-export const EditSetupModal = ({ isOpen, onClose, onSubmit, setup, strategyName }) => {
+export const EditSetupModal = ({ isOpen, onClose, onSubmit, setup, strategyName, paramSchema }) => {
   if (!isOpen || !setup) return null;
 
   return (
@@ -331,6 +428,8 @@ export const EditSetupModal = ({ isOpen, onClose, onSubmit, setup, strategyName
               placeholder="e.g. 0 9 * * 1-5 (9am weekdays)"
             />
           </div>
+
+          <FlattenInputs setup={setup} idPrefix="edit" />
           
           <div className="mt-4">
             <label className="block font-medium mb-1" htmlFor="editOtherMarketData">Other Market Data</label>
@@ -342,6 +441,8 @@ export const EditSetupModal = ({ isOpen, onClose, onSubmit, setup, strategyName
               defaultValue={setup.market_data || ''} //defaultValue={selectedSetup.market_data ? selectedSetup.market_data.join(',') : ''}
             />
           </div>
+
+          <ParamInputs schema={paramSchema} values={setup.params} idPrefix="edit" />
           
           <button 
             type="submit" 
@@ -1,5 +1,5 @@
 import React from 'react';
-import { Play, Pause, Settings, X } from 'lucide-react';
+import { Play, Pause, Settings, X, Archive } from 'lucide-react';
 import { TrendingUp, Activity } from 'lucide-react';
 
 const SetupRow = ({
@@ -10,7 +10,8 @@ const SetupRow = ({
   onSelect,
   onToggleSetup,
   onEditSetup,
-  onClosePosition
+  onClosePosition,
+  onArchiveSetup
 }) => {
   const performanceValue = position?.unrealized || 0;
 
@@ -87,6 +88,16 @@ const SetupRow = ({
               <X size={16} />
             </button>
           )}
+          <button
+            onClick={(e) => {
+              e.stopPropagation();
+              onArchiveSetup(setupName);
+            }}
+            className="p-1.5 bg-gray-100 text-gray-600 rounded-full hover:bg-gray-200"
+            title="Archive Setup"
+          >
+            <Archive size={16} />
+          </button>
         </div>
       </td>
     </tr>
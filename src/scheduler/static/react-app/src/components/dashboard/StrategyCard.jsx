@@ -1,7 +1,39 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect } from 'react';
 import { Plus, ChevronUp, ChevronDown } from 'lucide-react';
 import SetupRow from './SetupRow';
 
+const SCHEDULER_API_BASE = window.location.hostname === 'localhost' ? 'http://localhost:8080' : '';
+
+// Performance over the last 30 days, see GET /api/v1/analytics
+const formatMetric = (value, digits = 2, suffix = '') =>
+  value === null || value === undefined ? '–' : `${value.toFixed(digits)}${suffix}`;
+
+const PerformanceStrip = ({ analytics }) => {
+  if (!analytics) return null;
+  const items = [
+    ['Net P&L', `$${analytics.net_pnl.toFixed(2)}`, analytics.net_pnl >= 0 ? 'text-green-600' : 'text-red-600'],
+    ['Return', formatMetric(analytics.return_pct, 2, '%')],
+    ['Sharpe', formatMetric(analytics.sharpe)],
+    ['Sortino', formatMetric(analytics.sortino)],
+    ['Max DD', `$${analytics.max_drawdown.toFixed(2)}`],
+    ['Win Rate', formatMetric(analytics.win_rate, 1, '%')],
+    ['Avg Win / Loss', `$${analytics.average_win.toFixed(2)} / $${analytics.average_loss.toFixed(2)}`],
+    ['Profit Factor', formatMetric(analytics.profit_factor)],
+    ['Exposure', formatMetric(analytics.exposure_pct, 1, '%')],
+    ['Trades', analytics.trade_count],
+  ];
+  return (
+    <div className="px-6 py-2 border-b border-gray-200 flex flex-wrap gap-x-6 gap-y-1 text-xs">
+      {items.map(([label, value, valueClass]) => (
+        <div key={label}>
+          <span className="text-gray-500">{label}</span>{' '}
+          <span className={`font-medium ${valueClass || 'text-gray-800'}`}>{value}</span>
+        </div>
+      ))}
+    </div>
+  );
+};
+
 const StrategyCard = ({
   strategyName,
   strategy,
@@ -11,9 +43,25 @@ const StrategyCard = ({
   onToggleSetup,
   onEditSetup,
   onAddSetup,
-  onClosePosition
+  onClosePosition,
+  onArchiveSetup
 }) => {
   const [isStrategyListCollapsed, setIsStrategyListCollapsed] = useState(false);
+  const [analytics, setAnalytics] = useState(null);
+
+  useEffect(() => {
+    const fetchAnalytics = async () => {
+      try {
+        const response = await fetch(`${SCHEDULER_API_BASE}/api/v1/analytics?strategy=${encodeURIComponent(strategyName)}`, { credentials: 'include' });
+        if (!response.ok) return;
+        const data = await response.json();
+        setAnalytics(data.strategies.find((s) => s.strategy_name === strategyName) || null);
+      } catch (error) {
+        console.error('Error fetching strategy analytics:', error);
+      }
+    };
+    fetchAnalytics();
+  }, [strategyName]);
 
   return (
     <div className="bg-white rounded-lg shadow-md overflow-hidden">
@@ -36,6 +84,8 @@ const StrategyCard = ({
         </div>
       </div>
 
+      <PerformanceStrip analytics={analytics} />
+
       <div className={`overflow-x-auto ${isStrategyListCollapsed ? 'hidden' : 'block'}`}>
         <table className="min-w-full divide-y divide-gray-200">
           <thead className="bg-gray-50">
@@ -66,6 +116,7 @@ const StrategyCard = ({
                   onToggleSetup={() => onToggleSetup(strategyName, setupName)}
                   onEditSetup={() => onEditSetup(strategyName, setupName)}
                   onClosePosition={() => onClosePosition(strategyName, setupName)}
+                  onArchiveSetup={() => onArchiveSetup(strategyName, setupName)}
                 />
               );
             })}
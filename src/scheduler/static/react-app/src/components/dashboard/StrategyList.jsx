@@ -11,7 +11,8 @@ const StrategyList = ({
   onToggleSetup,
   onEditSetup,
   onAddSetup,
-  onClosePosition
+  onClosePosition,
+  onArchiveSetup
 }) => {
   if (loading) {
     return (
@@ -45,6 +46,7 @@ const StrategyList = ({
           onEditSetup={onEditSetup}
           onAddSetup={onAddSetup}
           onClosePosition={onClosePosition}
+          onArchiveSetup={onArchiveSetup}
         />
       ))}
     </div>
@@ -35,7 +35,18 @@ def load_and_parse_config(filepath: str, setup_name:str) -> Dict[str, Any]:
     except Exception as e:
         print("Unable to Load / Parse Configuration: ",e)
         return {}
-    
+
+def load_setup_params(config_data: Dict[str, Any]) -> Dict[str, Any]:
+    # The scheduler passes the resolved setup params (schema defaults applied)
+    # in SETUP_PARAMS; fall back to the raw values in the config file.
+    raw = os.getenv("SETUP_PARAMS")
+    if raw:
+        try:
+            return json.loads(raw)
+        except ValueError as e:
+            print("Unable to parse SETUP_PARAMS: ", e)
+    return config_data.get("params") or {}
+
 if __name__ == "__main__":
 
     print(load_and_parse_config("C:\\Users\\Jon\\Projects\\pyquant\\shared_files\\strategy-config.json", "Test-MYM"))
\ No newline at end of file
@@ -34,10 +34,9 @@ def get_futures_multiplier(symbol: str)-> float:
     try:
         with psycopg2.connect(f"postgresql://{user}:{password}@{host}:{port}/{name}") as conn:
             with conn.cursor() as cursor:
-                cursor.execute(f"SELECT multiplier FROM futures_contracts WHERE symbol='{symbol}'")
-                results = cursor.fetchall()
-                print(results)
-                return results
+                cursor.execute("SELECT multiplier FROM contracts WHERE symbol=%s AND contract_type='FUT' AND multiplier > 0 ORDER BY expiry DESC LIMIT 1", (symbol,))
+                result = cursor.fetchone()
+                return float(result[0]) if result else 1.0
     except psycopg2.Error as e:
         print(f"Database error: {e}")
         return 1.0
@@ -52,7 +51,7 @@ def get_futures_minimum_tick(symbol: str)-> float:
     try:
         with psycopg2.connect(f"postgresql://{user}:{password}@{host}:{port}/{name}") as conn:
             with conn.cursor() as cursor:
-                cursor.execute("SELECT minimum_tick FROM futures_contracts WHERE symbol=%s", (symbol,))
+                cursor.execute("SELECT tick_size FROM contracts WHERE symbol=%s AND tick_size > 0 ORDER BY expiry DESC LIMIT 1", (symbol,))
                 result = cursor.fetchone()
                 return float(result[0]) if result else 1.0
     except psycopg2.Error as e:
@@ -1,18 +1,42 @@
 import grpc
 import utils.trade_pb2 as trade_pb2
 import utils.trade_pb2_grpc as trade_pb2_grpc
+import json
+import os
 import time
+import uuid
 from utils.definitions import Trade as TradeInstruction
 
 
+def log(level: str, msg: str, **fields) -> None:
+    # The scheduler logs JSON lines a script prints with their level and fields
+    print(json.dumps({"level": level, "msg": msg, **fields}, default=str), flush=True)
+
+
+def get_channel(target: str) -> grpc.Channel:
+    # Use TLS when the scheduler passes down the CA that signed the backend's certificate
+    ca_file = os.getenv("GRPC_TLS_CA")
+    if not ca_file:
+        return grpc.insecure_channel(target)
+    with open(ca_file, "rb") as f:
+        credentials = grpc.ssl_channel_credentials(root_certificates=f.read())
+    server_name = os.getenv("GRPC_TLS_SERVER_NAME")
+    options = [("grpc.ssl_target_name_override", server_name)] if server_name else None
+    return grpc.secure_channel(target, credentials, options=options)
+
+
 def send_trade(trade: TradeInstruction) -> None:
     # Connect to the server
     # channel = grpc.insecure_channel('localhost:50051') # for local development
     # try:
-    channel = grpc.insecure_channel('backend:50051') # for docker container  with service "backend"
+    channel = get_channel('backend:50051') # for docker container  with service "backend"
     # except Exception:
         # channel = grpc.insecure_channel('localhost:50051') # for local development
     stub = trade_pb2_grpc.TradeServiceStub(channel)
+    # The backend and broker_api log the trade under its correlation-id
+    correlation_id = uuid.uuid4().hex[:16]
+    fields = {"correlation_id": correlation_id, "symbol": trade.symbol, "side": trade.side,
+              "quantity": trade.quantity, "order_type": trade.order_type}
     try:
         # Create a Trade message
         trade = trade_pb2.Trade(
@@ -28,10 +52,19 @@ def send_trade(trade: TradeInstruction) -> None:
         )
 
         # Send the Trade message
-        response = stub.SendTrade(trade)
-        print("Server response:", response.status)
+        # The scheduler sets SETUP_NAME and SCRIPT_VERSION so the trade records which setup and script produced it,
+        # and TRADE_TOKEN, which only allows trades for this process's strategy
+        metadata = [
+            ("script-version", os.getenv("SCRIPT_VERSION", "")),
+            ("setup-name", os.getenv("SETUP_NAME", "")),
+            ("authorization", "Bearer " + os.getenv("TRADE_TOKEN", "")),
+            ("correlation-id", correlation_id),
+        ]
+        log("INFO", "Sending trade", **fields)
+        response = stub.SendTrade(trade, metadata=metadata)
+        log("INFO", "Trade sent", status=response.status, **fields)
     except Exception as e:
-        print("Unable to send trade to backend: ", e)
+        log("ERROR", "Unable to send trade to backend", error=str(e), **fields)
         
 
 if __name__ == "__main__":
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Transaction Cost Analysis
+// -----------------------------------------------------------------
+
+// apiTCA handles GET /api/v1/tca. Returns the slippage of the filled orders
+// against their decision and arrival prices over from..to (inclusive trading
+// dates, the last 30 days by default), overall and by strategy, order type
+// and hour of day. strategy narrows it down.
+func apiTCA(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := handlers.TCAQuery{
+		StrategyName: q.Get("strategy"),
+		From:         q.Get("from"),
+		To:           q.Get("to"),
+	}
+	if query.To == "" {
+		query.To = time.Now().Format("2006-01-02")
+	}
+
+	var errs ValidationErrors
+	if _, err := time.Parse("2006-01-02", query.To); err != nil {
+		errs.add("to", "must be a date like 2006-01-02, got %q", query.To)
+	} else if query.From == "" {
+		to, _ := time.Parse("2006-01-02", query.To)
+		query.From = to.AddDate(0, 0, -30).Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", query.From); query.From != "" && err != nil {
+		errs.add("from", "must be a date like 2006-01-02, got %q", query.From)
+	} else if query.From > query.To {
+		errs.add("to", "must not be before from")
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	report, err := handlers.ComputeTCA(query)
+	if err != nil {
+		log.Println("[ERROR] Failed to compute TCA:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to compute TCA", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
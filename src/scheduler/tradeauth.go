@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// -----------------------------------------------------------------
+// TradeService Credentials
+// -----------------------------------------------------------------
+
+// The backend only accepts trades signed with a token for the trade's
+// strategy. Tokens are HMAC-SHA256 signed with TRADE_TOKEN_SECRET, shared with
+// the backend (see backend/auth), and handed to each setup process as
+// TRADE_TOKEN. Setup processes get an allowlisted environment without the
+// secret, and run as STRATEGY_UID/STRATEGY_GID so they cannot read it from
+// the scheduler's /proc/<pid>/environ either. Without STRATEGY_UID they run
+// as the scheduler's user and any script can sign tokens for every strategy.
+//
+// The backend rejects tokens older than TRADE_TOKEN_MAX_AGE (168h by
+// default), so monitorScripts restarts a setup with a fresh token. Once the
+// token is tokenRenewFrom of the way to expiring that happens while the
+// setup's exchange is between sessions; at tokenRenewAt it happens anyway.
+
+const (
+	defaultTradeTokenMaxAge = 7 * 24 * time.Hour
+	tokenRenewFrom          = 0.5
+	tokenRenewAt            = 0.9
+)
+
+// tradeTokenSecret returns TRADE_TOKEN_SECRET, which must be set
+func tradeTokenSecret() ([]byte, error) {
+	secret := os.Getenv("TRADE_TOKEN_SECRET")
+	if len(secret) < 32 {
+		return nil, errors.New("TRADE_TOKEN_SECRET must be set to at least 32 characters")
+	}
+	return []byte(secret), nil
+}
+
+// tradeTokenMaxAge returns TRADE_TOKEN_MAX_AGE, shared with the backend
+func tradeTokenMaxAge() (time.Duration, error) {
+	value := os.Getenv("TRADE_TOKEN_MAX_AGE")
+	if value == "" {
+		return defaultTradeTokenMaxAge, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge <= 0 {
+		return 0, fmt.Errorf("invalid TRADE_TOKEN_MAX_AGE %q, expected a positive duration like 72h", value)
+	}
+	return maxAge, nil
+}
+
+// tokenNeedsRenewal reports whether a token issued at issuedAt is more than
+// the given fraction of the way to the backend rejecting it
+func tokenNeedsRenewal(issuedAt time.Time, fraction float64) bool {
+	maxAge, err := tradeTokenMaxAge()
+	if err != nil {
+		return false
+	}
+	return time.Since(issuedAt) > time.Duration(float64(maxAge)*fraction)
+}
+
+// issueTradeToken signs a token that lets its holder trade for one strategy
+func issueTradeToken(strategyName string) (string, error) {
+	secret, err := tradeTokenSecret()
+	if err != nil {
+		return "", err
+	}
+	payload := strategyName + "." + strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// withTradeToken attaches a strategy's token to an outgoing SendTrade call
+func withTradeToken(ctx context.Context, strategyName string) (context.Context, error) {
+	token, err := issueTradeToken(strategyName)
+	if err != nil {
+		return ctx, err
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token), nil
+}
+
+// tradeTransportCredentials uses TLS when GRPC_TLS_CA names the CA that
+// signed the backend's certificate
+func tradeTransportCredentials() (grpc.DialOption, error) {
+	caFile := os.Getenv("GRPC_TLS_CA")
+	if caFile == "" {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	creds, err := credentials.NewClientTLSFromFile(caFile, os.Getenv("GRPC_TLS_SERVER_NAME"))
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(creds), nil
+}
+
+// strategyEnvNames are the variables of the scheduler's environment a setup
+// process inherits
+var strategyEnvNames = []string{
+	"PATH", "LANG", "LC_ALL", "TZ", "PYTHONUNBUFFERED",
+	"ENVIRONMENT", "SHARED_PATH", "GRPC_TLS_CA", "GRPC_TLS_SERVER_NAME",
+	"DB_HOST", "DB_PORT", "DB_NAME",
+}
+
+// strategyEnv is the environment for a setup process: the allowlisted
+// variables, the database login meant for scripts, and the strategy's trade
+// token
+func strategyEnv(strategyName string) ([]string, error) {
+	token, err := issueTradeToken(strategyName)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(strategyEnvNames)+3)
+	for _, name := range strategyEnvNames {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	// Scripts read the contract master with their own, ideally read-only,
+	// login rather than the scheduler's
+	if user := os.Getenv("STRATEGY_DB_USER"); user != "" {
+		env = append(env, "DB_USER="+user, "DB_PASSWORD="+os.Getenv("STRATEGY_DB_PASSWORD"))
+	}
+	return append(env, "TRADE_TOKEN="+token), nil
+}
+
+// strategyCredential is the user setup processes run as, nil to run them as
+// the scheduler's user
+func strategyCredential() (*syscall.Credential, error) {
+	uidValue := os.Getenv("STRATEGY_UID")
+	if uidValue == "" {
+		return nil, nil
+	}
+	uid, err := strconv.ParseUint(uidValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STRATEGY_UID %q", uidValue)
+	}
+	gid := uid
+	if gidValue := os.Getenv("STRATEGY_GID"); gidValue != "" {
+		if gid, err = strconv.ParseUint(gidValue, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid STRATEGY_GID %q", gidValue)
+		}
+	}
+	if uint64(os.Getuid()) == uid {
+		return nil, errors.New("STRATEGY_UID must differ from the scheduler's uid")
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), NoSetGroups: true}, nil
+}
+
+// checkTradeAuthConfig fails fast when trade tokens cannot be issued
+func checkTradeAuthConfig() error {
+	if _, err := tradeTokenSecret(); err != nil {
+		return err
+	}
+	if _, err := tradeTokenMaxAge(); err != nil {
+		return err
+	}
+	if _, err := tradeTransportCredentials(); err != nil {
+		return err
+	}
+	credential, err := strategyCredential()
+	if err != nil {
+		return err
+	}
+	if credential == nil {
+		log.Println("[WARN] STRATEGY_UID not set, strategy scripts run as the scheduler's user and can read TRADE_TOKEN_SECRET")
+	}
+	if os.Getenv("GRPC_TLS_CA") == "" {
+		log.Println("[WARN] GRPC_TLS_CA not set, trades are sent to the backend without TLS")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"scheduler/handlers"
+)
+
+// -----------------------------------------------------------------
+// Trade History
+// -----------------------------------------------------------------
+
+var tradeCSVHeader = []string{
+	"id", "strategy_name", "setup_name", "contract_id", "exchange", "symbol", "side",
+	"quantity", "order_type", "broker", "price", "broker_order_id", "trading_date",
+	"status", "created_at", "last_updated_at", "script_version",
+}
+
+// apiListTrades handles GET /api/v1/trades. Filters: strategy, setup, symbol,
+// status, from and to (trading dates, inclusive). sort names a column, with a
+// leading '-' for descending (default -created_at). Pages are continued with
+// the returned next_cursor. format=csv, or Accept: text/csv, exports the
+// matching trades as CSV, every page at once unless limit is set.
+func apiListTrades(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	asCSV := q.Get("format") == "csv" || (q.Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/csv"))
+	query := handlers.TradeQuery{
+		StrategyName: q.Get("strategy"),
+		SetupName:    q.Get("setup"),
+		Symbol:       q.Get("symbol"),
+		Status:       q.Get("status"),
+		From:         q.Get("from"),
+		To:           q.Get("to"),
+		Descending:   true,
+		SortBy:       "created_at",
+	}
+	if !asCSV {
+		query.Limit = 100
+	}
+
+	var errs ValidationErrors
+	if format := q.Get("format"); format != "" && format != "csv" && format != "json" {
+		errs.add("format", "must be json or csv")
+	}
+	for _, date := range []struct{ field, value string }{{"from", query.From}, {"to", query.To}} {
+		field, value := date.field, date.value
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			errs.add(field, "must be a date like 2006-01-02, got %q", value)
+		}
+	}
+	sortSpec := "-created_at"
+	if sort := q.Get("sort"); sort != "" {
+		sortSpec = sort
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.SortBy = strings.TrimPrefix(sort, "-")
+		valid := false
+		for _, column := range handlers.TradeSortColumns {
+			valid = valid || column == query.SortBy
+		}
+		if !valid {
+			errs.add("sort", "must be one of %s, optionally prefixed with '-'", strings.Join(handlers.TradeSortColumns, ", "))
+		}
+	}
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			errs.add("limit", "must be between 1 and 1000")
+		}
+		query.Limit = limit
+	}
+	if value := q.Get("cursor"); value != "" {
+		cursor, err := handlers.DecodeTradeCursor(value)
+		if err != nil {
+			errs.add("cursor", "%v", err)
+		} else if cursor.Sort != sortSpec {
+			errs.add("cursor", "was issued for sort %q", cursor.Sort)
+		}
+		query.After = cursor
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	trades, next, err := handlers.QueryTrades(query)
+	if err != nil {
+		log.Println("[ERROR] Failed to query trade history:", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to query trades", nil)
+		return
+	}
+	nextCursor := ""
+	if next != nil {
+		nextCursor = next.Encode()
+	}
+
+	if !asCSV {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"trades":      trades,
+			"next_cursor": nextCursor,
+		})
+		return
+	}
+
+	filename := "trades"
+	for _, part := range []string{query.StrategyName, query.SetupName, query.Symbol, query.From, query.To} {
+		if setupNamePattern.MatchString(part) {
+			filename += "_" + part
+		}
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(tradeCSVHeader)
+	for _, t := range trades {
+		cw.Write([]string{
+			strconv.FormatInt(t.ID, 10), t.StrategyName, t.SetupName, strconv.Itoa(t.ContractID),
+			t.Exchange, t.Symbol, t.Side, strconv.FormatFloat(t.Quantity, 'f', -1, 64),
+			t.OrderType, t.Broker, strconv.FormatFloat(t.Price, 'f', -1, 64), strconv.Itoa(t.BrokerOrderID),
+			t.TradingDate, t.Status, t.CreatedAt.Format(time.RFC3339), t.LastUpdatedAt.Format(time.RFC3339),
+			t.ScriptVersion,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Println("[ERROR] Failed to write trade export:", err)
+	}
+}
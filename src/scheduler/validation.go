@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"scheduler/handlers"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// -----------------------------------------------------------------
+// Strategy / Setup Schema
+// -----------------------------------------------------------------
+
+// Timeframes understood by the strategy scripts (see get_interval in the examples)
+var allowedTimeframes = map[string]bool{
+	"30 sec": true,
+	"1 min":  true,
+	"5 min":  true,
+	"15 min": true,
+	"30 min": true,
+	"1 hour": true,
+	"4 hour": true,
+	"1 day":  true,
+}
+
+var allowedStrategyTypes = map[string]bool{
+	"Rebalance": true,
+	"Alpha":     true,
+	"Other":     true,
+}
+
+var (
+	// Strategy names may not contain '-' (scripts split the setup name on it)
+	// or '|' (used in the running process key).
+	strategyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	setupNamePattern    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	paramNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// Market is EXCHANGE:SYMBOL, e.g. CME:MES
+	marketPattern = regexp.MustCompile(`^[A-Za-z0-9_.]+:[A-Za-z0-9_.]+$`)
+)
+
+// FieldError describes one invalid field in a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every invalid field so clients can fix them in one pass
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(v))
+	for _, fe := range v {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ErrorResponse is the JSON body returned for rejected requests
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// writeJSONError writes a consistent JSON error body
+func writeJSONError(w http.ResponseWriter, status int, message string, fields ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message, Fields: fields})
+}
+
+// writeValidationError rejects a request with field-level messages
+func writeValidationError(w http.ResponseWriter, errs ValidationErrors) {
+	writeJSONError(w, http.StatusUnprocessableEntity, "validation failed", errs)
+}
+
+// apiError is a failed operation along with the HTTP status to report it as
+type apiError struct {
+	Status  int
+	Message string
+	Fields  ValidationErrors
+}
+
+func (e *apiError) Error() string {
+	if len(e.Fields) > 0 {
+		return e.Message + ": " + e.Fields.Error()
+	}
+	return e.Message
+}
+
+func newAPIError(status int, message string, fields ValidationErrors) *apiError {
+	return &apiError{Status: status, Message: message, Fields: fields}
+}
+
+func validationFailed(errs ValidationErrors) *apiError {
+	return newAPIError(http.StatusUnprocessableEntity, "validation failed", errs)
+}
+
+// writeError writes err as a JSON error body, using its status when it is an
+// apiError and 500 otherwise
+func writeError(w http.ResponseWriter, err error) {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		writeJSONError(w, ae.Status, ae.Message, ae.Fields)
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+}
+
+// validateStrategy checks a strategy and all of its setups
+func validateStrategy(strategyName string, strat Strategy) ValidationErrors {
+	var errs ValidationErrors
+	if strategyName == "" {
+		errs.add("strategyName", "is required")
+	} else if !strategyNamePattern.MatchString(strategyName) {
+		errs.add("strategyName", "may only contain letters, digits and '_'")
+	}
+	if strat.Group != "" && !setupNamePattern.MatchString(strat.Group) {
+		errs.add("group", "may only contain letters, digits, '_' and '-'")
+	}
+	if strat.ScriptPath == "" {
+		errs.add("script_path", "is required")
+	}
+	if !allowedStrategyTypes[strat.StrategyType] {
+		errs.add("strategy_type", "must be one of %s", strings.Join(sortedKeys(allowedStrategyTypes), ", "))
+	}
+
+	errs = append(errs, validateParamSchema(strat.ParamSchema)...)
+	if len(strat.Versions) > 0 {
+		if _, ok := strat.findVersion(strat.CurrentVersion); !ok {
+			errs.add("current_version", "version %d not found", strat.CurrentVersion)
+		}
+	}
+	for setupName, setup := range strat.Setups {
+		if strat.Archived && setup.Enabled {
+			errs.add("setups."+setupName+".enabled", "setups of an archived strategy cannot be enabled")
+		}
+		if setup.ScriptVersion == 0 {
+			continue
+		}
+		if _, ok := strat.findVersion(setup.ScriptVersion); !ok {
+			errs.add("setups."+setupName+".script_version", "version %d not found", setup.ScriptVersion)
+		}
+	}
+
+	setupNames := make([]string, 0, len(strat.Setups))
+	for setupName := range strat.Setups {
+		setupNames = append(setupNames, setupName)
+	}
+	sort.Strings(setupNames)
+	for _, setupName := range setupNames {
+		for _, fe := range validateSetup(strategyName, setupName, strat.Setups[setupName], strat.ParamSchema) {
+			errs.add("setups."+setupName+"."+fe.Field, "%s", fe.Message)
+		}
+	}
+	return errs
+}
+
+// validateSetup checks a single setup against the schema, including its params
+// against the strategy's parameter declarations. Fields are named after their
+// JSON keys.
+func validateSetup(strategyName, setupName string, setup Setup, paramSchema []ParamSpec) ValidationErrors {
+	var errs ValidationErrors
+	switch {
+	case setupName == "":
+		errs.add("setupName", "is required")
+	case !setupNamePattern.MatchString(setupName):
+		errs.add("setupName", "may only contain letters, digits, '_' and '-'")
+	case !strings.HasPrefix(setupName, strategyName+"-"):
+		errs.add("setupName", "must start with %q", strategyName+"-")
+	}
+
+	if setup.Market == "" {
+		errs.add("market", "is required")
+	} else if !marketPattern.MatchString(setup.Market) {
+		errs.add("market", "must be EXCHANGE:SYMBOL, e.g. CME:MES")
+	}
+	if setup.ContractId <= 0 {
+		errs.add("contract_id", "must be a positive integer")
+	}
+	if !allowedTimeframes[setup.Timeframe] {
+		errs.add("timeframe", "must be one of %s", strings.Join(sortedKeys(allowedTimeframes), ", "))
+	}
+	if setup.Schedule == "" {
+		errs.add("schedule", "is required")
+	} else if _, err := cron.ParseStandard(setup.Schedule); err != nil {
+		errs.add("schedule", "invalid cron expression: %v", err)
+	}
+	for i, md := range setup.MarketData {
+		if msg := checkMarketData(md); msg != "" {
+			errs.add(fmt.Sprintf("market_data[%d]", i), "%s", msg)
+		}
+	}
+	if setup.FlattenAt != "" {
+		if _, err := time.Parse("15:04", setup.FlattenAt); err != nil {
+			errs.add("flatten_at", "must be a time like 15:45, got %q", setup.FlattenAt)
+		}
+	}
+	if setup.FlattenBeforeClose < 0 || setup.FlattenBeforeClose > 720 {
+		errs.add("flatten_before_close", "must be between 0 and 720 minutes")
+	} else if setup.FlattenBeforeClose > 0 && setup.FlattenAt != "" {
+		errs.add("flatten_before_close", "cannot be combined with flatten_at")
+	}
+	if setup.Archived && setup.Enabled {
+		errs.add("enabled", "archived setups cannot be enabled")
+	}
+	errs = append(errs, validateParams(paramSchema, setup.Params)...)
+	return errs
+}
+
+// parseSetupForm builds a Setup from form values, reporting fields that do
+// not parse instead of defaulting them.
+func parseSetupForm(r *http.Request, marketDataField string) (Setup, ValidationErrors) {
+	var errs ValidationErrors
+	setup := Setup{
+		Market:     strings.TrimSpace(r.FormValue("market")),
+		Timeframe:  r.FormValue("timeframe"),
+		Schedule:   strings.TrimSpace(r.FormValue("schedule")),
+		MarketData: splitMarketData(r.FormValue(marketDataField)),
+		FlattenAt:  strings.TrimSpace(r.FormValue("flatten_at")),
+	}
+	if value := strings.TrimSpace(r.FormValue("flatten_before_close")); value != "" {
+		if minutes, err := strconv.Atoi(value); err != nil {
+			errs.add("flatten_before_close", "must be a whole number of minutes, got %q", value)
+		} else {
+			setup.FlattenBeforeClose = minutes
+		}
+	}
+	contractId := strings.TrimSpace(r.FormValue("contract_id"))
+	if contractId == "" {
+		errs.add("contract_id", "is required")
+	} else if id, err := strconv.Atoi(contractId); err != nil {
+		errs.add("contract_id", "must be an integer, got %q", contractId)
+	} else {
+		setup.ContractId = id
+	}
+	return setup, errs
+}
+
+// checkMarketData validates one extra market data entry, which has the form
+// CONTRACT_ID:EXCHANGE:TIMEFRAME, e.g. 1111111:CME:1 day
+func checkMarketData(md string) string {
+	parts := strings.Split(md, ":")
+	if len(parts) != 3 {
+		return "must be CONTRACT_ID:EXCHANGE:TIMEFRAME"
+	}
+	if id, err := strconv.Atoi(parts[0]); err != nil || id <= 0 {
+		return "contract ID must be a positive integer"
+	}
+	if parts[1] == "" {
+		return "exchange is required"
+	}
+	if !allowedTimeframes[parts[2]] {
+		return "timeframe must be one of " + strings.Join(sortedKeys(allowedTimeframes), ", ")
+	}
+	return ""
+}
+
+func splitMarketData(value string) []string {
+	marketData := []string{}
+	for _, md := range strings.Split(value, ",") {
+		if md = strings.TrimSpace(md); md != "" {
+			marketData = append(marketData, md)
+		}
+	}
+	return marketData
+}
+
+// validateContractAtBroker asks broker_api whether the contract ID exists on
+// the setup's exchange.
+func validateContractAtBroker(setup Setup) ValidationErrors {
+	var errs ValidationErrors
+	exchange := strings.SplitN(setup.Market, ":", 2)[0]
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"contract_id": setup.ContractId,
+		"exchange":    exchange,
+	})
+	if err != nil {
+		errs.add("contract_id", "unable to build validation request: %v", err)
+		return errs
+	}
+
+	resp, err := handlers.DoBrokerAPI(handlers.BrokerCall{
+		Broker:     "IB",
+		Method:     http.MethodPost,
+		Path:       "/api/IB/validate-contract",
+		Body:       payload,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Idempotent: true,
+	})
+	if err != nil {
+		errs.add("contract_id", "unable to verify contract with broker: %v", err)
+		return errs
+	}
+	defer resp.Body.Close()
+
+	var valid bool
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&valid) != nil {
+		errs.add("contract_id", "broker could not verify contract %d (status %s)", setup.ContractId, resp.Status)
+		return errs
+	}
+	if !valid {
+		errs.add("contract_id", "contract %d not found on %s", setup.ContractId, exchange)
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------
+// Strategy Script Versions
+// -----------------------------------------------------------------
+
+// ScriptVersion is one immutable upload of a strategy script
+type ScriptVersion struct {
+	Version    int       `json:"version"`
+	Hash       string    `json:"hash"` // sha256 of the script contents
+	Filename   string    `json:"filename"`
+	Path       string    `json:"path"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Label identifies the version in trade records, e.g. "v3:1a2b3c4d5e6f"
+func (v ScriptVersion) Label() string {
+	return fmt.Sprintf("v%d:%s", v.Version, v.Hash[:12])
+}
+
+// getStrategyUploadDir returns where strategy scripts are stored
+func getStrategyUploadDir() string {
+	if os.Getenv("ENVIRONMENT") == "production" || os.Getenv("ENVIRONMENT") == "docker" {
+		return "/app/strategies"
+	}
+	return "C:/Users/Jon/Projects/pyquant/src/scheduler/shared_files/strategies"
+}
+
+// uploadedBy names the authenticated caller of a request. Clients cannot
+// choose the name recorded in the version history.
+func uploadedBy(r *http.Request) string {
+	if caller := callerIdentity(r); caller.Name != "" {
+		return caller.Name
+	}
+	return r.RemoteAddr
+}
+
+// findVersion returns the stored version with the given number
+func (s Strategy) findVersion(version int) (ScriptVersion, bool) {
+	for _, v := range s.Versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return ScriptVersion{}, false
+}
+
+// resolveScript returns the script a setup runs: its pinned version, or the
+// strategy's current version when it follows latest. Strategies created
+// before versioning have no versions and run ScriptPath unlabelled.
+func resolveScript(strat Strategy, setup Setup) (string, string, error) {
+	version := strat.CurrentVersion
+	if setup.ScriptVersion != 0 {
+		version = setup.ScriptVersion
+	}
+	if len(strat.Versions) == 0 {
+		return strat.ScriptPath, "", nil
+	}
+	v, ok := strat.findVersion(version)
+	if !ok {
+		return "", "", fmt.Errorf("script version %d not found", version)
+	}
+	return v.Path, v.Label(), nil
+}
+
+// reservedVersions is the last version number handed out per strategy,
+// guarded by strategiesMu
+var reservedVersions = make(map[string]int)
+
+// storeScriptVersion writes an uploaded script into the versions directory
+// under its content hash and returns its metadata. Uploading content that is
+// already stored returns the existing version.
+func storeScriptVersion(strategyName string, strat Strategy, filename string, src io.Reader, uploader string) (ScriptVersion, bool, error) {
+	versionDir := filepath.Join(getStrategyUploadDir(), "versions", strategyName)
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return ScriptVersion{}, false, err
+	}
+
+	tmp, err := os.CreateTemp(versionDir, "upload-*")
+	if err != nil {
+		return ScriptVersion{}, false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), src); err != nil {
+		tmp.Close()
+		return ScriptVersion{}, false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ScriptVersion{}, false, err
+	}
+	// CreateTemp makes it private, but scripts run as STRATEGY_UID
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return ScriptVersion{}, false, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	// Numbered under the lock from the versions stored by now, and reserved
+	// so a concurrent upload cannot take the same number before this one is
+	// added to the config
+	strategiesMu.Lock()
+	versions := strat.Versions
+	if current, ok := strategies[strategyName]; ok {
+		versions = current.Versions
+	}
+	next := reservedVersions[strategyName] + 1
+	for _, v := range versions {
+		if v.Hash == hash {
+			strategiesMu.Unlock()
+			return v, false, nil
+		}
+		if v.Version >= next {
+			next = v.Version + 1
+		}
+	}
+	reservedVersions[strategyName] = next
+	strategiesMu.Unlock()
+
+	version := ScriptVersion{
+		Version:    next,
+		Hash:       hash,
+		Filename:   filepath.Base(filename),
+		UploadedBy: uploader,
+		UploadedAt: time.Now(),
+	}
+	version.Path = filepath.Join(versionDir, fmt.Sprintf("v%d_%s_%s", next, hash[:12], version.Filename))
+	// A link, unlike a rename, fails rather than replace a stored version.
+	// The file may be left over from a deleted strategy of the same name; its
+	// name carries the hash, so it holds this very script.
+	if err := os.Link(tmp.Name(), version.Path); err != nil && !errors.Is(err, fs.ErrExist) {
+		return ScriptVersion{}, false, err
+	}
+	// Versions are immutable once stored
+	if err := os.Chmod(version.Path, 0444); err != nil {
+		log.Printf("[WARN] Unable to make %s read-only: %v", version.Path, err)
+	}
+	return version, true, nil
+}
+
+// setCurrentVersion points a strategy at a stored version. Callers must hold
+// strategiesMu.
+func setCurrentVersion(strategyName string, version ScriptVersion) {
+	strat := strategies[strategyName]
+	strat.CurrentVersion = version.Version
+	strat.ScriptPath = version.Path
+	strategies[strategyName] = strat
+}
+
+// restartSetupsFollowingLatest restarts running setups that are not pinned to
+// a version so they pick up the strategy's current script.
+func restartSetupsFollowingLatest(strategyName string) []string {
+	strategiesMu.Lock()
+	var setupNames []string
+	for setupName, setup := range strategies[strategyName].Setups {
+		if setup.Enabled && setup.ScriptVersion == 0 {
+			setupNames = append(setupNames, setupName)
+		}
+	}
+	strategiesMu.Unlock()
+
+	restarted := []string{}
+	for _, setupName := range setupNames {
+		if err := restartScript(strategyName, setupName); err != nil {
+			log.Printf("[ERROR] Unable to restart %s|%s on new version: %v", strategyName, setupName, err)
+			disableSetup(strategyName, setupName)
+		} else {
+			restarted = append(restarted, setupName)
+		}
+		notifyStrategyConfigChanged(strategyName + "|" + setupName)
+	}
+	return restarted
+}
+
+// parseVersionField reads a "script_version" form value: empty or "latest"
+// follows the strategy's current version, a number pins that version.
+func parseVersionField(raw string) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "latest" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(raw, "v"))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("must be \"latest\" or a version number, got %q", raw)
+	}
+	return version, nil
+}
+
+// uploadScriptVersion stores a new script for an existing strategy, makes it
+// the current version and restarts the setups that follow latest. Uploading
+// content that is already stored switches back to that version.
+func uploadScriptVersion(actor identity, strategyName string, script scriptUpload) (_ ScriptVersion, _ bool, _ []string, err error) {
+	defer auditChange(actor, "strategy.upload_version", strategyName, "")(&err)
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	strategiesMu.Unlock()
+	if !ok {
+		return ScriptVersion{}, false, nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+
+	version, created, err := storeScriptVersion(strategyName, strat, script.Filename, script.Src, script.UploadedBy)
+	if err != nil {
+		log.Println("[ERROR] Unable to store script version:", err)
+		return ScriptVersion{}, false, nil, newAPIError(http.StatusInternalServerError, "Unable to store script", nil)
+	}
+
+	strategiesMu.Lock()
+	strat, ok = strategies[strategyName]
+	if !ok {
+		strategiesMu.Unlock()
+		return ScriptVersion{}, false, nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	if created {
+		strat.Versions = append(strat.Versions, version)
+		strategies[strategyName] = strat
+	}
+	setCurrentVersion(strategyName, version)
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	strategiesMu.Unlock()
+	if err != nil {
+		return ScriptVersion{}, false, nil, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+	log.Printf("[INFO] Strategy %s now on script %s (uploaded by %s)", strategyName, version.Label(), version.UploadedBy)
+
+	return version, created, restartSetupsFollowingLatest(strategyName), nil
+}
+
+// rollbackToVersion makes a stored version current again and restarts the
+// setups that follow latest
+func rollbackToVersion(actor identity, strategyName string, version int) (_ ScriptVersion, _ []string, err error) {
+	defer auditChange(actor, "strategy.rollback", strategyName, "")(&err)
+	strategiesMu.Lock()
+	strat, ok := strategies[strategyName]
+	if !ok {
+		strategiesMu.Unlock()
+		return ScriptVersion{}, nil, newAPIError(http.StatusNotFound, "Strategy not found", nil)
+	}
+	target, found := strat.findVersion(version)
+	if !found {
+		strategiesMu.Unlock()
+		return ScriptVersion{}, nil, validationFailed(ValidationErrors{{Field: "version", Message: fmt.Sprintf("version %d not found", version)}})
+	}
+	setCurrentVersion(strategyName, target)
+	shared_strategy_config := GetSharedFilePath("strategy-config.json")
+	err = saveStrategies(shared_strategy_config)
+	strategiesMu.Unlock()
+	if err != nil {
+		return ScriptVersion{}, nil, newAPIError(http.StatusInternalServerError, "Failed to save config: "+err.Error(), nil)
+	}
+	log.Printf("[INFO] Strategy %s rolled back to script %s", strategyName, target.Label())
+
+	return target, restartSetupsFollowingLatest(strategyName), nil
+}
+
+// handleStrategyVersions handles
+// GET  /strategies/{strategyName}/versions -> list stored versions
+// POST /strategies/{strategyName}/versions -> upload a new version (multipart "uploaded_file")
+func handleStrategyVersions(strategyName string, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		strategiesMu.Lock()
+		strat, ok := strategies[strategyName]
+		strategiesMu.Unlock()
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Strategy not found", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"current_version": strat.CurrentVersion,
+			"versions":        strat.Versions,
+		})
+		return
+	case http.MethodPost:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error parsing form data", nil)
+		return
+	}
+	file, handler, err := r.FormFile("uploaded_file")
+	if err != nil {
+		writeValidationError(w, ValidationErrors{{Field: "uploaded_file", Message: "is required"}})
+		return
+	}
+	defer file.Close()
+	if filepath.Ext(handler.Filename) != ".py" {
+		writeValidationError(w, ValidationErrors{{Field: "uploaded_file", Message: "must be a .py script"}})
+		return
+	}
+
+	version, created, restarted, err := uploadScriptVersion(callerIdentity(r), strategyName, scriptUpload{
+		Filename:   handler.Filename,
+		Src:        file,
+		UploadedBy: uploadedBy(r),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":   version,
+		"created":   created,
+		"restarted": restarted,
+	})
+}
+
+// rollbackStrategy handles POST /strategies/{strategyName}/rollback with form
+// field "version". Running setups that follow latest restart on that version.
+func rollbackStrategy(strategyName string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(r.FormValue("version"), "v"))
+	if err != nil {
+		writeValidationError(w, ValidationErrors{{Field: "version", Message: "must be a version number"}})
+		return
+	}
+
+	target, restarted, err := rollbackToVersion(callerIdentity(r), strategyName, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":   target,
+		"restarted": restarted,
+	})
+}